@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"servicekit/origin"
+)
+
+// config is everything chat-service reads from the environment at startup.
+// loadConfig validates it in one pass so a bad deployment fails before any
+// connection is opened, listing every problem at once.
+type config struct {
+	listenAddr         string
+	mysqlDSN           string
+	redisAddr          string
+	messageSvcURL      string
+	messageCallTimeout time.Duration
+	messageHTTPTimeout time.Duration
+	jwtSecret          string
+	jwtIssuer          string
+	jwtAudience        string
+	historyLimit       int
+	typingDebounce     time.Duration
+	readCoalesce       time.Duration
+	shutdownGrace      time.Duration
+	limits             wsLimits
+	presenceMode       string
+	// allowedOrigins is WS_ALLOWED_ORIGINS, kept raw for the summary.
+	allowedOrigins string
+	origins        origin.Policy
+}
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// required returns the trimmed value of key, recording a problem when unset.
+func (p *configProblems) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		p.add("%s must be set", key)
+	}
+	return v
+}
+
+// millis parses a non-negative millisecond duration, recording a problem
+// rather than silently falling back when the value is malformed.
+func (p *configProblems) millis(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	ms, err := strconv.Atoi(raw)
+	if err != nil || ms < 0 {
+		p.add("%s must be a non-negative number of milliseconds, got %q", key, raw)
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// positiveFloat parses a positive number, reporting whether key was set to
+// a valid value.
+func (p *configProblems) positiveFloat(key string) (float64, bool) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil || n <= 0 {
+		p.add("%s must be a positive number, got %q", key, raw)
+		return 0, false
+	}
+	return n, true
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	cfg := config{
+		listenAddr:     envOrDefault("LISTEN_ADDR", ":8083"),
+		mysqlDSN:       problems.required("MYSQL_DSN"),
+		redisAddr:      problems.required("REDIS_ADDR"),
+		messageSvcURL:  strings.TrimRight(problems.required("MESSAGE_SERVICE_URL"), "/"),
+		jwtSecret:      strings.TrimSpace(os.Getenv("JWT_SECRET")),
+		jwtIssuer:      envOrDefault("JWT_ISSUER", "registration-api"),
+		jwtAudience:    envOrDefault("JWT_AUDIENCE", "chat"),
+		historyLimit:   50,
+		typingDebounce: problems.millis("TYPING_DEBOUNCE_MS", time.Second),
+		readCoalesce:   problems.millis("READ_COALESCE_MS", 2*time.Second),
+		shutdownGrace:  problems.millis("SHUTDOWN_GRACE_MS", 5*time.Second),
+		limits:         loadWSLimits(&problems),
+		presenceMode:   strings.ToLower(envOrDefault("PRESENCE_DEFAULT_MODE", presenceSnapshot)),
+		allowedOrigins: envOrDefault("WS_ALLOWED_ORIGINS", "http://localhost:5173,http://127.0.0.1:5173"),
+	}
+	if cfg.presenceMode != presenceSnapshot && cfg.presenceMode != presenceDelta {
+		problems.add("PRESENCE_DEFAULT_MODE must be %s or %s, got %q", presenceSnapshot, presenceDelta, cfg.presenceMode)
+	}
+
+	if cfg.messageSvcURL != "" {
+		if u, err := url.Parse(cfg.messageSvcURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("MESSAGE_SERVICE_URL must be an absolute URL, got %q", cfg.messageSvcURL)
+		}
+	}
+
+	// The http.Client timeout is clamped to the call timeout so a single
+	// round trip can never outlive the caller's deadline.
+	cfg.messageCallTimeout = problems.millis("MESSAGE_SERVICE_TIMEOUT_MS", 5*time.Second)
+	if cfg.messageCallTimeout == 0 {
+		problems.add("MESSAGE_SERVICE_TIMEOUT_MS must be greater than 0")
+	}
+	cfg.messageHTTPTimeout = problems.millis("MESSAGE_SERVICE_HTTP_TIMEOUT_MS", cfg.messageCallTimeout)
+	if cfg.messageHTTPTimeout <= 0 || cfg.messageHTTPTimeout > cfg.messageCallTimeout {
+		log.Printf("MESSAGE_SERVICE_HTTP_TIMEOUT_MS (%s) must be between 1ms and MESSAGE_SERVICE_TIMEOUT_MS (%s); using %s", cfg.messageHTTPTimeout, cfg.messageCallTimeout, cfg.messageCallTimeout)
+		cfg.messageHTTPTimeout = cfg.messageCallTimeout
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("CHAT_HISTORY_LIMIT")); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 && n <= 1000 {
+			cfg.historyLimit = n
+		} else {
+			problems.add("CHAT_HISTORY_LIMIT must be between 1 and 1000, got %q", raw)
+		}
+	}
+
+	cfg.origins = origin.Parse(cfg.allowedOrigins)
+	if cfg.origins.AllowsAny() {
+		log.Printf("WS_ALLOWED_ORIGINS contains *; websocket upgrades are accepted from any origin")
+	}
+
+	return cfg, problems.err()
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: listen=%s redis=%s message_service=%s (timeout %s, http %s) jwt=%t issuer=%s audience=%s history_limit=%d typing_debounce=%s read_coalesce=%s shutdown_grace=%s ws_read_limit=%d ws_read_timeout=%s ws_rate=%g/s burst %g presence=%s ws_origins=%s",
+		c.listenAddr, c.redisAddr, c.messageSvcURL, c.messageCallTimeout, c.messageHTTPTimeout,
+		c.jwtSecret != "", c.jwtIssuer, c.jwtAudience, c.historyLimit, c.typingDebounce, c.readCoalesce, c.shutdownGrace,
+		c.limits.readLimit, c.limits.readTimeout, c.limits.ratePerSec, c.limits.burst, c.presenceMode, c.allowedOrigins)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// deliveryQueueSize bounds the delivery reports waiting for message-service.
+// Reports past it are dropped: a missing delivered mark is cosmetic, and the
+// read receipt still arrives.
+const deliveryQueueSize = 1024
+
+// delivery records that a message frame was queued on at least one of a
+// recipient's connections.
+type delivery struct {
+	conversationID string
+	messageID      string
+	user           string
+}
+
+// queueDelivery hands a delivery to reportDeliveries without blocking the
+// Redis fan-out.
+func (s *server) queueDelivery(d delivery) {
+	select {
+	case s.deliveries <- d:
+	default:
+		slog.Warn("delivery queue full; dropping report", "conversation_id", d.conversationID, "message_id", d.messageID, "email", d.user)
+	}
+}
+
+// deliveryReporters is how many reports are in flight to message-service at
+// once, so one slow round trip does not hold up the rest of the queue.
+const deliveryReporters = 4
+
+// reportDeliveries posts queued deliveries to message-service until ctx is
+// done. flushDeliveries reports what is still queued after that.
+func (s *server) reportDeliveries(ctx context.Context) {
+	s.runReporters(func() {
+		for {
+			select {
+			case d := <-s.deliveries:
+				s.reportDelivery(context.Background(), d)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// flushDeliveries reports the deliveries still queued at shutdown until the
+// queue is empty or ctx, the shutdown grace period, is done. Reports left
+// over then are dropped.
+func (s *server) flushDeliveries(ctx context.Context) {
+	s.runReporters(func() {
+		for ctx.Err() == nil {
+			select {
+			case d := <-s.deliveries:
+				s.reportDelivery(ctx, d)
+			default:
+				return
+			}
+		}
+	})
+	if n := len(s.deliveries); n > 0 {
+		slog.Warn("shutdown grace period over; dropping delivery reports", "count", n)
+	}
+}
+
+// runReporters runs deliveryReporters copies of report and waits for them.
+func (s *server) runReporters(report func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < deliveryReporters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report()
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *server) reportDelivery(parent context.Context, d delivery) {
+	ctx, cancel := s.messages.withTimeout(parent)
+	defer cancel()
+	if err := s.messages.MarkMessageDelivered(ctx, d.conversationID, d.messageID, d.user); err != nil {
+		slog.Warn("report delivery failed", "conversation_id", d.conversationID, "message_id", d.messageID, "email", d.user, "err", err)
+	}
+}
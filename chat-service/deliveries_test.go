@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushDeliveriesStopsAtTheGracePeriod(t *testing.T) {
+	var reported atomic.Int32
+	release := make(chan struct{})
+	messageService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reported.Add(1)
+		<-release
+	}))
+	defer messageService.Close()
+	defer close(release)
+
+	s := &server{
+		messages:   newMessageServiceClient(messageService.URL, time.Minute, time.Minute),
+		deliveries: make(chan delivery, deliveryQueueSize),
+	}
+	for i := 0; i < 3*deliveryReporters; i++ {
+		s.queueDelivery(delivery{conversationID: "c1", messageID: "m1", user: "bob@example.com"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.flushDeliveries(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("flushDeliveries took %s past a 100ms grace period", elapsed)
+	}
+	if n := reported.Load(); n != deliveryReporters {
+		t.Fatalf("%d reports were sent, want %d before the grace period ran out", n, deliveryReporters)
+	}
+}
@@ -11,16 +11,22 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
+
+	"servicekit/logging"
 )
 
 type server struct {
@@ -29,27 +35,69 @@ type server struct {
 	messages *messageServiceClient
 	upgrader websocket.Upgrader
 
-	mu      sync.RWMutex
-	clients map[string]*client
+	mu sync.RWMutex
+	// clients holds every open connection per user, so a user can stay
+	// online from several devices at once.
+	clients map[string]map[*client]struct{}
+
+	signals *signalAggregator
+	limits  wsLimits
+	// historyLimit caps how many messages a "subscribe" frame returns.
+	historyLimit int
+	// presenceMode is used for connections that do not ask for one.
+	presenceMode string
+	// deliveries feeds reportDeliveries.
+	deliveries chan delivery
+}
+
+var (
+	jwtSecret   []byte
+	jwtIssuer   string
+	jwtAudience string
+)
+
+// errRateLimited is returned when message-service rejects a send with 429.
+// The per-conversation budget lives there, so chat-service does not keep a
+// separate message count.
+var errRateLimited = errors.New("rate limited")
+
+// rejectedError is message-service refusing a message's content with 422,
+// such as a moderation rejection; reason is shown to the sender.
+type rejectedError struct {
+	reason string
 }
 
-var jwtSecret []byte
+func (e *rejectedError) Error() string {
+	return "message rejected: " + e.reason
+}
 
 type client struct {
 	email     string
 	conn      *websocket.Conn
 	send      chan []byte
 	closeOnce sync.Once
+	// presenceMode is presenceSnapshot or presenceDelta.
+	presenceMode string
 }
 
 type incomingMessage struct {
 	Type           string `json:"type"`
 	ConversationID string `json:"conversation_id,omitempty"`
 	Text           string `json:"text,omitempty"`
+	// ClientMsgID is an optional client-chosen id echoed back in the
+	// ack/nack for a "message" so the app can reconcile optimistic sends.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// ViewOnce marks a "message" as readable once per recipient; the
+	// broadcast carries only a placeholder.
+	ViewOnce bool `json:"view_once,omitempty"`
+	// Limit is how many recent messages a "subscribe" wants, capped at
+	// the server's history limit.
+	Limit int `json:"limit,omitempty"`
 }
 
 type chatMessage struct {
 	Type             string               `json:"type"`
+	MessageID        string               `json:"message_id,omitempty"`
 	ConversationID   string               `json:"conversation_id,omitempty"`
 	ConversationName string               `json:"conversation_name,omitempty"`
 	From             string               `json:"from,omitempty"`
@@ -57,29 +105,30 @@ type chatMessage struct {
 	SentAt           string               `json:"sent_at,omitempty"`
 	Participants     []string             `json:"participants,omitempty"`
 	Conversation     *conversationSummary `json:"conversation,omitempty"`
+	ViewOnce         bool                 `json:"view_once,omitempty"`
+	UserEmail        string               `json:"user_email,omitempty"`
+	ReadCount        int64                `json:"read_count,omitempty"`
+	ReactionAction   string               `json:"reaction_action,omitempty"`
+	Reactions        []reactionSummary    `json:"reactions,omitempty"`
 }
 
 func main() {
-	mysqlDSN := os.Getenv("MYSQL_DSN")
-	redisAddr := os.Getenv("REDIS_ADDR")
-	messageSvcURL := os.Getenv("MESSAGE_SERVICE_URL")
-	jwtSecretValue := strings.TrimSpace(os.Getenv("JWT_SECRET"))
-	if jwtSecretValue != "" {
-		jwtSecret = []byte(jwtSecretValue)
+	logging.Setup("chat-service")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.logSummary()
+
+	if cfg.jwtSecret != "" {
+		jwtSecret = []byte(cfg.jwtSecret)
 	} else {
 		log.Println("JWT_SECRET is not set; JWT tokens for websocket auth will not be accepted")
 	}
-	if mysqlDSN == "" {
-		log.Fatal("MYSQL_DSN must be set")
-	}
-	if redisAddr == "" {
-		log.Fatal("REDIS_ADDR must be set")
-	}
-	if messageSvcURL == "" {
-		log.Fatal("MESSAGE_SERVICE_URL must be set")
-	}
+	jwtIssuer = cfg.jwtIssuer
+	jwtAudience = cfg.jwtAudience
 
-	db, err := sql.Open("mysql", mysqlDSN)
+	db, err := sql.Open("mysql", cfg.mysqlDSN)
 	if err != nil {
 		log.Fatalf("mysql connection error: %v", err)
 	}
@@ -88,17 +137,14 @@ func main() {
 	}
 
 	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
+		Addr: cfg.redisAddr,
 	})
 	ctx := context.Background()
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		log.Fatalf("redis connection error: %v", err)
 	}
 
-	messageClient, err := newMessageServiceClient(messageSvcURL)
-	if err != nil {
-		log.Fatalf("message service client error: %v", err)
-	}
+	messageClient := newMessageServiceClient(cfg.messageSvcURL, cfg.messageCallTimeout, cfg.messageHTTPTimeout)
 
 	srv := &server{
 		db:       db,
@@ -107,25 +153,77 @@ func main() {
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin:     cfg.origins.Check,
 		},
-		clients: make(map[string]*client),
+		clients:      make(map[string]map[*client]struct{}),
+		limits:       cfg.limits,
+		historyLimit: cfg.historyLimit,
+		presenceMode: cfg.presenceMode,
+		deliveries:   make(chan delivery, deliveryQueueSize),
 	}
-
-	go srv.consumeRedis(ctx)
+	srv.signals = newSignalAggregator(cfg.typingDebounce, cfg.readCoalesce, srv.flushRead)
+
+	// Background loops stop with runCtx once clients have been drained.
+	runCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	redisDone := make(chan struct{})
+	go func() {
+		srv.consumeRedis(runCtx)
+		close(redisDone)
+	}()
+	go srv.signals.pruneLoop(runCtx)
+	deliveriesDone := make(chan struct{})
+	go func() {
+		srv.reportDeliveries(runCtx)
+		close(deliveriesDone)
+	}()
 
 	http.HandleFunc("/ws", srv.handleWebsocket)
+	http.HandleFunc("/presence", srv.handlePresence)
+
+	listenAddr := cfg.listenAddr
+	httpServer := &http.Server{Addr: listenAddr}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("chat service listening", "addr", listenAddr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
 
-	log.Println("Chat service listening on :8083")
-	if err := http.ListenAndServe(":8083", nil); err != nil {
+	stop, cancelSignals := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancelSignals()
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case <-stop.Done():
+	}
+
+	// Stop accepting new connections, then ask connected clients to
+	// reconnect elsewhere and give them a moment to do so.
+	grace := cfg.shutdownGrace
+	log.Printf("shutting down, draining websocket clients for up to %s", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown error: %v", err)
 	}
+	srv.drainClients(shutdownCtx)
+
+	// With no clients left, drop the Redis subscription and persist any read
+	// updates still waiting out their coalescing window and any delivery
+	// reports the grace period leaves time for.
+	stopBackground()
+	<-redisDone
+	<-deliveriesDone
+	srv.flushDeliveries(shutdownCtx)
+	srv.signals.flushPending()
+	if err := rdb.Close(); err != nil {
+		log.Printf("redis close error: %v", err)
+	}
+	log.Printf("shutdown complete")
 }
 
 func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	token := bearerToken(r.URL.Query().Get("token"))
 	if token == "" {
 		http.Error(w, "Missing token", http.StatusUnauthorized)
 		return
@@ -139,27 +237,96 @@ func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("websocket upgrade error: %v", err)
+		slog.Warn("websocket upgrade failed", "err", err)
 		return
 	}
 
 	cl := &client{
-		email: email,
-		conn:  conn,
-		send:  make(chan []byte, 32),
+		email:        email,
+		conn:         conn,
+		send:         make(chan []byte, 32),
+		presenceMode: presenceModeFor(r.URL.Query().Get("presence"), s.presenceMode),
 	}
 
-	s.addClient(email, cl)
+	// The new connection always starts from a full snapshot; everyone else
+	// only hears about it if the user was not already online.
+	joined := s.addClient(email, cl)
+	s.sendPresenceSnapshot(cl)
+	if joined {
+		s.broadcastPresenceChange(email, true, cl)
+	}
 
-	go cl.writeLoop()
+	go cl.writeLoop(s.limits.pingInterval())
 	s.readLoop(cl)
 
 	if removed := s.removeClient(email, cl); removed {
-		s.broadcastPresence()
+		s.broadcastPresenceChange(email, false, nil)
 	}
 }
 
+// handlePresence returns who is connected right now so clients can render
+// presence on load instead of waiting for the next broadcast. The token is
+// accepted as ?token= (like /ws) or as a Bearer header; like /ws it allows
+// any origin since auth does not rely on cookies.
+func (s *server) handlePresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := bearerToken(r.URL.Query().Get("token"))
+	if token == "" {
+		token = bearerToken(r.Header.Get("Authorization"))
+	}
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+	if _, err := s.validateSession(token); err != nil {
+		http.Error(w, "Invalid session", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"users": s.onlineUsers()}); err != nil {
+		log.Printf("write presence error: %v", err)
+	}
+}
+
+// bearerToken strips an optional "Bearer " prefix, so clients can pass the
+// same value they send in an Authorization header as ?token=.
+func bearerToken(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > len("bearer ") && strings.EqualFold(raw[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(raw[len("bearer "):])
+	}
+	return raw
+}
+
+// Principal is the caller identity resolved from a websocket token. The chat
+// service only ever learns the email (and scope for JWTs); UserID is left zero.
+type Principal struct {
+	Email  string
+	UserID int64
+	Scope  string
+}
+
 func (s *server) validateSession(token string) (string, error) {
+	p, err := s.resolvePrincipal(token)
+	if err != nil {
+		return "", err
+	}
+	return p.Email, nil
+}
+
+func (s *server) resolvePrincipal(token string) (*Principal, error) {
 	var email string
 	var expires time.Time
 	err := s.db.QueryRow(
@@ -169,55 +336,78 @@ func (s *server) validateSession(token string) (string, error) {
 	if errors.Is(err, sql.ErrNoRows) {
 		// Fall back to JWT validation if configured.
 		if len(jwtSecret) > 0 {
-			emailFromJWT, exp, jwtErr := parseJWT(token)
+			claims, jwtErr := parseJWT(token)
 			if jwtErr != nil {
-				return "", jwtErr
+				return nil, jwtErr
 			}
-			if time.Now().After(exp) {
-				return "", errors.New("session expired")
+			if time.Now().After(time.Unix(claims.Exp, 0)) {
+				return nil, errors.New("session expired")
 			}
-			return emailFromJWT, nil
+			return &Principal{Email: claims.Sub, Scope: claims.Scope}, nil
 		}
-		return "", errors.New("session not found")
+		return nil, errors.New("session not found")
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if time.Now().After(expires) {
-		return "", errors.New("session expired")
+		return nil, errors.New("session expired")
 	}
-	return email, nil
+	return &Principal{Email: email}, nil
 }
 
-func (s *server) addClient(email string, cl *client) {
-	var previous *client
-
+// addClient registers a connection alongside any the user already has and
+// reports whether it is their first, i.e. whether they just came online.
+func (s *server) addClient(email string, cl *client) bool {
 	s.mu.Lock()
-	if existing, ok := s.clients[email]; ok {
-		previous = existing
-	}
-	s.clients[email] = cl
-	s.mu.Unlock()
+	defer s.mu.Unlock()
 
-	if previous != nil {
-		previous.close()
+	conns, ok := s.clients[email]
+	if !ok {
+		conns = make(map[*client]struct{})
+		s.clients[email] = conns
 	}
-	s.broadcastPresence()
+	conns[cl] = struct{}{}
+	return !ok
 }
 
+// removeClient drops one connection and reports whether it was the user's
+// last, i.e. whether they just went offline.
 func (s *server) removeClient(email string, cl *client) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	current, ok := s.clients[email]
-	if !ok || current != cl {
+	conns, ok := s.clients[email]
+	if !ok {
+		return false
+	}
+	if _, ok := conns[cl]; !ok {
+		return false
+	}
+	delete(conns, cl)
+	if len(conns) > 0 {
 		return false
 	}
 	delete(s.clients, email)
 	return true
 }
 
-func (s *server) broadcastPresence() {
+// allClients returns every open connection across all users.
+func (s *server) allClients() []*client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]*client, 0, len(s.clients))
+	for _, conns := range s.clients {
+		for cl := range conns {
+			clients = append(clients, cl)
+		}
+	}
+	return clients
+}
+
+// onlineUsers returns the sorted emails of connected clients.
+func (s *server) onlineUsers() []string {
 	s.mu.RLock()
 	users := make([]string, 0, len(s.clients))
 	for email := range s.clients {
@@ -226,45 +416,63 @@ func (s *server) broadcastPresence() {
 	s.mu.RUnlock()
 
 	sort.Strings(users)
+	return users
+}
 
-	payload := map[string]interface{}{
-		"type":  "presence",
-		"users": users,
-	}
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return
-	}
+// shutdownCloseReason accompanies the CloseServiceRestart frame sent on
+// shutdown; clients treat 1012 as a cue to reconnect.
+const shutdownCloseReason = "server shutting down, reconnect"
 
-	s.mu.RLock()
-	clients := make([]*client, 0, len(s.clients))
-	for _, cl := range s.clients {
-		clients = append(clients, cl)
-	}
-	s.mu.RUnlock()
+// drainClients sends every connected client a close frame and waits until
+// they have disconnected or ctx expires, then closes whatever is left.
+func (s *server) drainClients(ctx context.Context) {
+	clients := s.allClients()
 
+	frame := websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownCloseReason)
 	for _, cl := range clients {
-		cl.sendMessage(data)
+		if err := cl.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second)); err != nil {
+			cl.close()
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.RLock()
+		remaining := len(s.clients)
+		s.mu.RUnlock()
+		if remaining == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			for _, cl := range clients {
+				cl.close()
+			}
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 func (s *server) readLoop(cl *client) {
 	defer cl.close()
 
-	cl.conn.SetReadLimit(4096)
-	cl.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	cl.conn.SetReadLimit(s.limits.readLimit)
+	cl.conn.SetReadDeadline(time.Now().Add(s.limits.readTimeout))
 	cl.conn.SetPongHandler(func(string) error {
-		cl.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		cl.conn.SetReadDeadline(time.Now().Add(s.limits.readTimeout))
 		return nil
 	})
 
 	backgroundCtx := context.Background()
+	bucket := newTokenBucket(s.limits.ratePerSec, s.limits.burst)
 
 	for {
 		_, message, err := cl.conn.ReadMessage()
 		if err != nil {
 			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				log.Printf("read error for %s: %v", cl.email, err)
+				slog.Warn("websocket read failed", "email", cl.email, "err", err)
 			}
 			break
 		}
@@ -274,39 +482,105 @@ func (s *server) readLoop(cl *client) {
 			sendError(cl, "Invalid payload")
 			continue
 		}
+		// Frames over the per-connection rate are dropped before they
+		// reach message-service.
+		if !bucket.allow(time.Now()) {
+			if incoming.Type == "message" {
+				sendNack(cl, strings.TrimSpace(incoming.ClientMsgID), "You are sending messages too quickly")
+			} else {
+				sendError(cl, "You are sending messages too quickly")
+			}
+			continue
+		}
 
 		switch incoming.Type {
 		case "message":
 			conversationID := strings.TrimSpace(incoming.ConversationID)
 			text := strings.TrimSpace(incoming.Text)
+			clientMsgID := strings.TrimSpace(incoming.ClientMsgID)
 			if conversationID == "" || text == "" {
-				sendError(cl, "Conversation and message text are required")
+				sendNack(cl, clientMsgID, "Conversation and message text are required")
 				continue
 			}
 
-			ctx, cancel := context.WithTimeout(backgroundCtx, 5*time.Second)
-			stored, err := s.messages.CreateMessage(ctx, conversationID, cl.email, text)
+			ctx, cancel := s.messages.withTimeout(backgroundCtx)
+			stored, err := s.messages.CreateMessage(ctx, conversationID, cl.email, text, incoming.ViewOnce)
 			cancel()
+			if errors.Is(err, errRateLimited) {
+				sendNack(cl, clientMsgID, "You are sending messages too quickly")
+				continue
+			}
+			var rejected *rejectedError
+			if errors.As(err, &rejected) {
+				sendNack(cl, clientMsgID, rejected.reason)
+				continue
+			}
 			if err != nil {
-				log.Printf("store message error: %v", err)
-				sendError(cl, "Unable to store message")
+				slog.Error("store message failed", "email", cl.email, "conversation_id", conversationID, "err", err)
+				sendNack(cl, clientMsgID, "Unable to store message")
 				continue
 			}
+			sendAck(cl, clientMsgID, stored)
 
 			event := redisEvent{
 				Type:             "message",
+				MessageID:        stored.ID,
 				Participants:     stored.Participants,
 				ConversationID:   stored.ConversationID,
 				ConversationName: stored.ConversationName,
 				From:             stored.Sender,
 				Text:             stored.Text,
 				SentAt:           stored.SentAt,
+				ViewOnce:         stored.ViewOnce,
 			}
 			if err := s.publishEvent(backgroundCtx, &event); err != nil {
-				log.Printf("redis publish error: %v", err)
+				slog.Error("redis publish failed", "type", event.Type, "email", cl.email, "conversation_id", conversationID, "err", err)
 				sendError(cl, "Unable to deliver message")
 			}
 
+		case "subscribe":
+			conversationID := strings.TrimSpace(incoming.ConversationID)
+			if conversationID == "" {
+				sendError(cl, "Conversation id is required")
+				continue
+			}
+
+			ctx, cancel := s.messages.withTimeout(backgroundCtx)
+			conv, err := s.messages.GetConversation(ctx, conversationID)
+			cancel()
+			if err != nil {
+				slog.Error("load conversation failed", "email", cl.email, "conversation_id", conversationID, "err", err)
+				sendError(cl, "Unable to load conversation")
+				continue
+			}
+			if !contains(conv.Participants, cl.email) {
+				sendError(cl, "You are not part of this conversation")
+				continue
+			}
+
+			limit := s.historyLimit
+			if incoming.Limit > 0 && incoming.Limit < limit {
+				limit = incoming.Limit
+			}
+			ctx, cancel = s.messages.withTimeout(backgroundCtx)
+			history, err := s.messages.RecentMessages(ctx, conversationID, limit)
+			cancel()
+			if err != nil {
+				slog.Error("load history failed", "email", cl.email, "conversation_id", conversationID, "err", err)
+				sendError(cl, "Unable to load history")
+				continue
+			}
+			data, err := json.Marshal(map[string]interface{}{
+				"type":            "history",
+				"conversation_id": conversationID,
+				"messages":        history,
+			})
+			if err != nil {
+				slog.Error("marshal history failed", "conversation_id", conversationID, "err", err)
+				continue
+			}
+			cl.sendMessage(data)
+
 		case "conversation":
 			conversationID := strings.TrimSpace(incoming.ConversationID)
 			if conversationID == "" {
@@ -314,11 +588,11 @@ func (s *server) readLoop(cl *client) {
 				continue
 			}
 
-			ctx, cancel := context.WithTimeout(backgroundCtx, 5*time.Second)
+			ctx, cancel := s.messages.withTimeout(backgroundCtx)
 			conv, err := s.messages.GetConversation(ctx, conversationID)
 			cancel()
 			if err != nil {
-				log.Printf("load conversation error: %v", err)
+				slog.Error("load conversation failed", "email", cl.email, "conversation_id", conversationID, "err", err)
 				sendError(cl, "Unable to load conversation")
 				continue
 			}
@@ -334,7 +608,7 @@ func (s *server) readLoop(cl *client) {
 				Conversation:   conv,
 			}
 			if err := s.publishEvent(backgroundCtx, &event); err != nil {
-				log.Printf("redis publish error: %v", err)
+				slog.Error("redis publish failed", "type", event.Type, "email", cl.email, "conversation_id", conversationID, "err", err)
 				sendError(cl, "Unable to share conversation")
 			}
 
@@ -346,11 +620,11 @@ func (s *server) readLoop(cl *client) {
 				continue
 			}
 
-			ctx, cancel := context.WithTimeout(backgroundCtx, 5*time.Second)
+			ctx, cancel := s.messages.withTimeout(backgroundCtx)
 			conv, err := s.messages.GetConversation(ctx, conversationID)
 			cancel()
 			if err != nil {
-				log.Printf("load conversation error: %v", err)
+				slog.Error("load conversation failed", "email", cl.email, "conversation_id", conversationID, "err", err)
 				sendError(cl, "Unable to load conversation")
 				continue
 			}
@@ -368,45 +642,200 @@ func (s *server) readLoop(cl *client) {
 				Text:             payload,
 			}
 			if err := s.publishEvent(backgroundCtx, &event); err != nil {
-				log.Printf("redis publish error: %v", err)
+				slog.Error("redis publish failed", "type", event.Type, "email", cl.email, "conversation_id", conversationID, "err", err)
 				sendError(cl, "Unable to publish signal")
 			}
 
+		case "typing":
+			conversationID := strings.TrimSpace(incoming.ConversationID)
+			if conversationID == "" {
+				sendError(cl, "Conversation id is required")
+				continue
+			}
+			if !s.signals.allowTyping(cl.email, conversationID) {
+				continue
+			}
+
+			ctx, cancel := s.messages.withTimeout(backgroundCtx)
+			conv, err := s.messages.GetConversation(ctx, conversationID)
+			cancel()
+			if err != nil {
+				slog.Error("load conversation failed", "email", cl.email, "conversation_id", conversationID, "err", err)
+				continue
+			}
+			if !contains(conv.Participants, cl.email) {
+				sendError(cl, "You are not part of this conversation")
+				continue
+			}
+
+			event := redisEvent{
+				Type:           "typing",
+				Participants:   conv.Participants,
+				ConversationID: conv.ID,
+				From:           cl.email,
+			}
+			if err := s.publishEvent(backgroundCtx, &event); err != nil {
+				slog.Error("redis publish failed", "type", event.Type, "email", cl.email, "conversation_id", conversationID, "err", err)
+			}
+
+		case "read":
+			conversationID := strings.TrimSpace(incoming.ConversationID)
+			if conversationID == "" {
+				sendError(cl, "Conversation id is required")
+				continue
+			}
+			s.signals.scheduleRead(cl.email, conversationID)
+
 		default:
 			sendError(cl, "Unsupported message type")
 		}
 	}
 }
 
+// flushRead persists one coalesced read update and tells the other
+// participants about it.
+func (s *server) flushRead(user, conversationID string) {
+	ctx, cancel := s.messages.withTimeout(context.Background())
+	defer cancel()
+
+	conv, err := s.messages.GetConversation(ctx, conversationID)
+	if err != nil {
+		slog.Error("read flush: load conversation failed", "email", user, "conversation_id", conversationID, "err", err)
+		return
+	}
+	if !contains(conv.Participants, user) {
+		return
+	}
+	readCount, err := s.messages.MarkConversationRead(ctx, conversationID, user)
+	if err != nil {
+		slog.Error("read flush: mark read failed", "email", user, "conversation_id", conversationID, "err", err)
+		return
+	}
+
+	event := redisEvent{
+		Type:           "read",
+		Participants:   conv.Participants,
+		ConversationID: conv.ID,
+		From:           user,
+		SentAt:         time.Now().UTC().Format(time.RFC3339),
+		UserEmail:      user,
+		ReadCount:      readCount,
+	}
+	if err := s.publishEvent(ctx, &event); err != nil {
+		slog.Error("redis publish failed", "type", event.Type, "email", user, "conversation_id", conversationID, "err", err)
+	}
+}
+
+// consumeRedis keeps a chat:messages subscription alive for the life of
+// ctx. When the subscription cannot be established or its channel closes,
+// it re-subscribes with exponential backoff; WebSocket clients stay
+// connected throughout and resume receiving events once it is back.
 func (s *server) consumeRedis(ctx context.Context) {
+	const (
+		minBackoff = time.Second
+		maxBackoff = 30 * time.Second
+	)
+	backoff := minBackoff
+	for {
+		err := s.subscribeRedis(ctx, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("redis subscription lost (%v); resubscribing in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// subscribeRedis runs one subscription until it fails. onSubscribed is
+// called once Redis has confirmed it.
+func (s *server) subscribeRedis(ctx context.Context, onSubscribed func()) error {
 	pubsub := s.redis.Subscribe(ctx, "chat:messages")
 	defer pubsub.Close()
 
-	for msg := range pubsub.Channel() {
-		var event redisEvent
-		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
-			log.Printf("invalid chat event: %v", err)
-			continue
-		}
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	log.Printf("subscribed to redis channel chat:messages")
+	onSubscribed()
 
-		clientPayload := chatMessage{
-			Type:             event.Type,
-			ConversationID:   event.ConversationID,
-			ConversationName: event.ConversationName,
-			From:             event.From,
-			Text:             event.Text,
-			SentAt:           event.SentAt,
-			Conversation:     event.Conversation,
+	// Returning on cancellation lets the deferred Close unsubscribe instead
+	// of leaving the subscription open until the process exits.
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return errors.New("subscription channel closed")
+			}
+			s.dispatchRedisEvent(msg.Payload)
 		}
+	}
+}
 
-		data, err := json.Marshal(clientPayload)
-		if err != nil {
-			log.Printf("marshal error: %v", err)
+// dispatchRedisEvent fans one chat:messages event out to the connected
+// participants.
+func (s *server) dispatchRedisEvent(payload string) {
+	var event redisEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		slog.Warn("invalid chat event", "err", err)
+		return
+	}
+
+	clientPayload := chatMessage{
+		Type:             event.Type,
+		MessageID:        event.MessageID,
+		ConversationID:   event.ConversationID,
+		ConversationName: event.ConversationName,
+		From:             event.From,
+		Text:             event.Text,
+		SentAt:           event.SentAt,
+		Conversation:     event.Conversation,
+		ViewOnce:         event.ViewOnce,
+	}
+	// Membership frames carry the new participant set so clients can
+	// update cached membership in place.
+	if event.Type == "membership" {
+		clientPayload.Participants = event.Participants
+	}
+	if event.Type == "reaction" {
+		clientPayload.ReactionAction = event.ReactionAction
+		clientPayload.Reactions = event.Reactions
+	}
+	// Read receipts go to everyone but the reader, whose own devices
+	// already know.
+	skip := ""
+	if event.Type == "read" {
+		clientPayload.UserEmail = event.UserEmail
+		clientPayload.ReadCount = event.ReadCount
+		skip = strings.ToLower(strings.TrimSpace(event.UserEmail))
+	}
+
+	data, err := json.Marshal(clientPayload)
+	if err != nil {
+		log.Printf("marshal error: %v", err)
+		return
+	}
+
+	// A message that reached a recipient's device is reported back to
+	// message-service as delivered; the sender's own echo is not.
+	trackDelivery := event.Type == "message" && event.MessageID != ""
+	for _, email := range event.Participants {
+		email = strings.TrimSpace(email)
+		if skip != "" && strings.EqualFold(email, skip) {
 			continue
 		}
-
-		for _, email := range event.Participants {
-			s.sendTo(strings.TrimSpace(email), data)
+		if s.sendTo(email, data) > 0 && trackDelivery && !strings.EqualFold(email, event.From) {
+			s.queueDelivery(delivery{conversationID: event.ConversationID, messageID: event.MessageID, user: email})
 		}
 	}
 }
@@ -419,21 +848,31 @@ func (s *server) publishEvent(ctx context.Context, event *redisEvent) error {
 	return s.redis.Publish(ctx, "chat:messages", data).Err()
 }
 
-func (s *server) sendTo(email string, data []byte) {
+// sendTo queues data on every connection of email and returns how many
+// accepted it.
+func (s *server) sendTo(email string, data []byte) int {
 	if email == "" {
-		return
+		return 0
 	}
 	s.mu.RLock()
-	cl, ok := s.clients[email]
+	clients := make([]*client, 0, len(s.clients[email]))
+	for cl := range s.clients[email] {
+		clients = append(clients, cl)
+	}
 	s.mu.RUnlock()
-	if !ok {
-		return
+
+	sent := 0
+	for _, cl := range clients {
+		if cl.sendMessage(data) {
+			sent++
+		}
 	}
-	cl.sendMessage(data)
+	return sent
 }
 
 type redisEvent struct {
 	Type             string               `json:"type"`
+	MessageID        string               `json:"message_id,omitempty"`
 	Participants     []string             `json:"participants"`
 	ConversationID   string               `json:"conversation_id,omitempty"`
 	ConversationName string               `json:"conversation_name,omitempty"`
@@ -441,6 +880,21 @@ type redisEvent struct {
 	Text             string               `json:"text,omitempty"`
 	SentAt           string               `json:"sent_at,omitempty"`
 	Conversation     *conversationSummary `json:"conversation,omitempty"`
+	ViewOnce         bool                 `json:"view_once,omitempty"`
+	// UserEmail and ReadCount are set on "read" events.
+	UserEmail string `json:"user_email,omitempty"`
+	ReadCount int64  `json:"read_count,omitempty"`
+	// ReactionAction and Reactions are set on "reaction" events: From
+	// added or removed Text on MessageID, which now has Reactions.
+	ReactionAction string            `json:"reaction_action,omitempty"`
+	Reactions      []reactionSummary `json:"reactions,omitempty"`
+}
+
+// reactionSummary is one emoji's reactions on a message.
+type reactionSummary struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
 }
 
 type conversationSummary struct {
@@ -459,25 +913,30 @@ type messageResponse struct {
 	Text             string   `json:"text"`
 	SentAt           string   `json:"sent_at"`
 	Participants     []string `json:"participants"`
+	ViewOnce         bool     `json:"view_once,omitempty"`
 }
 
 type messageServiceClient struct {
 	baseURL string
 	client  *http.Client
+	// callTimeout is the context deadline given to a message-service call;
+	// client.Timeout caps each round trip and never exceeds it.
+	callTimeout time.Duration
 }
 
-func newMessageServiceClient(baseURL string) (*messageServiceClient, error) {
-	baseURL = strings.TrimSpace(baseURL)
-	if baseURL == "" {
-		return nil, fmt.Errorf("message service url is empty")
-	}
-	baseURL = strings.TrimRight(baseURL, "/")
+func newMessageServiceClient(baseURL string, callTimeout, httpTimeout time.Duration) *messageServiceClient {
 	return &messageServiceClient{
 		baseURL: baseURL,
 		client: &http.Client{
-			Timeout: 5 * time.Second,
+			Timeout: httpTimeout,
 		},
-	}, nil
+		callTimeout: callTimeout,
+	}
+}
+
+// withTimeout derives the context for a message-service call.
+func (m *messageServiceClient) withTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, m.callTimeout)
 }
 
 func (m *messageServiceClient) GetConversation(ctx context.Context, id string) (*conversationSummary, error) {
@@ -516,10 +975,11 @@ func (m *messageServiceClient) GetConversation(ctx context.Context, id string) (
 	}, nil
 }
 
-func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID, sender, text string) (*messageResponse, error) {
-	payload := map[string]string{
-		"sender": sender,
-		"text":   text,
+func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID, sender, text string, viewOnce bool) (*messageResponse, error) {
+	payload := map[string]interface{}{
+		"sender":    sender,
+		"text":      text,
+		"view_once": viewOnce,
 	}
 	body, err := json.Marshal(payload)
 	if err != nil {
@@ -538,6 +998,23 @@ func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, errRateLimited
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		var rejection struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&rejection); err != nil {
+			return nil, fmt.Errorf("message service create message status %d: %w", resp.StatusCode, err)
+		}
+		reason := rejection.Reason
+		if reason == "" {
+			reason = rejection.Error
+		}
+		return nil, &rejectedError{reason: reason}
+	}
 	if resp.StatusCode != http.StatusCreated {
 		return nil, fmt.Errorf("message service create message status %d", resp.StatusCode)
 	}
@@ -550,6 +1027,94 @@ func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID
 	return &result, nil
 }
 
+// historyMessage is one entry of a "history" frame.
+type historyMessage struct {
+	ID       string `json:"id"`
+	Sender   string `json:"sender"`
+	Text     string `json:"text"`
+	SentAt   string `json:"sent_at"`
+	ViewOnce bool   `json:"view_once,omitempty"`
+}
+
+// RecentMessages returns the latest limit messages, oldest first. It passes
+// no reader, so it neither marks the conversation read nor opens view-once
+// messages.
+func (m *messageServiceClient) RecentMessages(ctx context.Context, conversationID string, limit int) ([]historyMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/conversations/%s/messages?limit=%d&tail=true", m.baseURL, conversationID, limit), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("message service messages status %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		Messages []historyMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload.Messages, nil
+}
+
+// MarkConversationRead returns the reader's new read count, or 0 when
+// message-service does not report one.
+func (m *messageServiceClient) MarkConversationRead(ctx context.Context, conversationID, user string) (int64, error) {
+	body, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/read", m.baseURL, conversationID), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("message service mark read status %d", resp.StatusCode)
+	}
+	readCount, _ := strconv.ParseInt(resp.Header.Get("X-Read-Count"), 10, 64)
+	return readCount, nil
+}
+
+func (m *messageServiceClient) MarkMessageDelivered(ctx context.Context, conversationID, messageID, user string) error {
+	body, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/messages/%s/delivered", m.baseURL, conversationID, messageID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("message service mark delivered status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func contains(list []string, item string) bool {
 	for _, v := range list {
 		if v == item {
@@ -559,8 +1124,8 @@ func contains(list []string, item string) bool {
 	return false
 }
 
-func (cl *client) writeLoop() {
-	ticker := time.NewTicker(45 * time.Second)
+func (cl *client) writeLoop(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
 	defer func() {
 		ticker.Stop()
 		cl.close()
@@ -584,11 +1149,15 @@ func (cl *client) writeLoop() {
 	}
 }
 
-func (cl *client) sendMessage(data []byte) {
+// sendMessage queues data for the write loop. A client whose buffer is full
+// is too slow to keep up and is disconnected; sendMessage then returns false.
+func (cl *client) sendMessage(data []byte) bool {
 	select {
 	case cl.send <- data:
+		return true
 	default:
 		cl.close()
+		return false
 	}
 }
 
@@ -611,70 +1180,148 @@ func sendError(cl *client, message string) {
 	cl.sendMessage(data)
 }
 
+// sendAck confirms a stored message to its sender. It is only sent for
+// messages tagged with a client_msg_id; the broadcast still follows.
+func sendAck(cl *client, clientMsgID string, stored *messageResponse) {
+	if clientMsgID == "" {
+		return
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":            "ack",
+		"client_msg_id":   clientMsgID,
+		"id":              stored.ID,
+		"conversation_id": stored.ConversationID,
+		"sent_at":         stored.SentAt,
+	})
+	if err != nil {
+		return
+	}
+	cl.sendMessage(data)
+}
+
+// sendNack reports a message that was not stored. Untagged messages get
+// the plain error frame, as before.
+func sendNack(cl *client, clientMsgID, message string) {
+	if clientMsgID == "" {
+		sendError(cl, message)
+		return
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":          "nack",
+		"client_msg_id": clientMsgID,
+		"error":         message,
+	})
+	if err != nil {
+		return
+	}
+	cl.sendMessage(data)
+}
+
 type jwtClaims struct {
-	Sub   string `json:"sub"`
-	Exp   int64  `json:"exp"`
-	Iat   int64  `json:"iat"`
-	Scope string `json:"scope,omitempty"`
+	Sub   string   `json:"sub"`
+	Iss   string   `json:"iss,omitempty"`
+	Aud   audience `json:"aud,omitempty"`
+	Exp   int64    `json:"exp"`
+	Iat   int64    `json:"iat"`
+	Scope string   `json:"scope,omitempty"`
 }
 
-func parseJWT(token string) (string, time.Time, error) {
+// audience accepts the "aud" claim as either a single string or an array,
+// both of which RFC 7519 allows; golang-jwt issuers emit the array form.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func parseJWT(token string) (*jwtClaims, error) {
 	if len(jwtSecret) == 0 {
-		return "", time.Time{}, errors.New("jwt secret not configured")
+		return nil, errors.New("jwt secret not configured")
 	}
 
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return "", time.Time{}, errors.New("invalid jwt format")
+		return nil, errors.New("invalid jwt format")
 	}
 
 	enc := base64.RawURLEncoding
 
 	headerBytes, err := enc.DecodeString(parts[0])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt header encoding")
+		return nil, errors.New("invalid jwt header encoding")
 	}
 	var header map[string]interface{}
 	if err := json.Unmarshal(headerBytes, &header); err != nil {
-		return "", time.Time{}, errors.New("invalid jwt header")
+		return nil, errors.New("invalid jwt header")
 	}
 	alg, _ := header["alg"].(string)
 	if alg != "HS256" {
-		return "", time.Time{}, errors.New("unsupported jwt alg")
+		return nil, errors.New("unsupported jwt alg")
 	}
 
 	signature, err := enc.DecodeString(parts[2])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt signature encoding")
+		return nil, errors.New("invalid jwt signature encoding")
 	}
 
 	unsigned := parts[0] + "." + parts[1]
 	mac := hmac.New(sha256.New, jwtSecret)
 	if _, err := mac.Write([]byte(unsigned)); err != nil {
-		return "", time.Time{}, err
+		return nil, err
 	}
 	expectedSig := mac.Sum(nil)
 	if !hmac.Equal(expectedSig, signature) {
-		return "", time.Time{}, errors.New("invalid jwt signature")
+		return nil, errors.New("invalid jwt signature")
 	}
 
 	payloadBytes, err := enc.DecodeString(parts[1])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt payload encoding")
+		return nil, errors.New("invalid jwt payload encoding")
 	}
 
 	var claims jwtClaims
 	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-		return "", time.Time{}, errors.New("invalid jwt claims")
+		return nil, errors.New("invalid jwt claims")
 	}
 
 	if claims.Sub == "" {
-		return "", time.Time{}, errors.New("jwt missing subject")
+		return nil, errors.New("jwt missing subject")
 	}
 	if claims.Exp == 0 {
-		return "", time.Time{}, errors.New("jwt missing exp")
+		return nil, errors.New("jwt missing exp")
+	}
+	if jwtIssuer != "" && claims.Iss != jwtIssuer {
+		return nil, errors.New("invalid jwt issuer")
 	}
+	if jwtAudience != "" && !claims.Aud.contains(jwtAudience) {
+		return nil, errors.New("invalid jwt audience")
+	}
+
+	return &claims, nil
+}
 
-	expiresAt := time.Unix(claims.Exp, 0)
-	return claims.Sub, expiresAt, nil
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
 }
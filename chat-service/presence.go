@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// Presence modes. A snapshot connection is sent the full online list on
+// every change; a delta connection gets the list once on connect and then
+// only presence_join/presence_leave frames naming a single user, keeping
+// the set up to date locally.
+const (
+	presenceSnapshot = "snapshot"
+	presenceDelta    = "delta"
+)
+
+// presenceModeFor picks a connection's mode from its ?presence= parameter,
+// falling back to the server default.
+func presenceModeFor(requested, fallback string) string {
+	switch strings.ToLower(strings.TrimSpace(requested)) {
+	case presenceDelta:
+		return presenceDelta
+	case presenceSnapshot:
+		return presenceSnapshot
+	default:
+		return fallback
+	}
+}
+
+func (s *server) presenceSnapshot() []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":  "presence",
+		"users": s.onlineUsers(),
+	})
+	if err != nil {
+		log.Printf("marshal presence error: %v", err)
+		return nil
+	}
+	return data
+}
+
+// sendPresenceSnapshot gives a new connection the full online list.
+func (s *server) sendPresenceSnapshot(cl *client) {
+	if data := s.presenceSnapshot(); data != nil {
+		cl.sendMessage(data)
+	}
+}
+
+// broadcastPresenceChange tells every other connection that email came
+// online or went offline. The full list is only built if some connection
+// still wants snapshots.
+func (s *server) broadcastPresenceChange(email string, joined bool, except *client) {
+	deltaType := "presence_leave"
+	if joined {
+		deltaType = "presence_join"
+	}
+	delta, err := json.Marshal(map[string]string{
+		"type":  deltaType,
+		"email": email,
+	})
+	if err != nil {
+		log.Printf("marshal presence delta error: %v", err)
+		return
+	}
+
+	var snapshot []byte
+	for _, cl := range s.allClients() {
+		if cl == except {
+			continue
+		}
+		if cl.presenceMode == presenceDelta {
+			cl.sendMessage(delta)
+			continue
+		}
+		if snapshot == nil {
+			if snapshot = s.presenceSnapshot(); snapshot == nil {
+				return
+			}
+		}
+		cl.sendMessage(snapshot)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// wsLimits bounds what a single WebSocket connection may send.
+type wsLimits struct {
+	readLimit   int64
+	readTimeout time.Duration
+	// ratePerSec and burst configure the per-connection token bucket; a
+	// rate of 0 disables it.
+	ratePerSec float64
+	burst      float64
+}
+
+// loadWSLimits reads WS_READ_LIMIT_BYTES (default 4096),
+// WS_READ_TIMEOUT_SECONDS (default 60), WS_RATE_PER_SEC (frames per second,
+// default 5, 0 disables) and WS_RATE_BURST (default 10).
+func loadWSLimits(problems *configProblems) wsLimits {
+	limits := wsLimits{
+		readLimit:   4096,
+		readTimeout: 60 * time.Second,
+		ratePerSec:  5,
+		burst:       10,
+	}
+	if n, ok := problems.positiveFloat("WS_READ_LIMIT_BYTES"); ok {
+		limits.readLimit = int64(n)
+	}
+	if n, ok := problems.positiveFloat("WS_READ_TIMEOUT_SECONDS"); ok {
+		limits.readTimeout = time.Duration(n * float64(time.Second))
+	}
+	if raw := strings.TrimSpace(os.Getenv("WS_RATE_PER_SEC")); raw == "0" {
+		limits.ratePerSec = 0
+	} else if n, ok := problems.positiveFloat("WS_RATE_PER_SEC"); ok {
+		limits.ratePerSec = n
+	}
+	if n, ok := problems.positiveFloat("WS_RATE_BURST"); ok {
+		limits.burst = n
+	}
+	if limits.burst < 1 {
+		limits.burst = 1
+	}
+	return limits
+}
+
+// pingInterval keeps pings comfortably inside the read deadline so idle
+// but healthy connections are not dropped.
+func (l wsLimits) pingInterval() time.Duration {
+	return l.readTimeout * 3 / 4
+}
+
+// tokenBucket is a per-connection limiter. It is only touched from the
+// connection's read loop, so it needs no locking.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil when rate is 0; a nil bucket allows everything.
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		rate, burst float64
+		// at are offsets from start, in order, of the frames to admit.
+		at   []time.Duration
+		want []bool
+	}{
+		{
+			name: "burst then refused",
+			rate: 1, burst: 3,
+			at:   []time.Duration{0, 0, 0, 0},
+			want: []bool{true, true, true, false},
+		},
+		{
+			name: "refills at rate",
+			rate: 2, burst: 1,
+			at:   []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond},
+			want: []bool{true, false, false, true},
+		},
+		{
+			name: "refill capped at burst",
+			rate: 10, burst: 2,
+			at:   []time.Duration{0, 0, time.Hour, time.Hour, time.Hour},
+			want: []bool{true, true, true, true, false},
+		},
+		{
+			name: "rate 0 disables",
+			rate: 0, burst: 1,
+			at:   []time.Duration{0, 0, 0},
+			want: []bool{true, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			if b != nil {
+				b.last = start
+			}
+			for i, off := range tt.at {
+				if got := b.allow(start.Add(off)); got != tt.want[i] {
+					t.Fatalf("frame %d at +%s: allow = %v, want %v", i, off, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestReadLoopRateLimit sends more frames than the burst allows. Frames
+// inside the budget reach message-service, which answers 429; frames past it
+// are refused locally. Both are nacked as sending too quickly.
+func TestReadLoopRateLimit(t *testing.T) {
+	var stored atomic.Int64
+	messageService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stored.Add(1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer messageService.Close()
+
+	s := &server{
+		messages: newMessageServiceClient(messageService.URL, time.Second, time.Second),
+		limits:   wsLimits{readLimit: 4096, readTimeout: time.Minute, ratePerSec: 0.001, burst: 3},
+	}
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		cl := &client{email: "alice@example.com", conn: conn, send: make(chan []byte, 16)}
+		go cl.writeLoop(time.Minute)
+		s.readLoop(cl)
+	}))
+	defer chat.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(chat.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const frames = 5
+	for i := 0; i < frames; i++ {
+		frame := fmt.Sprintf(`{"type":"message","conversation_id":"c1","text":"hi","client_msg_id":"m%d"}`, i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < frames; i++ {
+		var nack map[string]string
+		if err := conn.ReadJSON(&nack); err != nil {
+			t.Fatalf("reading reply %d: %v", i, err)
+		}
+		if nack["type"] != "nack" || nack["client_msg_id"] != fmt.Sprintf("m%d", i) || nack["error"] != "You are sending messages too quickly" {
+			out, _ := json.Marshal(nack)
+			t.Fatalf("reply %d = %s, want a rate-limit nack for m%d", i, out, i)
+		}
+	}
+	if n := stored.Load(); n != 3 {
+		t.Fatalf("message-service saw %d sends, want the burst of 3", n)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// signalKey identifies one user's ephemeral signal stream for a conversation.
+type signalKey struct {
+	user         string
+	conversation string
+}
+
+// signalAggregator throttles high-frequency ephemeral signals before they hit
+// Redis and message-service. Typing events are debounced to at most one per
+// (user, conversation) per typingWindow; read updates are coalesced so a burst
+// collapses into a single trailing flush after readWindow.
+type signalAggregator struct {
+	typingWindow time.Duration
+	readWindow   time.Duration
+	flushRead    func(user, conversationID string)
+
+	mu          sync.Mutex
+	lastTyping  map[signalKey]time.Time
+	pendingRead map[signalKey]*time.Timer
+}
+
+func newSignalAggregator(typingWindow, readWindow time.Duration, flushRead func(user, conversationID string)) *signalAggregator {
+	return &signalAggregator{
+		typingWindow: typingWindow,
+		readWindow:   readWindow,
+		flushRead:    flushRead,
+		lastTyping:   make(map[signalKey]time.Time),
+		pendingRead:  make(map[signalKey]*time.Timer),
+	}
+}
+
+// allowTyping reports whether a typing event should be forwarded, recording
+// it if so.
+func (a *signalAggregator) allowTyping(user, conversationID string) bool {
+	key := signalKey{user: user, conversation: conversationID}
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.lastTyping[key]; ok && now.Sub(last) < a.typingWindow {
+		return false
+	}
+	a.lastTyping[key] = now
+	return true
+}
+
+// scheduleRead queues a read update. If one is already pending for the same
+// key it is absorbed into that flush.
+func (a *signalAggregator) scheduleRead(user, conversationID string) {
+	key := signalKey{user: user, conversation: conversationID}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, pending := a.pendingRead[key]; pending {
+		return
+	}
+	a.pendingRead[key] = time.AfterFunc(a.readWindow, func() {
+		a.mu.Lock()
+		delete(a.pendingRead, key)
+		a.mu.Unlock()
+		a.flushRead(key.user, key.conversation)
+	})
+}
+
+// pruneLoop drops stale typing entries so the map does not grow with every
+// conversation a user has ever typed in.
+func (a *signalAggregator) pruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for key, last := range a.lastTyping {
+				if now.Sub(last) >= a.typingWindow {
+					delete(a.lastTyping, key)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// flushPending runs every queued read flush now instead of waiting for its
+// window, so read state is not lost on shutdown.
+func (a *signalAggregator) flushPending() {
+	a.mu.Lock()
+	keys := make([]signalKey, 0, len(a.pendingRead))
+	for key, timer := range a.pendingRead {
+		if timer.Stop() {
+			keys = append(keys, key)
+		}
+		delete(a.pendingRead, key)
+	}
+	a.mu.Unlock()
+
+	for _, key := range keys {
+		a.flushRead(key.user, key.conversation)
+	}
+}
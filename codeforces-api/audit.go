@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Authentication event types recorded in auth_audit_log.
+const (
+	auditLogin        = "login"
+	auditTokenRefresh = "token_refresh"
+	auditLogout       = "logout"
+)
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// minAuditIPSaltLength is the shortest AUDIT_IP_SALT accepted. With an empty
+// or guessable key, hashing every IPv4 address reverses the stored hashes.
+const minAuditIPSaltLength = 16
+
+var (
+	// When AUDIT_HASH_IPS is true the client IP is stored as a keyed hash so
+	// repeated attempts from one address can be correlated without keeping
+	// the raw address.
+	auditHashIPs bool
+	auditIPSalt  []byte
+	// trustedProxies are the peers whose X-Forwarded-For is believed.
+	trustedProxies []netip.Prefix
+)
+
+type auditEvent struct {
+	EventType string    `json:"event_type"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordAuthEvent writes an audit row for an authentication event. Audit
+// failures never fail the request; the event is logged instead.
+func (s *server) recordAuthEvent(r *http.Request, eventType string, userID int64, email, outcome, detail string) {
+	event := auditEvent{
+		EventType: eventType,
+		UserID:    userID,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		ClientIP:  auditClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+		Outcome:   outcome,
+		Detail:    truncate(detail, 255),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var uid any
+	if userID > 0 {
+		uid = userID
+	}
+	// The row should land even if the client has already gone away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO auth_audit_log (event_type, user_id, email, client_ip, user_agent, outcome, detail, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, event.EventType, uid, event.Email, event.ClientIP, event.UserAgent, event.Outcome, event.Detail, event.CreatedAt)
+	if err != nil {
+		payload, _ := json.Marshal(event)
+		log.Printf("audit insert error: %v; event: %s", err, payload)
+	}
+}
+
+// clientIP returns the originating client address. X-Forwarded-For is only
+// believed when the peer is a trusted proxy, and then only as far as the
+// hops that trusted proxies appended: it is walked from the right, and the
+// first address not in trustedProxies is the client. Anything to its left
+// was sent by the client and may be forged.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IP
+// addresses and CIDR ranges.
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func auditClientIP(r *http.Request) string {
+	ip := clientIP(r)
+	if !auditHashIPs || ip == "" {
+		return ip
+	}
+	mac := hmac.New(sha256.New, auditIPSalt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+
+	cases := []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.5:4000", "", "203.0.113.5"},
+		{"203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:4000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("POST", "/auth/verify-otp", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("remote %s, X-Forwarded-For %q: clientIP = %q, want %q", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigRequiresAuditSalt(t *testing.T) {
+	t.Setenv("OTP_PEPPER", "test-pepper")
+	t.Setenv("AUDIT_HASH_IPS", "true")
+	t.Setenv("AUDIT_IP_SALT", "")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AUDIT_IP_SALT") {
+		t.Fatalf("AUDIT_HASH_IPS without AUDIT_IP_SALT: err = %v", err)
+	}
+	t.Setenv("AUDIT_IP_SALT", "0123456789abcdef")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.auditHashIPs || cfg.auditIPSalt != "0123456789abcdef" {
+		t.Fatalf("cfg = %+v", cfg)
+	}
+}
+
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	t.Setenv("OTP_PEPPER", "")
+	t.Setenv("AUDIT_HASH_IPS", "maybe")
+	t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://ok.example.com,ftp//broken")
+	t.Setenv("WS_IDLE_TIMEOUT_SECONDS", "0")
+	t.Setenv("SHUTDOWN_GRACE_MS", "5s")
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig accepted invalid settings")
+	}
+	for _, key := range []string{"OTP_PEPPER", "AUDIT_HASH_IPS", "TRUSTED_PROXIES", "WS_ALLOWED_ORIGINS", "WS_IDLE_TIMEOUT_SECONDS", "SHUTDOWN_GRACE_MS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// Codes in otp_codes are written by email-worker as
+// "hmac$<salt hex>$<mac hex>" with mac = HMAC-SHA256(OTP_PEPPER, salt || code).
+// Rows from before that hold the plain code; codes expire within minutes, so
+// those are only accepted during a rollout.
+const otpHMACPrefix = "hmac$"
+
+// otpMatches reports whether code matches the stored otp_codes value, in
+// constant time.
+func otpMatches(pepper []byte, stored, code string) bool {
+	if !strings.HasPrefix(stored, otpHMACPrefix) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(code)) == 1
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, otpHMACPrefix), "$")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write(salt)
+	mac.Write([]byte(code))
+	return hmac.Equal(mac.Sum(nil), want)
+}
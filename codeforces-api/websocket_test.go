@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newWebsocketTestServer(t *testing.T, idle time.Duration) (*server, string) {
+	t.Helper()
+	s := &server{
+		hub:           newHub(),
+		wsIdleTimeout: idle,
+		upgrader:      websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(s.handleWebsocket))
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http") + "?submissionId=42"
+}
+
+func subscribers(h *wsHub, id int64) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[id])
+}
+
+// waitForSubscribers polls until the hub holds want clients for submission 42.
+func waitForSubscribers(t *testing.T, h *wsHub, want int, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for subscribers(h, 42) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d subscribers, want %d", subscribers(h, 42), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebsocketKeepsClientsThatAnswerPings(t *testing.T) {
+	s, url := newWebsocketTestServer(t, 200*time.Millisecond)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Reading is what makes the client answer pings with pongs.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	waitForSubscribers(t, s.hub, 1, time.Second)
+	time.Sleep(5 * s.wsIdleTimeout)
+	if n := subscribers(s.hub, 42); n != 1 {
+		t.Fatalf("client answering pings was reaped; hub has %d subscribers", n)
+	}
+}
+
+func TestWebsocketReapsSilentClients(t *testing.T) {
+	s, url := newWebsocketTestServer(t, 200*time.Millisecond)
+	// This client never reads, so it never answers a ping.
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitForSubscribers(t, s.hub, 1, time.Second)
+	waitForSubscribers(t, s.hub, 0, 5*s.wsIdleTimeout)
+}
@@ -362,7 +362,10 @@ export default function ProblemPage({ params }) {
     setSelectedLoading(true);
     setSelectedError('');
     try {
-      const res = await fetch(`${apiBase}/submissions?id=${id}`, { cache: 'no-store' });
+      const res = await fetch(`${apiBase}/submissions?id=${id}`, {
+        cache: 'no-store',
+        headers: token ? { Authorization: `Bearer ${token}` } : {},
+      });
       if (!res.ok) {
         throw new Error(`Failed to load submission (${res.status})`);
       }
@@ -632,6 +635,12 @@ export default function ProblemPage({ params }) {
               <summary>Stderr</summary>
               <pre className="code-block">{selectedSub.stderr || '(empty)'}</pre>
             </details>
+            {selectedSub.warnings && (
+              <details>
+                <summary>Compiler warnings</summary>
+                <pre className="code-block">{selectedSub.warnings}</pre>
+              </details>
+            )}
             <details>
               <summary>Response</summary>
               <pre className="code-block">{selectedSub.response || '(empty)'}</pre>
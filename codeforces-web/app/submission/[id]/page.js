@@ -16,7 +16,11 @@ export default function SubmissionFixPage({ params }) {
       setLoading(true);
       setError('');
       try {
-        const res = await fetch(`${apiBase}/submissions?id=${subId}`, { cache: 'no-store' });
+        const token = localStorage.getItem('cf_token') || '';
+        const res = await fetch(`${apiBase}/submissions?id=${subId}`, {
+          cache: 'no-store',
+          headers: token ? { Authorization: `Bearer ${token}` } : {},
+        });
         if (!res.ok) throw new Error(`Failed to load submission (${res.status})`);
         const d = await res.json();
         setData(d);
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildCache keeps compiled candidates keyed by sha256 of the language, the
+// compiler version and the source, so a rejudge or an identical resubmission
+// skips the compile. Entries are written to a temp file and renamed into
+// place, so concurrent builds of the same source never see a partial binary.
+type buildCache struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	// versions is the compiler version line per normalized language, part
+	// of every key so a toolchain upgrade invalidates old binaries.
+	versions map[string]string
+
+	evictMu sync.Mutex
+}
+
+// buildCacheConfig is BUILD_CACHE_DIR, BUILD_CACHE_MAX_MB and
+// BUILD_CACHE_MAX_AGE_HOURS.
+type buildCacheConfig struct {
+	dir    string
+	maxMB  int
+	maxAge time.Duration
+}
+
+// loadBuildCache returns nil, disabling the cache, when BUILD_CACHE_MAX_MB
+// is 0 or the directory cannot be created.
+//
+// Cached binaries are run by later submissions, so no candidate may be able
+// to write them. The directory and its entries are private to the worker's
+// uid, which protects them only when candidates run under other uids
+// (RUN_UID_BASE); without that the cache is disabled.
+func loadBuildCache(cfg buildCacheConfig, versions map[string]string, sb *sandbox) *buildCache {
+	if cfg.maxMB == 0 {
+		return nil
+	}
+	if sb.uids == nil {
+		log.Printf("build cache disabled: candidates run as the worker's uid and could overwrite cached binaries; set RUN_UID_BASE to enable it")
+		return nil
+	}
+	dir := cfg.dir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("build cache disabled: %v", err)
+		return nil
+	}
+	// A directory left by an older worker may still be world-readable.
+	if err := os.Chmod(dir, 0o700); err != nil {
+		log.Printf("build cache disabled: %v", err)
+		return nil
+	}
+	return &buildCache{
+		dir:      dir,
+		maxBytes: int64(cfg.maxMB) << 20,
+		maxAge:   cfg.maxAge,
+		versions: versions,
+	}
+}
+
+// key returns the cache key for code in lang, or "" when lang is not
+// compiled (Python) or its compiler was not found.
+func (c *buildCache) key(lang, code string) string {
+	lang = normalizeLang(lang)
+	version := c.versions[lang]
+	if lang == "" || lang == "python" || version == "" {
+		return ""
+	}
+	if lang == "go" {
+		// The build mode decides which imports resolve.
+		version += " " + goBuildMode
+	}
+	sum := sha256.Sum256([]byte(lang + "\x00" + version + "\x00" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// fetch copies the cached binary for key to dst and returns the compiler
+// warnings recorded with it, reporting whether there was one. It copies
+// rather than links so the candidate never runs the cached file itself.
+func (c *buildCache) fetch(key, dst string) (string, bool) {
+	src := filepath.Join(c.dir, key)
+	if err := copyFile(src, dst); err != nil {
+		return "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(src, now, now)
+	warnings, _ := os.ReadFile(src + warningsSuffix)
+	return string(warnings), true
+}
+
+// warningsSuffix names the file next to a cached binary that holds the
+// warnings its build printed.
+const warningsSuffix = ".warnings"
+
+// store adds bin and its build warnings under key and then evicts old
+// entries.
+func (c *buildCache) store(key, bin, warnings string) {
+	if warnings != "" {
+		// Written first so a concurrent fetch never sees the binary without
+		// its warnings; a stray warnings file without a binary is harmless.
+		if err := os.WriteFile(filepath.Join(c.dir, key+warningsSuffix), []byte(warnings), 0o600); err != nil {
+			log.Printf("build cache store: %v", err)
+			return
+		}
+	}
+	// CreateTemp makes the file 0600, and copyFile keeps that mode.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-"+key+"-*")
+	if err != nil {
+		log.Printf("build cache store: %v", err)
+		return
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	if err := copyFile(bin, tmpName); err != nil {
+		os.Remove(tmpName)
+		log.Printf("build cache store: %v", err)
+		return
+	}
+	if err := os.Rename(tmpName, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmpName)
+		log.Printf("build cache store: %v", err)
+		return
+	}
+	c.evict()
+}
+
+// evict removes entries older than maxAge, then the least recently used
+// ones until the cache fits in maxBytes. Running candidates are unaffected
+// because they use a copy in their own temp dir.
+func (c *buildCache) evict() {
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		files []cached
+		total int64
+	)
+	cutoff := time.Now().Add(-c.maxAge)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(c.dir, e.Name())
+		// Leftover temp files from a crash are only removed once stale.
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			if info.ModTime().Before(time.Now().Add(-time.Hour)) {
+				os.Remove(path)
+			}
+			continue
+		}
+		// Warnings files are removed together with their binary.
+		if strings.HasSuffix(e.Name(), warningsSuffix) {
+			continue
+		}
+		if c.maxAge > 0 && info.ModTime().Before(cutoff) {
+			os.Remove(path)
+			os.Remove(path + warningsSuffix)
+			continue
+		}
+		files = append(files, cached{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			os.Remove(f.path + warningsSuffix)
+			total -= f.size
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compilerVersions returns the first line of each toolchain's version
+// output, keyed by normalized language. Missing toolchains are left out.
+func compilerVersions(ctx context.Context) map[string]string {
+	commands := map[string][]string{
+		"go":     {"go", "version"},
+		"cpp":    {"g++", "--version"},
+		"rust":   {"rustc", "--version"},
+		"python": {"python3", "--version"},
+	}
+	versions := make(map[string]string, len(commands))
+	for lang, argv := range commands {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+		cancel()
+		if err != nil {
+			log.Printf("toolchain %s: unavailable (%v)", lang, err)
+			continue
+		}
+		line := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+		versions[lang] = line
+		log.Printf("toolchain %s: %s", lang, line)
+	}
+	return versions
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildCacheIsPrivate(t *testing.T) {
+	cfg := buildCacheConfig{dir: filepath.Join(t.TempDir(), "cache"), maxMB: 512, maxAge: time.Hour}
+	sb := testSandbox()
+	if c := loadBuildCache(cfg, map[string]string{"cpp": "g++ 13"}, sb); c != nil {
+		t.Fatal("build cache enabled although candidates share the worker's uid")
+	}
+
+	sb.uids = make(chan int, 1)
+	c := loadBuildCache(cfg, map[string]string{"cpp": "g++ 13"}, sb)
+	if c == nil {
+		t.Fatal("build cache disabled")
+	}
+	bin := writeScript(t, t.TempDir(), "bin", "echo cached")
+	key := c.key("cpp", "int main() {}")
+	c.store(key, bin, "warning: unused")
+
+	for name, want := range map[string]os.FileMode{"": 0o700, key: 0o600, key + warningsSuffix: 0o600} {
+		info, err := os.Stat(filepath.Join(c.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%q has mode %o, want %o", name, got, want)
+		}
+	}
+}
+
+func TestCandidateCannotModifyBuildCache(t *testing.T) {
+	sb, runDir := runUIDSandbox(t, 1)
+	cacheDir, err := os.MkdirTemp("", "cf-cache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	c := loadBuildCache(buildCacheConfig{dir: cacheDir, maxMB: 512, maxAge: time.Hour}, map[string]string{"cpp": "g++ 13"}, sb)
+	if c == nil {
+		t.Fatal("build cache disabled")
+	}
+	key := c.key("cpp", "int main() {}")
+	c.store(key, writeScript(t, t.TempDir(), "good", "echo good"), "")
+	cached := filepath.Join(cacheDir, key)
+
+	// The candidate knows where the cache is and tries to replace, edit and
+	// delete the entry and to add a new one.
+	attack := "echo 'echo pwned' > " + cached + "\n" +
+		"mv /dev/null " + cached + "\n" +
+		"rm -f " + cached + "\n" +
+		"echo 'echo pwned' > " + filepath.Join(cacheDir, "planted") + "\n" +
+		"exit 0"
+	uid, release, err := sb.acquireUID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	wrapper, err := sb.wrap(runDir, writeScript(t, t.TempDir(), "attack", attack), "cpp", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sb.run(context.Background(), wrapper, "", 5*time.Second, 1<<10)
+	if res.err != nil {
+		t.Fatalf("run failed: %v: %s", res.err, res.stderr)
+	}
+
+	got, err := os.ReadFile(cached)
+	if err != nil {
+		t.Fatalf("cached binary is gone: %v", err)
+	}
+	if string(got) != "#!/bin/sh\necho good\n" {
+		t.Fatalf("cached binary was modified: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "planted")); err == nil {
+		t.Fatal("the candidate added an entry to the cache")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With RUN_CGROUP_DIR set, memory is limited by cgroup v2 instead of
+// RLIMIT_AS, and a run is only reported as MLE when the kernel's OOM killer
+// ended it inside its cgroup. Nothing the candidate prints or does to itself
+// can produce that verdict, unlike an allocation-failure message or a
+// SIGKILL it sends itself. Without RUN_CGROUP_DIR memory is still capped by
+// RLIMIT_AS, which gives no signal of its own, so running out of memory is
+// reported as a runtime error with the candidate's stderr.
+//
+// RUN_CGROUP_DIR must be an empty cgroup v2 directory delegated to the
+// worker's uid, with the memory controller available, and the worker's own
+// process must live in a cgroup under the same delegated parent so it can
+// move candidates. Each submission gets a child named after its run
+// directory, and each candidate process a child of that named after its pid,
+// whose memory.max is the language's memory limit. The cgroup files belong
+// to the worker's uid, so RUN_UID_BASE is required to keep candidates from
+// raising their own limit.
+
+// checkCgroupDir makes sure dir is a cgroup v2 directory with the memory
+// controller and enables it for the submissions' cgroups.
+func checkCgroupDir(dir string) error {
+	controllers, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %w", dir, err)
+	}
+	if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " memory ") {
+		return fmt.Errorf("%s does not offer the memory controller", dir)
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory"), 0)
+}
+
+// submissionCgroup is the cgroup for the submission whose candidate runs
+// from runDir, or "" when cgroups are not used.
+func (sb *sandbox) submissionCgroup(runDir string) string {
+	if sb.cgroupDir == "" {
+		return ""
+	}
+	return filepath.Join(sb.cgroupDir, filepath.Base(runDir))
+}
+
+// createSubmissionCgroup creates the submission's cgroup and lets its
+// candidate processes have memory limits of their own.
+func createSubmissionCgroup(dir string) error {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory"), 0)
+}
+
+// releaseCgroup kills whatever is left in the submission's cgroup and
+// removes it with its children.
+func (sb *sandbox) releaseCgroup(runDir string) {
+	dir := sb.submissionCgroup(runDir)
+	if dir == "" {
+		return
+	}
+	children, _ := filepath.Glob(filepath.Join(dir, "run-*"))
+	for _, child := range append(children, dir) {
+		_ = os.WriteFile(filepath.Join(child, "cgroup.kill"), []byte("1"), 0)
+	}
+	for _, child := range append(children, dir) {
+		// A cgroup cannot be removed until its killed processes are gone.
+		for attempt := 0; attempt < 20; attempt++ {
+			if err := os.Remove(child); err == nil || errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// runCgroup is the cgroup of the candidate process pid started by the
+// wrapper in a submission's cgroup.
+func runCgroup(submission string, pid int) string {
+	return filepath.Join(submission, "run-"+strconv.Itoa(pid))
+}
+
+// joinRunCgroup moves the calling process into a new cgroup under
+// submission whose memory.max is memoryMB, 0 meaning no limit. Swap is
+// turned off so the limit cannot be stretched by swapping.
+func joinRunCgroup(submission string, memoryMB int) error {
+	dir := runCgroup(submission, os.Getpid())
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	limit := "max"
+	if memoryMB > 0 {
+		limit = strconv.Itoa(memoryMB << 20)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limit), 0); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte("0"), 0)
+}
+
+// oomKilled reports whether the OOM killer ended a process in the cgroup
+// whose memory.events is at path.
+func oomKilled(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.Atoi(fields[1])
+			return err == nil && n > 0
+		}
+	}
+	return false
+}
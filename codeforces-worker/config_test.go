@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	t.Setenv("RUN_TIMEOUT_MS", "2s")
+	t.Setenv("RUN_MEMORY_MB", "-1")
+	t.Setenv("WORKER_CONCURRENCY", "0")
+	t.Setenv("STREAM_TEST_PROGRESS", "yes")
+	t.Setenv("RECONCILE_MODE", "retry")
+	t.Setenv("RUN_LIMITS_JSON", `{"python": {"time_ms": 0}}`)
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig accepted invalid settings")
+	}
+	for _, key := range []string{"RUN_TIMEOUT_MS", "RUN_MEMORY_MB", "WORKER_CONCURRENCY", "STREAM_TEST_PROGRESS", "RECONCILE_MODE", "RUN_LIMITS_JSON"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.streamTests || cfg.concurrency < 1 || cfg.sandbox.memoryMB != 512 || cfg.sandbox.outputLimit != 64<<10 || cfg.buildCache.maxMB != 512 {
+		t.Fatalf("cfg = %+v, sandbox = %+v", cfg, cfg.sandbox)
+	}
+}
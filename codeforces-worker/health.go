@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// workerStats counts submissions judged since the process started.
+// processed counts every submission handled; failed counts those that ended
+// with an internal error rather than a verdict.
+type workerStats struct {
+	processed atomic.Int64
+	failed    atomic.Int64
+	inFlight  atomic.Int64
+	// schemaReady is set once ensureSchema has succeeded and ready once the
+	// worker is consuming.
+	schemaReady atomic.Bool
+	ready       atomic.Bool
+}
+
+// healthServer answers liveness and readiness probes. It only exists when
+// HEALTH_ADDR is set, so local runs need no free port.
+type healthServer struct {
+	db      *sql.DB
+	brokers []string
+	stats   *workerStats
+}
+
+// startHealthServer serves /healthz, /readyz and /metrics on addr in the
+// background.
+func startHealthServer(addr string, hs *healthServer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", hs.handleHealthz)
+	mux.HandleFunc("/readyz", hs.handleReadyz)
+	mux.HandleFunc("/metrics", hs.handleMetrics)
+	go func() {
+		log.Printf("health endpoint listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("health endpoint stopped: %v", err)
+		}
+	}()
+}
+
+// handleHealthz reports that the process is up, with the submission counters.
+func (hs *healthServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":    "ok",
+		"processed": hs.stats.processed.Load(),
+		"failed":    hs.stats.failed.Load(),
+		"in_flight": hs.stats.inFlight.Load(),
+	})
+}
+
+// handleReadyz reports "migrating" until the schema is in place and
+// "starting" until the worker is consuming, then checks that Postgres and a
+// Kafka broker still answer.
+func (hs *healthServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !hs.stats.schemaReady.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "migrating"})
+		return
+	}
+	if !hs.stats.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := hs.db.PingContext(ctx); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "db: " + err.Error()})
+		return
+	}
+	if err := pingKafka(ctx, hs.brokers); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "kafka: " + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// handleMetrics exposes the counters in the Prometheus text format.
+func (hs *healthServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE codeforces_worker_submissions_processed_total counter\ncodeforces_worker_submissions_processed_total %d\n", hs.stats.processed.Load())
+	fmt.Fprintf(w, "# TYPE codeforces_worker_submissions_failed_total counter\ncodeforces_worker_submissions_failed_total %d\n", hs.stats.failed.Load())
+	fmt.Fprintf(w, "# TYPE codeforces_worker_submissions_in_flight gauge\ncodeforces_worker_submissions_in_flight %d\n", hs.stats.inFlight.Load())
+}
+
+// pingKafka succeeds when any broker accepts a connection.
+func pingKafka(ctx context.Context, brokers []string) error {
+	var lastErr error
+	for _, broker := range brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no brokers configured")
+	}
+	return lastErr
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A resource policy sets time, CPU and memory limits per language, for
+// languages that need more room than the defaults (Python is far slower than
+// C++). It is JSON keyed by language, read from RUN_LIMITS_JSON or, if that
+// is unset, from the file named by RUN_LIMITS_FILE:
+//
+//	{"python": {"time_ms": 8000, "cpu_seconds": 10, "memory_mb": 1024}, "cpp": {"time_ms": 2000}}
+//
+// Keys may be any accepted alias (py, c++, rs, ...). time_ms must be
+// positive; cpu_seconds and memory_mb must not be negative, with 0 disabling
+// the limit as RUN_CPU_SECONDS=0 and RUN_MEMORY_MB=0 do. A field that is
+// left out keeps the limit from the environment. The policy is validated at
+// startup and a bad one stops the worker.
+type languageLimits struct {
+	TimeMS     *int `json:"time_ms"`
+	CPUSeconds *int `json:"cpu_seconds"`
+	MemoryMB   *int `json:"memory_mb"`
+}
+
+// loadLanguageLimits returns the configured policy keyed by normalized
+// language, or nil when none is configured.
+func loadLanguageLimits() (map[string]languageLimits, error) {
+	data := []byte(strings.TrimSpace(os.Getenv("RUN_LIMITS_JSON")))
+	source := "RUN_LIMITS_JSON"
+	if len(data) == 0 {
+		path := strings.TrimSpace(os.Getenv("RUN_LIMITS_FILE"))
+		if path == "" {
+			return nil, nil
+		}
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("RUN_LIMITS_FILE: %w", err)
+		}
+		source = "RUN_LIMITS_FILE " + path
+	}
+	limits, err := parseLanguageLimits(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return limits, nil
+}
+
+func parseLanguageLimits(data []byte) (map[string]languageLimits, error) {
+	var raw map[string]languageLimits
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	limits := make(map[string]languageLimits, len(raw))
+	seen := make(map[string]string, len(raw))
+	for key, l := range raw {
+		lang := normalizeLang(key)
+		switch {
+		case lang == "":
+			problems = append(problems, fmt.Sprintf("unknown language %q", key))
+			continue
+		case seen[lang] != "":
+			problems = append(problems, fmt.Sprintf("%q and %q both set limits for %s", seen[lang], key, lang))
+			continue
+		}
+		seen[lang] = key
+		if l.TimeMS != nil && *l.TimeMS <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: time_ms must be positive, got %d", key, *l.TimeMS))
+		}
+		if l.CPUSeconds != nil && *l.CPUSeconds < 0 {
+			problems = append(problems, fmt.Sprintf("%s: cpu_seconds must not be negative, got %d", key, *l.CPUSeconds))
+		}
+		if l.MemoryMB != nil && *l.MemoryMB < 0 {
+			problems = append(problems, fmt.Sprintf("%s: memory_mb must not be negative, got %d", key, *l.MemoryMB))
+		}
+		limits[lang] = l
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return limits, nil
+}
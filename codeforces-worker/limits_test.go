@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLanguageLimits(t *testing.T) {
+	limits, err := parseLanguageLimits([]byte(`{"py": {"time_ms": 8000, "cpu_seconds": 10}, "c++": {"memory_mb": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	py := limits["python"]
+	if py.TimeMS == nil || *py.TimeMS != 8000 || py.CPUSeconds == nil || *py.CPUSeconds != 10 || py.MemoryMB != nil {
+		t.Fatalf("python limits = %+v", py)
+	}
+	cpp := limits["cpp"]
+	if cpp.MemoryMB == nil || *cpp.MemoryMB != 0 || cpp.TimeMS != nil || cpp.CPUSeconds != nil {
+		t.Fatalf("cpp limits = %+v", cpp)
+	}
+}
+
+func TestParseLanguageLimitsRejects(t *testing.T) {
+	tests := []struct {
+		policy, want string
+	}{
+		{`{"cobol": {"time_ms": 1000}}`, `unknown language "cobol"`},
+		{`{"py": {"time_ms": 0}}`, "time_ms must be positive"},
+		{`{"py": {"cpu_seconds": -1}}`, "cpu_seconds must not be negative"},
+		{`{"py": {"memory_mb": -1}}`, "memory_mb must not be negative"},
+		{`{"py": {"time_ms": 1000}, "python": {"time_ms": 2000}}`, "both set limits for python"},
+		{`{"py": {"cpu_ms": 1000}}`, "unknown field"},
+	}
+	for _, tt := range tests {
+		if _, err := parseLanguageLimits([]byte(tt.policy)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.policy, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+const truncatedMarker = "\n[truncated]"
+
+// cappedBuffer keeps at most limit bytes of what is written to it and
+// silently discards the rest, so a candidate printing without bound cannot
+// exhaust the worker's memory. Writes always succeed, which keeps the child
+// from blocking or dying on a closed pipe.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{limit: limit}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// String returns the captured output, with truncatedMarker appended when
+// anything was dropped.
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + truncatedMarker
+	}
+	return b.buf.String()
+}
+
+// truncateOutput cuts s to at most limit bytes on a UTF-8 boundary and marks
+// it as truncated.
+func truncateOutput(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncatedMarker
+}
+
+// clipOutput bounds the stdout and stderr carried by a status message, which
+// is shipped over Kafka and stored in the submissions table.
+func (sb *sandbox) clipOutput(msg statusMessage) statusMessage {
+	msg.Stdout = truncateOutput(msg.Stdout, sb.outputLimit)
+	msg.Stderr = truncateOutput(msg.Stderr, sb.outputLimit)
+	msg.Warnings = truncateOutput(msg.Warnings, sb.outputLimit)
+	return msg
+}
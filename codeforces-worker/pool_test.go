@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJudgePoolBoundsConcurrency(t *testing.T) {
+	const concurrency = 2
+	var (
+		stats   workerStats
+		running atomic.Int64
+		peak    atomic.Int64
+		release = make(chan struct{})
+	)
+	pool := newJudgePool(concurrency, &stats, func(id int64) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+	})
+
+	for id := int64(1); id <= concurrency; id++ {
+		pool.dispatch(id)
+	}
+
+	// Every slot is busy, so the next dispatch must wait for one to free up.
+	dispatched := make(chan struct{})
+	go func() {
+		pool.dispatch(concurrency + 1)
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch returned while every slot was busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := stats.inFlight.Load(); n != concurrency {
+		t.Fatalf("in flight = %d, want %d", n, concurrency)
+	}
+
+	release <- struct{}{}
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch still blocked after a judge finished")
+	}
+	close(release)
+	// A finished judge is counted as processed before it leaves in_flight.
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.inFlight.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("judges still in flight after release")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if p := peak.Load(); p > concurrency {
+		t.Fatalf("%d judges ran at once, limit is %d", p, concurrency)
+	}
+	if n := stats.processed.Load(); n != concurrency+1 {
+		t.Fatalf("processed = %d, want %d", n, concurrency+1)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Reconcile modes for submissions left in flight by a crashed worker.
+const (
+	reconcileRequeue = "requeue"
+	reconcileFail    = "fail"
+	reconcileOff     = "off"
+)
+
+// reconcileStuck finds submissions still "processing" or "running" that have
+// not been updated for longer than after, which no live worker can still be
+// judging since handleSubmission gives up after two minutes. In requeue mode
+// each one is put back on the submission topic and marked "queued" with its
+// verdict and test progress cleared; in fail mode it is marked "failed" with
+// verdict "worker restarted" and code CANCELLED, since judging was abandoned.
+// Each row is claimed with a conditional UPDATE, so when several workers
+// start together only one of them reconciles it. The new status is then sent
+// on the status topic so codeforces-api notifies open WebSockets.
+func reconcileStuck(ctx context.Context, db *sql.DB, producer *kafka.Writer, submissionTopic, mode string, after time.Duration) error {
+	if mode == reconcileOff {
+		return nil
+	}
+	staleSeconds := int64(after / time.Second)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM submissions
+		WHERE status IN ('processing', 'running')
+		  AND updated_at < NOW() - ($1 * INTERVAL '1 second')
+		ORDER BY id
+	`, staleSeconds)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	requeue := &kafka.Writer{
+		Addr:     producer.Addr,
+		Topic:    submissionTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer requeue.Close()
+
+	var reconciled []int64
+	for _, id := range ids {
+		status := statusMessage{SubmissionID: id, Status: "failed", Verdict: "worker restarted", VerdictCode: verdictCancelled}
+		if mode == reconcileRequeue {
+			status = statusMessage{SubmissionID: id, Status: "queued"}
+		}
+		claimed, err := claimStuck(ctx, db, status, staleSeconds, func() error {
+			if mode != reconcileRequeue {
+				return nil
+			}
+			payload, err := json.Marshal(status)
+			if err != nil {
+				return err
+			}
+			return requeue.WriteMessages(ctx, kafka.Message{
+				Key:   []byte(strconv.FormatInt(id, 10)),
+				Value: payload,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("reconcile submission %d: %w", id, err)
+		}
+		if !claimed {
+			continue
+		}
+		reconciled = append(reconciled, id)
+		if err := publishStatus(ctx, producer, status); err != nil {
+			return fmt.Errorf("update submission %d: %w", id, err)
+		}
+	}
+	if len(reconciled) > 0 {
+		slog.Info("reconciled stuck submissions", "count", len(reconciled), "mode", mode, "submission_ids", joinIDs(reconciled))
+	}
+	return nil
+}
+
+// claimStuck moves one submission to status if it is still stuck, clearing
+// the verdict, output, warnings and test progress left by the abandoned run,
+// and calls then before committing. The row stays locked until then returns,
+// so a second worker's claim waits and then finds the submission no longer
+// stuck; if then fails the claim is rolled back. It reports whether this call
+// made the change.
+func claimStuck(ctx context.Context, db *sql.DB, status statusMessage, staleSeconds int64, then func() error) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE submissions
+		SET status = $2, verdict = NULLIF($3, ''), verdict_code = NULLIF($4, ''),
+		    stdout = NULL, stderr = NULL, warnings = NULL,
+		    total_tests = NULL, passed_tests = NULL, updated_at = NOW()
+		WHERE id = $1
+		  AND status IN ('processing', 'running')
+		  AND updated_at < NOW() - ($5 * INTERVAL '1 second')
+	`, status.SubmissionID, status.Status, status.Verdict, status.VerdictCode, staleSeconds)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := then(); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ", ")
+}
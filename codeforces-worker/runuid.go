@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Candidates run under their own uids when RUN_UID_BASE is set. Each
+// submission being judged takes one of the uids RUN_UID_BASE ..
+// RUN_UID_BASE+WORKER_CONCURRENCY-1 for its whole run, so:
+//
+//   - RLIMIT_NPROC, which the kernel counts per uid, limits that submission
+//     alone. A fork bomb cannot use up the process limit of the worker or of
+//     the other submissions being judged.
+//   - The candidate cannot write the worker's files, such as the build
+//     cache, or signal the worker.
+//
+// The uids need no passwd entries. Switching to them takes root or
+// CAP_SETUID and CAP_SETGID, and killing their processes takes CAP_KILL; the
+// image grants the worker binary those capabilities.
+func loadRunUIDs(base, concurrency int) (chan int, error) {
+	if base == 0 {
+		return nil, nil
+	}
+	if base < 1000 {
+		return nil, fmt.Errorf("RUN_UID_BASE must be 0 or at least 1000, got %d", base)
+	}
+	if base == os.Getuid() {
+		return nil, fmt.Errorf("RUN_UID_BASE %d is the worker's own uid", base)
+	}
+	if err := probeRunUID(base); err != nil {
+		return nil, fmt.Errorf("RUN_UID_BASE is set but candidates cannot be started as uid %d: %w", base, err)
+	}
+	uids := make(chan int, concurrency)
+	for i := 0; i < concurrency; i++ {
+		uids <- base + i
+	}
+	return uids, nil
+}
+
+// probeRunUID checks at startup that the worker can switch to uid.
+func probeRunUID(uid int) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(self, sandboxExecArg, "0", "0", "0", strconv.Itoa(uid), "-", "/bin/true").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// acquireUID returns the uid to run one submission's candidate as, 0 when
+// candidates run as the worker, and a function that hands it back once the
+// submission is judged. Handing it back kills whatever the candidate left
+// running under it, even processes that left its process group.
+func (sb *sandbox) acquireUID(ctx context.Context) (int, func(), error) {
+	if sb.uids == nil {
+		return 0, func() {}, nil
+	}
+	select {
+	case uid := <-sb.uids:
+		return uid, func() {
+			reapUID(uid)
+			sb.uids <- uid
+		}, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// dropPrivileges switches the calling process to uid, with a primary group
+// of the same number and no supplementary groups.
+func dropPrivileges(uid int) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(uid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// reapUID kills every process whose real uid is uid.
+func reapUID(uid int) {
+	pids, _ := filepath.Glob("/proc/[0-9]*/status")
+	for _, status := range pids {
+		if procUID(status) != uid {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(status)))
+		if err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// procUID returns the real uid in a /proc/<pid>/status file, or -1.
+func procUID(status string) int {
+	f, err := os.Open(status)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "Uid:" {
+			if uid, err := strconv.Atoi(fields[1]); err == nil {
+				return uid
+			}
+		}
+	}
+	return -1
+}
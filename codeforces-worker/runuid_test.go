@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandboxExecMinimalEnv(t *testing.T) {
+	t.Setenv("DB_DSN", "postgres://secret")
+	sb := testSandbox()
+	bin := writeScript(t, t.TempDir(), "env.sh", "env; pwd")
+	runDir := t.TempDir()
+
+	wrapper, err := sb.wrap(runDir, bin, "cpp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sb.run(context.Background(), wrapper, "", 5*time.Second, 1<<10)
+	if res.err != nil {
+		t.Fatalf("run failed: %v: %s", res.err, res.stderr)
+	}
+	if strings.Contains(res.stdout, "DB_DSN") {
+		t.Fatalf("candidate saw the worker's environment:\n%s", res.stdout)
+	}
+	for _, want := range []string{"PATH=" + sandboxPath, "HOME=" + runDir, "\n" + runDir + "\n"} {
+		if !strings.Contains("\n"+res.stdout, want) {
+			t.Errorf("candidate output lacks %q:\n%s", want, res.stdout)
+		}
+	}
+}
+
+// runUIDSandbox returns a sandbox with n run uids from 54321 and a run dir
+// outside t.TempDir, whose parent is private to root. It skips unless the
+// test can switch uids.
+func runUIDSandbox(t *testing.T, n int) (*sandbox, string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("switching uids needs root")
+	}
+	sb := testSandbox()
+	sb.uids = make(chan int, n)
+	for i := 0; i < n; i++ {
+		sb.uids <- 54321 + i
+	}
+	runDir, err := os.MkdirTemp("", "cf-run-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(runDir) })
+	return sb, runDir
+}
+
+func TestCandidateRunsAsRunUID(t *testing.T) {
+	sb, runDir := runUIDSandbox(t, 1)
+	uid, release, err := sb.acquireUID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	bin := writeScript(t, t.TempDir(), "id.sh", "id -u; id -G")
+
+	wrapper, err := sb.wrap(runDir, bin, "cpp", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sb.run(context.Background(), wrapper, "", 5*time.Second, 1<<10)
+	if res.err != nil {
+		t.Fatalf("run failed: %v: %s", res.err, res.stderr)
+	}
+	if got := strings.Fields(res.stdout); len(got) != 2 || got[0] != "54321" || got[1] != "54321" {
+		t.Fatalf("candidate ran as uid/groups %q, want 54321 54321", res.stdout)
+	}
+}
+
+func TestProcessLimitIsPerSubmission(t *testing.T) {
+	sb, hogDir := runUIDSandbox(t, 2)
+	sb.maxProcs = 4
+	okDir, err := os.MkdirTemp("", "cf-run-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(okDir)
+	scripts := t.TempDir()
+
+	// The first submission sits at its process limit.
+	hogUID, releaseHog, err := sb.acquireUID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseHog()
+	hog, err := sb.wrap(hogDir, writeScript(t, scripts, "hog.sh", "while sleep 0.05 & do :; done; wait"), "cpp", hogUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hogDone := make(chan struct{})
+	go func() {
+		sb.run(context.Background(), hog, "", 3*time.Second, 1<<10)
+		close(hogDone)
+	}()
+	defer func() { <-hogDone }()
+	time.Sleep(300 * time.Millisecond)
+
+	// A concurrent submission can still fork.
+	uid, release, err := sb.acquireUID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	forker, err := sb.wrap(okDir, writeScript(t, scripts, "fork.sh", "sh -c 'echo child'"), "cpp", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sb.run(context.Background(), forker, "", 2*time.Second, 1<<10)
+	if res.err != nil || strings.TrimSpace(res.stdout) != "child" {
+		t.Fatalf("fork beside a process hog: err %v, stdout %q, stderr %q", res.err, res.stdout, res.stderr)
+	}
+}
+
+func TestReleaseUIDKillsLeftovers(t *testing.T) {
+	sb, runDir := runUIDSandbox(t, 1)
+	uid, release, err := sb.acquireUID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// setsid takes the sleeper out of the run's process group, so killing
+	// the group at the end of the run misses it.
+	bin := writeScript(t, t.TempDir(), "escape.sh", "setsid sleep 60 </dev/null >/dev/null 2>&1 &\nsleep 0.3")
+	wrapper, err := sb.wrap(runDir, bin, "cpp", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := sb.run(context.Background(), wrapper, "", 5*time.Second, 1<<10); res.err != nil {
+		t.Fatalf("run failed: %v: %s", res.err, res.stderr)
+	}
+	if countUID(uid) == 0 {
+		t.Fatal("the escaped sleeper is not running; the test proves nothing")
+	}
+
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for countUID(uid) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d process(es) of uid %d survived release", countUID(uid), uid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := <-sb.uids; got != uid {
+		t.Fatalf("released uid %d, want %d", got, uid)
+	}
+}
+
+func countUID(uid int) int {
+	n := 0
+	statuses, _ := filepath.Glob("/proc/[0-9]*/status")
+	for _, status := range statuses {
+		if procUID(status) == uid && !zombie(status) {
+			n++
+		}
+	}
+	return n
+}
+
+func zombie(status string) bool {
+	data, err := os.ReadFile(status)
+	return err == nil && strings.Contains(string(data), "State:\tZ")
+}
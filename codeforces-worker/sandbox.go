@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sandbox holds the limits applied to every run of untrusted code. The
+// candidate is started through a wrapper script that re-executes this worker
+// in sandboxExecArg mode, which sets the rlimits and then execs the real
+// binary, so the limits also apply when a Go verifier runs the candidate.
+type sandbox struct {
+	// timeouts is the wall-clock limit per run, keyed by normalized language.
+	timeouts       map[string]time.Duration
+	defaultTimeout time.Duration
+	cpuSeconds     int
+	// cpuSecondsByLang overrides cpuSeconds for languages in the resource
+	// policy.
+	cpuSecondsByLang map[string]int
+	memoryMB         int
+	// memoryMBByLang overrides memoryMB for languages in the resource
+	// policy.
+	memoryMBByLang map[string]int
+	maxProcs       int
+	// outputLimit caps the stdout and stderr kept per run and reported per
+	// submission, in bytes.
+	outputLimit int
+	// uids holds the unprivileged uids candidates run as, one per
+	// submission being judged; nil runs them as the worker's own uid. See
+	// acquireUID.
+	uids chan int
+	// cgroupDir is RUN_CGROUP_DIR: when set, memory is limited per
+	// candidate process by cgroup v2 and OOM kills are reported as MLE. See
+	// checkCgroupDir.
+	cgroupDir string
+}
+
+// loadSandbox reads the limits from the environment. RUN_TIMEOUT_MS sets the
+// default per-run wall-clock limit and RUN_TIMEOUT_<LANG>_MS (GO, CPP, RUST,
+// PYTHON) overrides it for one language. A zero resource limit disables it.
+// The resource policy (see loadLanguageLimits) takes precedence over both.
+// RUN_UID_BASE gives each of the concurrency submissions judged at once
+// its own uid (see loadRunUIDs).
+func loadSandbox(concurrency int, problems *configProblems) *sandbox {
+	sb := &sandbox{
+		timeouts:         map[string]time.Duration{},
+		cpuSecondsByLang: map[string]int{},
+		memoryMBByLang:   map[string]int{},
+		defaultTimeout:   problems.millis("RUN_TIMEOUT_MS", 2*time.Second),
+		cpuSeconds:       problems.intAtLeast("RUN_CPU_SECONDS", 0, 5),
+		memoryMB:         problems.intAtLeast("RUN_MEMORY_MB", 0, 512),
+		maxProcs:         problems.intAtLeast("RUN_MAX_PROCS", 0, 256),
+		outputLimit:      problems.intAtLeast("OUTPUT_LIMIT_KB", 1, 64) << 10,
+	}
+	defaults := map[string]time.Duration{"python": 2 * sb.defaultTimeout}
+	for _, lang := range []string{"go", "cpp", "rust", "python"} {
+		fallback, ok := defaults[lang]
+		if !ok {
+			fallback = sb.defaultTimeout
+		}
+		sb.timeouts[lang] = problems.millis("RUN_TIMEOUT_"+strings.ToUpper(lang)+"_MS", fallback)
+	}
+
+	policy, err := loadLanguageLimits()
+	if err != nil {
+		problems.add("%v", err)
+	}
+	if sb.uids, err = loadRunUIDs(problems.intAtLeast("RUN_UID_BASE", 0, 0), concurrency); err != nil {
+		problems.add("%v", err)
+	}
+	if sb.cgroupDir = strings.TrimSpace(os.Getenv("RUN_CGROUP_DIR")); sb.cgroupDir != "" {
+		if sb.uids == nil {
+			problems.add("RUN_CGROUP_DIR needs RUN_UID_BASE, or candidates could raise their own memory limit")
+		} else if err := checkCgroupDir(sb.cgroupDir); err != nil {
+			problems.add("RUN_CGROUP_DIR: %v", err)
+		}
+	}
+	for lang, l := range policy {
+		if l.TimeMS != nil {
+			sb.timeouts[lang] = time.Duration(*l.TimeMS) * time.Millisecond
+		}
+		if l.CPUSeconds != nil {
+			sb.cpuSecondsByLang[lang] = *l.CPUSeconds
+		}
+		if l.MemoryMB != nil {
+			sb.memoryMBByLang[lang] = *l.MemoryMB
+		}
+	}
+	// The CPU rlimit ends a run before a longer wall-clock limit would.
+	for lang, d := range sb.timeouts {
+		if cpu := sb.cpuLimit(lang); cpu > 0 && d > time.Duration(cpu)*time.Second {
+			slog.Warn("run time limit exceeds the CPU limit; CPU-bound runs stop at the CPU limit", "lang", lang, "time_limit", d, "cpu_seconds", cpu)
+		}
+	}
+	return sb
+}
+
+// timeout returns the wall-clock limit for one run of a program in lang.
+func (sb *sandbox) timeout(lang string) time.Duration {
+	if d, ok := sb.timeouts[normalizeLang(lang)]; ok {
+		return d
+	}
+	return sb.defaultTimeout
+}
+
+// cpuLimit returns the CPU-time limit in seconds for a program in lang; 0
+// means unlimited.
+func (sb *sandbox) cpuLimit(lang string) int {
+	if seconds, ok := sb.cpuSecondsByLang[normalizeLang(lang)]; ok {
+		return seconds
+	}
+	return sb.cpuSeconds
+}
+
+// memoryLimit returns the address-space limit in MB for a program in lang;
+// 0 means unlimited.
+func (sb *sandbox) memoryLimit(lang string) int {
+	if mb, ok := sb.memoryMBByLang[normalizeLang(lang)]; ok {
+		return mb
+	}
+	return sb.memoryMB
+}
+
+// wrap copies bin into runDir and writes an executable script there that
+// applies the resource limits for lang, switches to uid (0 keeps the
+// worker's) and then execs the copy, returning the script's path. runDir is
+// the only place the candidate can see: the worker's temp dir, with the
+// source, reference solution and verifier, stays private to the worker.
+// With cgroups in use it also creates the submission's cgroup, which
+// releaseCgroup removes.
+func (sb *sandbox) wrap(runDir, bin, lang string, uid int) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(runDir, 0o755); err != nil {
+		return "", err
+	}
+	candidate := filepath.Join(runDir, "candidate")
+	if err := copyFile(bin, candidate); err != nil {
+		return "", err
+	}
+	cgroup := "-"
+	if dir := sb.submissionCgroup(runDir); dir != "" {
+		if err := createSubmissionCgroup(dir); err != nil {
+			return "", err
+		}
+		cgroup = dir
+	}
+	script := fmt.Sprintf("#!/bin/sh\nexec %s %s %d %d %d %d %s %s \"$@\"\n",
+		shellQuote(self), sandboxExecArg, sb.cpuLimit(lang), sb.memoryLimit(lang), sb.maxProcs, uid, shellQuote(cgroup), shellQuote(candidate))
+
+	path := filepath.Join(runDir, "candidate.sh")
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// sandboxExecArg is the first argument that switches the worker binary into
+// sandboxExec mode.
+const sandboxExecArg = "__sandbox-exec"
+
+// rlimitNproc is RLIMIT_NPROC on Linux, which package syscall does not
+// export. It is not enforced for root, and it counts every process of the
+// uid, so candidates should run under their own uids (RUN_UID_BASE).
+const rlimitNproc = 6
+
+// sandboxPath is the only PATH a candidate sees.
+const sandboxPath = "/usr/local/bin:/usr/bin:/bin"
+
+// sandboxExec handles
+// `worker __sandbox-exec <cpu> <memMB> <procs> <uid> <cgroup> <bin> args...`:
+// it applies the limits to itself, switches to uid unless it is 0, and
+// replaces itself with bin. When cgroup is not "-" the memory limit is set
+// by joining a new cgroup under it (see joinRunCgroup) rather than with
+// RLIMIT_AS. bin gets a minimal environment rather than the worker's,
+// which holds DB_DSN and the Kafka settings, with HOME and the working
+// directory set to bin's directory. It never returns.
+func sandboxExec(args []string) {
+	if len(args) < 6 {
+		fmt.Fprintln(os.Stderr, "sandbox: usage: cpu memory procs uid cgroup binary [args...]")
+		os.Exit(125)
+	}
+	if cgroup := args[4]; cgroup != "-" {
+		memoryMB, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: bad limit %q\n", args[1])
+			os.Exit(125)
+		}
+		if err := joinRunCgroup(cgroup, memoryMB); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: join cgroup: %v\n", err)
+			os.Exit(125)
+		}
+		args[1] = "0"
+	}
+	limits := []struct {
+		resource int
+		value    string
+		scale    uint64
+	}{
+		{syscall.RLIMIT_CPU, args[0], 1},
+		{syscall.RLIMIT_AS, args[1], 1 << 20},
+		{rlimitNproc, args[2], 1},
+	}
+	for _, l := range limits {
+		n, err := strconv.ParseUint(l.value, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: bad limit %q\n", l.value)
+			os.Exit(125)
+		}
+		if n == 0 {
+			continue
+		}
+		lim := &syscall.Rlimit{Cur: n * l.scale, Max: n * l.scale}
+		if l.resource == syscall.RLIMIT_CPU {
+			// A hard limit one second above the soft one makes the kernel
+			// send SIGXCPU first, which run reports as a time limit.
+			lim.Max++
+		}
+		if err := syscall.Setrlimit(l.resource, lim); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: setrlimit %d: %v\n", l.resource, err)
+			os.Exit(125)
+		}
+	}
+	uid, err := strconv.Atoi(args[3])
+	if err != nil || uid < 0 {
+		fmt.Fprintf(os.Stderr, "sandbox: bad uid %q\n", args[3])
+		os.Exit(125)
+	}
+	if uid != 0 {
+		if err := dropPrivileges(uid); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: switch to uid %d: %v\n", uid, err)
+			os.Exit(125)
+		}
+	}
+	bin := args[5]
+	home := filepath.Dir(bin)
+	if err := os.Chdir(home); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: chdir %s: %v\n", home, err)
+		os.Exit(125)
+	}
+	env := []string{"PATH=" + sandboxPath, "HOME=" + home, "LANG=C.UTF-8"}
+	err = syscall.Exec(bin, append([]string{bin}, args[6:]...), env)
+	fmt.Fprintf(os.Stderr, "sandbox: exec %s: %v\n", bin, err)
+	os.Exit(126)
+}
+
+// runResult is the outcome of one sandboxed run.
+type runResult struct {
+	stdout   string
+	stderr   string
+	elapsed  time.Duration
+	timedOut bool
+	// memoryExceeded is set when the OOM killer ended the run in its
+	// cgroup; it is never set without RUN_CGROUP_DIR.
+	memoryExceeded bool
+	err            error
+}
+
+// run executes the wrapped candidate with stdin, enforcing limit as a wall
+// clock deadline. At most maxStdout bytes of stdout and outputLimit bytes of
+// stderr are kept. Exceeding the CPU rlimit also counts as a timeout. The
+// candidate gets its own process group, and the whole group is killed when
+// the run ends so no child it forked outlives the test.
+func (sb *sandbox) run(ctx context.Context, wrapper, stdin string, limit time.Duration, maxStdout int) runResult {
+	runCtx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, wrapper)
+	cmd.Stdin = strings.NewReader(stdin)
+	outBuf, errBuf := newCappedBuffer(maxStdout), newCappedBuffer(sb.outputLimit)
+	cmd.Stdout = outBuf
+	cmd.Stderr = errBuf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return killGroup(cmd.Process.Pid)
+	}
+	// A background child holding stdout open would otherwise keep Wait
+	// blocked after the candidate itself is dead.
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	if cmd.Process != nil {
+		_ = killGroup(cmd.Process.Pid)
+	}
+	res := runResult{
+		stdout:  outBuf.String(),
+		stderr:  errBuf.String(),
+		elapsed: time.Since(start),
+		err:     err,
+	}
+	switch {
+	case err == nil:
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded) || killedBy(err, syscall.SIGXCPU):
+		res.timedOut = true
+	case cmd.Process != nil && sb.cgroupDir != "":
+		// The wrapper execs its way to the candidate, so the candidate's
+		// cgroup is named after the pid started here.
+		submission := sb.submissionCgroup(filepath.Dir(wrapper))
+		res.memoryExceeded = oomKilled(filepath.Join(runCgroup(submission, cmd.Process.Pid), "memory.events"))
+	}
+	return res
+}
+
+// killGroup sends SIGKILL to the process group led by pid. A group that has
+// already exited is not an error.
+func killGroup(pid int) error {
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// killedBy reports whether the process was terminated by sig. SIGXCPU means
+// RLIMIT_CPU was exceeded.
+func killedBy(err error, sig syscall.Signal) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == sig
+}
+
+// timeLimitExceeded builds the verdict for a run that hit its limit; test is
+// the 1-based test number, or 0 when the run is not tied to one test.
+func timeLimitExceeded(id int64, test int, elapsed time.Duration) statusMessage {
+	verdict := "time limit exceeded"
+	if test > 0 {
+		verdict = fmt.Sprintf("time limit exceeded on test %d", test)
+	}
+	return statusMessage{
+		SubmissionID: id,
+		Status:       "completed",
+		Verdict:      verdict,
+		VerdictCode:  verdictTimeLimit,
+		Stderr:       fmt.Sprintf("Time limit exceeded after %s", elapsed.Round(time.Millisecond)),
+	}
+}
+
+// memoryLimitExceeded builds the verdict for a run of a program in lang
+// that ran out of memory; test is the 1-based test number.
+func (sb *sandbox) memoryLimitExceeded(id int64, lang string, test int, res runResult) statusMessage {
+	limit := "the memory limit"
+	if mb := sb.memoryLimit(lang); mb > 0 {
+		limit = fmt.Sprintf("%d MB", mb)
+	}
+	exit := exitCode(res.err)
+	return statusMessage{
+		SubmissionID: id,
+		Status:       "completed",
+		Verdict:      fmt.Sprintf("memory limit exceeded on test %d", test),
+		VerdictCode:  verdictMemoryLimit,
+		Stdout:       res.stdout,
+		Stderr:       strings.TrimSpace(res.stderr + "\n" + "Memory limit exceeded (limit " + limit + ")"),
+		ExitCode:     &exit,
+	}
+}
+
+// normalizeLang maps the accepted language aliases to one name.
+func normalizeLang(lang string) string {
+	switch strings.ToLower(strings.TrimSpace(lang)) {
+	case "go", "golang":
+		return "go"
+	case "cpp", "c++", "cc", "cxx":
+		return "cpp"
+	case "rs", "rust":
+		return "rust"
+	case "py", "python", "python3":
+		return "python"
+	default:
+		return ""
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
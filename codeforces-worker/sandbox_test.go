@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for the worker when a wrapper
+// script re-executes it in sandbox mode.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandboxExecArg {
+		sandboxExec(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
+// writeScript writes an executable shell script to dir and returns its path.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testSandbox() *sandbox {
+	return &sandbox{
+		timeouts:         map[string]time.Duration{},
+		cpuSecondsByLang: map[string]int{},
+		memoryMBByLang:   map[string]int{},
+		defaultTimeout:   2 * time.Second,
+		outputLimit:      1 << 10,
+	}
+}
+
+func TestRunPassesStdin(t *testing.T) {
+	sb := testSandbox()
+	bin := writeScript(t, t.TempDir(), "cat.sh", "cat")
+
+	res := sb.run(context.Background(), bin, "1 2 3\n", time.Second, 1<<10)
+	if res.err != nil || res.timedOut || res.memoryExceeded {
+		t.Fatalf("run = %+v, want a clean exit", res)
+	}
+	if res.stdout != "1 2 3\n" {
+		t.Fatalf("stdout = %q", res.stdout)
+	}
+}
+
+func TestRunWallClockLimit(t *testing.T) {
+	sb := testSandbox()
+	bin := writeScript(t, t.TempDir(), "sleep.sh", "sleep 30")
+
+	res := sb.run(context.Background(), bin, "", 200*time.Millisecond, 1<<10)
+	if !res.timedOut {
+		t.Fatalf("run = %+v, want timedOut", res)
+	}
+	if res.elapsed > 5*time.Second {
+		t.Fatalf("run took %s after a 200ms limit", res.elapsed)
+	}
+}
+
+func TestRunKillsBackgroundChildren(t *testing.T) {
+	sb := testSandbox()
+	// The child keeps stdout open after the candidate itself exits.
+	bin := writeScript(t, t.TempDir(), "fork.sh", "sleep 30 &\necho done")
+
+	start := time.Now()
+	res := sb.run(context.Background(), bin, "", 10*time.Second, 1<<10)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("run waited %s for a background child", time.Since(start))
+	}
+	if res.timedOut {
+		t.Fatalf("run = %+v, want no timeout", res)
+	}
+	if strings.TrimSpace(res.stdout) != "done" {
+		t.Fatalf("stdout = %q", res.stdout)
+	}
+}
+
+func TestRunCapsOutput(t *testing.T) {
+	sb := testSandbox()
+	bin := writeScript(t, t.TempDir(), "spam.sh", "yes | head -c 100000\nyes | head -c 100000 1>&2")
+
+	res := sb.run(context.Background(), bin, "", 5*time.Second, 100)
+	if res.timedOut {
+		t.Fatalf("run = %+v, want no timeout", res)
+	}
+	if want := 100 + len(truncatedMarker); len(res.stdout) != want || !strings.HasSuffix(res.stdout, truncatedMarker) {
+		t.Fatalf("kept %d bytes of stdout, want %d ending in the truncation marker", len(res.stdout), want)
+	}
+	if want := sb.outputLimit + len(truncatedMarker); len(res.stderr) != want {
+		t.Fatalf("kept %d bytes of stderr, want %d", len(res.stderr), want)
+	}
+}
+
+func TestCPULimit(t *testing.T) {
+	sb := testSandbox()
+	sb.cpuSeconds = 5
+	sb.cpuSecondsByLang["python"] = 10
+	sb.cpuSecondsByLang["go"] = 0
+
+	for lang, want := range map[string]int{"cpp": 5, "py": 10, "python3": 10, "golang": 0} {
+		if got := sb.cpuLimit(lang); got != want {
+			t.Errorf("cpuLimit(%q) = %d, want %d", lang, got, want)
+		}
+	}
+}
+
+func TestWrapAppliesCPULimit(t *testing.T) {
+	sb := testSandbox()
+	// The global limit is off, so only the language's own limit can stop
+	// the run.
+	sb.cpuSecondsByLang["cpp"] = 1
+	dir := t.TempDir()
+	bin := writeScript(t, dir, "spin.sh", "while :; do :; done")
+
+	wrapper, err := sb.wrap(t.TempDir(), bin, "c++", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sb.run(context.Background(), wrapper, "", 20*time.Second, 1<<10)
+	if !res.timedOut {
+		t.Fatalf("run = %+v, want timedOut from the CPU limit", res)
+	}
+	if res.elapsed > 10*time.Second {
+		t.Fatalf("CPU limit of 1s took %s to stop the run", res.elapsed)
+	}
+}
+
+func TestRunReportsMemoryExceeded(t *testing.T) {
+	sb := testSandbox()
+	tests := []struct {
+		name, body string
+		want       bool
+	}{
+		// Without a cgroup nothing the candidate does can claim MLE.
+		{"killed itself with SIGKILL", "kill -9 $$", false},
+		{"allocation failure on stderr", "echo 'fatal error: runtime: out of memory' >&2\nexit 2", false},
+		{"python MemoryError", "echo MemoryError >&2\nexit 1", false},
+		{"ordinary runtime error", "echo 'index out of range' >&2\nexit 2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := writeScript(t, t.TempDir(), "mem.sh", tt.body)
+			res := sb.run(context.Background(), bin, "", 5*time.Second, 1<<10)
+			if res.err == nil {
+				t.Fatal("run succeeded, want a failure")
+			}
+			if res.timedOut {
+				t.Fatal("run reported a timeout")
+			}
+			if res.memoryExceeded != tt.want {
+				t.Fatalf("memoryExceeded = %v, want %v", res.memoryExceeded, tt.want)
+			}
+		})
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	tests := []struct {
+		name, events string
+		want         bool
+	}{
+		{"killed", "low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n", true},
+		{"hit the limit without a kill", "low 0\nhigh 0\nmax 3\noom 0\noom_kill 0\n", false},
+		{"no oom_kill line", "low 0\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "memory.events")
+			if err := os.WriteFile(path, []byte(tt.events), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if got := oomKilled(path); got != tt.want {
+				t.Fatalf("oomKilled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if oomKilled(filepath.Join(t.TempDir(), "missing")) {
+		t.Fatal("oomKilled reported a kill for a missing cgroup")
+	}
+}
+
+func TestMemoryLimitExceededVerdict(t *testing.T) {
+	sb := testSandbox()
+	sb.memoryMB = 256
+	sb.memoryMBByLang["python"] = 1024
+	sb.memoryMBByLang["go"] = 0
+	res := runResult{stderr: "MemoryError", err: errors.New("exit status 1")}
+
+	tests := []struct {
+		lang, limit string
+	}{
+		{"cpp", "256 MB"},
+		{"py", "1024 MB"},
+		{"go", "the memory limit"},
+	}
+	for _, tt := range tests {
+		msg := sb.memoryLimitExceeded(7, tt.lang, 3, res)
+		if msg.Verdict != "memory limit exceeded on test 3" || msg.VerdictCode != verdictMemoryLimit {
+			t.Errorf("%s: verdict %q (%s)", tt.lang, msg.Verdict, msg.VerdictCode)
+		}
+		if want := "MemoryError\nMemory limit exceeded (limit " + tt.limit + ")"; msg.Stderr != want {
+			t.Errorf("%s: stderr %q, want %q", tt.lang, msg.Stderr, want)
+		}
+	}
+}
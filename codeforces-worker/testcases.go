@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Output comparison modes, stored per problem in problems.output_compare.
+const (
+	// compareTokens compares whitespace-separated tokens, ignoring layout.
+	compareTokens = "tokens"
+	// compareLines ignores trailing whitespace on each line and trailing
+	// blank lines, but otherwise requires the same lines.
+	compareLines = "lines"
+	// compareExact requires byte-identical output.
+	compareExact = "exact"
+)
+
+// testCase is one row of problem_tests or one pair of files in TESTS_DIR.
+type testCase struct {
+	Input    string
+	Expected string
+}
+
+func loadTests(ctx context.Context, db *sql.DB, problemID int64) ([]testCase, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT input, expected_output
+		FROM problem_tests
+		WHERE problem_id = $1
+		ORDER BY ordinal
+	`, problemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tests []testCase
+	for rows.Next() {
+		var t testCase
+		if err := rows.Scan(&t.Input, &t.Expected); err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+	}
+	return tests, rows.Err()
+}
+
+// seedProblem1A stores the cases the worker used to generate for problem 1A
+// (Theatre Square) before problems were judged from problem_tests. It runs
+// at startup, does nothing until the problems table has a 1A row, and leaves
+// 1A alone once it has any tests.
+func seedProblem1A(ctx context.Context, db *sql.DB) error {
+	var problemID int64
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM problems
+		WHERE contest_id::TEXT = '1' AND UPPER(index_name) = 'A'
+		  AND NOT EXISTS (SELECT 1 FROM problem_tests WHERE problem_id = problems.id)
+	`).Scan(&problemID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, t := range problem1ACases() {
+		// Another worker seeding at the same time inserts the same rows.
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO problem_tests (problem_id, ordinal, input, expected_output)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (problem_id, ordinal) DO NOTHING
+		`, problemID, i+1, t.Input, t.Expected); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// problem1ACases returns 110 cases for 1A: n, m and a on one line, and the
+// number of a-by-a flagstones that cover an n-by-m square.
+func problem1ACases() []testCase {
+	params := [][3]int64{
+		{6, 6, 4},
+		{1, 1, 1},
+		{1, 2, 3},
+		{1_000_000_000, 1, 1_000_000_000},
+		{1_000_000_000, 1_000_000_000, 1_000_000_000},
+		{999_999_937, 999_999_929, 2},
+		{100, 25, 7},
+		{25, 100, 7},
+		{99999999, 1234567, 89},
+		{33, 44, 5},
+		{44, 33, 5},
+		{100000, 99999, 17},
+	}
+	for i := int64(0); len(params) < 110; i++ {
+		params = append(params, [3]int64{1 + (i*37)%1_000_000_000, 1 + (i*91)%1_000_000_000, 1 + (i*53)%999_999_900})
+	}
+
+	tests := make([]testCase, len(params))
+	for i, p := range params {
+		n, m, a := p[0], p[1], p[2]
+		tests[i] = testCase{
+			Input:    fmt.Sprintf("%d %d %d\n", n, m, a),
+			Expected: fmt.Sprintf("%d\n", ((n+a-1)/a)*((m+a-1)/a)),
+		}
+	}
+	return tests
+}
+
+// loadTestsFromDir reads the cases for a problem from
+// <dir>/<contest>/<INDEX>/: each NAME.in is fed on stdin and compared with
+// NAME.out (or NAME.ans). Cases run in natural order of NAME, so 2.in comes
+// before 10.in. A missing problem directory means no tests.
+func loadTestsFromDir(dir, contest, index string) ([]testCase, error) {
+	problemDir := filepath.Join(dir, filepath.Base(strings.TrimSpace(contest)), strings.ToUpper(filepath.Base(strings.TrimSpace(index))))
+	inputs, err := filepath.Glob(filepath.Join(problemDir, "*.in"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(inputs, func(i, j int) bool { return naturalLess(inputs[i], inputs[j]) })
+
+	tests := make([]testCase, 0, len(inputs))
+	for _, in := range inputs {
+		input, err := os.ReadFile(in)
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(in, ".in")
+		expected, err := os.ReadFile(base + ".out")
+		if errors.Is(err, fs.ErrNotExist) {
+			expected, err = os.ReadFile(base + ".ans")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("expected output for %s: %w", filepath.Base(in), err)
+		}
+		tests = append(tests, testCase{Input: string(input), Expected: string(expected)})
+	}
+	return tests, nil
+}
+
+// naturalLess orders names so digit runs compare by value.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, _ := strconv.ParseUint(da, 10, 64)
+			nb, _ := strconv.ParseUint(db, 10, 64)
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// outputMatches compares a candidate's output with the expected output
+// under the given mode; unknown modes fall back to token comparison.
+func outputMatches(mode, got, want string) bool {
+	switch mode {
+	case compareExact:
+		return got == want
+	case compareLines:
+		return normalizeLines(got) == normalizeLines(want)
+	default:
+		gotTokens, wantTokens := strings.Fields(got), strings.Fields(want)
+		if len(gotTokens) != len(wantTokens) {
+			return false
+		}
+		for i := range gotTokens {
+			if gotTokens[i] != wantTokens[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func normalizeLines(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runTestCases feeds each stored test to the candidate and stops at the
+// first failure, streaming per-test progress when enabled. Every status it
+// returns or streams carries TotalTests and PassedTests.
+func runTestCases(ctx context.Context, sub *submission, prob *problem, candidateBin string, producer *kafka.Writer, sb *sandbox, stream bool) statusMessage {
+	limit := sb.timeout(sub.Lang)
+	total := len(prob.Tests)
+	withProgress := func(res statusMessage, passed int) statusMessage {
+		res.TotalTests = total
+		res.PassedTests = passed
+		return res
+	}
+	for i, t := range prob.Tests {
+		if stream && producer != nil {
+			_ = publishStatus(ctx, producer, withProgress(statusMessage{
+				SubmissionID: sub.ID,
+				Status:       "running",
+				Verdict:      fmt.Sprintf("test %d/%d", i+1, total),
+			}, i))
+		}
+
+		// Keep enough stdout to compare a correct answer even when it is
+		// larger than what is reported back.
+		maxStdout := sb.outputLimit
+		if n := 2*len(t.Expected) + 4096; n > maxStdout {
+			maxStdout = n
+		}
+		run := sb.run(ctx, candidateBin, t.Input, limit, maxStdout)
+		if run.timedOut {
+			return withProgress(timeLimitExceeded(sub.ID, i+1, run.elapsed), i)
+		}
+		if run.memoryExceeded {
+			return withProgress(sb.memoryLimitExceeded(sub.ID, sub.Lang, i+1, run), i)
+		}
+		if run.err != nil {
+			exit := exitCode(run.err)
+			return withProgress(statusMessage{
+				SubmissionID: sub.ID,
+				Status:       "completed",
+				Verdict:      fmt.Sprintf("runtime error on test %d", i+1),
+				VerdictCode:  verdictRuntimeError,
+				Stdout:       run.stdout,
+				Stderr:       run.stderr,
+				ExitCode:     &exit,
+			}, i)
+		}
+		if !outputMatches(prob.Compare, run.stdout, t.Expected) {
+			exit := 0
+			// The verdict column is VARCHAR(64), so the outputs go in stderr.
+			return withProgress(statusMessage{
+				SubmissionID: sub.ID,
+				Status:       "completed",
+				Verdict:      fmt.Sprintf("wrong answer on test %d", i+1),
+				VerdictCode:  verdictWrongAnswer,
+				Stdout:       run.stdout,
+				Stderr:       strings.TrimSpace(run.stderr + "\n" + fmt.Sprintf("Expected %s, got %s", preview(t.Expected), preview(run.stdout))),
+				ExitCode:     &exit,
+			}, i)
+		}
+	}
+
+	exit := 0
+	return withProgress(statusMessage{
+		SubmissionID: sub.ID,
+		Status:       "completed",
+		Verdict:      "accepted",
+		VerdictCode:  verdictAccepted,
+		Stdout:       fmt.Sprintf("Passed %d tests", total),
+		ExitCode:     &exit,
+	}, total)
+}
+
+// preview shortens output for the wrong-answer message.
+func preview(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
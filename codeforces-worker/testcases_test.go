@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProblem1ACases(t *testing.T) {
+	tests := problem1ACases()
+	if len(tests) != 110 {
+		t.Fatalf("got %d cases, want 110", len(tests))
+	}
+	known := map[string]string{
+		"6 6 4\n":                            "4\n",
+		"1 2 3\n":                            "1\n",
+		"999999937 999999929 2\n":            "249999967000001085\n",
+		"1000000000 1000000000 1000000000\n": "1\n",
+	}
+	seen := map[string]bool{}
+	for _, tc := range tests {
+		if want, ok := known[tc.Input]; ok && tc.Expected != want {
+			t.Errorf("input %q: expected %q, want %q", tc.Input, tc.Expected, want)
+		}
+		seen[tc.Input] = true
+	}
+	for input := range known {
+		if !seen[input] {
+			t.Errorf("no case for input %q", input)
+		}
+	}
+}
+
+func TestRunTestCasesWrongAnswer(t *testing.T) {
+	sb := testSandbox()
+	sb.outputLimit = 1 << 10
+	long := strings.Repeat("9", 200)
+	bin := writeScript(t, t.TempDir(), "wrong.sh", "echo "+long)
+	prob := &problem{Tests: []testCase{
+		{Input: "", Expected: long + "\n"},
+		{Input: "", Expected: strings.Repeat("1", 200) + "\n"},
+	}}
+
+	res := runTestCases(context.Background(), &submission{ID: 1, Lang: "cpp"}, prob, bin, nil, sb, false)
+	if res.Verdict != "wrong answer on test 2" || res.VerdictCode != verdictWrongAnswer {
+		t.Fatalf("verdict %q (%s), want wrong answer on test 2", res.Verdict, res.VerdictCode)
+	}
+	// submissions.verdict is VARCHAR(64).
+	if len(res.Verdict) > 64 {
+		t.Fatalf("verdict is %d bytes", len(res.Verdict))
+	}
+	if !strings.HasPrefix(res.Stderr, "Expected 1111") || !strings.Contains(res.Stderr, ", got 9999") {
+		t.Fatalf("stderr %q does not show the expected and actual output", res.Stderr)
+	}
+	if res.TotalTests != 2 || res.PassedTests != 1 {
+		t.Fatalf("progress %d/%d, want 1/2", res.PassedTests, res.TotalTests)
+	}
+}
+
+func TestRunTestCasesAccepted(t *testing.T) {
+	sb := testSandbox()
+	sb.timeouts["cpp"] = 5 * time.Second
+	bin := writeScript(t, t.TempDir(), "tiles.sh", `read n m a; echo $(( ((n+a-1)/a) * ((m+a-1)/a) ))`)
+	prob := &problem{Tests: problem1ACases()[:12]}
+
+	res := runTestCases(context.Background(), &submission{ID: 1, Lang: "cpp"}, prob, bin, nil, sb, false)
+	if res.Verdict != "accepted" {
+		t.Fatalf("verdict %q, stderr %q", res.Verdict, res.Stderr)
+	}
+}
+
+func TestSubmissionDeadlineKeepsProgress(t *testing.T) {
+	sb := testSandbox()
+	sb.timeouts["cpp"] = 5 * time.Second
+	bin := writeScript(t, t.TempDir(), "slow.sh", `read n m a; if [ "$n" = 6 ]; then echo 4; else sleep 5; fi`)
+	prob := &problem{Tests: problem1ACases()[:3]}
+
+	// The submission's overall deadline passes while the second test runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	res := runTestCases(ctx, &submission{ID: 7, Lang: "cpp"}, prob, bin, nil, sb, false)
+	res.Warnings = "warning: unused variable"
+	res = submissionDeadlineExceeded(res)
+
+	if res.VerdictCode != verdictTimeLimit || res.SubmissionID != 7 {
+		t.Fatalf("verdict %q (%s) for submission %d", res.Verdict, res.VerdictCode, res.SubmissionID)
+	}
+	if res.TotalTests != 3 || res.PassedTests != 1 {
+		t.Fatalf("progress %d/%d, want 1/3", res.PassedTests, res.TotalTests)
+	}
+	if res.Warnings != "warning: unused variable" {
+		t.Fatalf("warnings %q were dropped", res.Warnings)
+	}
+}
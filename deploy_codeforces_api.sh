@@ -15,7 +15,7 @@ POSTGRES_DSN="${POSTGRES_DSN:-postgres://postgres:orib98wBpwUr15btAqoF2PksuDMTts
 KAFKA_BROKERS="${KAFKA_BROKERS:-kafka.default.svc.cluster.local:9092}"
 
 log "Building ${IMAGE_NAME}"
-sudo nerdctl build -t "${IMAGE_NAME}" "${SCRIPT_DIR}/codeforces-api"
+sudo nerdctl build -t "${IMAGE_NAME}" -f "${SCRIPT_DIR}/codeforces-api/Dockerfile" "${SCRIPT_DIR}"
 
 log "Saving image archive to ${ARCHIVE}"
 sudo nerdctl save -o "${ARCHIVE}" "${IMAGE_NAME}"
@@ -38,6 +38,12 @@ kubectl apply -f "${MANIFEST}"
 log "Ensuring deployment env is set"
 kubectl set env deployment codeforces-api DB_DSN="${POSTGRES_DSN}" --overwrite
 kubectl set env deployment codeforces-api KAFKA_BROKERS="${KAFKA_BROKERS}" --overwrite
+if [[ -n "${OTP_PEPPER:-}" ]]; then
+  kubectl set env deployment codeforces-api OTP_PEPPER="${OTP_PEPPER}" --overwrite
+fi
+if [[ -n "${WS_ALLOWED_ORIGINS:-}" ]]; then
+  kubectl set env deployment codeforces-api WS_ALLOWED_ORIGINS="${WS_ALLOWED_ORIGINS}" --overwrite
+fi
 
 log "Restarting deployment to pick up the new image"
 kubectl rollout restart deployment codeforces-api
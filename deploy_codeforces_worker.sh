@@ -14,7 +14,7 @@ POSTGRES_DSN="${POSTGRES_DSN:-postgres://postgres:orib98wBpwUr15btAqoF2PksuDMTts
 KAFKA_BROKERS="${KAFKA_BROKERS:-kafka.default.svc.cluster.local:9092}"
 
 log "Building ${IMAGE_NAME}"
-sudo nerdctl build -t "${IMAGE_NAME}" "${SCRIPT_DIR}/codeforces-worker"
+sudo nerdctl build -t "${IMAGE_NAME}" -f "${SCRIPT_DIR}/codeforces-worker/Dockerfile" "${SCRIPT_DIR}"
 
 log "Saving image archive to ${ARCHIVE}"
 sudo nerdctl save -o "${ARCHIVE}" "${IMAGE_NAME}"
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything email-worker reads from the environment at startup.
+// loadConfig validates it in one pass so a bad deployment fails before any
+// connection is opened, listing every problem at once.
+type config struct {
+	kafkaURL      string
+	mysqlDSN      string
+	emailProvider string
+	// emailFrom is the From address; with Mailgun it defaults to
+	// auth@MAILGUN_DOMAIN.
+	emailFrom     string
+	mailgunDomain string
+	mailgunAPIKey string
+	smtp          smtpConfig
+	emailSubject  string
+	emailTemplate *template.Template
+	// resendCooldown suppresses a new code while the previous one for the
+	// same identifier is younger than this and still valid; 0 disables it.
+	resendCooldown time.Duration
+	retry          retryPolicy
+	dlqTopic       string
+	twilio         twilioConfig
+	// otpPepper keys the hash codes are stored under. registration-api and
+	// codeforces-api must be given the same OTP_PEPPER to verify them.
+	otpPepper []byte
+}
+
+// twilioConfig is empty when SMS delivery is disabled.
+type twilioConfig struct {
+	accountSID string
+	authToken  string
+	from       string
+}
+
+func (t twilioConfig) enabled() bool {
+	return t.accountSID != ""
+}
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// required returns the trimmed value of key, recording a problem when unset.
+func (p *configProblems) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		p.add("%s must be set", key)
+	}
+	return v
+}
+
+// intAtLeast parses an integer no smaller than min, recording a problem
+// rather than silently falling back when the value is malformed.
+func (p *configProblems) intAtLeast(key string, min, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min {
+		p.add("%s must be an integer >= %d, got %q", key, min, raw)
+		return fallback
+	}
+	return n
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	cfg := config{
+		kafkaURL:      problems.required("KAFKA_URL"),
+		mysqlDSN:      problems.required("MYSQL_DSN"),
+		emailProvider: strings.ToLower(envOrDefault("EMAIL_PROVIDER", emailProviderMailgun)),
+		emailFrom:     strings.TrimSpace(os.Getenv("EMAIL_FROM")),
+		emailSubject:  defaultOTPSubject,
+	}
+	switch cfg.emailProvider {
+	case emailProviderMailgun:
+		cfg.mailgunDomain = problems.required("MAILGUN_DOMAIN")
+		cfg.mailgunAPIKey = problems.required("MAILGUN_API_KEY")
+		if cfg.emailFrom == "" {
+			cfg.emailFrom = "auth@" + cfg.mailgunDomain
+		}
+	case emailProviderSMTP:
+		cfg.smtp = smtpConfig{
+			host:     problems.required("SMTP_HOST"),
+			port:     problems.intAtLeast("SMTP_PORT", 1, 587),
+			username: strings.TrimSpace(os.Getenv("SMTP_USERNAME")),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if cfg.emailFrom == "" {
+			problems.add("EMAIL_FROM must be set when EMAIL_PROVIDER=smtp")
+		}
+		if cfg.smtp.password != "" && cfg.smtp.username == "" {
+			problems.add("SMTP_USERNAME must be set when SMTP_PASSWORD is set")
+		}
+	default:
+		problems.add("EMAIL_PROVIDER must be %q or %q, got %q", emailProviderMailgun, emailProviderSMTP, cfg.emailProvider)
+	}
+	if cfg.emailFrom != "" {
+		if _, err := mail.ParseAddress(cfg.emailFrom); err != nil {
+			problems.add("EMAIL_FROM %q is not a valid address: %v", cfg.emailFrom, err)
+		}
+	}
+	if subject := strings.TrimSpace(os.Getenv("OTP_EMAIL_SUBJECT")); subject != "" {
+		cfg.emailSubject = subject
+	}
+	templatePath := strings.TrimSpace(os.Getenv("OTP_EMAIL_TEMPLATE"))
+	tmpl, err := loadOTPEmailTemplate(templatePath)
+	if err != nil {
+		problems.add("OTP_EMAIL_TEMPLATE: %v", err)
+	}
+	cfg.emailTemplate = tmpl
+	cfg.resendCooldown = time.Duration(problems.intAtLeast("OTP_RESEND_COOLDOWN_SECONDS", 0, 60)) * time.Second
+	cfg.retry = retryPolicy{
+		attempts: problems.intAtLeast("OTP_SEND_ATTEMPTS", 1, 3),
+		backoff:  time.Duration(problems.intAtLeast("OTP_SEND_BACKOFF_MS", 1, 1000)) * time.Millisecond,
+	}
+	cfg.dlqTopic = envOrDefault("OTP_DLQ_TOPIC", "new-registration-dlq")
+	cfg.otpPepper = []byte(problems.required("OTP_PEPPER"))
+
+	// Twilio is optional, but a partial configuration is almost certainly a
+	// mistake rather than a deliberate way to disable SMS.
+	twilioKeys := []string{"TWILIO_ACCOUNT_SID", "TWILIO_AUTH_TOKEN", "TWILIO_FROM"}
+	var set, unset []string
+	for _, key := range twilioKeys {
+		if strings.TrimSpace(os.Getenv(key)) != "" {
+			set = append(set, key)
+		} else {
+			unset = append(unset, key)
+		}
+	}
+	switch {
+	case len(set) == len(twilioKeys):
+		cfg.twilio = twilioConfig{
+			accountSID: strings.TrimSpace(os.Getenv("TWILIO_ACCOUNT_SID")),
+			authToken:  strings.TrimSpace(os.Getenv("TWILIO_AUTH_TOKEN")),
+			from:       strings.TrimSpace(os.Getenv("TWILIO_FROM")),
+		}
+	case len(set) > 0:
+		problems.add("%s must also be set when %s is", strings.Join(unset, " and "), strings.Join(set, " and "))
+	}
+
+	return cfg, problems.err()
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: kafka=%s email_provider=%s email_from=%s email_subject=%q resend_cooldown=%s send_attempts=%d dlq=%s sms=%t",
+		c.kafkaURL, c.emailProvider, c.emailFrom, c.emailSubject, c.resendCooldown, c.retry.attempts, c.dlqTopic, c.twilio.enabled())
+}
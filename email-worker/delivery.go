@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// permanentError marks a send failure that retrying cannot fix, such as a
+// rejected recipient, so the request goes straight to the dead-letter topic.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// permanentStatus reports whether an HTTP status from a provider means the
+// request itself is bad; 408 and 429 are worth retrying.
+func permanentStatus(status int) bool {
+	return status >= 400 && status < 500 && status != 408 && status != 429
+}
+
+// retryPolicy bounds how often a failed send is retried.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// sendWithRetry sends the code, retrying transient failures with
+// exponential backoff. It returns the last error and the attempts made.
+func sendWithRetry(ctx context.Context, policy retryPolicy, sender otpSender, destination, code string) (int, error) {
+	delay := policy.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = sender.Send(sendCtx, destination, code)
+		cancel()
+		if err == nil || isPermanent(err) || attempt >= policy.attempts {
+			return attempt, err
+		}
+		log.Printf("send attempt %d/%d failed, retrying in %s: %v", attempt, policy.attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// deadLetter is what lands on the dead-letter topic. Request is the original
+// new-registration value, so replaying it issues a fresh code; the code that
+// failed to send is deliberately not included.
+type deadLetter struct {
+	Request   json.RawMessage `json:"request"`
+	Error     string          `json:"error"`
+	Attempts  int             `json:"attempts"`
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// publishDeadLetter writes msg to the dead-letter topic, retrying until it
+// succeeds or ctx ends: the offset must not be committed before the request
+// is recorded somewhere.
+func publishDeadLetter(ctx context.Context, w *kafka.Writer, msg kafka.Message, attempts int, cause error) error {
+	value, err := deadLetterValue(msg, attempts, cause)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for {
+		err := w.WriteMessages(ctx, kafka.Message{Key: msg.Key, Value: value})
+		if err == nil {
+			return nil
+		}
+		log.Printf("dead-letter publish to %s failed, retrying in %s: %v", w.Topic, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// deadLetterValue encodes the dead-letter record for msg.
+func deadLetterValue(msg kafka.Message, attempts int, cause error) ([]byte, error) {
+	request := json.RawMessage(msg.Value)
+	if !json.Valid(msg.Value) {
+		// Legacy bare-email values and garbage are kept as a JSON string.
+		request, _ = json.Marshal(string(msg.Value))
+	}
+	return json.Marshal(deadLetter{
+		Request:   request,
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		FailedAt:  time.Now().UTC(),
+	})
+}
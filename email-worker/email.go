@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	mailgun "github.com/mailgun/mailgun-go/v4"
+)
+
+// Email providers selectable with EMAIL_PROVIDER.
+const (
+	emailProviderMailgun = "mailgun"
+	emailProviderSMTP    = "smtp"
+)
+
+// emailSender delivers one multipart email. Implementations must send both
+// parts so clients that cannot render HTML still show the text.
+type emailSender interface {
+	Send(ctx context.Context, to, subject, text, html string) error
+}
+
+func newEmailSender(cfg config) emailSender {
+	if cfg.emailProvider == emailProviderSMTP {
+		return smtpSender{cfg: cfg.smtp, from: cfg.emailFrom}
+	}
+	return mailgunSender{
+		mg:   mailgun.NewMailgun(cfg.mailgunDomain, cfg.mailgunAPIKey),
+		from: cfg.emailFrom,
+	}
+}
+
+type mailgunSender struct {
+	mg   *mailgun.MailgunImpl
+	from string
+}
+
+func (s mailgunSender) Send(ctx context.Context, to, subject, text, html string) error {
+	message := s.mg.NewMessage(s.from, subject, text, to)
+	message.SetHtml(html)
+	_, _, err := s.mg.Send(ctx, message)
+	var unexpected *mailgun.UnexpectedResponseError
+	if errors.As(err, &unexpected) && permanentStatus(unexpected.Actual) {
+		return permanent(err)
+	}
+	return err
+}
+
+// errSMTPNoTLS is returned when credentials would go over an unencrypted
+// connection.
+var errSMTPNoTLS = errors.New("smtp server does not offer STARTTLS; refusing to send credentials unencrypted")
+
+// smtpConfig is only populated when EMAIL_PROVIDER=smtp.
+type smtpConfig struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+// smtpSender talks to an SMTP relay directly. Port 465 uses implicit TLS;
+// any other port upgrades with STARTTLS when the server offers it. With
+// SMTP_USERNAME set the connection must be encrypted, so a relay that does
+// not offer STARTTLS is refused rather than sent the password in the clear.
+type smtpSender struct {
+	cfg  smtpConfig
+	from string
+}
+
+func (s smtpSender) Send(ctx context.Context, to, subject, text, html string) error {
+	msg, err := buildMultipartEmail(s.from, to, subject, text, html)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.cfg.host, strconv.Itoa(s.cfg.port))
+	tlsConfig := &tls.Config{ServerName: s.cfg.host}
+	var conn net.Conn
+	if s.cfg.port == 465 {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.cfg.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if s.cfg.port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if s.cfg.username != "" {
+			return permanent(errSMTPNoTLS)
+		}
+	}
+	if s.cfg.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.cfg.username, s.cfg.password, s.cfg.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(addressOnly(s.from)); err != nil {
+		return smtpError(err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return smtpError(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return client.Quit()
+}
+
+// smtpError marks 5xx replies as permanent; 4xx replies are temporary by
+// definition in SMTP.
+func smtpError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanent(err)
+	}
+	return err
+}
+
+// addressOnly strips a display name, so "Auth <auth@example.com>" can be used
+// both as the From header and the envelope sender.
+func addressOnly(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Address
+	}
+	return from
+}
+
+// buildMultipartEmail renders a multipart/alternative RFC 5322 message with
+// quoted-printable text and HTML parts.
+func buildMultipartEmail(from, to, subject, text, html string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domainOf(addressOnly(from)))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return "localhost"
+}
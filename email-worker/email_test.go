@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEmailSender records the emails it is asked to send.
+type fakeEmailSender struct {
+	err  error
+	sent []sentEmail
+}
+
+type sentEmail struct{ to, subject, text, html string }
+
+func (s *fakeEmailSender) Send(_ context.Context, to, subject, text, html string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, sentEmail{to, subject, text, html})
+	return nil
+}
+
+func TestEmailOTPSenderRendersBothParts(t *testing.T) {
+	tmpl, err := loadOTPEmailTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeEmailSender{}
+	sender := emailOTPSender{email: fake, subject: defaultOTPSubject, html: tmpl}
+	if err := sender.Send(context.Background(), "alice@example.com", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(fake.sent))
+	}
+	got := fake.sent[0]
+	if got.to != "alice@example.com" || got.subject != defaultOTPSubject {
+		t.Fatalf("sent %+v", got)
+	}
+	if !strings.Contains(got.text, "123456") || !strings.Contains(got.html, "123456") {
+		t.Fatalf("code missing from a part: text %q, html %q", got.text, got.html)
+	}
+
+	fake.err = permanent(errors.New("550 mailbox unavailable"))
+	if err := sender.Send(context.Background(), "alice@example.com", "123456"); !isPermanent(err) {
+		t.Fatalf("provider error = %v, want it passed through as permanent", err)
+	}
+}
+
+// fakeSMTPServer accepts one SMTP session on a local port. It never offers
+// STARTTLS and records the commands it receives.
+func fakeSMTPServer(t *testing.T) (port int, commands <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan []string, 1)
+	go func() {
+		var seen []string
+		defer func() { done <- seen }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if inData {
+				seen = append(seen, line)
+				if line == "." {
+					inData = false
+					reply("250 queued")
+				}
+				continue
+			}
+			seen = append(seen, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO":
+				reply("250-fake")
+				reply("250 AUTH PLAIN")
+			case "DATA":
+				inData = true
+				reply("354 go ahead")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	_, p, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ = strconv.Atoi(p)
+	return port, done
+}
+
+func TestSMTPSenderDelivers(t *testing.T) {
+	port, commands := fakeSMTPServer(t)
+	sender := smtpSender{cfg: smtpConfig{host: "127.0.0.1", port: port}, from: "Auth <auth@example.com>"}
+	if err := sender.Send(context.Background(), "alice@example.com", "Your login code", "code 123456", "<b>123456</b>"); err != nil {
+		t.Fatal(err)
+	}
+	session := strings.Join(<-commands, "\n")
+	for _, want := range []string{"MAIL FROM:<auth@example.com>", "RCPT TO:<alice@example.com>", "Subject: Your login code", "text/plain", "text/html"} {
+		if !strings.Contains(session, want) {
+			t.Errorf("session is missing %q:\n%s", want, session)
+		}
+	}
+}
+
+func TestSMTPSenderRequiresTLSForCredentials(t *testing.T) {
+	port, commands := fakeSMTPServer(t)
+	sender := smtpSender{
+		cfg:  smtpConfig{host: "127.0.0.1", port: port, username: "auth", password: "secret"},
+		from: "auth@example.com",
+	}
+	err := sender.Send(context.Background(), "alice@example.com", "Your login code", "code", "<b>code</b>")
+	if !errors.Is(err, errSMTPNoTLS) || !isPermanent(err) {
+		t.Fatalf("Send = %v, want a permanent %v", err, errSMTPNoTLS)
+	}
+	for _, line := range <-commands {
+		if strings.HasPrefix(strings.ToUpper(line), "AUTH") || strings.Contains(line, "secret") {
+			t.Fatalf("credentials were sent without TLS: %q", line)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTwilioSenderPostsTheCode(t *testing.T) {
+	status := http.StatusCreated
+	var got *http.Request
+	var form url.Values
+	sender := &twilioSender{
+		accountSID: "AC123",
+		authToken:  "token",
+		from:       "+15550000000",
+		client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			got = r
+			body, _ := io.ReadAll(r.Body)
+			form, _ = url.ParseQuery(string(body))
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("{}")), Header: http.Header{}}, nil
+		})},
+	}
+	if err := sender.Send(context.Background(), "+15551234567", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.String() != "https://api.twilio.com/2010-04-01/Accounts/AC123/Messages.json" {
+		t.Fatalf("posted to %s", got.URL)
+	}
+	if user, pass, ok := got.BasicAuth(); !ok || user != "AC123" || pass != "token" {
+		t.Fatalf("basic auth = %q, %q, %v", user, pass, ok)
+	}
+	want := url.Values{
+		"To":   {"+15551234567"},
+		"From": {"+15550000000"},
+		"Body": {"Your login code is 123456. It is valid for 3 minutes."},
+	}
+	for key := range want {
+		if form.Get(key) != want.Get(key) {
+			t.Errorf("%s = %q, want %q", key, form.Get(key), want.Get(key))
+		}
+	}
+
+	status = http.StatusBadRequest
+	if err := sender.Send(context.Background(), "+15551234567", "123456"); !isPermanent(err) {
+		t.Fatalf("400 from Twilio = %v, want a permanent error", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := sender.Send(context.Background(), "+15551234567", "123456"); err == nil || isPermanent(err) {
+		t.Fatalf("503 from Twilio = %v, want a retryable error", err)
+	}
+}
@@ -2,128 +2,268 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
-	"os"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	mailgun "github.com/mailgun/mailgun-go/v4"
 	"github.com/segmentio/kafka-go"
 )
 
-const otpTTL = 3 * time.Minute
+const (
+	otpTTL           = 3 * time.Minute
+	schemaAttempts   = 30
+	schemaRetryDelay = 2 * time.Second
+)
 
 func main() {
-	kafkaURL := os.Getenv("KAFKA_URL")
-	mgDomain := os.Getenv("MAILGUN_DOMAIN")
-	mgAPIKey := os.Getenv("MAILGUN_API_KEY")
-	mysqlDSN := os.Getenv("MYSQL_DSN")
-
-	if kafkaURL == "" || mgDomain == "" || mgAPIKey == "" {
-		log.Fatal("KAFKA_URL, MAILGUN_DOMAIN, and MAILGUN_API_KEY must be set")
-	}
-	if mysqlDSN == "" {
-		log.Fatal("MYSQL_DSN must be set for OTP storage")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
+	cfg.logSummary()
 
-	db, err := sql.Open("mysql", mysqlDSN)
+	db, err := sql.Open("mysql", cfg.mysqlDSN)
 	if err != nil {
 		log.Fatalf("mysql connection error: %v", err)
 	}
 	defer db.Close()
 
-	if err := db.Ping(); err != nil {
-		log.Fatalf("mysql ping error: %v", err)
-	}
-
-	if err := ensureSchema(db); err != nil {
+	// No OTP request is read until otp_codes is in place.
+	if err := waitForSchema(db); err != nil {
 		log.Fatalf("schema setup error: %v", err)
 	}
 
-	mg := mailgun.NewMailgun(mgDomain, mgAPIKey)
+	senders := map[string]otpSender{
+		"email": emailOTPSender{
+			email:   newEmailSender(cfg),
+			subject: cfg.emailSubject,
+			html:    cfg.emailTemplate,
+		},
+	}
+	if cfg.twilio.enabled() {
+		senders["sms"] = newTwilioSender(cfg.twilio)
+	} else {
+		log.Println("TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM not set; sms codes will not be sent")
+	}
 
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{kafkaURL},
+		Brokers: []string{cfg.kafkaURL},
 		Topic:   "new-registration",
 		GroupID: "email-worker-group",
 	})
 	defer reader.Close()
 
+	dlq := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.kafkaURL),
+		Topic:    cfg.dlqTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer dlq.Close()
+
+	w := &worker{db: db, senders: senders, cfg: cfg}
+
 	log.Println("Email worker listening to Kafka...")
 
+	// Offsets are committed only once a request has been sent, deliberately
+	// skipped, or recorded on the dead-letter topic, so a crash mid-send
+	// redelivers the request instead of dropping it.
+	ctx := context.Background()
 	for {
-		msg, err := reader.ReadMessage(context.Background())
+		msg, err := reader.FetchMessage(ctx)
 		if err != nil {
 			log.Println("Error reading Kafka:", err)
 			continue
 		}
 
-		email := string(msg.Value)
-		if email == "" {
-			continue
+		if attempts, err := w.process(ctx, msg.Value); err != nil {
+			log.Printf("otp request at partition %d offset %d failed after %d attempt(s), sending to %s: %v",
+				msg.Partition, msg.Offset, attempts, cfg.dlqTopic, err)
+			if err := publishDeadLetter(ctx, dlq, msg, attempts, err); err != nil {
+				log.Printf("dead-letter publish error: %v", err)
+				continue
+			}
 		}
-		log.Printf("Generating OTP for %s", email)
 
-		otp, err := generateOTP()
-		if err != nil {
-			log.Printf("otp generation error: %v", err)
-			continue
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			log.Printf("commit offset %d error: %v", msg.Offset, err)
 		}
+	}
+}
 
-		if err := storeOTP(db, email, otp); err != nil {
-			log.Printf("failed to store otp for %s: %v", email, err)
-			continue
-		}
+type worker struct {
+	db      *sql.DB
+	senders map[string]otpSender
+	cfg     config
+}
 
-		message := mg.NewMessage(
-			"auth@"+mgDomain,
-			"Your login code",
-			fmt.Sprintf("Your one-time password is %s. It is valid for 3 minutes.", otp),
-			email,
-		)
+// process issues and delivers one OTP. A nil error means the message is done
+// with, including when it was throttled; otherwise it returns the number of
+// send attempts made and the failure to dead-letter.
+func (w *worker) process(ctx context.Context, value []byte) (int, error) {
+	req, ok := parseOTPRequest(value)
+	if !ok {
+		return 0, errors.New("malformed otp request")
+	}
+	sender, ok := w.senders[req.Channel]
+	if !ok {
+		return 0, fmt.Errorf("no sender for channel %q", req.Channel)
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		_, _, err = mg.Send(ctx, message)
-		cancel()
+	if w.cfg.resendCooldown > 0 {
+		recent, err := hasRecentOTP(w.db, req.Identifier, w.cfg.resendCooldown)
 		if err != nil {
-			log.Printf("Mailgun send error for %s: %v", email, err)
-			continue
+			// Sending a duplicate is better than locking the user out.
+			log.Printf("otp cooldown check failed for %s: %v", req.Identifier, err)
+		} else if recent {
+			log.Printf("OTP for %s throttled: previous code issued less than %s ago", req.Identifier, w.cfg.resendCooldown)
+			return 0, nil
 		}
-		log.Printf("OTP email sent to %s", email)
 	}
+
+	log.Printf("Generating %s OTP for %s", req.Channel, req.Identifier)
+
+	otp, err := generateOTP()
+	if err != nil {
+		return 0, fmt.Errorf("generate otp: %w", err)
+	}
+
+	// The code is stored before it is sent so that it can be verified as
+	// soon as it arrives. If the send fails the row is removed again:
+	// left behind, it would make a redelivery, a dead-letter replay or the
+	// user's own retry look throttled, and no code would ever go out.
+	hashed, err := storeOTP(w.db, w.cfg.otpPepper, req.Identifier, otp)
+	if err != nil {
+		return 0, fmt.Errorf("store otp for %s: %w", req.Identifier, err)
+	}
+
+	attempts, err := sendWithRetry(ctx, w.cfg.retry, sender, req.Destination, otp)
+	if err != nil {
+		if derr := discardOTP(w.db, req.Identifier, hashed); derr != nil {
+			log.Printf("discard unsent otp for %s: %v", req.Identifier, derr)
+		}
+		return attempts, fmt.Errorf("%s send to %s: %w", req.Channel, req.Identifier, err)
+	}
+	log.Printf("OTP %s sent to %s", req.Channel, req.Identifier)
+	return attempts, nil
+}
+
+// waitForSchema retries ensureSchema while MySQL is still coming up.
+func waitForSchema(db *sql.DB) error {
+	var err error
+	for attempt := 1; attempt <= schemaAttempts; attempt++ {
+		if err = db.Ping(); err == nil {
+			if err = ensureSchema(db); err == nil {
+				return nil
+			}
+		}
+		log.Printf("schema not ready (attempt %d/%d): %v", attempt, schemaAttempts, err)
+		time.Sleep(schemaRetryDelay)
+	}
+	return err
 }
 
+// ensureSchema creates otp_codes. The email column holds the normalized
+// identifier the code was issued for: a lowercased email or an E.164 phone
+// number.
 func ensureSchema(db *sql.DB) error {
 	query := `
 		CREATE TABLE IF NOT EXISTS otp_codes (
 			email VARCHAR(255) NOT NULL PRIMARY KEY,
-			code VARCHAR(12) NOT NULL,
+			code VARCHAR(128) NOT NULL,
 			expires_at DATETIME NOT NULL,
 			created_at DATETIME NOT NULL
 		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 	`
-	_, err := db.Exec(query)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	// Tables created before codes were hashed have a VARCHAR(12) column.
+	// Widen it once rather than rewriting the table on every boot.
+	var length sql.NullInt64
+	err := db.QueryRow(`
+		SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'otp_codes' AND COLUMN_NAME = 'code'
+	`).Scan(&length)
+	if err != nil || length.Int64 >= 128 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE otp_codes MODIFY code VARCHAR(128) NOT NULL`)
 	return err
 }
 
-func storeOTP(db *sql.DB, email, code string) error {
+// storeOTP saves a keyed hash of code, never the code itself, so a leaked
+// otp_codes table does not expose live codes. It returns the stored value.
+func storeOTP(db *sql.DB, pepper []byte, identifier, code string) (string, error) {
+	hashed, err := hashOTP(pepper, code)
+	if err != nil {
+		return "", err
+	}
 	now := time.Now()
 	expires := now.Add(otpTTL)
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		INSERT INTO otp_codes (email, code, expires_at, created_at)
 		VALUES (?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE
 			code = VALUES(code),
 			expires_at = VALUES(expires_at),
 			created_at = VALUES(created_at)
-	`, email, code, expires, now)
+	`, identifier, hashed, expires, now)
+	return hashed, err
+}
+
+// discardOTP deletes the code storeOTP saved as hashed. A newer code issued
+// for identifier in the meantime is left alone.
+func discardOTP(db *sql.DB, identifier, hashed string) error {
+	_, err := db.Exec(`DELETE FROM otp_codes WHERE email = ? AND code = ?`, identifier, hashed)
 	return err
 }
 
+// hasRecentOTP reports whether identifier already has an unexpired code that
+// was issued within cooldown.
+func hasRecentOTP(db *sql.DB, identifier string, cooldown time.Duration) (bool, error) {
+	now := time.Now()
+	var exists int
+	err := db.QueryRow(`
+		SELECT 1 FROM otp_codes
+		WHERE email = ? AND created_at > ? AND expires_at > ?
+	`, identifier, now.Add(-cooldown), now).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hashOTP returns "hmac$<salt hex>$<mac hex>" with a fresh random salt and
+// mac = HMAC-SHA256(pepper, salt || code). A plain hash of a 6-digit code is
+// reversed by trying all million codes; without OTP_PEPPER, which never
+// touches the database, the MAC cannot be. The verifiers in registration-api
+// and codeforces-api parse this format with the same pepper.
+func hashOTP(pepper []byte, code string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "hmac$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(otpMAC(pepper, salt, code)), nil
+}
+
+func otpMAC(pepper, salt []byte, code string) []byte {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write(salt)
+	mac.Write([]byte(code))
+	return mac.Sum(nil)
+}
+
 func generateOTP() (string, error) {
 	max := big.NewInt(1000000)
 	n, err := rand.Int(rand.Reader, max)
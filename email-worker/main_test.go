@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestOTPMAC(t *testing.T) {
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	// The verifiers in registration-api and codeforces-api test against
+	// this same vector.
+	const want = "21eff9a40144e4b3f2bee3ecfb00b44d271fb29a3cbfbd8bb47ab488bcb49343"
+	if got := hex.EncodeToString(otpMAC([]byte("test-pepper"), salt, "123456")); got != want {
+		t.Fatalf("otpMAC = %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(otpMAC([]byte("other-pepper"), salt, "123456")); got == want {
+		t.Fatal("otpMAC ignored the pepper")
+	}
+}
+
+func TestHashOTP(t *testing.T) {
+	pepper := []byte("test-pepper")
+	first, err := hashOTP(pepper, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := hashOTP(pepper, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("two hashes of the same code are identical; the salt is not random")
+	}
+
+	parts := strings.Split(first, "$")
+	if len(parts) != 3 || parts[0] != "hmac" {
+		t.Fatalf("hashOTP = %q, want hmac$<salt>$<mac>", first)
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || len(salt) != 16 {
+		t.Fatalf("salt %q is not 16 hex bytes", parts[1])
+	}
+	if parts[2] != hex.EncodeToString(otpMAC(pepper, salt, "123456")) {
+		t.Fatalf("mac %q does not match the code", parts[2])
+	}
+	if strings.Contains(first, "123456") {
+		t.Fatalf("hashOTP = %q contains the code", first)
+	}
+}
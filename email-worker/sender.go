@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// otpRequest is the payload on new-registration. Producers that predate
+// SMS codes send a bare email string, which parseOTPRequest maps to the
+// email channel.
+type otpRequest struct {
+	Channel     string `json:"channel"`
+	Destination string `json:"destination"`
+	Identifier  string `json:"identifier"`
+}
+
+func parseOTPRequest(value []byte) (otpRequest, bool) {
+	raw := strings.TrimSpace(string(value))
+	if raw == "" {
+		return otpRequest{}, false
+	}
+	if !strings.HasPrefix(raw, "{") {
+		email := strings.ToLower(raw)
+		return otpRequest{Channel: "email", Destination: email, Identifier: email}, true
+	}
+	var req otpRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		return otpRequest{}, false
+	}
+	if req.Channel == "" {
+		req.Channel = "email"
+	}
+	if req.Identifier == "" {
+		req.Identifier = req.Destination
+	}
+	if req.Destination == "" || req.Identifier == "" {
+		return otpRequest{}, false
+	}
+	return req, true
+}
+
+// otpSender delivers a code to a destination on one channel.
+type otpSender interface {
+	Send(ctx context.Context, destination, code string) error
+}
+
+// emailOTPSender renders the OTP email and hands it to the configured
+// provider: the plain-text code as the text part and the template as HTML.
+type emailOTPSender struct {
+	email   emailSender
+	subject string
+	html    *template.Template
+}
+
+func (s emailOTPSender) Send(ctx context.Context, destination, code string) error {
+	var body bytes.Buffer
+	if err := s.html.Execute(&body, newOTPEmailData(code)); err != nil {
+		return permanent(fmt.Errorf("render otp email: %w", err))
+	}
+	return s.email.Send(ctx, destination, s.subject, otpText(code), body.String())
+}
+
+// twilioSender sends SMS through the Twilio Messages API.
+type twilioSender struct {
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+func newTwilioSender(cfg twilioConfig) *twilioSender {
+	return &twilioSender{
+		accountSID: cfg.accountSID,
+		authToken:  cfg.authToken,
+		from:       cfg.from,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *twilioSender) Send(ctx context.Context, destination, code string) error {
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", url.PathEscape(s.accountSID))
+	form := url.Values{
+		"To":   {destination},
+		"From": {s.from},
+		"Body": {fmt.Sprintf("Your login code is %s. It is valid for 3 minutes.", code)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("twilio status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if permanentStatus(resp.StatusCode) {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// otpTable is an in-memory otp_codes table behind database/sql that answers
+// the queries the worker makes.
+type otpTable struct {
+	mu   sync.Mutex
+	rows map[string]otpRow
+}
+
+type otpRow struct {
+	code               string
+	expires, createdAt time.Time
+}
+
+func (t *otpTable) Connect(context.Context) (driver.Conn, error) { return otpConn{t}, nil }
+func (t *otpTable) Driver() driver.Driver                        { return nil }
+
+type otpConn struct{ t *otpTable }
+
+func (c otpConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c otpConn) Close() error                        { return nil }
+func (c otpConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c otpConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "SELECT 1 FROM otp_codes") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	row, ok := c.t.rows[args[0].Value.(string)]
+	if !ok || !row.createdAt.After(args[1].Value.(time.Time)) || !row.expires.After(args[2].Value.(time.Time)) {
+		return &oneRow{}, nil
+	}
+	return &oneRow{row: []driver.Value{int64(1)}}, nil
+}
+
+func (c otpConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	email := args[0].Value.(string)
+	switch {
+	case strings.Contains(query, "INSERT INTO otp_codes"):
+		c.t.rows[email] = otpRow{
+			code:      args[1].Value.(string),
+			expires:   args[2].Value.(time.Time),
+			createdAt: args[3].Value.(time.Time),
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM otp_codes WHERE email = ? AND code = ?"):
+		if row, ok := c.t.rows[email]; !ok || row.code != args[1].Value.(string) {
+			return driver.RowsAffected(0), nil
+		}
+		delete(c.t.rows, email)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+type oneRow struct{ row []driver.Value }
+
+func (r *oneRow) Columns() []string { return []string{"1"} }
+func (r *oneRow) Close() error      { return nil }
+func (r *oneRow) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+// fakeSender fails the first `failures` sends and records the codes of the
+// rest.
+type fakeSender struct {
+	failures int
+	sent     []string
+}
+
+func (s *fakeSender) Send(_ context.Context, destination, code string) error {
+	if s.failures > 0 {
+		s.failures--
+		return permanent(errors.New("550 mailbox unavailable"))
+	}
+	s.sent = append(s.sent, destination+" "+code)
+	return nil
+}
+
+func newTestWorker(t *testing.T, sender *fakeSender) (*worker, *otpTable) {
+	t.Helper()
+	table := &otpTable{rows: map[string]otpRow{}}
+	db := sql.OpenDB(table)
+	t.Cleanup(func() { db.Close() })
+	return &worker{
+		db:      db,
+		senders: map[string]otpSender{"email": sender},
+		cfg: config{
+			resendCooldown: time.Minute,
+			retry:          retryPolicy{attempts: 1, backoff: time.Millisecond},
+			otpPepper:      []byte("test-pepper"),
+		},
+	}, table
+}
+
+const otpRequestValue = `{"channel":"email","destination":"alice@example.com","identifier":"alice@example.com"}`
+
+func TestProcessSendFailureThenRetry(t *testing.T) {
+	sender := &fakeSender{failures: 1}
+	w, table := newTestWorker(t, sender)
+
+	if _, err := w.process(context.Background(), []byte(otpRequestValue)); err == nil {
+		t.Fatal("process succeeded although the send failed")
+	}
+	if _, ok := table.rows["alice@example.com"]; ok {
+		t.Fatal("the unsent code was left in otp_codes")
+	}
+
+	// A redelivery or the user asking again within the cooldown must send
+	// a code instead of being throttled by the failed attempt.
+	if _, err := w.process(context.Background(), []byte(otpRequestValue)); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d codes on retry, want 1", len(sender.sent))
+	}
+	row, ok := table.rows["alice@example.com"]
+	if !ok {
+		t.Fatal("the sent code was not stored")
+	}
+	code := strings.Fields(sender.sent[0])[1]
+	parts := strings.Split(row.code, "$")
+	if len(parts) != 3 || strings.Contains(row.code, code) {
+		t.Fatalf("stored %q for code %s", row.code, code)
+	}
+
+	// With the code delivered, a second request is throttled.
+	if _, err := w.process(context.Background(), []byte(otpRequestValue)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d codes, want the second request throttled", len(sender.sent))
+	}
+}
+
+func TestProcessDeadLetterReplay(t *testing.T) {
+	sender := &fakeSender{failures: 1}
+	w, table := newTestWorker(t, sender)
+	msg := kafka.Message{Partition: 2, Offset: 41, Value: []byte(otpRequestValue)}
+
+	attempts, err := w.process(context.Background(), msg.Value)
+	if err == nil {
+		t.Fatal("process succeeded although the send failed")
+	}
+	value, err := deadLetterValue(msg, attempts, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl deadLetter
+	if err := json.Unmarshal(value, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Attempts != 1 || dl.Partition != 2 || dl.Offset != 41 || !strings.Contains(dl.Error, "550") {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+
+	if _, err := w.process(context.Background(), dl.Request); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(sender.sent) != 1 || !strings.HasPrefix(sender.sent[0], "alice@example.com ") {
+		t.Fatalf("replay sent %v, want one code to alice@example.com", sender.sent)
+	}
+	if _, ok := table.rows["alice@example.com"]; !ok {
+		t.Fatal("the replayed code was not stored")
+	}
+}
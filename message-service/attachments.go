@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// A message may carry one attachment: an http(s) URL to media the client has
+// already uploaded, and its kind. The service stores and returns both as
+// given and never fetches the URL. A message with an attachment may have
+// empty text; conversation previews then show attachmentPreview instead.
+const (
+	maxAttachmentURLLength = 2048
+
+	attachmentTypeImage = "image"
+	attachmentTypeVideo = "video"
+	attachmentTypeAudio = "audio"
+	attachmentTypeFile  = "file"
+)
+
+// validateAttachment normalizes an attachment from a create payload. Both
+// fields are empty for a text-only message.
+func validateAttachment(rawURL, kind string) (string, string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if rawURL == "" && kind == "" {
+		return "", "", nil
+	}
+	if rawURL == "" {
+		return "", "", errors.New("attachment_url is required with attachment_type")
+	}
+	if len(rawURL) > maxAttachmentURLLength {
+		return "", "", errors.New("attachment_url is too long")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", errors.New("attachment_url must be an http or https URL")
+	}
+	switch kind {
+	case "":
+		kind = attachmentTypeFile
+	case attachmentTypeImage, attachmentTypeVideo, attachmentTypeAudio, attachmentTypeFile:
+	default:
+		return "", "", errors.New("attachment_type must be image, video, audio or file")
+	}
+	return rawURL, kind, nil
+}
+
+// attachmentPreview is the conversation preview for a message that has an
+// attachment but no text.
+func attachmentPreview(kind string) string {
+	switch kind {
+	case attachmentTypeImage:
+		return "Photo"
+	case attachmentTypeVideo:
+		return "Video"
+	case attachmentTypeAudio:
+		return "Audio"
+	default:
+		return "Attachment"
+	}
+}
+
+// addAttachment sets the attachment fields on a message item when it has one.
+// A view-once message only names the attachment type; its URL is revealed
+// with its body, on the reader's claiming fetch.
+func addAttachment(item map[string]interface{}, attachmentURL, attachmentType string, viewOnce bool) {
+	if attachmentURL == "" {
+		return
+	}
+	item["attachment_type"] = attachmentType
+	if !viewOnce {
+		item["attachment_url"] = attachmentURL
+	}
+}
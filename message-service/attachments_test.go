@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestAddAttachment(t *testing.T) {
+	const url = "https://cdn.example.com/a.png"
+	tests := []struct {
+		name     string
+		url      string
+		viewOnce bool
+		want     map[string]interface{}
+	}{
+		{"no attachment", "", false, map[string]interface{}{}},
+		{"attachment", url, false, map[string]interface{}{"attachment_url": url, "attachment_type": "image"}},
+		{"view-once hides the url", url, true, map[string]interface{}{"attachment_type": "image"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := map[string]interface{}{}
+			addAttachment(item, tt.url, "image", tt.viewOnce)
+			if len(item) != len(tt.want) {
+				t.Fatalf("item = %v, want %v", item, tt.want)
+			}
+			for k, v := range tt.want {
+				if item[k] != v {
+					t.Fatalf("item = %v, want %v", item, tt.want)
+				}
+			}
+		})
+	}
+}
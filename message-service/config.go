@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// config is everything message-service reads from the environment at
+// startup. loadConfig validates it in one pass so a bad deployment fails
+// before the listener or Cassandra session is opened, listing every problem
+// at once.
+type config struct {
+	listenAddr        string
+	cassandraHosts    []string
+	keyspace          string
+	kafkaURL          string
+	messageTopic      string
+	reconcileInterval time.Duration
+	// registrationURL is set only when STRICT_PARTICIPANTS=true.
+	registrationURL  string
+	internalAPIToken string
+	rateLimit        int
+	rateWindow       time.Duration
+	// maxConversations is MAX_CONVERSATIONS_PER_USER; 0 disables it.
+	maxConversations int
+	// idempotencyTTL is how long a message Idempotency-Key is remembered:
+	// long enough for a client's retries, and longer than
+	// idempotencyStaleAfter so a stuck claim can still be taken over.
+	idempotencyTTL time.Duration
+	// consistency is the default for every query. queryRetries is how many
+	// times a failed query is retried with exponential backoff.
+	consistency  gocql.Consistency
+	queryRetries int
+	// replicationFactor and dcReplication only apply when the keyspace is
+	// first created. dcReplication, when set, maps each datacenter to its
+	// replication factor and selects NetworkTopologyStrategy.
+	replicationFactor int
+	dcReplication     map[string]int
+	// moderationURL and moderationBannedWords enable message moderation
+	// when either is set.
+	moderationURL         string
+	moderationSecret      string
+	moderationBannedWords []string
+	moderationTimeout     time.Duration
+}
+
+var (
+	keyspacePattern   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+	datacenterPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// intAtLeast parses an integer no smaller than min, recording a problem
+// rather than silently falling back when the value is malformed.
+func (p *configProblems) intAtLeast(key string, min, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min {
+		p.add("%s must be an integer >= %d, got %q", key, min, raw)
+		return fallback
+	}
+	return n
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	port := envOrDefault("SERVICE_PORT", "8084")
+	cfg := config{
+		// LISTEN_ADDR (host:port) takes precedence for binding one interface.
+		listenAddr:       envOrDefault("LISTEN_ADDR", ":"+port),
+		keyspace:         envOrDefault("CASSANDRA_KEYSPACE", "chat_data"),
+		kafkaURL:         envOrDefault("KAFKA_URL", "kafka:9092"),
+		messageTopic:     envOrDefault("MESSAGE_EVENTS_TOPIC", "chat-messages"),
+		internalAPIToken: strings.TrimSpace(os.Getenv("INTERNAL_API_TOKEN")),
+	}
+
+	for _, host := range strings.Split(envOrDefault("CASSANDRA_HOSTS", "cassandra"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.cassandraHosts = append(cfg.cassandraHosts, host)
+		}
+	}
+	if len(cfg.cassandraHosts) == 0 {
+		problems.add("CASSANDRA_HOSTS must list at least one host")
+	}
+	if !keyspacePattern.MatchString(cfg.keyspace) {
+		problems.add("CASSANDRA_KEYSPACE must be a valid keyspace name, got %q", cfg.keyspace)
+	}
+
+	if minutes := problems.intAtLeast("COUNTER_RECONCILE_INTERVAL_MINUTES", 1, 0); minutes > 0 {
+		cfg.reconcileInterval = time.Duration(minutes) * time.Minute
+	}
+
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("STRICT_PARTICIPANTS")), "true") {
+		cfg.registrationURL = strings.TrimRight(strings.TrimSpace(os.Getenv("REGISTRATION_API_URL")), "/")
+		if cfg.registrationURL == "" {
+			problems.add("REGISTRATION_API_URL must be set when STRICT_PARTICIPANTS=true")
+		} else if u, err := url.Parse(cfg.registrationURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("REGISTRATION_API_URL must be an absolute URL, got %q", cfg.registrationURL)
+		}
+	}
+
+	cfg.rateLimit = problems.intAtLeast("MESSAGE_RATE_LIMIT", 0, 10)
+	cfg.rateWindow = time.Duration(problems.intAtLeast("MESSAGE_RATE_WINDOW_SECONDS", 1, 10)) * time.Second
+	cfg.maxConversations = problems.intAtLeast("MAX_CONVERSATIONS_PER_USER", 0, 500)
+	cfg.idempotencyTTL = time.Duration(problems.intAtLeast("IDEMPOTENCY_TTL_MINUTES", 2, 10)) * time.Minute
+
+	consistency := envOrDefault("CASSANDRA_CONSISTENCY", "QUORUM")
+	var err error
+	if cfg.consistency, err = gocql.ParseConsistencyWrapper(consistency); err != nil {
+		problems.add("CASSANDRA_CONSISTENCY must be a Cassandra consistency level such as ONE, QUORUM or LOCAL_QUORUM, got %q", consistency)
+	}
+	cfg.queryRetries = problems.intAtLeast("CASSANDRA_RETRY_ATTEMPTS", 0, 3)
+	cfg.replicationFactor = problems.intAtLeast("CASSANDRA_REPLICATION_FACTOR", 1, 1)
+	if raw := strings.TrimSpace(os.Getenv("CASSANDRA_DC_REPLICATION")); raw != "" {
+		if strings.TrimSpace(os.Getenv("CASSANDRA_REPLICATION_FACTOR")) != "" {
+			problems.add("set only one of CASSANDRA_REPLICATION_FACTOR and CASSANDRA_DC_REPLICATION")
+		}
+		cfg.dcReplication = parseDCReplication(raw, &problems)
+	}
+
+	cfg.moderationURL = strings.TrimSpace(os.Getenv("MODERATION_URL"))
+	cfg.moderationSecret = strings.TrimSpace(os.Getenv("MODERATION_SECRET"))
+	cfg.moderationBannedWords = parseBannedWords(os.Getenv("MODERATION_BANNED_WORDS"), &problems)
+	cfg.moderationTimeout = time.Duration(problems.intAtLeast("MODERATION_TIMEOUT_MS", 1, int(defaultModerationTimeout/time.Millisecond))) * time.Millisecond
+	if cfg.moderationURL != "" {
+		if u, err := url.Parse(cfg.moderationURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("MODERATION_URL must be an absolute http or https URL, got %q", cfg.moderationURL)
+		}
+	}
+
+	return cfg, problems.err()
+}
+
+// parseDCReplication parses CASSANDRA_DC_REPLICATION, a comma-separated list
+// of datacenter:factor pairs such as "dc1:3,dc2:3".
+func parseDCReplication(raw string, problems *configProblems) map[string]int {
+	perDC := make(map[string]int)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		dc, factor, ok := strings.Cut(pair, ":")
+		dc = strings.TrimSpace(dc)
+		n, err := strconv.Atoi(strings.TrimSpace(factor))
+		switch {
+		case !ok || err != nil || n < 1:
+			problems.add("CASSANDRA_DC_REPLICATION entries must be datacenter:factor with factor >= 1, got %q", pair)
+		case !datacenterPattern.MatchString(dc):
+			problems.add("CASSANDRA_DC_REPLICATION has an invalid datacenter name %q", dc)
+		case perDC[dc] != 0:
+			problems.add("CASSANDRA_DC_REPLICATION lists datacenter %q twice", dc)
+		default:
+			perDC[dc] = n
+		}
+	}
+	if len(perDC) == 0 {
+		problems.add("CASSANDRA_DC_REPLICATION must list at least one datacenter:factor pair")
+	}
+	return perDC
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: listen=%s cassandra=%s keyspace=%s consistency=%s retries=%d replication=%s kafka=%s topic=%s reconcile_interval=%s strict_participants=%t rate_limit=%d per %s max_conversations=%d idempotency_ttl=%s moderation_url=%t banned_words=%d",
+		c.listenAddr, strings.Join(c.cassandraHosts, ","), c.keyspace, c.consistency, c.queryRetries, keyspaceReplication(c.replicationFactor, c.dcReplication), c.kafkaURL, c.messageTopic, c.reconcileInterval,
+		c.registrationURL != "", c.rateLimit, c.rateWindow, c.maxConversations, c.idempotencyTTL, c.moderationURL != "", len(c.moderationBannedWords))
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
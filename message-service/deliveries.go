@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Delivery receipts record that a message reached at least one of a
+// recipient's connected devices. chat-service reports them with
+// POST /conversations/{id}/messages/{messageId}/delivered {user} as it fans a
+// message out. Each (message, user) is stored once, and a repeated report
+// just rewrites delivered_at, so a plain insert is enough. The receipts
+// response lists the delivered set of each message on the requested page
+// next to the read counts, so clients can tell sent, delivered and read apart.
+
+func (s *server) handleMessageDelivered(w http.ResponseWriter, r *http.Request, conversationID gocql.UUID, messageIDStr string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	messageID, err := gocql.ParseUUID(messageIDStr)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	payload.User = strings.TrimSpace(payload.User)
+	if payload.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	user, ok := s.participantSpelling(payload.User, conversationID)
+	if !ok {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	payload.User = user
+	if err := s.idempotentQuery(
+		`INSERT INTO conversation_deliveries (conversation_id, message_id, user_email, delivered_at) VALUES (?, ?, ?, ?)`,
+		conversationID, messageID, payload.User, time.Now().UTC(),
+	).Exec(); err != nil {
+		slog.Error("record delivery failed", "conversation_id", conversationID.String(), "message_id", messageID.String(), "email", payload.User, "err", err)
+		http.Error(w, "unable to record delivery", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// participantSpelling returns user as the conversation stores it. Older rows
+// keep an address in the case it was first written in, so after an exact
+// lookup the participants are matched case-insensitively.
+func (s *server) participantSpelling(user string, conversationID gocql.UUID) (string, bool) {
+	if s.userInConversation(user, conversationID) {
+		return user, true
+	}
+	conv, err := s.loadConversation(conversationID)
+	if err != nil {
+		return "", false
+	}
+	stored, ok := findFold(conv.Participants, user)
+	if !ok || stored == user {
+		return "", false
+	}
+	return stored, s.userInConversation(stored, conversationID)
+}
+
+// findFold returns the item of list equal to value under case folding.
+func findFold(list []string, value string) (string, bool) {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return item, true
+		}
+	}
+	return "", false
+}
+
+// conversationDeliveries returns who each of messageIDs has been delivered
+// to, keyed by message id. Only those messages' rows are read, however long
+// the conversation is.
+func (s *server) conversationDeliveries(conversationID gocql.UUID, messageIDs []gocql.UUID) (map[string][]string, error) {
+	out := make(map[string][]string)
+	if len(messageIDs) == 0 {
+		return out, nil
+	}
+	iter := s.idempotentQuery(
+		`SELECT message_id, user_email FROM conversation_deliveries WHERE conversation_id = ? AND message_id IN ?`,
+		conversationID, messageIDs,
+	).Iter()
+
+	var (
+		messageID gocql.UUID
+		user      string
+	)
+	for iter.Scan(&messageID, &user) {
+		id := messageID.String()
+		out[id] = append(out[id], user)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// pageMessageIDs returns the ids of the messages listMessages would return
+// for the same limit and tail.
+func (s *server) pageMessageIDs(conversationID gocql.UUID, limit int, tail bool) ([]gocql.UUID, error) {
+	stmt := `SELECT message_id FROM messages WHERE conversation_id = ? LIMIT ?`
+	if tail {
+		stmt = `SELECT message_id FROM messages WHERE conversation_id = ? ORDER BY sent_at DESC, message_id DESC LIMIT ?`
+	}
+	iter := s.idempotentQuery(stmt, conversationID, limit).Iter()
+
+	var messageID gocql.UUID
+	ids := make([]gocql.UUID, 0, limit)
+	for iter.Scan(&messageID) {
+		ids = append(ids, messageID)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
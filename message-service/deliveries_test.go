@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestFindFold(t *testing.T) {
+	participants := []string{"Alice@Example.com", "bob@example.com"}
+	tests := []struct {
+		value, want string
+		ok          bool
+	}{
+		{"Alice@Example.com", "Alice@Example.com", true},
+		{"alice@example.com", "Alice@Example.com", true},
+		{"BOB@EXAMPLE.COM", "bob@example.com", true},
+		{"carol@example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := findFold(participants, tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("findFold(%q) = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
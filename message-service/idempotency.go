@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Idempotency keys make POST /conversations/{id}/messages safe to retry:
+//
+//   - A sender may pass an Idempotency-Key header. The first request with a
+//     key claims it in message_idempotency with a lightweight transaction,
+//     before the message is stored, recording the message id and sent_at it
+//     is about to use and a hash of the payload.
+//   - A later request from the same sender in the same conversation with the
+//     same key and payload gets the stored message back with
+//     Idempotent-Replayed: true, and no new message, counter bump or event.
+//     The same key with a different payload is a client bug and gets 422.
+//   - If the claimed message is not stored yet the original request is still
+//     running, so the retry gets 409. A claim whose message never appears
+//     within idempotencyStaleAfter (the original crashed) is taken over.
+//   - A request that fails before storing its message releases the key.
+//
+// Keys expire after IDEMPOTENCY_TTL_MINUTES, a window meant to cover a
+// client's retries after a timeout, not to deduplicate for good.
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotentReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+	idempotencyStaleAfter   = time.Minute
+)
+
+var (
+	errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+	errIdempotencyKeyReused  = errors.New("Idempotency-Key was already used with a different message")
+)
+
+// idempotencyClaim is the message a key was claimed for.
+type idempotencyClaim struct {
+	messageID gocql.UUID
+	sentAt    time.Time
+	// payloadHash is empty on claims stored before hashes were recorded.
+	payloadHash string
+}
+
+// storedMessage is a message row read back for a replay.
+type storedMessage struct {
+	sender         string
+	body           string
+	viewOnce       bool
+	attachmentURL  string
+	attachmentType string
+}
+
+// messagePayloadHash identifies what a create request asked to store, so a
+// key reused for a different message can be told apart from a retry.
+func messagePayloadHash(text string, viewOnce bool, attachmentURL, attachmentType string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{text, strconv.FormatBool(viewOnce), attachmentURL, attachmentType}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyStore is the storage claimIdempotencyKey works against:
+// message_idempotency and the messages table in Cassandra.
+type idempotencyStore interface {
+	// insert claims key for claim if nobody holds it. Otherwise it returns
+	// the claim holding it, or nil if that expired in the meantime.
+	insert(conversationID gocql.UUID, sender, key string, claim idempotencyClaim) (bool, *idempotencyClaim, error)
+	// takeOver moves key from the claim for prev to claim, if it still
+	// holds prev.
+	takeOver(conversationID gocql.UUID, sender, key string, prev gocql.UUID, claim idempotencyClaim) (bool, error)
+	// message returns the message stored for claim or gocql.ErrNotFound.
+	message(conversationID gocql.UUID, claim idempotencyClaim) (*storedMessage, error)
+}
+
+// claimIdempotencyKey reserves key for the message described by claim. When
+// the key is already held it returns false and, if that message is already
+// stored, the message to replay; errIdempotencyInProgress means it is not,
+// and errIdempotencyKeyReused that the key was claimed for another payload.
+func claimIdempotencyKey(store idempotencyStore, conversationID gocql.UUID, sender, key string, claim idempotencyClaim) (bool, *idempotencyClaim, *storedMessage, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		applied, prev, err := store.insert(conversationID, sender, key, claim)
+		if err != nil || applied {
+			return applied, nil, nil, err
+		}
+		// The row expired between the insert and the read.
+		if prev == nil {
+			continue
+		}
+		if prev.payloadHash != "" && prev.payloadHash != claim.payloadHash {
+			return false, nil, nil, errIdempotencyKeyReused
+		}
+
+		msg, err := store.message(conversationID, *prev)
+		if err == nil {
+			return false, prev, msg, nil
+		}
+		if !errors.Is(err, gocql.ErrNotFound) {
+			return false, nil, nil, err
+		}
+		if time.Since(prev.sentAt) < idempotencyStaleAfter {
+			return false, nil, nil, errIdempotencyInProgress
+		}
+
+		// The original request died between claiming and storing; take
+		// the key over unless someone else already has.
+		applied, err = store.takeOver(conversationID, sender, key, prev.messageID, claim)
+		if err != nil || applied {
+			return applied, nil, nil, err
+		}
+	}
+	return false, nil, nil, errIdempotencyInProgress
+}
+
+// cassandraIdempotency is the idempotencyStore behind a running server.
+type cassandraIdempotency struct {
+	s *server
+}
+
+func (c cassandraIdempotency) insert(conversationID gocql.UUID, sender, key string, claim idempotencyClaim) (bool, *idempotencyClaim, error) {
+	existing := make(map[string]interface{})
+	applied, err := c.s.session.Query(
+		`INSERT INTO message_idempotency (conversation_id, sender, idempotency_key, message_id, sent_at, payload_hash) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS USING TTL ?`,
+		conversationID, sender, key, claim.messageID, claim.sentAt, claim.payloadHash, c.ttl(),
+	).MapScanCAS(existing)
+	if err != nil || applied || len(existing) == 0 {
+		return applied, nil, err
+	}
+	prev := &idempotencyClaim{}
+	prev.messageID, _ = existing["message_id"].(gocql.UUID)
+	prev.sentAt, _ = existing["sent_at"].(time.Time)
+	prev.payloadHash, _ = existing["payload_hash"].(string)
+	return false, prev, nil
+}
+
+func (c cassandraIdempotency) takeOver(conversationID gocql.UUID, sender, key string, prev gocql.UUID, claim idempotencyClaim) (bool, error) {
+	return c.s.session.Query(
+		`UPDATE message_idempotency USING TTL ? SET message_id = ?, sent_at = ?, payload_hash = ? WHERE conversation_id = ? AND sender = ? AND idempotency_key = ? IF message_id = ?`,
+		c.ttl(), claim.messageID, claim.sentAt, claim.payloadHash, conversationID, sender, key, prev,
+	).MapScanCAS(make(map[string]interface{}))
+}
+
+func (c cassandraIdempotency) message(conversationID gocql.UUID, claim idempotencyClaim) (*storedMessage, error) {
+	return c.s.loadStoredMessage(conversationID, claim)
+}
+
+func (c cassandraIdempotency) ttl() int {
+	return int(c.s.idempotencyTTL / time.Second)
+}
+
+// releaseIdempotencyKey frees key after the request that claimed it failed
+// without storing its message, so the client's retry can go through.
+func (s *server) releaseIdempotencyKey(conversationID gocql.UUID, sender, key string, claim idempotencyClaim) {
+	if _, err := s.session.Query(
+		`DELETE FROM message_idempotency WHERE conversation_id = ? AND sender = ? AND idempotency_key = ? IF message_id = ?`,
+		conversationID, sender, key, claim.messageID,
+	).MapScanCAS(make(map[string]interface{})); err != nil {
+		slog.Warn("release idempotency key failed", "conversation_id", conversationID.String(), "email", sender, "err", err)
+	}
+}
+
+func (s *server) loadStoredMessage(conversationID gocql.UUID, claim idempotencyClaim) (*storedMessage, error) {
+	var (
+		msg      storedMessage
+		viewOnce *bool
+	)
+	if err := s.idempotentQuery(
+		`SELECT sender, body, view_once, attachment_url, attachment_type FROM messages WHERE conversation_id = ? AND sent_at = ? AND message_id = ?`,
+		conversationID, claim.sentAt, claim.messageID,
+	).Scan(&msg.sender, &msg.body, &viewOnce, &msg.attachmentURL, &msg.attachmentType); err != nil {
+		return nil, err
+	}
+	msg.viewOnce = viewOnce != nil && *viewOnce
+	return &msg, nil
+}
+
+// writeReplayedMessage answers a retried create with the message the first
+// request stored, in the same shape as a fresh create.
+func writeReplayedMessage(w http.ResponseWriter, conv *conversation, conversationID gocql.UUID, claim *idempotencyClaim, msg *storedMessage) {
+	text := msg.body
+	if msg.viewOnce {
+		text = viewOncePlaceholder
+	}
+	resp := map[string]interface{}{
+		"id":                claim.messageID.String(),
+		"conversation_id":   conversationID.String(),
+		"sender":            msg.sender,
+		"text":              text,
+		"sent_at":           claim.sentAt.UTC().Format(time.RFC3339),
+		"participants":      conv.Participants,
+		"conversation_name": conv.Name,
+	}
+	addAttachment(resp, msg.attachmentURL, msg.attachmentType, msg.viewOnce)
+	if msg.viewOnce {
+		resp["view_once"] = true
+	}
+	w.Header().Set(idempotentReplayHeader, "true")
+	writeJSON(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// memoryIdempotency is an in-memory idempotencyStore: claims by key and the
+// messages that have been stored.
+type memoryIdempotency struct {
+	claims   map[string]idempotencyClaim
+	messages map[gocql.UUID]*storedMessage
+}
+
+func newMemoryIdempotency() *memoryIdempotency {
+	return &memoryIdempotency{claims: map[string]idempotencyClaim{}, messages: map[gocql.UUID]*storedMessage{}}
+}
+
+func (m *memoryIdempotency) insert(_ gocql.UUID, sender, key string, claim idempotencyClaim) (bool, *idempotencyClaim, error) {
+	if prev, ok := m.claims[sender+"/"+key]; ok {
+		return false, &prev, nil
+	}
+	m.claims[sender+"/"+key] = claim
+	return true, nil, nil
+}
+
+func (m *memoryIdempotency) takeOver(_ gocql.UUID, sender, key string, prev gocql.UUID, claim idempotencyClaim) (bool, error) {
+	if m.claims[sender+"/"+key].messageID != prev {
+		return false, nil
+	}
+	m.claims[sender+"/"+key] = claim
+	return true, nil
+}
+
+func (m *memoryIdempotency) message(_ gocql.UUID, claim idempotencyClaim) (*storedMessage, error) {
+	if msg, ok := m.messages[claim.messageID]; ok {
+		return msg, nil
+	}
+	return nil, gocql.ErrNotFound
+}
+
+func newClaim(text string, sentAt time.Time) idempotencyClaim {
+	return idempotencyClaim{messageID: gocql.TimeUUID(), sentAt: sentAt, payloadHash: messagePayloadHash(text, false, "", "")}
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	store := newMemoryIdempotency()
+	conversationID := gocql.TimeUUID()
+	first := newClaim("hello", time.Now())
+
+	claimed, _, _, err := claimIdempotencyKey(store, conversationID, "alice@example.com", "k1", first)
+	if err != nil || !claimed {
+		t.Fatalf("first request: claimed %t, err %v", claimed, err)
+	}
+
+	// The retry arrives while the first request is still storing.
+	_, _, _, err = claimIdempotencyKey(store, conversationID, "alice@example.com", "k1", newClaim("hello", time.Now()))
+	if !errors.Is(err, errIdempotencyInProgress) {
+		t.Fatalf("retry during the first request: err = %v, want %v", err, errIdempotencyInProgress)
+	}
+
+	// Once stored, the retry gets the first message back.
+	store.messages[first.messageID] = &storedMessage{sender: "alice@example.com", body: "hello"}
+	claimed, prev, msg, err := claimIdempotencyKey(store, conversationID, "alice@example.com", "k1", newClaim("hello", time.Now()))
+	if err != nil || claimed {
+		t.Fatalf("replay: claimed %t, err %v", claimed, err)
+	}
+	if prev.messageID != first.messageID || msg.body != "hello" {
+		t.Fatalf("replayed %v %+v, want message %v", prev.messageID, msg, first.messageID)
+	}
+
+	// The same key with another message is refused, stored or not.
+	if _, _, _, err := claimIdempotencyKey(store, conversationID, "alice@example.com", "k1", newClaim("goodbye", time.Now())); !errors.Is(err, errIdempotencyKeyReused) {
+		t.Fatalf("different payload: err = %v, want %v", err, errIdempotencyKeyReused)
+	}
+
+	// Keys are per sender.
+	if claimed, _, _, err := claimIdempotencyKey(store, conversationID, "bob@example.com", "k1", newClaim("hello", time.Now())); err != nil || !claimed {
+		t.Fatalf("another sender: claimed %t, err %v", claimed, err)
+	}
+}
+
+func TestClaimIdempotencyKeyTakesOverStaleClaim(t *testing.T) {
+	store := newMemoryIdempotency()
+	conversationID := gocql.TimeUUID()
+	crashed := newClaim("hello", time.Now().Add(-2*idempotencyStaleAfter))
+	store.claims["alice@example.com/k1"] = crashed
+
+	retry := newClaim("hello", time.Now())
+	claimed, _, _, err := claimIdempotencyKey(store, conversationID, "alice@example.com", "k1", retry)
+	if err != nil || !claimed {
+		t.Fatalf("claimed %t, err %v, want the stale claim taken over", claimed, err)
+	}
+	if store.claims["alice@example.com/k1"].messageID != retry.messageID {
+		t.Fatal("the key still points at the crashed request's message")
+	}
+}
+
+func TestClaimIdempotencyKeyAcceptsLegacyClaims(t *testing.T) {
+	store := newMemoryIdempotency()
+	legacy := newClaim("hello", time.Now())
+	legacy.payloadHash = ""
+	store.claims["alice@example.com/k1"] = legacy
+	store.messages[legacy.messageID] = &storedMessage{body: "hello"}
+
+	claimed, prev, _, err := claimIdempotencyKey(store, gocql.TimeUUID(), "alice@example.com", "k1", newClaim("hello", time.Now()))
+	if err != nil || claimed || prev.messageID != legacy.messageID {
+		t.Fatalf("claimed %t, prev %v, err %v, want a replay of the legacy claim", claimed, prev, err)
+	}
+}
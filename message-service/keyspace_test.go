@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyspaceReplication(t *testing.T) {
+	if got, want := keyspaceReplication(3, nil), "{'class': 'SimpleStrategy', 'replication_factor': '3'}"; got != want {
+		t.Errorf("single DC = %s, want %s", got, want)
+	}
+	got := keyspaceReplication(1, map[string]int{"eu-west": 3, "dc1": 2})
+	if want := "{'class': 'NetworkTopologyStrategy', 'dc1': '2', 'eu-west': '3'}"; got != want {
+		t.Errorf("multi DC = %s, want %s", got, want)
+	}
+}
+
+func TestParseDCReplication(t *testing.T) {
+	var problems configProblems
+	got := parseDCReplication(" dc1:3, dc2 : 2 ,", &problems)
+	if len(problems) != 0 || len(got) != 2 || got["dc1"] != 3 || got["dc2"] != 2 {
+		t.Fatalf("parseDCReplication = %v, problems %v", got, problems)
+	}
+
+	tests := []struct {
+		raw, want string
+	}{
+		{"dc1", "datacenter:factor"},
+		{"dc1:0", "datacenter:factor"},
+		{"dc1:x", "datacenter:factor"},
+		{"dc'1:3", "invalid datacenter name"},
+		{"dc1:3,dc1:2", "twice"},
+		{",", "at least one"},
+	}
+	for _, tt := range tests {
+		var problems configProblems
+		parseDCReplication(tt.raw, &problems)
+		if err := problems.err(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: err = %v, want %q", tt.raw, err, tt.want)
+		}
+	}
+}
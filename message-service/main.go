@@ -6,21 +6,46 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gocql/gocql"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/codes"
+
+	"servicekit/logging"
+	"servicekit/readiness"
 )
 
 type server struct {
 	session     *gocql.Session
 	kafkaWriter *kafka.Writer
+	users       *userDirectory
+	limiter     *messageLimiter
+	// maxConversations is the most conversations a user can be in and
+	// still create another; 0 disables the check.
+	maxConversations int
+	idempotencyTTL   time.Duration
+	// retry is applied only to statements built with idempotentQuery.
+	retry gocql.RetryPolicy
+	// moderator is nil when moderation is off.
+	moderator *moderator
+}
+
+// idempotentQuery builds a statement that is safe to run more than once and
+// so may be retried after a timeout: a read, or a plain write of fixed
+// values. Lightweight transactions, counter updates and anything else whose
+// second run would differ from the first must use s.session.Query, which
+// is never retried.
+func (s *server) idempotentQuery(stmt string, values ...interface{}) *gocql.Query {
+	return s.session.Query(stmt, values...).Idempotent(true).RetryPolicy(s.retry)
 }
 
 type conversation struct {
@@ -33,6 +58,9 @@ type conversation struct {
 	LastMessage    string
 	LastMessageAt  time.Time
 	LastSender     string
+	AvatarUpdated  time.Time
+	Archived       bool
+	Pinned         bool
 }
 
 type message struct {
@@ -43,30 +71,87 @@ type message struct {
 	CreatedAt time.Time
 }
 
+// messageEvent is published to Kafka for every stored message, membership
+// change, read, reaction and rename. Type is empty for messages (consumers
+// that predate it treat every event as a message) and eventTypeMembership,
+// eventTypeRead, eventTypeReaction or eventTypeRename otherwise.
 type messageEvent struct {
+	Type string `json:"type,omitempty"`
+	// EventID, when set, replaces MessageID in the event_id header for
+	// events that are about a message but are not the message itself.
+	EventID          string   `json:"-"`
+	MessageID        string   `json:"message_id"`
 	ConversationID   string   `json:"conversation_id"`
 	ConversationName string   `json:"conversation_name"`
 	Sender           string   `json:"sender"`
 	Text             string   `json:"text"`
 	SentAt           string   `json:"sent_at"`
 	Participants     []string `json:"participants"`
+	ViewOnce         bool     `json:"view_once,omitempty"`
+	// AttachmentURL and AttachmentType are set on messages that carry an
+	// attachment; Text may then be empty.
+	AttachmentURL  string `json:"attachment_url,omitempty"`
+	AttachmentType string `json:"attachment_type,omitempty"`
+	// UserEmail and ReadCount describe an eventTypeRead: who read the
+	// conversation and how many of its messages they have now seen.
+	UserEmail string `json:"user_email,omitempty"`
+	ReadCount int64  `json:"read_count,omitempty"`
+	// ReactionAction ("added" or "removed") and Reactions describe an
+	// eventTypeReaction: Sender reacted with Text to MessageID, which now
+	// has Reactions.
+	ReactionAction string            `json:"reaction_action,omitempty"`
+	Reactions      []reactionSummary `json:"reactions,omitempty"`
 }
 
 func main() {
-	hostsEnv := strings.TrimSpace(os.Getenv("CASSANDRA_HOSTS"))
-	if hostsEnv == "" {
-		hostsEnv = "cassandra"
+	logging.Setup("message-service")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-	hosts := strings.Split(hostsEnv, ",")
-	for i := range hosts {
-		hosts[i] = strings.TrimSpace(hosts[i])
+	cfg.logSummary()
+	shutdownTracing, err := setupTracing(context.Background(), "message-service")
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
 	}
+	defer shutdownTracing(context.Background())
+	hosts := cfg.cassandraHosts
+	keyspace := cfg.keyspace
+	listenAddr := cfg.listenAddr
 
-	keyspace := strings.TrimSpace(os.Getenv("CASSANDRA_KEYSPACE"))
-	if keyspace == "" {
-		keyspace = "chat_data"
+	// Bind the listener right away so /readyz can report "migrating", but
+	// gate every other route until the schema is confirmed.
+	srv := &server{
+		users:            newUserDirectory(cfg.registrationURL, cfg.internalAPIToken),
+		limiter:          newMessageLimiter(cfg.rateLimit, cfg.rateWindow),
+		maxConversations: cfg.maxConversations,
+		idempotencyTTL:   cfg.idempotencyTTL,
+		moderator:        newModerator(cfg.moderationURL, cfg.moderationSecret, cfg.moderationBannedWords, cfg.moderationTimeout),
 	}
-	if err := ensureKeyspace(hosts, keyspace); err != nil {
+	go srv.limiter.pruneLoop(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", srv.handleHealth)
+	mux.HandleFunc("/conversations", srv.handleConversations)
+	mux.HandleFunc("/conversations/", srv.handleConversationResource)
+	mux.HandleFunc("/messages/sync", srv.handleMessagesSync)
+	mux.HandleFunc("/users/", srv.handleUserResource)
+
+	ready := &readiness.Gate{Liveness: "/healthz"}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("message-service listening", "addr", listenAddr)
+		// Spans are named by route pattern, not raw path, to keep ids out of
+		// span names.
+		traced := otelhttp.NewHandler(logRequest(ready.Wrap(mux)), "message-service",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				_, pattern := mux.Handler(r)
+				return r.Method + " " + pattern
+			}),
+		)
+		serveErr <- http.ListenAndServe(listenAddr, traced)
+	}()
+
+	if err := ensureKeyspace(hosts, keyspace, keyspaceReplication(cfg.replicationFactor, cfg.dcReplication)); err != nil {
 		log.Fatalf("unable to ensure keyspace: %v", err)
 	}
 
@@ -74,7 +159,15 @@ func main() {
 	cluster.Timeout = 10 * time.Second
 	cluster.ConnectTimeout = 10 * time.Second
 	cluster.Keyspace = keyspace
-	cluster.Consistency = gocql.Quorum
+	cluster.Consistency = cfg.consistency
+	// No cluster-wide retry policy: gocql would retry every statement,
+	// including lightweight transactions and counter updates, which must not
+	// run twice. Idempotent statements opt in through idempotentQuery.
+	srv.retry = &gocql.ExponentialBackoffRetryPolicy{
+		NumRetries: cfg.queryRetries,
+		Min:        100 * time.Millisecond,
+		Max:        2 * time.Second,
+	}
 
 	session, err := cluster.CreateSession()
 	if err != nil {
@@ -86,39 +179,26 @@ func main() {
 		log.Fatalf("unable to ensure schema: %v", err)
 	}
 
-	kafkaURL := strings.TrimSpace(os.Getenv("KAFKA_URL"))
-	if kafkaURL == "" {
-		kafkaURL = "kafka:9092"
-	}
-	messageTopic := strings.TrimSpace(os.Getenv("MESSAGE_EVENTS_TOPIC"))
-	if messageTopic == "" {
-		messageTopic = "chat-messages"
-	}
-	kafkaWriter := newMessageWriter(kafkaURL, messageTopic)
+	kafkaWriter := newMessageWriter(cfg.kafkaURL, cfg.messageTopic)
 	defer kafkaWriter.Close()
 
-	srv := &server{
-		session:     session,
-		kafkaWriter: kafkaWriter,
-	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", srv.handleHealth)
-	mux.HandleFunc("/conversations", srv.handleConversations)
-	mux.HandleFunc("/conversations/", srv.handleConversationResource)
+	srv.session = session
+	srv.kafkaWriter = kafkaWriter
+	ready.MarkReady()
+	log.Printf("message-service schema ready")
 
-	port := strings.TrimSpace(os.Getenv("SERVICE_PORT"))
-	if port == "" {
-		port = "8084"
+	if cfg.reconcileInterval > 0 {
+		go srv.reconcileCountersLoop(context.Background(), cfg.reconcileInterval)
 	}
 
-	log.Printf("message-service listening on :%s", port)
-	if err := http.ListenAndServe(":"+port, logRequest(mux)); err != nil {
+	if err := <-serveErr; err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
 
-func ensureKeyspace(hosts []string, keyspace string) error {
+// ensureKeyspace creates the keyspace with the given replication map if it
+// does not exist yet. An existing keyspace keeps its replication settings.
+func ensureKeyspace(hosts []string, keyspace, replication string) error {
 	cluster := gocql.NewCluster(hosts...)
 	cluster.Timeout = 10 * time.Second
 	cluster.ConnectTimeout = 10 * time.Second
@@ -129,10 +209,32 @@ func ensureKeyspace(hosts []string, keyspace string) error {
 	}
 	defer session.Close()
 
-	cql := fmt.Sprintf(`CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'}`, keyspace)
+	cql := fmt.Sprintf(`CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s`, keyspace, replication)
 	return session.Query(cql).Exec()
 }
 
+// keyspaceReplication returns the CQL replication map for a new keyspace:
+// NetworkTopologyStrategy with perDC's factors when any are given, and
+// SimpleStrategy with factor otherwise. Datacenters are sorted so the
+// statement is stable.
+func keyspaceReplication(factor int, perDC map[string]int) string {
+	if len(perDC) == 0 {
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': '%d'}", factor)
+	}
+	dcs := make([]string, 0, len(perDC))
+	for dc := range perDC {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+	var b strings.Builder
+	b.WriteString("{'class': 'NetworkTopologyStrategy'")
+	for _, dc := range dcs {
+		fmt.Fprintf(&b, ", '%s': '%d'", dc, perDC[dc])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
 func ensureSchema(session *gocql.Session) error {
 	statements := []string{
 		`CREATE TABLE IF NOT EXISTS conversations (
@@ -172,6 +274,50 @@ func ensureSchema(session *gocql.Session) error {
 			last_read_at timestamp,
 			PRIMARY KEY (user_email, conversation_id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS conversation_reads_by_conversation (
+			conversation_id uuid,
+			user_email text,
+			read_count bigint,
+			last_read_at timestamp,
+			PRIMARY KEY ((conversation_id), user_email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS view_once_views (
+			conversation_id uuid,
+			message_id uuid,
+			user_email text,
+			viewed_at timestamp,
+			PRIMARY KEY ((conversation_id), message_id, user_email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_idempotency (
+			conversation_id uuid,
+			sender text,
+			idempotency_key text,
+			message_id uuid,
+			sent_at timestamp,
+			payload_hash text,
+			PRIMARY KEY ((conversation_id), sender, idempotency_key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS conversation_deliveries (
+			conversation_id uuid,
+			message_id uuid,
+			user_email text,
+			delivered_at timestamp,
+			PRIMARY KEY ((conversation_id), message_id, user_email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_reactions (
+			conversation_id uuid,
+			message_id uuid,
+			emoji text,
+			user_email text,
+			reacted_at timestamp,
+			PRIMARY KEY ((conversation_id), message_id, emoji, user_email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS conversations_by_creator (
+			created_by text,
+			conversation_id uuid,
+			created_at timestamp,
+			PRIMARY KEY (created_by, conversation_id)
+		)`,
 	}
 
 	for _, stmt := range statements {
@@ -187,6 +333,14 @@ func ensureSchema(session *gocql.Session) error {
 		`ALTER TABLE conversations_by_user ADD last_message text`,
 		`ALTER TABLE conversations_by_user ADD last_message_at timestamp`,
 		`ALTER TABLE conversations_by_user ADD last_sender text`,
+		`ALTER TABLE conversations ADD avatar_updated_at timestamp`,
+		`ALTER TABLE conversations_by_user ADD avatar_updated_at timestamp`,
+		`ALTER TABLE conversations_by_user ADD archived boolean`,
+		`ALTER TABLE conversations_by_user ADD pinned boolean`,
+		`ALTER TABLE messages ADD view_once boolean`,
+		`ALTER TABLE messages ADD attachment_url text`,
+		`ALTER TABLE messages ADD attachment_type text`,
+		`ALTER TABLE message_idempotency ADD payload_hash text`,
 	}
 	for _, stmt := range alterStatements {
 		if err := session.Query(stmt).Exec(); err != nil {
@@ -198,11 +352,32 @@ func ensureSchema(session *gocql.Session) error {
 	return nil
 }
 
+// eventTypeMembership marks an event announcing a conversation's new
+// participant set, so caches can invalidate and clients can refresh.
+const eventTypeMembership = "membership"
+
+// eventTypeRead marks an event announcing that a participant has read a
+// conversation up to ReadCount messages.
+const eventTypeRead = "read"
+
+// eventTypeRename marks an event announcing that Sender renamed a
+// conversation to ConversationName.
+const eventTypeRename = "rename"
+
+// maxConversationNameLength caps a conversation name, in characters.
+const maxConversationNameLength = 100
+
+// eventIDHeader carries the message id on every event so consumers can drop
+// redeliveries.
+const eventIDHeader = "event_id"
+
 func newMessageWriter(broker, topic string) *kafka.Writer {
+	// Events are keyed by conversation id; hashing the key keeps each
+	// conversation on one partition so consumers see its messages in order.
 	return kafka.NewWriter(kafka.WriterConfig{
 		Brokers:  []string{broker},
 		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
+		Balancer: &kafka.Hash{},
 	})
 }
 
@@ -244,6 +419,8 @@ func (s *server) handleConversationResource(w http.ResponseWriter, r *http.Reque
 		switch r.Method {
 		case http.MethodGet:
 			s.getConversation(w, r, conversationID)
+		case http.MethodPatch:
+			s.renameConversation(w, r, conversationID)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -262,6 +439,16 @@ func (s *server) handleConversationResource(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if len(parts) == 4 && parts[1] == "messages" && parts[3] == "reactions" {
+		s.handleMessageReactions(w, r, conversationID, parts[2])
+		return
+	}
+
+	if len(parts) == 4 && parts[1] == "messages" && parts[3] == "delivered" {
+		s.handleMessageDelivered(w, r, conversationID, parts[2])
+		return
+	}
+
 	if len(parts) == 2 && parts[1] == "read" {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -271,6 +458,60 @@ func (s *server) handleConversationResource(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if len(parts) == 2 && parts[1] == "unread" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleConversationUnread(w, r, conversationID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "receipts" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.listReadReceipts(w, r, conversationID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "archive" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleConversationArchive(w, r, conversationID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "pin" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleConversationPin(w, r, conversationID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "recount" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleConversationRecount(w, r, conversationID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "avatar" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleConversationAvatar(w, r, conversationID)
+		return
+	}
+
 	http.NotFound(w, r)
 }
 
@@ -280,8 +521,9 @@ func (s *server) listConversations(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "user query param required", http.StatusBadRequest)
 		return
 	}
+	includeArchived, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("include_archived")))
 
-	iter := s.session.Query(`SELECT conversation_id, name, participants, last_activity_at, last_message, last_message_at, last_sender FROM conversations_by_user WHERE user_email = ?`, user).Iter()
+	iter := s.idempotentQuery(`SELECT conversation_id, name, participants, last_activity_at, last_message, last_message_at, last_sender, avatar_updated_at, archived, pinned FROM conversations_by_user WHERE user_email = ?`, user).Iter()
 	var (
 		id            gocql.UUID
 		name          string
@@ -290,11 +532,17 @@ func (s *server) listConversations(w http.ResponseWriter, r *http.Request) {
 		lastMessage   string
 		lastMessageAt time.Time
 		lastSender    string
+		avatarUpdated time.Time
+		archived      bool
+		pinned        bool
 	)
 
 	conversations := make([]conversation, 0, 16)
 
-	for iter.Scan(&id, &name, &participants, &lastActivity, &lastMessage, &lastMessageAt, &lastSender) {
+	for iter.Scan(&id, &name, &participants, &lastActivity, &lastMessage, &lastMessageAt, &lastSender, &avatarUpdated, &archived, &pinned) {
+		if archived && !includeArchived {
+			continue
+		}
 		conversations = append(conversations, conversation{
 			ID:             id,
 			Name:           name,
@@ -303,6 +551,9 @@ func (s *server) listConversations(w http.ResponseWriter, r *http.Request) {
 			LastMessage:    lastMessage,
 			LastMessageAt:  lastMessageAt,
 			LastSender:     lastSender,
+			AvatarUpdated:  avatarUpdated,
+			Archived:       archived,
+			Pinned:         pinned,
 		})
 	}
 	if err := iter.Close(); err != nil {
@@ -310,30 +561,100 @@ func (s *server) listConversations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The caller's pinned conversations come first; each group is newest
+	// first.
 	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].Pinned != conversations[j].Pinned {
+			return conversations[i].Pinned
+		}
 		return conversations[i].LastActivityAt.After(conversations[j].LastActivityAt)
 	})
 
 	resp := make([]map[string]interface{}, 0, len(conversations))
-	for _, c := range conversations {
-		isGroup := isGroupConversation(c.Name, c.Participants)
-		unread := s.calculateUnread(user, c.ID)
-		resp = append(resp, map[string]interface{}{
-			"id":               c.ID.String(),
-			"name":             c.Name,
-			"participants":     c.Participants,
-			"last_activity_at": c.LastActivityAt.UTC().Format(time.RFC3339),
-			"is_group":         isGroup,
-			"last_message":     strings.TrimSpace(c.LastMessage),
-			"last_message_at":  formatTime(c.LastMessageAt),
-			"last_sender":      c.LastSender,
-			"unread_count":     unread,
-		})
+	for i := range conversations {
+		c := &conversations[i]
+		item := conversationFields(c)
+		item["last_message"] = strings.TrimSpace(c.LastMessage)
+		item["last_message_at"] = formatTime(c.LastMessageAt)
+		item["last_sender"] = c.LastSender
+		item["unread_count"] = s.calculateUnread(user, c.ID, c.LastMessageAt, c.LastSender)
+		item["archived"] = c.Archived
+		item["pinned"] = c.Pinned
+		resp = append(resp, item)
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{"conversations": resp})
 }
 
+func (s *server) handleUserResource(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/users/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		http.NotFound(w, r)
+		return
+	}
+	user := strings.TrimSpace(parts[0])
+
+	switch parts[1] {
+	case "summary":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.userSummary(w, r, user)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// summaryMaxConversations bounds how many conversations a summary request
+// will inspect, since each one costs two counter reads.
+const summaryMaxConversations = 500
+
+// userSummary returns badge data for a user's home screen: conversation
+// count, total unread messages, and the latest activity time.
+func (s *server) userSummary(w http.ResponseWriter, r *http.Request, user string) {
+	iter := s.idempotentQuery(
+		`SELECT conversation_id, last_activity_at, last_message_at, last_sender FROM conversations_by_user WHERE user_email = ? LIMIT ?`,
+		user, summaryMaxConversations+1,
+	).Iter()
+
+	var (
+		id            gocql.UUID
+		lastActivity  time.Time
+		lastMessageAt time.Time
+		lastSender    string
+		latest        time.Time
+		total         int
+		unread        int64
+		truncated     bool
+	)
+	for iter.Scan(&id, &lastActivity, &lastMessageAt, &lastSender) {
+		if total == summaryMaxConversations {
+			truncated = true
+			continue
+		}
+		total++
+		unread += int64(s.calculateUnread(user, id, lastMessageAt, lastSender))
+		if lastActivity.After(latest) {
+			latest = lastActivity
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("user summary for %s error: %v", user, err)
+		http.Error(w, "unable to load summary", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":                user,
+		"total_conversations": total,
+		"total_unread":        unread,
+		"last_activity_at":    formatTime(latest),
+		"truncated":           truncated,
+	})
+}
+
 func (s *server) createConversation(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Name         string   `json:"name"`
@@ -359,6 +680,34 @@ func (s *server) createConversation(w http.ResponseWriter, r *http.Request) {
 		participants = append(participants, payload.CreatedBy)
 	}
 
+	reached, err := conversationLimitReached(s.maxConversations, payload.CreatedBy, s.conversationsCreated)
+	if err != nil {
+		http.Error(w, "unable to check conversation limit", http.StatusInternalServerError)
+		return
+	}
+	if reached {
+		http.Error(w, fmt.Sprintf("conversation limit of %d reached", s.maxConversations), http.StatusTooManyRequests)
+		return
+	}
+
+	if s.users != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		unknown, err := s.users.unknown(ctx, participants)
+		cancel()
+		if err != nil {
+			log.Printf("verify participants error: %v", err)
+			http.Error(w, "unable to verify participants", http.StatusBadGateway)
+			return
+		}
+		if len(unknown) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":                "unknown participants",
+				"unknown_participants": unknown,
+			})
+			return
+		}
+	}
+
 	now := time.Now().UTC()
 	conversationID := gocql.TimeUUID()
 	name := strings.TrimSpace(payload.Name)
@@ -371,16 +720,23 @@ func (s *server) createConversation(w http.ResponseWriter, r *http.Request) {
 		setParticipants[p] = struct{}{}
 	}
 
-	if err := s.session.Query(
+	if err := s.idempotentQuery(
 		`INSERT INTO conversations (conversation_id, name, participants, created_at, created_by, last_activity_at) VALUES (?, ?, ?, ?, ?, ?)`,
 		conversationID, name, setParticipants, now, payload.CreatedBy, now,
 	).Exec(); err != nil {
 		http.Error(w, "unable to create conversation", http.StatusInternalServerError)
 		return
 	}
+	if err := s.idempotentQuery(
+		`INSERT INTO conversations_by_creator (created_by, conversation_id, created_at) VALUES (?, ?, ?)`,
+		strings.ToLower(payload.CreatedBy), conversationID, now,
+	).Exec(); err != nil {
+		http.Error(w, "unable to create conversation", http.StatusInternalServerError)
+		return
+	}
 
 	for _, participant := range participants {
-		if err := s.session.Query(
+		if err := s.idempotentQuery(
 			`INSERT INTO conversations_by_user (user_email, conversation_id, name, participants, last_activity_at) VALUES (?, ?, ?, ?, ?)`,
 			participant, conversationID, name, setParticipants, now,
 		).Exec(); err != nil {
@@ -397,23 +753,12 @@ func (s *server) createConversation(w http.ResponseWriter, r *http.Request) {
 		"created_at":       now.Format(time.RFC3339),
 		"last_activity_at": now.Format(time.RFC3339),
 	}
+	s.publishMembershipEvent(r.Context(), conversationID, name, participants, now)
 	writeJSON(w, http.StatusCreated, resp)
 }
 
 func (s *server) getConversation(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
-	var (
-		name         string
-		participants []string
-		createdAt    time.Time
-		createdBy    string
-		lastActivity time.Time
-	)
-
-	err := s.session.Query(
-		`SELECT name, participants, created_at, created_by, last_activity_at FROM conversations WHERE conversation_id = ?`,
-		id,
-	).Consistency(gocql.Quorum).Scan(&name, &participants, &createdAt, &createdBy, &lastActivity)
-
+	conv, err := s.loadConversation(id)
 	if errors.Is(err, gocql.ErrNotFound) {
 		http.Error(w, "conversation not found", http.StatusNotFound)
 		return
@@ -424,70 +769,54 @@ func (s *server) getConversation(w http.ResponseWriter, r *http.Request, id gocq
 		return
 	}
 
-	sortedParticipants := copyAndSort(participants)
-	resp := map[string]interface{}{
-		"id":               id.String(),
-		"name":             name,
-		"participants":     sortedParticipants,
-		"created_by":       createdBy,
-		"created_at":       createdAt.UTC().Format(time.RFC3339),
-		"last_activity_at": lastActivity.UTC().Format(time.RFC3339),
-		"is_group":         isGroupConversation(name, sortedParticipants),
-	}
+	resp := conversationFields(conv)
+	resp["created_by"] = conv.CreatedBy
+	resp["created_at"] = conv.CreatedAt.UTC().Format(time.RFC3339)
 
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func (s *server) listMessages(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
-	limit := 200
-	if limitParam := strings.TrimSpace(r.URL.Query().Get("limit")); limitParam != "" {
-		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 && parsed <= 1000 {
-			limit = parsed
-		}
+// handleConversationArchive sets the caller's archived flag for a
+// conversation. Archiving is per-user UI state: it only touches the caller's
+// conversations_by_user row and publishes no event.
+func (s *server) handleConversationArchive(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	var payload struct {
+		User     string `json:"user"`
+		Archived bool   `json:"archived"`
 	}
-	reader := strings.TrimSpace(r.URL.Query().Get("reader"))
-
-	iter := s.session.Query(
-		`SELECT sent_at, message_id, sender, body FROM messages WHERE conversation_id = ? LIMIT ?`,
-		id, limit,
-	).Iter()
-
-	var (
-		sentAt    time.Time
-		messageID gocql.UUID
-		sender    string
-		body      string
-	)
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
 
-	messages := make([]map[string]interface{}, 0, limit)
-	for iter.Scan(&sentAt, &messageID, &sender, &body) {
-		messages = append(messages, map[string]interface{}{
-			"id":      messageID.String(),
-			"sender":  sender,
-			"text":    body,
-			"sent_at": sentAt.UTC().Format(time.RFC3339),
-		})
+	payload.User = strings.TrimSpace(payload.User)
+	if payload.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
 	}
-	if err := iter.Close(); err != nil {
-		http.Error(w, "unable to load messages", http.StatusInternalServerError)
+	if !s.userInConversation(payload.User, id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"conversation_id": id.String(),
-		"messages":        messages,
-	})
-
-	if reader != "" {
-		if err := s.markConversationRead(reader, id, -1); err != nil {
-			log.Printf("mark conversation read for %s/%s failed: %v", reader, id, err)
-		}
+	if err := s.idempotentQuery(
+		`UPDATE conversations_by_user SET archived = ? WHERE user_email = ? AND conversation_id = ?`,
+		payload.Archived, payload.User, id,
+	).Exec(); err != nil {
+		log.Printf("archive conversation %s for %s error: %v", id, payload.User, err)
+		http.Error(w, "unable to update conversation", http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *server) handleConversationRead(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+// handleConversationPin sets the caller's pinned flag for a conversation.
+// Like archiving it is per-user: only the caller's conversations_by_user row
+// changes, so other participants' ordering is unaffected.
+func (s *server) handleConversationPin(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
 	var payload struct {
-		User string `json:"user"`
+		User   string `json:"user"`
+		Pinned bool   `json:"pinned"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid json payload", http.StatusBadRequest)
@@ -504,18 +833,24 @@ func (s *server) handleConversationRead(w http.ResponseWriter, r *http.Request,
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	if err := s.markConversationRead(payload.User, id, -1); err != nil {
-		log.Printf("mark conversation read error: %v", err)
-		http.Error(w, "unable to mark conversation read", http.StatusInternalServerError)
+	if err := s.idempotentQuery(
+		`UPDATE conversations_by_user SET pinned = ? WHERE user_email = ? AND conversation_id = ?`,
+		payload.Pinned, payload.User, id,
+	).Exec(); err != nil {
+		slog.Error("pin conversation failed", "conversation_id", id.String(), "email", payload.User, "err", err)
+		http.Error(w, "unable to update conversation", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *server) createMessage(w http.ResponseWriter, r *http.Request, conversationID gocql.UUID) {
+// renameConversation sets a conversation's name for every participant.
+// Any participant may rename; the new name is announced as an
+// eventTypeRename so open clients update their headers.
+func (s *server) renameConversation(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
 	var payload struct {
-		Sender string `json:"sender"`
-		Text   string `json:"text"`
+		User string `json:"user"`
+		Name string `json:"name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid json payload", http.StatusBadRequest)
@@ -523,103 +858,634 @@ func (s *server) createMessage(w http.ResponseWriter, r *http.Request, conversat
 	}
 	defer r.Body.Close()
 
-	payload.Sender = strings.TrimSpace(payload.Sender)
-	payload.Text = strings.TrimSpace(payload.Text)
-
-	if payload.Sender == "" || payload.Text == "" {
-		http.Error(w, "sender and text are required", http.StatusBadRequest)
+	payload.User = strings.TrimSpace(payload.User)
+	if payload.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(payload.Name)
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(name) > maxConversationNameLength {
+		http.Error(w, fmt.Sprintf("name must be at most %d characters", maxConversationNameLength), http.StatusBadRequest)
 		return
 	}
 
-	conv, err := s.loadConversation(conversationID)
+	conv, err := s.loadConversation(id)
+	if errors.Is(err, gocql.ErrNotFound) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		if errors.Is(err, gocql.ErrNotFound) {
-			http.Error(w, "conversation not found", http.StatusNotFound)
-		} else {
-			log.Printf("create message load conversation %s error: %v", conversationID, err)
-			http.Error(w, "unable to load conversation", http.StatusInternalServerError)
-		}
+		slog.Error("load conversation for rename failed", "conversation_id", id.String(), "err", err)
+		http.Error(w, "unable to load conversation", http.StatusInternalServerError)
 		return
 	}
-	if !contains(conv.Participants, payload.Sender) {
-		http.Error(w, "sender not in conversation", http.StatusForbidden)
+	if !contains(conv.Participants, payload.User) {
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
-	now := time.Now().UTC()
-	messageID := gocql.TimeUUID()
-
-	if err := s.session.Query(
-		`INSERT INTO messages (conversation_id, sent_at, message_id, sender, body) VALUES (?, ?, ?, ?, ?)`,
-		conversationID, now, messageID, payload.Sender, payload.Text,
+	if err := s.idempotentQuery(
+		`UPDATE conversations SET name = ? WHERE conversation_id = ?`,
+		name, id,
 	).Exec(); err != nil {
-		log.Printf("store message insert error for conversation %s: %v", conversationID, err)
-		http.Error(w, "unable to store message", http.StatusInternalServerError)
+		slog.Error("rename conversation failed", "conversation_id", id.String(), "err", err)
+		http.Error(w, "unable to update conversation", http.StatusInternalServerError)
 		return
 	}
-
-	// update denormalized tables with latest activity
-	setParticipants := make(map[string]struct{}, len(conv.Participants))
 	for _, participant := range conv.Participants {
-		setParticipants[participant] = struct{}{}
-		if err := s.session.Query(
-			`UPDATE conversations_by_user SET last_activity_at = ?, last_message = ?, last_message_at = ?, last_sender = ? WHERE user_email = ? AND conversation_id = ?`,
-			now, payload.Text, now, payload.Sender, participant, conversationID,
+		if err := s.idempotentQuery(
+			`UPDATE conversations_by_user SET name = ? WHERE user_email = ? AND conversation_id = ?`,
+			name, participant, id,
 		).Exec(); err != nil {
-			log.Printf("warn: update conversations_by_user for %s failed: %v", participant, err)
+			slog.Warn("rename conversations_by_user failed", "conversation_id", id.String(), "email", participant, "err", err)
 		}
 	}
-	if err := s.session.Query(
-		`UPDATE conversations SET last_activity_at = ?, last_message = ?, last_message_at = ?, last_sender = ? WHERE conversation_id = ?`,
-		now, payload.Text, now, payload.Sender, conversationID,
-	).Exec(); err != nil {
-		log.Printf("warn: update conversations last_activity failed: %v", err)
+	conv.Name = name
+
+	now := time.Now().UTC()
+	s.publishMessageEvent(r.Context(), &messageEvent{
+		Type:             eventTypeRename,
+		MessageID:        fmt.Sprintf("rename:%s:%d", id, now.UnixNano()),
+		ConversationID:   id.String(),
+		ConversationName: name,
+		Sender:           payload.User,
+		SentAt:           now.Format(time.RFC3339),
+		Participants:     conv.Participants,
+	})
+
+	resp := conversationFields(conv)
+	resp["created_by"] = conv.CreatedBy
+	resp["created_at"] = conv.CreatedAt.UTC().Format(time.RFC3339)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleConversationAvatar records that the conversation photo (stored by
+// registration-api) changed, so conversation payloads can report has_avatar
+// without reaching into another service's database.
+func (s *server) handleConversationAvatar(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	var payload struct {
+		HasAvatar bool `json:"has_avatar"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	conv, err := s.loadConversation(id)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "conversation not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "unable to load conversation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// A null timestamp means no avatar.
+	var updatedAt interface{}
+	if payload.HasAvatar {
+		updatedAt = time.Now().UTC()
+	}
+
+	if err := s.idempotentQuery(
+		`UPDATE conversations SET avatar_updated_at = ? WHERE conversation_id = ?`,
+		updatedAt, id,
+	).Exec(); err != nil {
+		log.Printf("update conversation avatar %s error: %v", id, err)
+		http.Error(w, "unable to update conversation", http.StatusInternalServerError)
+		return
+	}
+	for _, participant := range conv.Participants {
+		if err := s.idempotentQuery(
+			`UPDATE conversations_by_user SET avatar_updated_at = ? WHERE user_email = ? AND conversation_id = ?`,
+			updatedAt, participant, id,
+		).Exec(); err != nil {
+			log.Printf("warn: update conversations_by_user avatar for %s failed: %v", participant, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messagePage reads the limit and tail query parameters shared by the
+// message listing and the receipts that go with it. tail=true selects the
+// most recent messages instead of the oldest.
+func messagePage(r *http.Request) (int, bool) {
+	limit := 200
+	if limitParam := strings.TrimSpace(r.URL.Query().Get("limit")); limitParam != "" {
+		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 && parsed <= 1000 {
+			limit = parsed
+		}
+	}
+	tail, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("tail")))
+	return limit, tail
+}
+
+func (s *server) listMessages(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	// The response is oldest first whether or not tail is set.
+	limit, tail := messagePage(r)
+	reader := strings.TrimSpace(r.URL.Query().Get("reader"))
+
+	stmt := `SELECT sent_at, message_id, sender, body, view_once, attachment_url, attachment_type FROM messages WHERE conversation_id = ? LIMIT ?`
+	if tail {
+		stmt = `SELECT sent_at, message_id, sender, body, view_once, attachment_url, attachment_type FROM messages WHERE conversation_id = ? ORDER BY sent_at DESC, message_id DESC LIMIT ?`
+	}
+	iter := s.idempotentQuery(stmt, id, limit).Iter()
+
+	var (
+		sentAt         time.Time
+		messageID      gocql.UUID
+		sender         string
+		body           string
+		viewOnce       bool
+		attachmentURL  string
+		attachmentType string
+	)
+
+	type viewOnceRow struct {
+		item          map[string]interface{}
+		messageID     gocql.UUID
+		sender        string
+		body          string
+		attachmentURL string
+	}
+	var viewOnceRows []viewOnceRow
+	itemsByID := make(map[gocql.UUID]map[string]interface{}, limit)
+	pageIDs := make([]gocql.UUID, 0, limit)
+
+	messages := make([]map[string]interface{}, 0, limit)
+	for iter.Scan(&sentAt, &messageID, &sender, &body, &viewOnce, &attachmentURL, &attachmentType) {
+		item := map[string]interface{}{
+			"id":      messageID.String(),
+			"sender":  sender,
+			"text":    body,
+			"sent_at": sentAt.UTC().Format(time.RFC3339),
+		}
+		addAttachment(item, attachmentURL, attachmentType, viewOnce)
+		if viewOnce {
+			item["view_once"] = true
+			item["text"] = viewOncePlaceholder
+			viewOnceRows = append(viewOnceRows, viewOnceRow{item: item, messageID: messageID, sender: sender, body: body, attachmentURL: attachmentURL})
+		}
+		itemsByID[messageID] = item
+		pageIDs = append(pageIDs, messageID)
+		messages = append(messages, item)
+	}
+	if err := iter.Close(); err != nil {
+		http.Error(w, "unable to load messages", http.StatusInternalServerError)
+		return
+	}
+
+	if len(messages) > 0 {
+		reactions, err := s.conversationReactions(id, pageIDs)
+		if err != nil {
+			slog.Error("list reactions failed", "conversation_id", id.String(), "err", err)
+			http.Error(w, "unable to load messages", http.StatusInternalServerError)
+			return
+		}
+		for messageID, summary := range reactions {
+			if item, ok := itemsByID[messageID]; ok {
+				item["reactions"] = summary
+			}
+		}
+	}
+	if tail {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	if len(viewOnceRows) > 0 {
+		conv, err := s.loadConversation(id)
+		if err != nil {
+			log.Printf("list messages load conversation %s error: %v", id, err)
+			http.Error(w, "unable to load messages", http.StatusInternalServerError)
+			return
+		}
+		openers, err := s.viewOnceOpeners(id)
+		if err != nil {
+			log.Printf("list view-once openers %s error: %v", id, err)
+			http.Error(w, "unable to load messages", http.StatusInternalServerError)
+			return
+		}
+		for _, row := range viewOnceRows {
+			text, opened := s.viewOnceText(r.Context(), conv, row.messageID, row.sender, row.body, reader, openers[row.messageID])
+			row.item["text"] = text
+			if opened && row.attachmentURL != "" {
+				row.item["attachment_url"] = row.attachmentURL
+			}
+			if strings.EqualFold(reader, row.sender) {
+				row.item["opened_by"] = append([]string{}, openers[row.messageID]...)
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation_id": id.String(),
+		"messages":        messages,
+	})
+
+	if reader != "" {
+		readCount, err := s.markConversationRead(reader, id, -1)
+		if err != nil {
+			log.Printf("mark conversation read for %s/%s failed: %v", reader, id, err)
+		} else {
+			s.publishReadEvent(r.Context(), id, reader, readCount)
+		}
+	}
+}
+
+const (
+	syncMaxConversations   = 100
+	syncPerConversationMax = 100
+	syncTotalMax           = 1000
+)
+
+// handleMessagesSync returns messages newer than a per-conversation cursor for
+// many conversations at once, so a client coming online can catch up in one
+// request. Each conversation is bounded, as is the total across the response;
+// the returned cursor is what the client should send next time.
+func (s *server) handleMessagesSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		User    string            `json:"user"`
+		Cursors map[string]string `json:"cursors"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	payload.User = strings.TrimSpace(payload.User)
+	if payload.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Cursors) > syncMaxConversations {
+		http.Error(w, fmt.Sprintf("at most %d conversations per sync", syncMaxConversations), http.StatusBadRequest)
+		return
+	}
+
+	// Iterate in a stable order so truncation is deterministic.
+	ids := make([]string, 0, len(payload.Cursors))
+	for id := range payload.Cursors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	results := make(map[string]interface{}, len(ids))
+	remaining := syncTotalMax
+	truncated := false
+	for _, idStr := range ids {
+		if remaining <= 0 {
+			truncated = true
+			break
+		}
+		conversationID, err := gocql.ParseUUID(idStr)
+		if err != nil {
+			http.Error(w, "invalid conversation id "+idStr, http.StatusBadRequest)
+			return
+		}
+		if !s.userInConversation(payload.User, conversationID) {
+			results[idStr] = map[string]interface{}{"error": "forbidden"}
+			continue
+		}
+
+		var since time.Time
+		if raw := strings.TrimSpace(payload.Cursors[idStr]); raw != "" {
+			since, err = time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				http.Error(w, "invalid cursor for "+idStr, http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := syncPerConversationMax
+		if limit > remaining {
+			limit = remaining
+		}
+		// Fetch one extra row to learn whether more messages remain.
+		iter := s.idempotentQuery(
+			`SELECT sent_at, message_id, sender, body, view_once, attachment_url, attachment_type FROM messages WHERE conversation_id = ? AND sent_at > ? LIMIT ?`,
+			conversationID, since, limit+1,
+		).Iter()
+
+		var (
+			sentAt         time.Time
+			messageID      gocql.UUID
+			sender         string
+			body           string
+			viewOnce       bool
+			attachmentURL  string
+			attachmentType string
+		)
+		messages := make([]map[string]interface{}, 0, limit)
+		hasMore := false
+		cursor := payload.Cursors[idStr]
+		for iter.Scan(&sentAt, &messageID, &sender, &body, &viewOnce, &attachmentURL, &attachmentType) {
+			if len(messages) == limit {
+				hasMore = true
+				continue
+			}
+			item := map[string]interface{}{
+				"id":      messageID.String(),
+				"sender":  sender,
+				"text":    body,
+				"sent_at": sentAt.UTC().Format(time.RFC3339),
+			}
+			addAttachment(item, attachmentURL, attachmentType, viewOnce)
+			// Sync never opens view-once messages; the client fetches the
+			// conversation to do that.
+			if viewOnce {
+				item["view_once"] = true
+				item["text"] = viewOncePlaceholder
+			}
+			messages = append(messages, item)
+			cursor = sentAt.UTC().Format(time.RFC3339Nano)
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("sync messages for %s error: %v", conversationID, err)
+			http.Error(w, "unable to load messages", http.StatusInternalServerError)
+			return
+		}
+
+		remaining -= len(messages)
+		results[idStr] = map[string]interface{}{
+			"messages": messages,
+			"cursor":   cursor,
+			"has_more": hasMore,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversations": results,
+		"truncated":     truncated,
+	})
+}
+
+func (s *server) handleConversationRead(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	var payload struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	payload.User = strings.TrimSpace(payload.User)
+	if payload.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	if !s.userInConversation(payload.User, id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	readCount, err := s.markConversationRead(payload.User, id, -1)
+	if err != nil {
+		log.Printf("mark conversation read error: %v", err)
+		http.Error(w, "unable to mark conversation read", http.StatusInternalServerError)
+		return
+	}
+	s.publishReadEvent(r.Context(), id, payload.User, readCount)
+	// The body stays empty for older callers; the count rides in a header.
+	w.Header().Set("X-Read-Count", strconv.FormatInt(readCount, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConversationUnread marks a conversation unread for one user by
+// leaving the latest message out of their read count. The next real read
+// stores the full total again and clears it.
+func (s *server) handleConversationUnread(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	user := strings.TrimSpace(r.URL.Query().Get("user"))
+	if user == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	if !s.userInConversation(user, id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := s.markConversationUnread(user, id); err != nil {
+		if errors.Is(err, errNothingToMarkUnread) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("mark conversation unread error: %v", err)
+		http.Error(w, "unable to mark conversation unread", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) createMessage(w http.ResponseWriter, r *http.Request, conversationID gocql.UUID) {
+	var payload struct {
+		Sender         string `json:"sender"`
+		Text           string `json:"text"`
+		ViewOnce       bool   `json:"view_once"`
+		AttachmentURL  string `json:"attachment_url"`
+		AttachmentType string `json:"attachment_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	payload.Sender = strings.TrimSpace(payload.Sender)
+	payload.Text = strings.TrimSpace(payload.Text)
+
+	attachmentURL, attachmentType, err := validateAttachment(payload.AttachmentURL, payload.AttachmentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.Sender == "" || (payload.Text == "" && attachmentURL == "") {
+		http.Error(w, "sender and text or attachment_url are required", http.StatusBadRequest)
+		return
+	}
+	if payload.ViewOnce && attachmentURL != "" {
+		http.Error(w, "view-once messages cannot carry attachments", http.StatusBadRequest)
+		return
+	}
+
+	conv, err := s.loadConversation(conversationID)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "conversation not found", http.StatusNotFound)
+		} else {
+			slog.Error("create message: load conversation failed", "conversation_id", conversationID.String(), "email", payload.Sender, "err", err)
+			http.Error(w, "unable to load conversation", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !contains(conv.Participants, payload.Sender) {
+		http.Error(w, "sender not in conversation", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now().UTC()
+	messageID := gocql.TimeUUID()
+
+	// A retried request with a known key gets the original message back
+	// before the rate limiter sees it.
+	idempotencyKey := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return
+	}
+	claim := idempotencyClaim{
+		messageID:   messageID,
+		sentAt:      now,
+		payloadHash: messagePayloadHash(payload.Text, payload.ViewOnce, attachmentURL, attachmentType),
+	}
+	if idempotencyKey != "" {
+		claimed, prev, stored, err := claimIdempotencyKey(cassandraIdempotency{s}, conversationID, payload.Sender, idempotencyKey, claim)
+		switch {
+		case errors.Is(err, errIdempotencyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errIdempotencyKeyReused):
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			slog.Error("claim idempotency key failed", "conversation_id", conversationID.String(), "email", payload.Sender, "err", err)
+			http.Error(w, "unable to store message", http.StatusInternalServerError)
+			return
+		case !claimed:
+			writeReplayedMessage(w, conv, conversationID, prev, stored)
+			return
+		}
+	}
+	releaseKey := func() {
+		if idempotencyKey != "" {
+			s.releaseIdempotencyKey(conversationID, payload.Sender, idempotencyKey, claim)
+		}
+	}
+
+	if ok, retryAfter := s.limiter.allow(conversationID.String(), payload.Sender); !ok {
+		releaseKey()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if reason, flagged := s.moderator.check(r.Context(), payload.Sender, conversationID.String(), payload.Text); flagged {
+		releaseKey()
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"error":  errModerationRejected,
+			"reason": reason,
+		})
+		return
+	}
+
+	if err := s.idempotentQuery(
+		`INSERT INTO messages (conversation_id, sent_at, message_id, sender, body, view_once, attachment_url, attachment_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		conversationID, now, messageID, payload.Sender, payload.Text, payload.ViewOnce, attachmentURL, attachmentType,
+	).Exec(); err != nil {
+		releaseKey()
+		slog.Error("store message insert failed", "conversation_id", conversationID.String(), "email", payload.Sender, "err", err)
+		http.Error(w, "unable to store message", http.StatusInternalServerError)
+		return
+	}
+
+	// Past this point only the placeholder leaves the service for a
+	// view-once message: previews, the response and the event. Its
+	// attachment URL is left out of all three.
+	text := payload.Text
+	if payload.ViewOnce {
+		text = viewOncePlaceholder
+	}
+	preview := text
+	if preview == "" {
+		preview = attachmentPreview(attachmentType)
+	}
+
+	// update denormalized tables with latest activity
+	setParticipants := make(map[string]struct{}, len(conv.Participants))
+	for _, participant := range conv.Participants {
+		setParticipants[participant] = struct{}{}
+		if err := s.idempotentQuery(
+			`UPDATE conversations_by_user SET last_activity_at = ?, last_message = ?, last_message_at = ?, last_sender = ? WHERE user_email = ? AND conversation_id = ?`,
+			now, preview, now, payload.Sender, participant, conversationID,
+		).Exec(); err != nil {
+			slog.Warn("update conversations_by_user failed", "conversation_id", conversationID.String(), "email", participant, "err", err)
+		}
+	}
+	if err := s.idempotentQuery(
+		`UPDATE conversations SET last_activity_at = ?, last_message = ?, last_message_at = ?, last_sender = ? WHERE conversation_id = ?`,
+		now, preview, now, payload.Sender, conversationID,
+	).Exec(); err != nil {
+		slog.Warn("update conversations last_activity failed", "conversation_id", conversationID.String(), "err", err)
 	}
 
 	total, err := s.incrementConversationMessageCount(conversationID)
 	if err != nil {
-		log.Printf("warn: increment conversation counter failed: %v", err)
+		slog.Warn("increment conversation counter failed", "conversation_id", conversationID.String(), "err", err)
+		// Fall back to the stored counter rather than resetting the
+		// sender's read position to zero.
+		total = -1
 	}
-	if err := s.markConversationRead(payload.Sender, conversationID, total); err != nil {
-		log.Printf("warn: mark sender read failed: %v", err)
+	if _, err := s.markConversationRead(payload.Sender, conversationID, total); err != nil {
+		slog.Warn("mark sender read failed", "conversation_id", conversationID.String(), "email", payload.Sender, "err", err)
 	}
 
 	resp := map[string]interface{}{
 		"id":                messageID.String(),
 		"conversation_id":   conversationID.String(),
 		"sender":            payload.Sender,
-		"text":              payload.Text,
+		"text":              text,
 		"sent_at":           now.Format(time.RFC3339),
 		"participants":      conv.Participants,
 		"conversation_name": conv.Name,
 	}
+	addAttachment(resp, attachmentURL, attachmentType, payload.ViewOnce)
 
 	event := &messageEvent{
+		MessageID:        messageID.String(),
 		ConversationID:   conversationID.String(),
 		ConversationName: conv.Name,
 		Sender:           payload.Sender,
-		Text:             payload.Text,
+		Text:             text,
 		SentAt:           now.Format(time.RFC3339),
 		Participants:     conv.Participants,
+		ViewOnce:         payload.ViewOnce,
+		AttachmentURL:    attachmentURL,
+		AttachmentType:   attachmentType,
+	}
+	if payload.ViewOnce {
+		resp["view_once"] = true
+		event.AttachmentURL = ""
 	}
-	s.publishMessageEvent(event)
+	s.publishMessageEvent(r.Context(), event)
 
 	writeJSON(w, http.StatusCreated, resp)
 }
 
 func (s *server) loadConversation(id gocql.UUID) (*conversation, error) {
 	var (
-		name         string
-		participants []string
-		createdAt    time.Time
-		createdBy    string
-		lastActivity time.Time
+		name          string
+		participants  []string
+		createdAt     time.Time
+		createdBy     string
+		lastActivity  time.Time
+		avatarUpdated time.Time
 	)
 
-	err := s.session.Query(
-		`SELECT name, participants, created_at, created_by, last_activity_at FROM conversations WHERE conversation_id = ?`,
+	err := s.idempotentQuery(
+		`SELECT name, participants, created_at, created_by, last_activity_at, avatar_updated_at FROM conversations WHERE conversation_id = ?`,
 		id,
-	).Consistency(gocql.Quorum).Scan(&name, &participants, &createdAt, &createdBy, &lastActivity)
+	).Scan(&name, &participants, &createdAt, &createdBy, &lastActivity, &avatarUpdated)
 	if err != nil {
 		log.Printf("load conversation %s error: %v", id, err)
 		return nil, err
@@ -632,23 +1498,76 @@ func (s *server) loadConversation(id gocql.UUID) (*conversation, error) {
 		CreatedAt:      createdAt,
 		CreatedBy:      createdBy,
 		LastActivityAt: lastActivity,
+		AvatarUpdated:  avatarUpdated,
 	}, nil
 }
 
-func (s *server) publishMessageEvent(event *messageEvent) {
+// publishMessageEvent writes event to Kafka under a producer span that is a
+// child of the request's span. The write is not cancelled with the request.
+func (s *server) publishMessageEvent(ctx context.Context, event *messageEvent) {
 	if s.kafkaWriter == nil || event == nil {
 		return
 	}
 	data, err := json.Marshal(event)
 	if err != nil {
-		log.Printf("kafka event marshal error: %v", err)
+		slog.Error("kafka event marshal failed", "conversation_id", event.ConversationID, "message_id", event.MessageID, "err", err)
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	eventID := event.MessageID
+	if event.EventID != "" {
+		eventID = event.EventID
+	}
+	headers := []kafka.Header{
+		{Key: eventIDHeader, Value: []byte(eventID)},
+	}
+	ctx, span := startPublishSpan(ctx, s.kafkaWriter.Topic, event, &headers)
+	defer span.End()
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 	defer cancel()
-	if err := s.kafkaWriter.WriteMessages(ctx, kafka.Message{Value: data}); err != nil {
-		log.Printf("kafka write error: %v", err)
+	msg := kafka.Message{
+		Key:     []byte(event.ConversationID),
+		Value:   data,
+		Headers: headers,
+	}
+	if err := s.kafkaWriter.WriteMessages(ctx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "kafka write failed")
+		slog.Error("kafka write failed", "conversation_id", event.ConversationID, "message_id", event.MessageID, "err", err)
+	}
+}
+
+// publishMembershipEvent announces a conversation's participant set after it
+// changes. Creating a conversation is currently the only membership change.
+func (s *server) publishMembershipEvent(ctx context.Context, conversationID gocql.UUID, name string, participants []string, at time.Time) {
+	s.publishMessageEvent(ctx, &messageEvent{
+		Type:             eventTypeMembership,
+		MessageID:        fmt.Sprintf("membership:%s:%d", conversationID, at.UnixNano()),
+		ConversationID:   conversationID.String(),
+		ConversationName: name,
+		SentAt:           at.Format(time.RFC3339),
+		Participants:     participants,
+	})
+}
+
+// publishReadEvent announces that user has read a conversation up to
+// readCount messages, so other participants can show a receipt.
+func (s *server) publishReadEvent(ctx context.Context, conversationID gocql.UUID, user string, readCount int64) {
+	conv, err := s.loadConversation(conversationID)
+	if err != nil {
+		slog.Error("load conversation for read event failed", "conversation_id", conversationID.String(), "email", user, "err", err)
+		return
 	}
+	now := time.Now().UTC()
+	s.publishMessageEvent(ctx, &messageEvent{
+		Type:             eventTypeRead,
+		MessageID:        fmt.Sprintf("read:%s:%s:%d", conv.ID, user, readCount),
+		ConversationID:   conv.ID.String(),
+		ConversationName: conv.Name,
+		SentAt:           now.Format(time.RFC3339),
+		Participants:     conv.Participants,
+		UserEmail:        user,
+		ReadCount:        readCount,
+	})
 }
 
 func copyAndSort(values []string) []string {
@@ -716,7 +1635,7 @@ func (s *server) userInConversation(user string, conversationID gocql.UUID) bool
 		return false
 	}
 	var id gocql.UUID
-	err := s.session.Query(
+	err := s.idempotentQuery(
 		`SELECT conversation_id FROM conversations_by_user WHERE user_email = ? AND conversation_id = ?`,
 		user, conversationID,
 	).Scan(&id)
@@ -732,7 +1651,7 @@ func (s *server) userInConversation(user string, conversationID gocql.UUID) bool
 
 func (s *server) getConversationTotalMessages(conversationID gocql.UUID) (int64, error) {
 	var total int64
-	err := s.session.Query(
+	err := s.idempotentQuery(
 		`SELECT total_messages FROM conversation_message_counts WHERE conversation_id = ?`,
 		conversationID,
 	).Scan(&total)
@@ -745,63 +1664,260 @@ func (s *server) getConversationTotalMessages(conversationID gocql.UUID) (int64,
 	return total, nil
 }
 
+// incrementConversationMessageCount bumps the counter and returns this
+// message's position in the conversation. Cassandra has no atomic
+// increment-and-get, so the position is taken from the value read before
+// the increment rather than after it: reading afterwards would include
+// messages that raced this one, and a sender marked read up to that total
+// would never see them as unread.
 func (s *server) incrementConversationMessageCount(conversationID gocql.UUID) (int64, error) {
+	previous, err := s.getConversationTotalMessages(conversationID)
+	if err != nil {
+		return 0, err
+	}
 	if err := s.session.Query(
 		`UPDATE conversation_message_counts SET total_messages = total_messages + 1 WHERE conversation_id = ?`,
 		conversationID,
 	).Exec(); err != nil {
 		return 0, err
 	}
-	return s.getConversationTotalMessages(conversationID)
+	return previous + 1, nil
+}
+
+// recountConversation resets the message counter to the number of rows
+// actually stored for the conversation. Cassandra counters cannot be set
+// directly, so this reads the current value and applies the difference as
+// an increment. A message written between the read and the adjustment is
+// counted by its own increment, so the result can only be off by messages
+// that raced the recount and is corrected by the next one.
+func (s *server) recountConversation(conversationID gocql.UUID) (previous, actual int64, err error) {
+	if err := s.idempotentQuery(
+		`SELECT COUNT(*) FROM messages WHERE conversation_id = ?`,
+		conversationID,
+	).Scan(&actual); err != nil {
+		return 0, 0, err
+	}
+	previous, err = s.getConversationTotalMessages(conversationID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if delta := actual - previous; delta != 0 {
+		if err := s.session.Query(
+			`UPDATE conversation_message_counts SET total_messages = total_messages + ? WHERE conversation_id = ?`,
+			delta, conversationID,
+		).Exec(); err != nil {
+			return previous, 0, err
+		}
+	}
+	return previous, actual, nil
+}
+
+func (s *server) handleConversationRecount(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	if _, err := s.loadConversation(id); err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "conversation not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("recount load conversation %s error: %v", id, err)
+		http.Error(w, "unable to load conversation", http.StatusInternalServerError)
+		return
+	}
+
+	previous, actual, err := s.recountConversation(id)
+	if err != nil {
+		log.Printf("recount conversation %s error: %v", id, err)
+		http.Error(w, "unable to recount conversation", http.StatusInternalServerError)
+		return
+	}
+	if previous != actual {
+		log.Printf("recount conversation %s: counter %d -> %d", id, previous, actual)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation_id": id.String(),
+		"previous":        previous,
+		"total_messages":  actual,
+		"adjusted":        previous != actual,
+	})
+}
+
+// reconcileCountersLoop periodically recounts every conversation. It is
+// only started when COUNTER_RECONCILE_INTERVAL_MINUTES is set, since it
+// scans the whole conversations table.
+func (s *server) reconcileCountersLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		iter := s.idempotentQuery(`SELECT conversation_id FROM conversations`).Iter()
+		var (
+			id       gocql.UUID
+			checked  int
+			adjusted int
+		)
+		for iter.Scan(&id) {
+			checked++
+			previous, actual, err := s.recountConversation(id)
+			if err != nil {
+				log.Printf("reconcile counter %s error: %v", id, err)
+				continue
+			}
+			if previous != actual {
+				adjusted++
+			}
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("reconcile counters scan error: %v", err)
+		}
+		log.Printf("reconciled message counters: %d checked, %d adjusted", checked, adjusted)
+	}
 }
 
-func (s *server) getConversationReadCount(user string, conversationID gocql.UUID) (int64, error) {
-	var readCount int64
-	err := s.session.Query(
-		`SELECT read_count FROM conversation_reads WHERE user_email = ? AND conversation_id = ?`,
+func (s *server) getConversationReadCount(user string, conversationID gocql.UUID) (int64, time.Time, error) {
+	var (
+		readCount  int64
+		lastReadAt time.Time
+	)
+	err := s.idempotentQuery(
+		`SELECT read_count, last_read_at FROM conversation_reads WHERE user_email = ? AND conversation_id = ?`,
 		user, conversationID,
-	).Scan(&readCount)
+	).Scan(&readCount, &lastReadAt)
 	if errors.Is(err, gocql.ErrNotFound) {
-		return 0, nil
+		return 0, time.Time{}, nil
 	}
 	if err != nil {
-		return 0, err
+		return 0, time.Time{}, err
 	}
-	return readCount, nil
+	return readCount, lastReadAt, nil
 }
 
-func (s *server) markConversationRead(user string, conversationID gocql.UUID, total int64) error {
+func (s *server) markConversationRead(user string, conversationID gocql.UUID, total int64) (int64, error) {
 	if user == "" {
-		return errors.New("user required")
+		return 0, errors.New("user required")
 	}
 	if total < 0 {
 		var err error
 		total, err = s.getConversationTotalMessages(conversationID)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
-	now := time.Now().UTC()
-	return s.session.Query(
+	return total, s.writeReadState(user, conversationID, total, time.Now().UTC())
+}
+
+var errNothingToMarkUnread = errors.New("conversation has no messages to mark unread")
+
+// markConversationUnread sets the user's read count one below the total.
+// last_read_at is left where it was so receipts do not claim a read that
+// never happened; calculateUnread then reports at least one unread.
+func (s *server) markConversationUnread(user string, conversationID gocql.UUID) error {
+	total, err := s.getConversationTotalMessages(conversationID)
+	if err != nil {
+		return err
+	}
+	if total <= 0 {
+		return errNothingToMarkUnread
+	}
+	_, lastReadAt, err := s.getConversationReadCount(user, conversationID)
+	if err != nil {
+		return err
+	}
+	return s.writeReadState(user, conversationID, total-1, lastReadAt)
+}
+
+func (s *server) writeReadState(user string, conversationID gocql.UUID, readCount int64, lastReadAt time.Time) error {
+	// Both read tables are written in one logged batch so the per-user and
+	// per-conversation views never disagree. The values are fixed, so the
+	// batch may be retried.
+	batch := s.session.NewBatch(gocql.LoggedBatch).RetryPolicy(s.retry)
+	batch.Query(
 		`INSERT INTO conversation_reads (user_email, conversation_id, read_count, last_read_at) VALUES (?, ?, ?, ?)`,
-		user, conversationID, total, now,
-	).Exec()
+		user, conversationID, readCount, lastReadAt,
+	)
+	batch.Query(
+		`INSERT INTO conversation_reads_by_conversation (conversation_id, user_email, read_count, last_read_at) VALUES (?, ?, ?, ?)`,
+		conversationID, user, readCount, lastReadAt,
+	)
+	return s.session.ExecuteBatch(batch)
 }
 
-func (s *server) calculateUnread(user string, conversationID gocql.UUID) int {
+func (s *server) listReadReceipts(w http.ResponseWriter, r *http.Request, id gocql.UUID) {
+	iter := s.idempotentQuery(
+		`SELECT user_email, read_count, last_read_at FROM conversation_reads_by_conversation WHERE conversation_id = ?`,
+		id,
+	).Iter()
+
+	var (
+		user       string
+		readCount  int64
+		lastReadAt time.Time
+	)
+	receipts := make([]map[string]interface{}, 0, 8)
+	for iter.Scan(&user, &readCount, &lastReadAt) {
+		receipts = append(receipts, map[string]interface{}{
+			"user":         user,
+			"read_count":   readCount,
+			"last_read_at": formatTime(lastReadAt),
+		})
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("list read receipts %s error: %v", id, err)
+		http.Error(w, "unable to load receipts", http.StatusInternalServerError)
+		return
+	}
+	limit, tail := messagePage(r)
+	messageIDs, err := s.pageMessageIDs(id, limit, tail)
+	if err != nil {
+		slog.Error("list page messages failed", "conversation_id", id.String(), "err", err)
+		http.Error(w, "unable to load receipts", http.StatusInternalServerError)
+		return
+	}
+	delivered, err := s.conversationDeliveries(id, messageIDs)
+	if err != nil {
+		slog.Error("list deliveries failed", "conversation_id", id.String(), "err", err)
+		http.Error(w, "unable to load receipts", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation_id": id.String(),
+		"receipts":        receipts,
+		"delivered":       delivered,
+	})
+}
+
+// calculateUnread returns total - read from the counters. Counters can
+// drift (retries, missed increments), so when they claim nothing is unread
+// but someone else posted after the user's last read, at least one message
+// is reported unread.
+func (s *server) calculateUnread(user string, conversationID gocql.UUID, lastMessageAt time.Time, lastSender string) int {
 	total, err := s.getConversationTotalMessages(conversationID)
 	if err != nil {
 		log.Printf("get total messages for %s error: %v", conversationID, err)
 		return 0
 	}
-	read, err := s.getConversationReadCount(user, conversationID)
+	read, lastReadAt, err := s.getConversationReadCount(user, conversationID)
 	if err != nil {
 		log.Printf("get read messages for %s/%s error: %v", user, conversationID, err)
 		return 0
 	}
+	return unreadCount(total, read, lastReadAt, user, lastMessageAt, lastSender)
+}
+
+// unreadCount is the arithmetic behind calculateUnread, kept free of
+// Cassandra so the drift rules can be tested on their own.
+func unreadCount(total, read int64, lastReadAt time.Time, user string, lastMessageAt time.Time, lastSender string) int {
 	diff := total - read
-	if diff < 0 {
+	if diff <= 0 {
 		diff = 0
+		if lastSender != "" && !strings.EqualFold(lastSender, user) && lastMessageAt.After(lastReadAt) {
+			diff = 1
+		}
 	}
 	if diff > int64(math.MaxInt32) {
 		return math.MaxInt32
@@ -816,6 +1932,20 @@ func formatTime(t time.Time) string {
 	return t.UTC().Format(time.RFC3339)
 }
 
+// conversationFields returns the attributes shared by the list and single-get
+// conversation payloads so both report identical is_group/has_avatar values.
+func conversationFields(c *conversation) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                c.ID.String(),
+		"name":              c.Name,
+		"participants":      c.Participants,
+		"last_activity_at":  c.LastActivityAt.UTC().Format(time.RFC3339),
+		"is_group":          isGroupConversation(c.Name, c.Participants),
+		"has_avatar":        !c.AvatarUpdated.IsZero(),
+		"avatar_updated_at": formatTime(c.AvatarUpdated),
+	}
+}
+
 func isGroupConversation(name string, participants []string) bool {
 	// Self-chat is never a group.
 	if len(participants) <= 1 {
@@ -833,7 +1963,7 @@ func isGroupConversation(name string, participants []string) bool {
 	// If the name matches one of the participant emails, treat as a
 	// regular one-to-one conversation.
 	for _, p := range participants {
-		if trimmedName == p {
+		if strings.EqualFold(trimmedName, strings.TrimSpace(p)) {
 			return false
 		}
 	}
@@ -846,6 +1976,6 @@ func logRequest(next http.Handler) http.Handler {
 		start := time.Now()
 		next.ServeHTTP(w, r)
 		duration := time.Since(start)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, duration)
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "duration_ms", duration.Milliseconds())
 	})
 }
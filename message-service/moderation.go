@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Every message is checked by createMessage before it is stored, whichever
+// path it came in by: registration-api's REST POST or chat-service's
+// WebSocket. Moderation is off unless MODERATION_URL or
+// MODERATION_BANNED_WORDS is set:
+//
+//   - MODERATION_BANNED_WORDS is a comma-separated list of single words. A
+//     message containing any of them as a whole word, ignoring case, is
+//     rejected. Entries that split into more than one word could never
+//     match and fail config validation.
+//   - MODERATION_URL receives a POST of {"text","sender","conversation_id"}
+//     and answers {"flagged": bool, "reason": string}. MODERATION_SECRET, when
+//     set, is sent as a bearer token.
+//
+// Rejected messages get 422 with {"error", "reason"}. If the endpoint fails
+// or times out the message is let through, so a moderation outage does not
+// stop chat.
+const (
+	defaultModerationTimeout = 2 * time.Second
+	errModerationRejected    = "message rejected by moderation"
+)
+
+type moderator struct {
+	bannedWords map[string]struct{}
+	url         string
+	secret      string
+	client      *http.Client
+}
+
+// newModerator returns nil when moderation is off.
+func newModerator(url, secret string, bannedWords []string, timeout time.Duration) *moderator {
+	if url == "" && len(bannedWords) == 0 {
+		return nil
+	}
+	m := &moderator{
+		bannedWords: make(map[string]struct{}, len(bannedWords)),
+		url:         url,
+		secret:      secret,
+		client:      &http.Client{Timeout: timeout},
+	}
+	for _, word := range bannedWords {
+		m.bannedWords[strings.ToLower(word)] = struct{}{}
+	}
+	return m
+}
+
+// moderationWords splits text into the lowercased words banned entries are
+// matched against: runs of letters and digits.
+func moderationWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseBannedWords splits a comma-separated list, dropping blanks and
+// recording a problem for any entry that is not a single word.
+func parseBannedWords(raw string, problems *configProblems) []string {
+	var words []string
+	for _, word := range strings.Split(raw, ",") {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		if tokens := moderationWords(word); len(tokens) != 1 || tokens[0] != strings.ToLower(word) {
+			problems.add("MODERATION_BANNED_WORDS entries must be single words of letters and digits, got %q", word)
+			continue
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// check reports whether text should be rejected and why. It is a no-op on a
+// nil moderator.
+func (m *moderator) check(ctx context.Context, sender, conversationID, text string) (string, bool) {
+	if m == nil || text == "" {
+		return "", false
+	}
+	if len(m.bannedWords) > 0 {
+		for _, word := range moderationWords(text) {
+			if _, banned := m.bannedWords[word]; banned {
+				return "message contains a banned word", true
+			}
+		}
+	}
+	if m.url == "" {
+		return "", false
+	}
+	reason, flagged, err := m.callEndpoint(ctx, sender, conversationID, text)
+	if err != nil {
+		slog.Warn("moderation check failed, allowing message", "conversation_id", conversationID, "err", err)
+		return "", false
+	}
+	if flagged && reason == "" {
+		reason = "message was flagged by moderation"
+	}
+	return reason, flagged
+}
+
+func (m *moderator) callEndpoint(ctx context.Context, sender, conversationID, text string) (string, bool, error) {
+	body, err := json.Marshal(map[string]string{
+		"text":            text,
+		"sender":          sender,
+		"conversation_id": conversationID,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+m.secret)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var verdict struct {
+		Flagged bool   `json:"flagged"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(verdict.Reason), verdict.Flagged, nil
+}
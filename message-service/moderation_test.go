@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModerationWords(t *testing.T) {
+	cases := map[string]string{
+		"Hello, World!":        "hello world",
+		"spam-bot's 2nd offer": "spam bot s 2nd offer",
+		"Ünïcode café":         "ünïcode café",
+		"  ":                   "",
+	}
+	for text, want := range cases {
+		if got := strings.Join(moderationWords(text), " "); got != want {
+			t.Errorf("moderationWords(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestParseBannedWordsRejectsPhrases(t *testing.T) {
+	var problems configProblems
+	words := parseBannedWords("spam, , Scam ,free money,e-mail", &problems)
+	if strings.Join(words, ",") != "spam,Scam" {
+		t.Fatalf("words = %v", words)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("problems = %v, want one each for %q and %q", problems, "free money", "e-mail")
+	}
+}
+
+func TestModeratorBannedWords(t *testing.T) {
+	var problems configProblems
+	m := newModerator("", "", parseBannedWords("scam", &problems), time.Second)
+	if reason, flagged := m.check(context.Background(), "a@example.com", "c1", "Not a SCAM, promise"); !flagged || reason == "" {
+		t.Fatalf("banned word not flagged: %q %v", reason, flagged)
+	}
+	if _, flagged := m.check(context.Background(), "a@example.com", "c1", "scampi for dinner"); flagged {
+		t.Fatal("a word containing a banned word was flagged")
+	}
+	var off *moderator
+	if _, flagged := off.check(context.Background(), "a@example.com", "c1", "scam"); flagged {
+		t.Fatal("a nil moderator flagged a message")
+	}
+}
+
+func TestModeratorEndpoint(t *testing.T) {
+	var verdict func(w http.ResponseWriter, text string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct{ Text, Sender, ConversationID string }
+		json.NewDecoder(r.Body).Decode(&body)
+		verdict(w, body.Text)
+	}))
+	defer srv.Close()
+	m := newModerator(srv.URL, "secret", nil, 50*time.Millisecond)
+
+	verdict = func(w http.ResponseWriter, text string) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flagged": strings.Contains(text, "bad"), "reason": "harassment"})
+	}
+	if reason, flagged := m.check(context.Background(), "a@example.com", "c1", "something bad"); !flagged || reason != "harassment" {
+		t.Fatalf("flagged message = %q %v, want harassment", reason, flagged)
+	}
+	if _, flagged := m.check(context.Background(), "a@example.com", "c1", "something nice"); flagged {
+		t.Fatal("clean message flagged")
+	}
+
+	verdict = func(w http.ResponseWriter, _ string) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flagged": true})
+	}
+	if reason, _ := m.check(context.Background(), "a@example.com", "c1", "x"); reason == "" {
+		t.Fatal("a flag without a reason got no reason")
+	}
+
+	// Failures let the message through.
+	verdict = func(w http.ResponseWriter, _ string) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}
+	if _, flagged := m.check(context.Background(), "a@example.com", "c1", "something bad"); flagged {
+		t.Fatal("a failing endpoint rejected the message")
+	}
+	verdict = func(w http.ResponseWriter, _ string) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if _, flagged := m.check(context.Background(), "a@example.com", "c1", "something bad"); flagged {
+		t.Fatal("a timed out endpoint rejected the message")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// userDirectory confirms that conversation participants are registered
+// users by asking registration-api. It is only configured when
+// STRICT_PARTICIPANTS=true; otherwise any email is accepted.
+type userDirectory struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// newUserDirectory returns nil, accepting any email, when baseURL is empty.
+func newUserDirectory(baseURL, token string) *userDirectory {
+	if baseURL == "" {
+		return nil
+	}
+	return &userDirectory{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// unknown returns the subset of emails that registration-api does not
+// recognise, lowercased.
+func (d *userDirectory) unknown(ctx context.Context, emails []string) ([]string, error) {
+	buf, err := json.Marshal(map[string][]string{"emails": emails})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.baseURL+"/internal/users/lookup", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Token", d.token)
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("user lookup status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Unknown []string `json:"unknown"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Unknown, nil
+}
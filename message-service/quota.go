@@ -0,0 +1,30 @@
+package main
+
+import "strings"
+
+// conversationsCreated counts the conversations creator has created, from
+// conversations_by_creator. conversations_by_user is no use here: it also
+// holds every conversation someone else added the user to.
+func (s *server) conversationsCreated(creator string) (int, error) {
+	var n int
+	err := s.idempotentQuery(
+		`SELECT COUNT(*) FROM conversations_by_creator WHERE created_by = ?`,
+		strings.ToLower(creator),
+	).Scan(&n)
+	return n, err
+}
+
+// conversationLimitReached reports whether creator has already created max
+// conversations; max 0 disables the limit. Only conversations the user
+// created count, so nobody can use up another user's quota by adding them
+// to conversations. count is conversationsCreated outside tests.
+func conversationLimitReached(max int, creator string, count func(string) (int, error)) (bool, error) {
+	if max <= 0 {
+		return false, nil
+	}
+	created, err := count(creator)
+	if err != nil {
+		return false, err
+	}
+	return created >= max, nil
+}
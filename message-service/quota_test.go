@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// conversationLog records created conversations the way createConversation
+// writes them: one row per creator and one per participant.
+type conversationLog struct {
+	byCreator map[string]int
+	byUser    map[string]int
+}
+
+func (l *conversationLog) create(creator string, participants ...string) {
+	l.byCreator[strings.ToLower(creator)]++
+	l.byUser[creator]++
+	for _, p := range participants {
+		l.byUser[p]++
+	}
+}
+
+func (l *conversationLog) created(creator string) (int, error) {
+	return l.byCreator[strings.ToLower(creator)], nil
+}
+
+func TestOthersCannotFillConversationQuota(t *testing.T) {
+	const max = 5
+	log := &conversationLog{byCreator: map[string]int{}, byUser: map[string]int{}}
+
+	// Another user adds the victim to conversations until the victim is in
+	// more than the cap.
+	for i := 0; i < 2*max; i++ {
+		reached, err := conversationLimitReached(max*10, "mallory@example.com", log.created)
+		if err != nil || reached {
+			t.Fatalf("attacker stopped at %d: %v", i, err)
+		}
+		log.create("mallory@example.com", "victim@example.com")
+	}
+	if log.byUser["victim@example.com"] <= max {
+		t.Fatalf("victim is in %d conversations, want more than %d", log.byUser["victim@example.com"], max)
+	}
+
+	// The victim can still create their own, up to the cap.
+	for i := 0; i < max; i++ {
+		reached, err := conversationLimitReached(max, "Victim@example.com", log.created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reached {
+			t.Fatalf("victim refused after creating %d conversations", i)
+		}
+		log.create("Victim@example.com", "friend@example.com")
+	}
+	if reached, _ := conversationLimitReached(max, "victim@example.com", log.created); !reached {
+		t.Fatalf("victim allowed past the cap of %d", max)
+	}
+}
+
+func TestConversationLimitDisabledAndErrors(t *testing.T) {
+	failing := func(string) (int, error) { return 0, errors.New("cassandra down") }
+	if reached, err := conversationLimitReached(0, "a@example.com", failing); reached || err != nil {
+		t.Fatalf("disabled limit = %v, %v", reached, err)
+	}
+	if _, err := conversationLimitReached(5, "a@example.com", failing); err == nil {
+		t.Fatal("count error was swallowed")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageLimiter caps how many messages one sender may post to one
+// conversation per window. It sits in message-service so every gateway
+// (chat-service, registration-api, direct callers) shares the same budget;
+// gateways only translate the 429 instead of keeping their own count.
+type messageLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	buckets map[messageLimitKey]*messageBucket
+}
+
+type messageLimitKey struct {
+	conversationID string
+	sender         string
+}
+
+type messageBucket struct {
+	start time.Time
+	count int
+}
+
+// newMessageLimiter allows limit messages per sender and conversation in
+// each window. A limit of 0 disables it.
+func newMessageLimiter(limit int, window time.Duration) *messageLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &messageLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: make(map[messageLimitKey]*messageBucket),
+	}
+}
+
+// allow records an attempt and reports whether it is within the limit. When
+// it is not, the returned duration is how long until the window resets.
+func (l *messageLimiter) allow(conversationID, sender string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	key := messageLimitKey{conversationID: conversationID, sender: strings.ToLower(sender)}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok || now.Sub(b.start) >= l.window {
+		l.buckets[key] = &messageBucket{start: now, count: 1}
+		return true, 0
+	}
+	if b.count >= l.limit {
+		return false, b.start.Add(l.window).Sub(now)
+	}
+	b.count++
+	return true, 0
+}
+
+// pruneLoop drops buckets whose window has passed so idle senders do not
+// accumulate.
+func (l *messageLimiter) pruneLoop(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if now.Sub(b.start) >= l.window {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gocql/gocql"
+)
+
+// Reactions are stored one row per (message, emoji, user) in
+// message_reactions, partitioned by conversation so listMessages reads a
+// page's reactions in one query. POST /conversations/{id}/messages/{messageId}/reactions with
+// {user, emoji} toggles the user's reaction; DELETE with the same body
+// removes it. Every change publishes an eventTypeReaction event carrying the
+// message's full reaction summary, so clients can replace what they show.
+const (
+	eventTypeReaction = "reaction"
+	maxEmojiBytes     = 32
+	// reactionLookupWindow bounds the sent_at range searched for a message
+	// id. Message ids are time UUIDs minted together with sent_at.
+	reactionLookupWindow = time.Minute
+)
+
+// reactionSummary is one emoji's reactions on a message.
+type reactionSummary struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+var errMessageNotFound = errors.New("message not found")
+
+func (s *server) handleMessageReactions(w http.ResponseWriter, r *http.Request, conversationID gocql.UUID, messageIDStr string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	messageID, err := gocql.ParseUUID(messageIDStr)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		User  string `json:"user"`
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid json payload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	payload.User = strings.TrimSpace(payload.User)
+	payload.Emoji = strings.TrimSpace(payload.Emoji)
+	if payload.User == "" || payload.Emoji == "" {
+		http.Error(w, "user and emoji are required", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Emoji) > maxEmojiBytes || !utf8.ValidString(payload.Emoji) || strings.ContainsAny(payload.Emoji, " \t\r\n") {
+		http.Error(w, "invalid emoji", http.StatusBadRequest)
+		return
+	}
+
+	conv, err := s.loadConversation(conversationID)
+	if err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "conversation not found", http.StatusNotFound)
+		} else {
+			slog.Error("reaction: load conversation failed", "conversation_id", conversationID.String(), "err", err)
+			http.Error(w, "unable to load conversation", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !contains(conv.Participants, payload.User) {
+		http.Error(w, "user not in conversation", http.StatusForbidden)
+		return
+	}
+	if err := s.messageExists(conversationID, messageID); err != nil {
+		if errors.Is(err, errMessageNotFound) {
+			http.Error(w, "message not found", http.StatusNotFound)
+		} else {
+			slog.Error("reaction: load message failed", "conversation_id", conversationID.String(), "message_id", messageID.String(), "err", err)
+			http.Error(w, "unable to load message", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var added bool
+	if r.Method == http.MethodPost {
+		added, err = s.toggleReaction(conversationID, messageID, payload.Emoji, payload.User)
+	} else {
+		err = s.removeReaction(conversationID, messageID, payload.Emoji, payload.User)
+	}
+	if err != nil {
+		slog.Error("update reaction failed", "conversation_id", conversationID.String(), "message_id", messageID.String(), "email", payload.User, "err", err)
+		http.Error(w, "unable to update reaction", http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := s.messageReactions(conversationID, messageID)
+	if err != nil {
+		slog.Error("load reactions failed", "conversation_id", conversationID.String(), "message_id", messageID.String(), "err", err)
+		http.Error(w, "unable to load reactions", http.StatusInternalServerError)
+		return
+	}
+
+	action := "removed"
+	if added {
+		action = "added"
+	}
+	now := time.Now().UTC()
+	s.publishMessageEvent(r.Context(), &messageEvent{
+		Type:             eventTypeReaction,
+		EventID:          fmt.Sprintf("reaction:%s:%s:%s:%d", messageID, payload.User, payload.Emoji, now.UnixNano()),
+		MessageID:        messageID.String(),
+		ConversationID:   conversationID.String(),
+		ConversationName: conv.Name,
+		Sender:           payload.User,
+		Text:             payload.Emoji,
+		SentAt:           now.Format(time.RFC3339),
+		Participants:     conv.Participants,
+		ReactionAction:   action,
+		Reactions:        summary,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation_id": conversationID.String(),
+		"message_id":      messageID.String(),
+		"emoji":           payload.Emoji,
+		"action":          action,
+		"reactions":       summary,
+	})
+}
+
+// messageExists looks the message up by the time encoded in its id.
+func (s *server) messageExists(conversationID, messageID gocql.UUID) error {
+	if messageID.Version() != 1 {
+		return errMessageNotFound
+	}
+	at := messageID.Time()
+	iter := s.idempotentQuery(
+		`SELECT message_id FROM messages WHERE conversation_id = ? AND sent_at >= ? AND sent_at <= ?`,
+		conversationID, at.Add(-reactionLookupWindow), at.Add(reactionLookupWindow),
+	).Iter()
+	var id gocql.UUID
+	found := false
+	for iter.Scan(&id) {
+		if id == messageID {
+			found = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if !found {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// toggleReaction adds the user's reaction, or removes it when it is already
+// there, and reports whether it was added.
+func (s *server) toggleReaction(conversationID, messageID gocql.UUID, emoji, user string) (bool, error) {
+	applied, err := s.session.Query(
+		`INSERT INTO message_reactions (conversation_id, message_id, emoji, user_email, reacted_at) VALUES (?, ?, ?, ?, ?) IF NOT EXISTS`,
+		conversationID, messageID, emoji, user, time.Now().UTC(),
+	).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return false, err
+	}
+	if applied {
+		return true, nil
+	}
+	return false, s.removeReaction(conversationID, messageID, emoji, user)
+}
+
+// removeReaction deletes the user's reaction. The rows are written with
+// lightweight transactions, so the delete is one too: mixing plain writes
+// with LWTs on the same row can let a toggle's INSERT IF NOT EXISTS and this
+// delete be applied out of order.
+func (s *server) removeReaction(conversationID, messageID gocql.UUID, emoji, user string) error {
+	_, err := s.session.Query(
+		`DELETE FROM message_reactions WHERE conversation_id = ? AND message_id = ? AND emoji = ? AND user_email = ? IF EXISTS`,
+		conversationID, messageID, emoji, user,
+	).MapScanCAS(make(map[string]interface{}))
+	return err
+}
+
+// messageReactions summarizes one message's reactions.
+func (s *server) messageReactions(conversationID, messageID gocql.UUID) ([]reactionSummary, error) {
+	iter := s.idempotentQuery(
+		`SELECT emoji, user_email FROM message_reactions WHERE conversation_id = ? AND message_id = ?`,
+		conversationID, messageID,
+	).Iter()
+	users := make(map[string][]string)
+	var emoji, user string
+	for iter.Scan(&emoji, &user) {
+		users[emoji] = append(users[emoji], user)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return summarizeReactions(users), nil
+}
+
+// conversationReactions summarizes the reactions on the given messages of a
+// conversation, keyed by message id. Only their rows are read, not the whole
+// partition.
+func (s *server) conversationReactions(conversationID gocql.UUID, messageIDs []gocql.UUID) (map[gocql.UUID][]reactionSummary, error) {
+	if len(messageIDs) == 0 {
+		return map[gocql.UUID][]reactionSummary{}, nil
+	}
+	iter := s.idempotentQuery(
+		`SELECT message_id, emoji, user_email FROM message_reactions WHERE conversation_id = ? AND message_id IN ?`,
+		conversationID, messageIDs,
+	).Iter()
+	byMessage := make(map[gocql.UUID]map[string][]string)
+	var (
+		messageID   gocql.UUID
+		emoji, user string
+	)
+	for iter.Scan(&messageID, &emoji, &user) {
+		if byMessage[messageID] == nil {
+			byMessage[messageID] = make(map[string][]string)
+		}
+		byMessage[messageID][emoji] = append(byMessage[messageID][emoji], user)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	out := make(map[gocql.UUID][]reactionSummary, len(byMessage))
+	for id, users := range byMessage {
+		out[id] = summarizeReactions(users)
+	}
+	return out, nil
+}
+
+// summarizeReactions orders emoji by count, most used first.
+func summarizeReactions(users map[string][]string) []reactionSummary {
+	out := make([]reactionSummary, 0, len(users))
+	for emoji, list := range users {
+		out = append(out, reactionSummary{Emoji: emoji, Count: len(list), Users: list})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Emoji < out[j].Emoji
+	})
+	return out
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUnreadCount(t *testing.T) {
+	read := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	before := read.Add(-time.Minute)
+	after := read.Add(time.Minute)
+
+	tests := []struct {
+		name          string
+		total, read   int64
+		lastMessageAt time.Time
+		lastSender    string
+		want          int
+	}{
+		{"counters agree", 10, 7, after, "bob@example.com", 3},
+		{"all read", 10, 10, before, "bob@example.com", 0},
+		{"read count ahead of total", 8, 10, before, "bob@example.com", 0},
+		{"drift hides a newer message", 10, 10, after, "bob@example.com", 1},
+		{"drift past total hides a newer message", 9, 10, after, "bob@example.com", 1},
+		{"own message after last read", 10, 10, after, "alice@example.com", 0},
+		{"own message in another case", 10, 10, after, "Alice@Example.com", 0},
+		{"no last sender", 10, 10, after, "", 0},
+		{"counters already report unread", 10, 9, after, "bob@example.com", 1},
+		{"clamped to int32", math.MaxInt32 + 10, 0, after, "bob@example.com", math.MaxInt32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unreadCount(tt.total, tt.read, read, "alice@example.com", tt.lastMessageAt, tt.lastSender)
+			if got != tt.want {
+				t.Fatalf("unreadCount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnreadCountNeverRead(t *testing.T) {
+	// A user with no conversation_reads row has a zero last_read_at.
+	if got := unreadCount(0, 0, time.Time{}, "alice@example.com", time.Now(), "bob@example.com"); got != 1 {
+		t.Fatalf("unreadCount = %d, want 1", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// View-once messages are readable exactly once by each recipient:
+//
+//   - The body is stored like any other message, but every response, preview
+//     and event carries viewOncePlaceholder instead, so gateways never fan the
+//     body out. An attachment's URL is withheld the same way; only its type
+//     is shown.
+//   - A recipient opens it by fetching the conversation with ?reader=. The
+//     first such fetch claims the view with a lightweight transaction and
+//     returns the body and attachment URL; later fetches by that user get the
+//     placeholder.
+//   - The sender never gets the body back. Their listing shows who has
+//     opened it in opened_by.
+//   - Each open publishes an eventTypeViewOnceOpened event whose message_id
+//     is the opened message and whose sender is the reader, so clients can
+//     render the opened state.
+const (
+	viewOncePlaceholder     = "View once message"
+	eventTypeViewOnceOpened = "view_once_opened"
+)
+
+// viewOnceOpeners returns who has opened each view-once message in a
+// conversation.
+func (s *server) viewOnceOpeners(conversationID gocql.UUID) (map[gocql.UUID][]string, error) {
+	iter := s.idempotentQuery(
+		`SELECT message_id, user_email FROM view_once_views WHERE conversation_id = ?`,
+		conversationID,
+	).Iter()
+
+	var (
+		messageID gocql.UUID
+		user      string
+	)
+	openers := make(map[gocql.UUID][]string)
+	for iter.Scan(&messageID, &user) {
+		openers[messageID] = append(openers[messageID], user)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return openers, nil
+}
+
+// claimViewOnce records that user opened a message and reports whether this
+// was the first time. The conditional insert makes concurrent fetches agree
+// on a single winner.
+func (s *server) claimViewOnce(conversationID, messageID gocql.UUID, user string) (bool, error) {
+	existing := make(map[string]interface{})
+	return s.session.Query(
+		`INSERT INTO view_once_views (conversation_id, message_id, user_email, viewed_at) VALUES (?, ?, ?, ?) IF NOT EXISTS`,
+		conversationID, messageID, strings.ToLower(user), time.Now().UTC(),
+	).MapScanCAS(existing)
+}
+
+// viewOnceText decides what a reader sees for a view-once message, claiming
+// the view when it is theirs to open. It reports whether this call opened
+// the message, in which case the caller may also reveal its attachment.
+func (s *server) viewOnceText(ctx context.Context, conv *conversation, messageID gocql.UUID, sender, body, reader string, openers []string) (string, bool) {
+	if reader == "" || strings.EqualFold(reader, sender) || containsFold(openers, reader) {
+		return viewOncePlaceholder, false
+	}
+	first, err := s.claimViewOnce(conv.ID, messageID, reader)
+	if err != nil {
+		log.Printf("claim view-once %s for %s error: %v", messageID, reader, err)
+		return viewOncePlaceholder, false
+	}
+	if !first {
+		return viewOncePlaceholder, false
+	}
+	s.publishMessageEvent(ctx, &messageEvent{
+		Type:             eventTypeViewOnceOpened,
+		MessageID:        messageID.String(),
+		ConversationID:   conv.ID.String(),
+		ConversationName: conv.Name,
+		Sender:           reader,
+		SentAt:           time.Now().UTC().Format(time.RFC3339),
+		Participants:     conv.Participants,
+	})
+	return body, true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
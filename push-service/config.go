@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// config is everything push-service reads from the environment at startup.
+// loadConfig validates it in one pass so a bad deployment fails before any
+// connection is opened, listing every problem at once.
+type config struct {
+	kafkaURL  string
+	topic     string
+	groupID   string
+	mysqlDSN  string
+	redisAddr string
+	apns      apnsConfig
+}
+
+type apnsConfig struct {
+	keyPath    string
+	keyID      string
+	teamID     string
+	topic      string
+	useSandbox bool
+}
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// required returns the trimmed value of key, recording a problem when unset.
+func (p *configProblems) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		p.add("%s must be set", key)
+	}
+	return v
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	cfg := config{
+		kafkaURL:  envOrDefault("KAFKA_URL", "kafka:9092"),
+		topic:     envOrDefault("KAFKA_TOPIC", "chat-messages"),
+		groupID:   envOrDefault("KAFKA_CONSUMER_GROUP", "push-service"),
+		mysqlDSN:  problems.required("MYSQL_DSN"),
+		redisAddr: strings.TrimSpace(os.Getenv("REDIS_ADDR")),
+		apns: apnsConfig{
+			keyPath: problems.required("APNS_KEY_PATH"),
+			keyID:   problems.required("APNS_KEY_ID"),
+			teamID:  problems.required("APNS_TEAM_ID"),
+			topic:   problems.required("APNS_TOPIC"),
+		},
+	}
+
+	if cfg.apns.keyPath != "" {
+		if _, err := os.Stat(cfg.apns.keyPath); err != nil {
+			problems.add("APNS_KEY_PATH %q is not readable: %v", cfg.apns.keyPath, err)
+		}
+	}
+	switch env := strings.ToLower(strings.TrimSpace(os.Getenv("APNS_ENVIRONMENT"))); env {
+	case "development", "sandbox":
+		cfg.apns.useSandbox = true
+	case "production":
+	case "":
+		cfg.apns.useSandbox = strings.EqualFold(strings.TrimSpace(os.Getenv("APNS_USE_SANDBOX")), "true")
+	default:
+		problems.add("APNS_ENVIRONMENT must be development, sandbox or production, got %q", env)
+	}
+
+	return cfg, problems.err()
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: kafka=%s topic=%s group=%s redis=%s apns_topic=%s apns_sandbox=%t",
+		c.kafkaURL, c.topic, c.groupID, c.redisAddr, c.apns.topic, c.apns.useSandbox)
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
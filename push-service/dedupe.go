@@ -0,0 +1,57 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// eventDeduper remembers recently processed event ids so a Kafka redelivery
+// (e.g. after a rebalance before the offset commit) does not push twice.
+// It is only used from the single consumer loop and is not goroutine safe.
+type eventDeduper struct {
+	ttl time.Duration
+	max int
+	// order holds one seenEvent per remembered id, least recently seen
+	// first; seen points at each id's element so re-seeing it moves the
+	// entry instead of adding a second one.
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+type seenEvent struct {
+	id string
+	at time.Time
+}
+
+func newEventDeduper(ttl time.Duration, max int) *eventDeduper {
+	return &eventDeduper{
+		ttl:   ttl,
+		max:   max,
+		order: list.New(),
+		seen:  make(map[string]*list.Element, max),
+	}
+}
+
+// firstSeen records id and reports whether it had not been seen within ttl.
+func (d *eventDeduper) firstSeen(id string) bool {
+	if id == "" {
+		return true
+	}
+	now := time.Now()
+	if el, ok := d.seen[id]; ok {
+		entry := el.Value.(*seenEvent)
+		if now.Sub(entry.at) < d.ttl {
+			return false
+		}
+		entry.at = now
+		d.order.MoveToBack(el)
+		return true
+	}
+	d.seen[id] = d.order.PushBack(&seenEvent{id: id, at: now})
+	for d.order.Len() > d.max {
+		oldest := d.order.Front()
+		d.order.Remove(oldest)
+		delete(d.seen, oldest.Value.(*seenEvent).id)
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventDeduperReseenExpiredID(t *testing.T) {
+	d := newEventDeduper(time.Hour, 2)
+	if !d.firstSeen("a") {
+		t.Fatal("a reported as a duplicate on first sight")
+	}
+	if d.firstSeen("a") {
+		t.Fatal("a not reported as a duplicate within ttl")
+	}
+
+	// Let a expire and see it again: it must be remembered once, as the
+	// most recent id.
+	d.seen["a"].Value.(*seenEvent).at = time.Now().Add(-2 * time.Hour)
+	if !d.firstSeen("a") {
+		t.Fatal("expired a reported as a duplicate")
+	}
+	if d.order.Len() != 1 {
+		t.Fatalf("%d entries remembered, want 1", d.order.Len())
+	}
+
+	// Overflowing max evicts the oldest id, not the live a.
+	d.firstSeen("b")
+	d.firstSeen("c")
+	if d.firstSeen("c") || d.firstSeen("b") {
+		t.Fatal("recent ids forgotten")
+	}
+	if _, ok := d.seen["a"]; ok {
+		t.Fatal("a should have been evicted as the oldest id")
+	}
+	if d.order.Len() != 2 || len(d.seen) != 2 {
+		t.Fatalf("remembering %d ids in order and %d in seen, want 2", d.order.Len(), len(d.seen))
+	}
+
+	d = newEventDeduper(time.Hour, 2)
+	d.firstSeen("a")
+	d.firstSeen("b")
+	d.seen["a"].Value.(*seenEvent).at = time.Now().Add(-2 * time.Hour)
+	d.firstSeen("a")
+	d.firstSeen("c")
+	if d.firstSeen("a") {
+		t.Fatal("re-seen a was evicted in place of b")
+	}
+	if _, ok := d.seen["b"]; ok {
+		t.Fatal("b should have been evicted as the oldest id")
+	}
+}
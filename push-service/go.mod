@@ -9,6 +9,7 @@ require (
 	github.com/redis/go-redis/v9 v9.16.0
 	github.com/segmentio/kafka-go v0.4.48
 	github.com/sideshow/apns2 v0.25.0
+	servicekit v0.0.0
 )
 
 require (
@@ -21,3 +22,5 @@ require (
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 )
+
+replace servicekit => ../servicekit
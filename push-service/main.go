@@ -6,7 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -16,15 +16,24 @@ import (
 	"github.com/sideshow/apns2/payload"
 	apnstoken "github.com/sideshow/apns2/token"
 	"github.com/redis/go-redis/v9"
+
+	"servicekit/logging"
 )
 
 type messageEvent struct {
+	// Type is empty for chat messages; other event types (such as
+	// "membership") carry nothing to notify about.
+	Type             string   `json:"type,omitempty"`
+	MessageID        string   `json:"message_id"`
 	ConversationID   string   `json:"conversation_id"`
 	ConversationName string   `json:"conversation_name"`
 	Sender           string   `json:"sender"`
 	Text             string   `json:"text"`
 	SentAt           string   `json:"sent_at"`
 	Participants     []string `json:"participants"`
+	// AttachmentType is set when the message carries an attachment, in
+	// which case Text may be empty.
+	AttachmentType string `json:"attachment_type,omitempty"`
 }
 
 type deviceToken struct {
@@ -46,28 +55,31 @@ type service struct {
 	tokens *tokenStore
 	apns   *apnsSender
 	redis  *redis.Client
+	seen   *eventDeduper
 }
 
-func main() {
-	kafkaURL := strings.TrimSpace(os.Getenv("KAFKA_URL"))
-	if kafkaURL == "" {
-		kafkaURL = "kafka:9092"
-	}
-	topic := strings.TrimSpace(os.Getenv("KAFKA_TOPIC"))
-	if topic == "" {
-		topic = "chat-messages"
-	}
-	groupID := strings.TrimSpace(os.Getenv("KAFKA_CONSUMER_GROUP"))
-	if groupID == "" {
-		groupID = "push-service"
+// eventIDHeader is set by message-service to the message id of each event.
+const eventIDHeader = "event_id"
+
+func eventID(msg kafka.Message, event *messageEvent) string {
+	for _, h := range msg.Headers {
+		if h.Key == eventIDHeader {
+			return string(h.Value)
+		}
 	}
+	return event.MessageID
+}
 
-	mysqlDSN := strings.TrimSpace(os.Getenv("MYSQL_DSN"))
-	if mysqlDSN == "" {
-		log.Fatal("MYSQL_DSN must be set for push service")
+func main() {
+	logging.Setup("push-service")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
+	cfg.logSummary()
+	topic, groupID := cfg.topic, cfg.groupID
 
-	db, err := sql.Open("mysql", mysqlDSN)
+	db, err := sql.Open("mysql", cfg.mysqlDSN)
 	if err != nil {
 		log.Fatalf("mysql open error: %v", err)
 	}
@@ -77,13 +89,13 @@ func main() {
 	}
 
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{kafkaURL},
+		Brokers: []string{cfg.kafkaURL},
 		Topic:   topic,
 		GroupID: groupID,
 	})
 	defer reader.Close()
 
-	redisAddr := strings.TrimSpace(os.Getenv("REDIS_ADDR"))
+	redisAddr := cfg.redisAddr
 	var rdb *redis.Client
 	if redisAddr != "" {
 		rdb = redis.NewClient(&redis.Options{
@@ -97,7 +109,7 @@ func main() {
 		log.Printf("REDIS_ADDR not set; rtc_signal VoIP pushes will be disabled")
 	}
 
-	apnsConfig, err := buildAPNSSender()
+	apnsConfig, err := buildAPNSSender(cfg.apns)
 	if err != nil {
 		log.Fatalf("apns setup error: %v", err)
 	}
@@ -107,9 +119,10 @@ func main() {
 		tokens: &tokenStore{db: db},
 		apns:   apnsConfig,
 		redis:  rdb,
+		seen:   newEventDeduper(10*time.Minute, 10000),
 	}
 
-	log.Printf("Push service listening on topic %s as %s", topic, groupID)
+	slog.Info("push service listening", "topic", topic, "group", groupID)
 
 	if srv.redis != nil {
 		go srv.runRedis(context.Background())
@@ -121,14 +134,22 @@ func (s *service) run() {
 	for {
 		msg, err := s.reader.ReadMessage(context.Background())
 		if err != nil {
-			log.Printf("kafka read error: %v", err)
+			slog.Error("kafka read failed", "err", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
 		var event messageEvent
 		if err := json.Unmarshal(msg.Value, &event); err != nil {
-			log.Printf("invalid message event: %v", err)
+			slog.Warn("invalid message event", "err", err, "offset", msg.Offset)
+			continue
+		}
+		if event.Type != "" && event.Type != "message" {
+			continue
+		}
+
+		if id := eventID(msg, &event); !s.seen.firstSeen(id) {
+			slog.Info("skipping duplicate message event", "event_id", id)
 			continue
 		}
 
@@ -147,11 +168,11 @@ func (s *service) processEvent(event *messageEvent) {
 		tokens, err := s.tokens.TokensForUser(ctx, recipient)
 		cancel()
 		if err != nil {
-			log.Printf("token lookup error for %s: %v", recipient, err)
+			slog.Error("token lookup failed", "email", recipient, "conversation_id", event.ConversationID, "err", err)
 			continue
 		}
 		if len(tokens) == 0 {
-			log.Printf("no device tokens for %s", recipient)
+			slog.Info("no device tokens", "email", recipient, "conversation_id", event.ConversationID)
 			continue
 		}
 
@@ -159,12 +180,12 @@ func (s *service) processEvent(event *messageEvent) {
 			switch strings.ToLower(tk.Platform) {
 			case "ios", "apple", "apns", "":
 				if err := s.apns.Send(event, tk.Token); err != nil {
-					log.Printf("apns send error token=%s: %v", tk.Token, err)
+					slog.Error("apns send failed", "email", recipient, "conversation_id", event.ConversationID, "token", tk.Token, "err", err)
 				}
 			case "android":
 				sendAndroidPush(event, recipient, tk.Token)
 			default:
-				log.Printf("unsupported platform %q for token %s", tk.Platform, tk.Token)
+				slog.Warn("unsupported platform", "email", recipient, "platform", tk.Platform, "token", tk.Token)
 			}
 		}
 	}
@@ -192,18 +213,18 @@ func (s *service) runRedis(ctx context.Context) {
 	}
 	sub := s.redis.Subscribe(ctx, "chat:messages")
 	ch := sub.Channel()
-	log.Printf("Subscribed to redis channel chat:messages for rtc_signal events")
+	slog.Info("subscribed to redis channel for rtc_signal events", "channel", "chat:messages")
 	for msg := range ch {
 		var evt rtcRedisEvent
 		if err := json.Unmarshal([]byte(msg.Payload), &evt); err != nil {
-			log.Printf("invalid redis event: %v", err)
+			slog.Warn("invalid redis event", "err", err)
 			continue
 		}
 		if strings.TrimSpace(evt.Type) != "rtc_signal" {
 			continue
 		}
 		if err := s.processRtcSignal(ctx, &evt); err != nil {
-			log.Printf("process rtc_signal error: %v", err)
+			slog.Error("process rtc_signal failed", "conversation_id", evt.ConversationID, "err", err)
 		}
 	}
 }
@@ -235,11 +256,11 @@ func (s *service) processRtcSignal(ctx context.Context, evt *rtcRedisEvent) erro
 		tokens, err := s.tokens.TokensForUser(ctx, recipient)
 		cancel()
 		if err != nil {
-			log.Printf("rtc: token lookup error for %s: %v", recipient, err)
+			slog.Error("rtc token lookup failed", "email", recipient, "conversation_id", evt.ConversationID, "err", err)
 			continue
 		}
 		if len(tokens) == 0 {
-			log.Printf("rtc: no device tokens for %s", recipient)
+			slog.Info("rtc: no device tokens", "email", recipient, "conversation_id", evt.ConversationID)
 			continue
 		}
 
@@ -247,7 +268,7 @@ func (s *service) processRtcSignal(ctx context.Context, evt *rtcRedisEvent) erro
 			switch strings.ToLower(tk.Platform) {
 			case "ios_voip":
 				if err := s.apns.SendVoIPInvite(evt, &sig, tk.Token); err != nil {
-					log.Printf("rtc: apns voip send error token=%s: %v", tk.Token, err)
+					slog.Error("rtc apns voip send failed", "email", recipient, "conversation_id", evt.ConversationID, "session_id", sig.SessionID, "token", tk.Token, "err", err)
 				}
 			}
 		}
@@ -277,35 +298,20 @@ func (ts *tokenStore) TokensForUser(ctx context.Context, email string) ([]device
 	return tokens, rows.Err()
 }
 
-func buildAPNSSender() (*apnsSender, error) {
-	keyPath := strings.TrimSpace(os.Getenv("APNS_KEY_PATH"))
-	keyID := strings.TrimSpace(os.Getenv("APNS_KEY_ID"))
-	teamID := strings.TrimSpace(os.Getenv("APNS_TEAM_ID"))
-	topic := strings.TrimSpace(os.Getenv("APNS_TOPIC"))
-	env := strings.ToLower(strings.TrimSpace(os.Getenv("APNS_ENVIRONMENT")))
-
-	if keyPath == "" || keyID == "" || teamID == "" || topic == "" {
-		return nil, fmt.Errorf("APNS configuration is incomplete")
-	}
-
-	authKey, err := apnstoken.AuthKeyFromFile(keyPath)
+func buildAPNSSender(cfg apnsConfig) (*apnsSender, error) {
+	authKey, err := apnstoken.AuthKeyFromFile(cfg.keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("load APNS key: %w", err)
 	}
 
 	apnsToken := &apnstoken.Token{
 		AuthKey: authKey,
-		KeyID:   keyID,
-		TeamID:  teamID,
+		KeyID:   cfg.keyID,
+		TeamID:  cfg.teamID,
 	}
 
 	client := apns2.NewTokenClient(apnsToken)
-	useSandbox := env == "development" || env == "sandbox"
-	if !useSandbox && env == "" {
-		useSandbox = strings.EqualFold(strings.TrimSpace(os.Getenv("APNS_USE_SANDBOX")), "true")
-	}
-
-	if useSandbox {
+	if cfg.useSandbox {
 		client = client.Development()
 		log.Printf("APNS environment set to development")
 	} else {
@@ -315,16 +321,33 @@ func buildAPNSSender() (*apnsSender, error) {
 
 	return &apnsSender{
 		client: client,
-		topic:  topic,
+		topic:  cfg.topic,
 	}, nil
 }
 
+// attachmentAction describes a message that has an attachment but no text.
+func attachmentAction(kind string) string {
+	switch kind {
+	case "video":
+		return "sent a video"
+	case "audio":
+		return "sent an audio message"
+	case "file":
+		return "sent a file"
+	default:
+		return "sent a photo"
+	}
+}
+
 func (a *apnsSender) Send(evt *messageEvent, deviceToken string) error {
 	if evt == nil {
 		return fmt.Errorf("nil event")
 	}
 
 	alert := fmt.Sprintf("%s: %s", evt.Sender, truncate(evt.Text, 140))
+	if strings.TrimSpace(evt.Text) == "" {
+		alert = fmt.Sprintf("%s %s", evt.Sender, attachmentAction(evt.AttachmentType))
+	}
 	data := payload.NewPayload().
 		AlertTitle(evt.ConversationName).
 		AlertBody(alert).
@@ -415,8 +438,8 @@ func recipientsForRTC(evt *rtcRedisEvent) []string {
 }
 
 func sendAndroidPush(evt *messageEvent, recipient, token string) {
-	log.Printf("[push][android] skipping real send (no FCM config) conversation=%s recipient=%s token=%s from=%s text=%q",
-		evt.ConversationID, recipient, token, evt.Sender, evt.Text)
+	slog.Info("android push skipped (no FCM config)",
+		"conversation_id", evt.ConversationID, "email", recipient, "token", token, "from", evt.Sender, "text", evt.Text)
 }
 
 func truncate(text string, max int) string {
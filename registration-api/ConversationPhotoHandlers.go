@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"io"
@@ -11,16 +12,16 @@ import (
 )
 
 func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversationID string) {
-	sess, err := getSessionFromRequest(r)
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
 		// Anyone in the conversation can view the photo.
-		conv, err := loadConversationForUser(w, r, conversationID, sess.Email)
+		conv, err := loadConversationForUser(w, r, conversationID, me.Email)
 		if err != nil {
 			return
 		}
@@ -29,12 +30,13 @@ func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversa
 		var (
 			data        []byte
 			contentType sql.NullString
+			lastUpdated time.Time
 		)
 
 		err = db.QueryRow(
-			"SELECT avatar, avatar_content_type FROM conversation_avatars WHERE conversation_id = ?",
+			"SELECT avatar, avatar_content_type, updated_at FROM conversation_avatars WHERE conversation_id = ?",
 			conversationID,
-		).Scan(&data, &contentType)
+		).Scan(&data, &contentType, &lastUpdated)
 		if errors.Is(err, sql.ErrNoRows) || len(data) == 0 {
 			http.NotFound(w, r)
 			return
@@ -49,6 +51,9 @@ func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversa
 		if ct == "" {
 			ct = "image/jpeg"
 		}
+		if notModified(w, r, len(data), lastUpdated) {
+			return
+		}
 		w.Header().Set("Content-Type", ct)
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write(data); err != nil {
@@ -57,11 +62,11 @@ func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversa
 
 	case http.MethodPost:
 		// Only participants may update the conversation photo.
-		conv, err := loadConversationForUser(w, r, conversationID, sess.Email)
+		conv, err := loadConversationForUser(w, r, conversationID, me.Email)
 		if err != nil {
 			return
 		}
-		if !contains(conv.Participants, sess.Email) {
+		if !isParticipant(conv.Participants, me.Email) {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 			return
 		}
@@ -84,9 +89,9 @@ func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversa
 
 		now := time.Now()
 		_, err = db.Exec(`
-            INSERT INTO conversation_avatars (conversation_id, avatar, avatar_content_type, updated_at)
-            VALUES (?, ?, ?, ?)
-            ON DUPLICATE KEY UPDATE avatar = VALUES(avatar), avatar_content_type = VALUES(avatar_content_type), updated_at = VALUES(updated_at)
+            INSERT INTO conversation_avatars (conversation_id, avatar, avatar_content_type, updated_at, avatar_synced)
+            VALUES (?, ?, ?, ?, 0)
+            ON DUPLICATE KEY UPDATE avatar = VALUES(avatar), avatar_content_type = VALUES(avatar_content_type), updated_at = VALUES(updated_at), avatar_synced = 0
         `, conversationID, body, contentType, now)
 		if err != nil {
 			log.Printf("update conversation avatar %s error: %v", conversationID, err)
@@ -94,10 +99,92 @@ func handleAPIConversationPhoto(w http.ResponseWriter, r *http.Request, conversa
 			return
 		}
 
+		// message-service tracks avatar presence so conversation payloads
+		// can report has_avatar; a failure here only affects that flag,
+		// and the row stays unsynced for syncConversationAvatars.
+		recordConversationAvatar(r.Context(), conversationID, true)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		// Only participants may remove the conversation photo.
+		conv, err := loadConversationForUser(w, r, conversationID, me.Email)
+		if err != nil {
+			return
+		}
+		if !isParticipant(conv.Participants, me.Email) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+
+		_, err = db.Exec(
+			"UPDATE conversation_avatars SET avatar = NULL, avatar_content_type = NULL, updated_at = ?, avatar_synced = 0 WHERE conversation_id = ?",
+			time.Now(), conversationID,
+		)
+		if err != nil {
+			log.Printf("delete conversation avatar %s error: %v", conversationID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to delete conversation avatar"})
+			return
+		}
+
+		recordConversationAvatar(r.Context(), conversationID, false)
+
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
-		w.Header().Set("Allow", "GET, POST")
+		w.Header().Set("Allow", "GET, POST, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// recordConversationAvatar tells message-service whether the conversation
+// has a photo and, once it has accepted, marks the row synced.
+func recordConversationAvatar(ctx context.Context, conversationID string, hasAvatar bool) bool {
+	callCtx, cancel := messageSvc.withTimeout(ctx)
+	err := messageSvc.SetConversationAvatar(callCtx, conversationID, hasAvatar)
+	cancel()
+	if err != nil {
+		log.Printf("record conversation avatar %s (has_avatar=%t) error: %v", conversationID, hasAvatar, err)
+		return false
+	}
+	if _, err := db.Exec("UPDATE conversation_avatars SET avatar_synced = 1 WHERE conversation_id = ?", conversationID); err != nil {
+		log.Printf("mark conversation avatar %s synced error: %v", conversationID, err)
+	}
+	return true
+}
+
+// syncConversationAvatars pushes every unsynced conversation_avatars row to
+// message-service. This backfills has_avatar for photos stored before
+// message-service tracked it, and retries updates that failed at upload or
+// delete time. It runs once at startup.
+func syncConversationAvatars(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, "SELECT conversation_id, avatar IS NOT NULL AND LENGTH(avatar) > 0 FROM conversation_avatars WHERE avatar_synced = 0")
+	if err != nil {
+		log.Printf("list unsynced conversation avatars error: %v", err)
+		return
+	}
+	type pending struct {
+		id        string
+		hasAvatar bool
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.hasAvatar); err != nil {
+			log.Printf("scan unsynced conversation avatar error: %v", err)
+			continue
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+
+	synced := 0
+	for _, p := range todo {
+		if recordConversationAvatar(ctx, p.id, p.hasAvatar) {
+			synced++
+		}
+	}
+	if len(todo) > 0 {
+		log.Printf("synced %d of %d conversation avatars to message-service", synced, len(todo))
+	}
+}
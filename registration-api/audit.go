@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Authentication event types recorded in auth_audit_log.
+const (
+	auditLogin        = "login"
+	auditTokenRefresh = "token_refresh"
+	auditLogout       = "logout"
+	// auditSessionRevoke covers revoking sessions from the session list,
+	// as opposed to logging out of the current one.
+	auditSessionRevoke = "session_revoke"
+)
+
+// minAuditIPSaltLength is the shortest AUDIT_IP_SALT accepted. With an empty
+// or guessable key, hashing every IPv4 address reverses the stored hashes.
+const minAuditIPSaltLength = 16
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+var (
+	// auditHashIPs stores a keyed hash of the client IP instead of the raw
+	// address. The hash is stable for a given salt so repeated attempts
+	// from one address can still be correlated.
+	auditHashIPs bool
+	auditIPSalt  []byte
+	// trustedProxies are the peers whose X-Forwarded-For is believed.
+	trustedProxies []netip.Prefix
+)
+
+type auditEvent struct {
+	EventType string    `json:"event_type"`
+	Email     string    `json:"email,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ensureAuditSchema() error {
+	createAudit := `
+        CREATE TABLE IF NOT EXISTS auth_audit_log (
+            id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+            event_type VARCHAR(32) NOT NULL,
+            email VARCHAR(255) NOT NULL DEFAULT '',
+            client_ip VARCHAR(64) NOT NULL DEFAULT '',
+            user_agent VARCHAR(255) NOT NULL DEFAULT '',
+            outcome VARCHAR(16) NOT NULL,
+            detail VARCHAR(255) NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            INDEX idx_audit_email_created (email, created_at),
+            INDEX idx_audit_ip_created (client_ip, created_at)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `
+	_, err := db.Exec(createAudit)
+	return err
+}
+
+// recordAuthEvent writes an audit row for an authentication event. Audit
+// failures never fail the request; the event is logged instead so it still
+// reaches the log stream.
+func recordAuthEvent(r *http.Request, eventType, email, outcome, detail string) {
+	event := auditEvent{
+		EventType: eventType,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		ClientIP:  auditClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+		Outcome:   outcome,
+		Detail:    truncate(detail, 255),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// The row should land even if the client has already gone away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO auth_audit_log (event_type, email, client_ip, user_agent, outcome, detail, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, event.EventType, event.Email, event.ClientIP, event.UserAgent, event.Outcome, event.Detail, event.CreatedAt)
+	if err != nil {
+		payload, _ := json.Marshal(event)
+		log.Printf("audit insert error: %v; event: %s", err, payload)
+	}
+}
+
+// clientIP returns the originating client address. X-Forwarded-For is only
+// believed when the peer is a trusted proxy, and then only as far as the
+// hops that trusted proxies appended: it is walked from the right, and the
+// first address not in trustedProxies is the client. Anything to its left
+// was sent by the client and may be forged.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IP
+// addresses and CIDR ranges.
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func auditClientIP(r *http.Request) string {
+	ip := clientIP(r)
+	if !auditHashIPs || ip == "" {
+		return ip
+	}
+	mac := hmac.New(sha256.New, auditIPSalt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []netip.Prefix) { trustedProxies = saved }(trustedProxies)
+	trustedProxies = proxies
+
+	cases := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"forged header from an untrusted peer", "203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepends a forged hop", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "192.0.2.7:4000", []string{"198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"repeated headers", "10.1.2.3:4000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage hop stops the walk", "10.1.2.3:4000", []string{"198.51.100.1, bogus"}, "10.1.2.3"},
+		{"trusted proxy without header", "10.1.2.3:4000", nil, "10.1.2.3"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/api/session", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, raw := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1, ::1/200"} {
+		if _, err := parseTrustedProxies(raw); err == nil {
+			t.Errorf("parseTrustedProxies(%q) accepted an invalid entry", raw)
+		}
+	}
+	proxies, err := parseTrustedProxies("")
+	if err != nil || len(proxies) != 0 {
+		t.Fatalf("empty TRUSTED_PROXIES = %v, %v; want no proxies", proxies, err)
+	}
+}
+
+func TestAuditSaltRequired(t *testing.T) {
+	t.Setenv("KAFKA_URL", "kafka:9092")
+	t.Setenv("MYSQL_DSN", "user@/db")
+	t.Setenv("MESSAGE_SERVICE_URL", "http://message-service:8082")
+	t.Setenv("OTP_PEPPER", "pepper")
+	t.Setenv("AUDIT_HASH_IPS", "true")
+	t.Setenv("AUDIT_IP_SALT", "")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("AUDIT_HASH_IPS without AUDIT_IP_SALT was accepted")
+	}
+	t.Setenv("AUDIT_IP_SALT", "0123456789abcdef")
+	if _, err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// Registered for image.Decode.
+	_ "image/gif"
+	_ "image/png"
+)
+
+// GET /api/users?include_avatar=true embeds a small thumbnail of each avatar
+// as a data URI so a contact list renders without one photo request per
+// user. Thumbnails are built per request, so only small avatars qualify:
+// larger ones, images that fail to decode, the avatars of users past
+// maxEmbeddedAvatars and those past the request's pixel budget keep
+// has_avatar and are fetched from /api/users/photo as before.
+const (
+	// maxThumbnailSourceBytes is the largest stored avatar that is read
+	// and decoded for a thumbnail.
+	maxThumbnailSourceBytes = 512 * 1024
+	// maxThumbnailSourcePixels guards against small files that decode to
+	// huge images. The header is read with image.DecodeConfig first, so an
+	// image over it is never decoded.
+	maxThumbnailSourcePixels = 2048 * 2048
+	// maxThumbnailPixelsPerRequest caps the source pixels one request
+	// decodes across all its thumbnails: about a hundred 512x512 avatars.
+	maxThumbnailPixelsPerRequest = 32 * 1024 * 1024
+	avatarThumbnailSize          = 64
+	// maxThumbnailBytes caps one encoded thumbnail before base64.
+	maxThumbnailBytes  = 8 * 1024
+	maxEmbeddedAvatars = 100
+	thumbnailSamples   = 4
+)
+
+// avatarThumbnail returns a JPEG data URI of avatar scaled to fit
+// avatarThumbnailSize, or "" when it cannot or should not be embedded.
+// budget is the number of source pixels the request may still decode; the
+// avatar's pixels are taken from it before decoding.
+func avatarThumbnail(avatar []byte, budget *int) string {
+	if len(avatar) == 0 || len(avatar) > maxThumbnailSourceBytes {
+		return ""
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(avatar))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxThumbnailSourcePixels/cfg.Height {
+		return ""
+	}
+	pixels := cfg.Width * cfg.Height
+	if pixels > *budget {
+		return ""
+	}
+	*budget -= pixels
+	src, _, err := image.Decode(bytes.NewReader(avatar))
+	if err != nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(src, avatarThumbnailSize), &jpeg.Options{Quality: 75}); err != nil {
+		return ""
+	}
+	if buf.Len() > maxThumbnailBytes {
+		return ""
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// downscale fits src within size x size, keeping its aspect ratio. Each
+// output pixel averages a thumbnailSamples x thumbnailSamples grid of the
+// source pixels it covers; transparent areas are flattened onto white since
+// JPEG has no alpha.
+func downscale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > size || h > size {
+		if w >= h {
+			dw, dh = size, max(1, h*size/w)
+		} else {
+			dw, dh = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, bl, n uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				py := b.Min.Y + (y*thumbnailSamples+sy)*h/(dh*thumbnailSamples)
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := b.Min.X + (x*thumbnailSamples+sx)*w/(dw*thumbnailSamples)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					// Premultiplied: add white for the transparent part.
+					white := 0xffff - ca
+					r += cr + white
+					g += cg + white
+					bl += cb + white
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAvatarThumbnailBudget(t *testing.T) {
+	avatar := encodePNG(t, 100, 100)
+
+	budget := 25000
+	for i, want := range []bool{true, true, false} {
+		got := avatarThumbnail(avatar, &budget)
+		if (got != "") != want {
+			t.Fatalf("thumbnail %d: got %q, want embedded %t", i, got, want)
+		}
+		if want && !strings.HasPrefix(got, "data:image/jpeg;base64,") {
+			t.Fatalf("thumbnail %d is not a JPEG data URI: %q", i, got)
+		}
+	}
+	if budget != 5000 {
+		t.Fatalf("budget left %d, want 5000 after two 100x100 avatars", budget)
+	}
+}
+
+func TestAvatarThumbnailRejectsLargeImages(t *testing.T) {
+	budget := maxThumbnailPixelsPerRequest
+	// A blank image compresses to a few KiB however large it is, so only
+	// the header check keeps it from being decoded.
+	large := encodePNG(t, 4096, 2049)
+	if len(large) > maxThumbnailSourceBytes {
+		t.Fatalf("test image is %d bytes, over the size limit it should pass", len(large))
+	}
+	if got := avatarThumbnail(large, &budget); got != "" {
+		t.Fatal("embedded an image over maxThumbnailSourcePixels")
+	}
+	if budget != maxThumbnailPixelsPerRequest {
+		t.Fatalf("a rejected image used %d pixels of the budget", maxThumbnailPixelsPerRequest-budget)
+	}
+}
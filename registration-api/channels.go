@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A user signs in with one identifier, an email or a phone, and may add a
+// second one that they have shown they receive codes on. Step-up challenges
+// for logins from an unrecognized address go to that second channel, so
+// holding the login channel alone is not enough to answer them.
+//
+// Codes for these flows live in otp_codes under their own keys, so a code
+// sent to confirm a channel or to answer a challenge can never be used as a
+// login code, and the reverse.
+const (
+	channelLinkKeyPrefix = "link:"
+	stepUpKeyPrefix      = "stepup:"
+)
+
+func ensureChannelSchema() error {
+	createUserChannels := `
+        CREATE TABLE IF NOT EXISTS user_channels (
+            email VARCHAR(255) NOT NULL PRIMARY KEY,
+            identifier VARCHAR(255) NOT NULL,
+            verified_at DATETIME NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `
+	_, err := db.Exec(createUserChannels)
+	return err
+}
+
+// channelLinkKey is the otp_codes key of the code confirming that email's
+// owner receives codes at identifier. It names both, so a code sent to one
+// destination cannot confirm another; hashing keeps it within the column.
+func channelLinkKey(email, identifier string) string {
+	sum := sha256.Sum256([]byte(email + "\x00" + identifier))
+	return channelLinkKeyPrefix + hex.EncodeToString(sum[:20])
+}
+
+// stepUpKey is the otp_codes key of a step-up code sent to email's second
+// channel.
+func stepUpKey(email string) string {
+	return stepUpKeyPrefix + email
+}
+
+// secondChannel returns email's verified second identifier, or "" when the
+// user has none.
+func secondChannel(ctx context.Context, email string) (string, error) {
+	var identifier string
+	err := db.QueryRowContext(ctx, "SELECT identifier FROM user_channels WHERE email = ?", email).Scan(&identifier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return identifier, err
+}
+
+// maskIdentifier hides most of an email's local part or a phone number, for
+// telling the user where a code went.
+func maskIdentifier(identifier string) string {
+	if local, domain, ok := strings.Cut(identifier, "@"); ok {
+		if len(local) > 1 {
+			local = local[:1] + strings.Repeat("*", len(local)-1)
+		}
+		return local + "@" + domain
+	}
+	if len(identifier) <= 4 {
+		return identifier
+	}
+	return strings.Repeat("*", len(identifier)-4) + identifier[len(identifier)-4:]
+}
+
+// handleAPIProfileChannel manages the caller's second channel:
+//
+//	GET  /api/profile/channel          the verified second channel, if any
+//	POST /api/profile/channel          {channel, email|phone} sends a code there
+//	POST /api/profile/channel/verify   {channel, email|phone, otp} saves it
+func handleAPIProfileChannel(w http.ResponseWriter, r *http.Request) {
+	me, err := resolvePrincipal(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	email := strings.ToLower(me.Email)
+
+	verify := strings.TrimSuffix(r.URL.Path, "/") == "/api/profile/channel/verify"
+	if r.Method == http.MethodGet && !verify {
+		identifier, err := secondChannel(r.Context(), email)
+		if err != nil {
+			log.Printf("load second channel for %s error: %v", email, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load channel"})
+			return
+		}
+		if identifier == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"channel": nil})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"channel":     otpChannelFor(identifier),
+			"destination": identifier,
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	var payload struct {
+		Email   string `json:"email"`
+		Phone   string `json:"phone"`
+		Channel string `json:"channel"`
+		OTP     string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+		return
+	}
+	channel, destination := otpDestination(payload.Channel, payload.Email, payload.Phone)
+	identifier, err := normalizeOTPIdentifier(channel, destination)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if identifier == email {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "the second channel must differ from the one you sign in with"})
+		return
+	}
+
+	if !verify {
+		if err := enqueueOTPTo(r.Context(), channel, identifier, channelLinkKey(email, identifier)); err != nil {
+			log.Printf("Kafka write error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to queue otp"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	code := strings.TrimSpace(payload.OTP)
+	if code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "otp is required"})
+		return
+	}
+	if err := verifyOTP(channelLinkKey(email, identifier), code); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), `
+        INSERT INTO user_channels (email, identifier, verified_at) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE identifier = VALUES(identifier), verified_at = VALUES(verified_at)
+    `, email, identifier, time.Now().UTC()); err != nil {
+		log.Printf("save second channel for %s error: %v", email, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to save channel"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"channel":     channel,
+		"destination": identifier,
+	})
+}
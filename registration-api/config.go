@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything registration-api reads from the environment at
+// startup. loadConfig validates it in one pass so a bad deployment fails
+// before any connection is opened, listing every problem at once.
+type config struct {
+	listenAddr         string
+	kafkaURL           string
+	mysqlDSN           string
+	redisAddr          string
+	messageSvcURL      string
+	messageCallTimeout time.Duration
+	messageHTTPTimeout time.Duration
+	messageSyncTimeout time.Duration
+	jwtSecret          string
+	jwtIssuer          string
+	jwtAudience        string
+	internalAPIToken   string
+	loginPolicy        string
+	sessions           sessionPolicy
+	// messageRetries is how many times an idempotent GET to message-service
+	// is retried after a connection error or 5xx, waiting messageBackoff
+	// before the first retry and doubling it after each.
+	messageRetries int
+	messageBackoff time.Duration
+	// webhookURL, when set, receives a signed POST per new conversation.
+	webhookURL    string
+	webhookSecret string
+	// messagePageSize is how many messages a listing returns when the
+	// client sends no limit.
+	messagePageSize int
+	// otpPepper is the HMAC key email-worker stores codes under.
+	otpPepper string
+	// auditHashIPs stores audit and login-risk IPs as an HMAC keyed with
+	// auditIPSalt, which must then be set.
+	auditHashIPs bool
+	auditIPSalt  string
+	// trustedProxies are the peers allowed to set X-Forwarded-For.
+	trustedProxies []netip.Prefix
+	// corsAllowedOrigins is CORS_ALLOWED_ORIGINS: comma separated origins,
+	// or "*" for any.
+	corsAllowedOrigins string
+}
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// required returns the trimmed value of key, recording a problem when unset.
+func (p *configProblems) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		p.add("%s must be set", key)
+	}
+	return v
+}
+
+// millis parses a positive millisecond duration, recording a problem rather
+// than silently falling back when the value is malformed.
+func (p *configProblems) millis(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	ms, err := strconv.Atoi(raw)
+	if err != nil || ms <= 0 {
+		p.add("%s must be a positive number of milliseconds, got %q", key, raw)
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// intAtLeast parses an integer no smaller than min, recording a problem
+// rather than silently falling back when the value is malformed.
+func (p *configProblems) intAtLeast(key string, min, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min {
+		p.add("%s must be an integer >= %d, got %q", key, min, raw)
+		return fallback
+	}
+	return n
+}
+
+// boolean parses true or false, recording a problem for anything else.
+func (p *configProblems) boolean(key string, fallback bool) bool {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.add("%s must be true or false, got %q", key, raw)
+		return fallback
+	}
+	return v
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	cfg := config{
+		listenAddr:       envOrDefault("LISTEN_ADDR", ":8080"),
+		kafkaURL:         problems.required("KAFKA_URL"),
+		mysqlDSN:         problems.required("MYSQL_DSN"),
+		redisAddr:        envOrDefault("REDIS_ADDR", "redis:6379"),
+		messageSvcURL:    problems.required("MESSAGE_SERVICE_URL"),
+		jwtSecret:        strings.TrimSpace(os.Getenv("JWT_SECRET")),
+		jwtIssuer:        envOrDefault("JWT_ISSUER", "registration-api"),
+		jwtAudience:      envOrDefault("JWT_AUDIENCE", "chat"),
+		internalAPIToken: strings.TrimSpace(os.Getenv("INTERNAL_API_TOKEN")),
+		loginPolicy:      strings.ToLower(envOrDefault("SUSPICIOUS_LOGIN_POLICY", loginPolicyFlag)),
+		otpPepper:        problems.required("OTP_PEPPER"),
+
+		corsAllowedOrigins: envOrDefault("CORS_ALLOWED_ORIGINS", "http://localhost:5173,http://127.0.0.1:5173"),
+	}
+
+	if cfg.messageSvcURL != "" {
+		if u, err := url.Parse(cfg.messageSvcURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("MESSAGE_SERVICE_URL must be an absolute URL, got %q", cfg.messageSvcURL)
+		}
+	}
+
+	// The http.Client timeout is clamped to the call timeout so a single
+	// round trip can never outlive the caller's deadline.
+	cfg.messageCallTimeout = problems.millis("MESSAGE_SERVICE_TIMEOUT_MS", 5*time.Second)
+	cfg.messageHTTPTimeout = problems.millis("MESSAGE_SERVICE_HTTP_TIMEOUT_MS", cfg.messageCallTimeout)
+	if cfg.messageHTTPTimeout > cfg.messageCallTimeout {
+		log.Printf("MESSAGE_SERVICE_HTTP_TIMEOUT_MS (%s) exceeds MESSAGE_SERVICE_TIMEOUT_MS (%s); using %s", cfg.messageHTTPTimeout, cfg.messageCallTimeout, cfg.messageCallTimeout)
+		cfg.messageHTTPTimeout = cfg.messageCallTimeout
+	}
+	// A sync reads every conversation the user is in, so it keeps the longer
+	// deadline it always had.
+	cfg.messageSyncTimeout = problems.millis("MESSAGE_SERVICE_SYNC_TIMEOUT_MS", 10*time.Second)
+	cfg.messageRetries = problems.intAtLeast("MESSAGE_SERVICE_GET_RETRIES", 0, 2)
+	cfg.messageBackoff = problems.millis("MESSAGE_SERVICE_RETRY_BACKOFF_MS", 100*time.Millisecond)
+
+	switch cfg.loginPolicy {
+	case loginPolicyOff, loginPolicyFlag, loginPolicyBlock:
+	default:
+		problems.add("SUSPICIOUS_LOGIN_POLICY must be one of %s, %s or %s, got %q", loginPolicyOff, loginPolicyFlag, loginPolicyBlock, cfg.loginPolicy)
+	}
+
+	cfg.sessions = sessionPolicy{
+		ttl:                time.Duration(problems.intAtLeast("SESSION_TTL_DAYS", 1, 90)) * 24 * time.Hour,
+		refreshWindow:      time.Duration(problems.intAtLeast("SESSION_REFRESH_WINDOW_DAYS", 0, 0)) * 24 * time.Hour,
+		refreshMinInterval: time.Duration(problems.intAtLeast("SESSION_REFRESH_MIN_INTERVAL_MINUTES", 1, 60)) * time.Minute,
+	}
+	if cfg.sessions.refreshWindow > cfg.sessions.ttl {
+		problems.add("SESSION_REFRESH_WINDOW_DAYS (%s) must not exceed SESSION_TTL_DAYS (%s)", cfg.sessions.refreshWindow, cfg.sessions.ttl)
+	}
+
+	cfg.webhookURL = strings.TrimSpace(os.Getenv("WEBHOOK_URL"))
+	cfg.webhookSecret = strings.TrimSpace(os.Getenv("WEBHOOK_SECRET"))
+	if cfg.webhookURL != "" {
+		if u, err := url.Parse(cfg.webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("WEBHOOK_URL must be an absolute http or https URL, got %q", cfg.webhookURL)
+		}
+		if cfg.webhookSecret == "" {
+			problems.add("WEBHOOK_SECRET must be set when WEBHOOK_URL is set")
+		}
+	}
+
+	cfg.messagePageSize = problems.intAtLeast("MESSAGE_PAGE_SIZE", 1, defaultMessagePageSize)
+	if cfg.messagePageSize > maxMessagePageSize {
+		problems.add("MESSAGE_PAGE_SIZE must be at most %d, got %d", maxMessagePageSize, cfg.messagePageSize)
+	}
+
+	cfg.auditHashIPs = problems.boolean("AUDIT_HASH_IPS", false)
+	cfg.auditIPSalt = strings.TrimSpace(os.Getenv("AUDIT_IP_SALT"))
+	if cfg.auditHashIPs && len(cfg.auditIPSalt) < minAuditIPSaltLength {
+		problems.add("AUDIT_IP_SALT must be at least %d characters when AUDIT_HASH_IPS is true", minAuditIPSaltLength)
+	}
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		problems.add("TRUSTED_PROXIES must be a comma separated list of IP addresses and CIDR ranges: %v", err)
+	}
+	cfg.trustedProxies = proxies
+
+	for _, part := range strings.Split(cfg.corsAllowedOrigins, ",") {
+		origin := strings.TrimSpace(part)
+		if origin == "" || origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			problems.add("CORS_ALLOWED_ORIGINS entries must be origins such as https://example.com, got %q", origin)
+		}
+	}
+
+	return cfg, problems.err()
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: listen=%s kafka=%s redis=%s message_service=%s (timeout %s, http %s, sync %s, get retries %d, backoff %s) jwt=%t issuer=%s audience=%s internal_token=%t login_policy=%s session_ttl=%s session_refresh_window=%s webhook=%t message_page_size=%d audit_hash_ips=%t trusted_proxies=%v cors_origins=%s",
+		c.listenAddr, c.kafkaURL, c.redisAddr, c.messageSvcURL, c.messageCallTimeout, c.messageHTTPTimeout, c.messageSyncTimeout, c.messageRetries, c.messageBackoff,
+		c.jwtSecret != "", c.jwtIssuer, c.jwtAudience, c.internalAPIToken != "", c.loginPolicy, c.sessions.ttl, c.sessions.refreshWindow, c.webhookURL != "", c.messagePageSize, c.auditHashIPs, c.trustedProxies, c.corsAllowedOrigins)
+}
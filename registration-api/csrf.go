@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Requests authenticated by the session_token cookie are exposed to CSRF,
+// since the browser attaches the cookie and CORS allows credentials. They
+// must use the double-submit pattern:
+//
+//   - Sign-in and GET /api/session set a csrf_token cookie and return the
+//     same value as csrf_token in the body. The cookie is readable by
+//     scripts, unlike the session cookie.
+//   - Every POST, PUT, PATCH or DELETE that carries the session cookie and no
+//     Authorization header must echo the value in X-CSRF-Token.
+//
+// Bearer-authenticated requests are not checked: a cross-site page cannot
+// make the browser attach an Authorization header.
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfTokenBytes = 32
+)
+
+// csrfExemptPaths authenticate without the session cookie, so a stale cookie
+// must not block them.
+var csrfExemptPaths = map[string]struct{}{
+	"/api/request-otp": {},
+	"/api/verify-otp":  {},
+}
+
+// csrfProtect rejects unsafe cookie-authenticated requests whose
+// X-CSRF-Token header does not match the csrf_token cookie.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrfRequired(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookieName)
+		header := strings.TrimSpace(r.Header.Get(csrfHeaderName))
+		if err != nil || cookie.Value == "" || header == "" ||
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "missing or invalid CSRF token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfRequired reports whether r changes state using cookie authentication.
+func csrfRequired(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if _, ok := csrfExemptPaths[r.URL.Path]; ok {
+		return false
+	}
+	if bearerToken(r) != "" {
+		return false
+	}
+	cookie, err := r.Cookie("session_token")
+	return err == nil && strings.TrimSpace(cookie.Value) != ""
+}
+
+// issueCSRFToken sets the csrf_token cookie, keeping the value of one the
+// client already holds but renewing its lifetime, and returns the value.
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	token := ""
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) == 2*csrfTokenBytes {
+		token = cookie.Value
+	} else {
+		buf := make([]byte, csrfTokenBytes)
+		if _, err := rand.Read(buf); err != nil {
+			return ""
+		}
+		token = hex.EncodeToString(buf)
+	}
+	// The API is called cross-origin with credentials, so over HTTPS the
+	// cookie must be SameSite=None to travel with those requests. Browsers
+	// only accept that on Secure cookies.
+	secure := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	sameSite := http.SameSiteLaxMode
+	if secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.ttl.Seconds()),
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+	return token
+}
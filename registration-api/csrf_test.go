@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	const token = "0123456789abcdef"
+	handler := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		session bool
+		cookie  string
+		header  string
+		bearer  string
+		want    int
+	}{
+		{name: "cookie without header", method: http.MethodPost, path: "/api/conversations", session: true, cookie: token, want: http.StatusForbidden},
+		{name: "cookie with mismatched header", method: http.MethodPost, path: "/api/conversations", session: true, cookie: token, header: "fedcba9876543210", want: http.StatusForbidden},
+		{name: "header without csrf cookie", method: http.MethodDelete, path: "/api/session", session: true, header: token, want: http.StatusForbidden},
+		{name: "cookie with matching header", method: http.MethodPost, path: "/api/conversations", session: true, cookie: token, header: token, want: http.StatusNoContent},
+		{name: "bearer with session cookie", method: http.MethodPost, path: "/api/conversations", session: true, bearer: "jwt", want: http.StatusNoContent},
+		{name: "request-otp is exempt", method: http.MethodPost, path: "/api/request-otp", session: true, cookie: token, want: http.StatusNoContent},
+		{name: "verify-otp is exempt", method: http.MethodPost, path: "/api/verify-otp", session: true, cookie: token, header: "stale", want: http.StatusNoContent},
+		{name: "safe method", method: http.MethodGet, path: "/api/conversations", session: true, want: http.StatusNoContent},
+		{name: "no session cookie", method: http.MethodPost, path: "/api/conversations", want: http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.session {
+				r.AddCookie(&http.Cookie{Name: "session_token", Value: "session"})
+			}
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tc.cookie})
+			}
+			if tc.header != "" {
+				r.Header.Set(csrfHeaderName, tc.header)
+			}
+			if tc.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.bearer)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("status %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
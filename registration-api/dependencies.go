@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"servicekit/readiness"
+)
+
+// ready holds back every route but / and /readyz until startup migrations
+// are done, then reports checkDependencies on /readyz.
+var ready = &readiness.Gate{Liveness: "/", Checks: checkDependencies}
+
+// dependencyCheckTimeout bounds each /readyz dependency check, so a hung
+// dependency fails the probe instead of stalling it.
+const dependencyCheckTimeout = 2 * time.Second
+
+// checkDependencies probes MySQL, Redis, Kafka and message-service in
+// parallel and reports "ok" or the error for each, and whether all passed.
+func checkDependencies(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"mysql": func(ctx context.Context) error {
+			return db.PingContext(ctx)
+		},
+		"redis": func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		},
+		"kafka":           pingKafka,
+		"message_service": pingMessageService,
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]string, len(checks))
+		healthy = true
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			status := "ok"
+			if err := check(ctx); err != nil {
+				status = err.Error()
+			}
+			mu.Lock()
+			results[name] = status
+			if status != "ok" {
+				healthy = false
+			}
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results, healthy
+}
+
+// pingKafka fetches broker metadata from the cluster the registration
+// writer publishes to.
+func pingKafka(ctx context.Context) error {
+	conn, err := kafka.DialContext(ctx, writer.Addr.Network(), writer.Addr.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Brokers()
+	return err
+}
+
+// pingMessageService sends a HEAD to message-service's base URL. Any answer
+// below 500 means it is up; while it is still migrating it answers 503.
+func pingMessageService(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, messageSvc.baseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := messageSvc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
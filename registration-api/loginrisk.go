@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policies for logins from an address the user has never verified from.
+const (
+	loginPolicyOff   = "off"
+	loginPolicyFlag  = "flag"
+	loginPolicyBlock = "block"
+)
+
+const (
+	auditSuspiciousLogin = "suspicious_login"
+	auditStepUp          = "step_up_required"
+
+	// recentLoginRetention bounds the per-user history so the table stays
+	// small; addresses not seen for this long count as new again.
+	recentLoginRetention = 90 * 24 * time.Hour
+	// stepUpWindow is how long a blocked address waits for the follow-up
+	// verification before the next login from it is challenged afresh.
+	stepUpWindow = 15 * time.Minute
+)
+
+var suspiciousLoginPolicy = loginPolicyFlag
+
+// loginAssessment is the outcome of checking a verified login against the
+// user's recent history.
+type loginAssessment struct {
+	Unrecognized bool
+	StepUp       bool
+	// SecondChannel is the user's verified second identifier, where step-up
+	// codes go, or "" when they have none.
+	SecondChannel string
+}
+
+func ensureLoginRiskSchema() error {
+	createRecentLogins := `
+        CREATE TABLE IF NOT EXISTS recent_logins (
+            email VARCHAR(255) NOT NULL,
+            client_ip VARCHAR(64) NOT NULL,
+            user_agent VARCHAR(255) NOT NULL DEFAULT '',
+            verified TINYINT(1) NOT NULL DEFAULT 1,
+            first_seen_at DATETIME NOT NULL,
+            last_seen_at DATETIME NOT NULL,
+            PRIMARY KEY (email, client_ip)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `
+	_, err := db.Exec(createRecentLogins)
+	return err
+}
+
+// assessLogin runs after the OTP has been verified. A login from an address
+// the user has no verified history for is flagged, and under the block
+// policy it must be confirmed by a second OTP. Users with no history at all
+// are never challenged. The address is clientIP's, which only believes
+// X-Forwarded-For from trusted proxies, so a client cannot pick one it has
+// history for.
+//
+// The second OTP goes to the user's verified second channel when they have
+// one, and then only a login presenting that code (stepUpVerified) answers
+// the challenge. Otherwise it goes to the login channel, and any verified
+// login from the address within stepUpWindow answers it.
+func assessLogin(ctx context.Context, r *http.Request, email string, stepUpVerified bool) (loginAssessment, error) {
+	var result loginAssessment
+	if suspiciousLoginPolicy == loginPolicyOff {
+		return result, nil
+	}
+
+	email = strings.ToLower(email)
+	ip := auditClientIP(r)
+	ua := truncate(r.UserAgent(), 255)
+	now := time.Now().UTC()
+
+	if _, err := db.ExecContext(ctx,
+		"DELETE FROM recent_logins WHERE email = ? AND last_seen_at < ?",
+		email, now.Add(-recentLoginRetention),
+	); err != nil {
+		log.Printf("prune recent logins error: %v", err)
+	}
+
+	var established int
+	if err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM recent_logins WHERE email = ? AND verified = 1",
+		email,
+	).Scan(&established); err != nil {
+		return result, err
+	}
+
+	var (
+		verified bool
+		lastSeen time.Time
+	)
+	err := db.QueryRowContext(ctx,
+		"SELECT verified, last_seen_at FROM recent_logins WHERE email = ? AND client_ip = ?",
+		email, ip,
+	).Scan(&verified, &lastSeen)
+	known := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return result, err
+	}
+
+	if result.SecondChannel, err = secondChannel(ctx, email); err != nil {
+		return result, err
+	}
+
+	// A pending row inside the window means this login is the follow-up
+	// verification for an earlier challenge.
+	pendingConfirmed := known && !verified && now.Sub(lastSeen) <= stepUpWindow &&
+		(result.SecondChannel == "" || stepUpVerified)
+	result.Unrecognized = established > 0 && (!known || !verified)
+
+	if result.Unrecognized && suspiciousLoginPolicy == loginPolicyBlock && !pendingConfirmed {
+		result.StepUp = true
+		_, err := db.ExecContext(ctx, `
+            INSERT INTO recent_logins (email, client_ip, user_agent, verified, first_seen_at, last_seen_at)
+            VALUES (?, ?, ?, 0, ?, ?)
+            ON DUPLICATE KEY UPDATE user_agent = VALUES(user_agent), last_seen_at = VALUES(last_seen_at)
+        `, email, ip, ua, now, now)
+		return result, err
+	}
+
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO recent_logins (email, client_ip, user_agent, verified, first_seen_at, last_seen_at)
+        VALUES (?, ?, ?, 1, ?, ?)
+        ON DUPLICATE KEY UPDATE user_agent = VALUES(user_agent), verified = 1, last_seen_at = VALUES(last_seen_at)
+    `, email, ip, ua, now, now)
+	return result, err
+}
+
+// requestStepUpOTP queues the code for the follow-up verification: to the
+// second channel under stepUpKey when there is one, otherwise as a fresh
+// login code over the channel being challenged.
+func requestStepUpOTP(ctx context.Context, identifier, second string) error {
+	if second == "" {
+		return enqueueOTP(ctx, otpChannelFor(identifier), identifier)
+	}
+	return enqueueOTPTo(ctx, otpChannelFor(second), second, stepUpKey(identifier))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loginHistory is an in-memory recent_logins and user_channels behind
+// database/sql, answering the queries assessLogin makes.
+type loginHistory struct {
+	mu       sync.Mutex
+	logins   map[string]*recentLogin // keyed by email + " " + client_ip
+	channels map[string]string
+}
+
+type recentLogin struct {
+	verified bool
+	lastSeen time.Time
+}
+
+func (h *loginHistory) Connect(context.Context) (driver.Conn, error) { return historyConn{h}, nil }
+func (h *loginHistory) Driver() driver.Driver                        { return nil }
+
+type historyConn struct{ h *loginHistory }
+
+func (c historyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c historyConn) Close() error                        { return nil }
+func (c historyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c historyConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.h.mu.Lock()
+	defer c.h.mu.Unlock()
+	email := args[0].Value.(string)
+	switch {
+	case strings.HasPrefix(query, "SELECT COUNT(*) FROM recent_logins"):
+		n := int64(0)
+		for key, login := range c.h.logins {
+			if strings.HasPrefix(key, email+" ") && login.verified {
+				n++
+			}
+		}
+		return &historyRows{cols: []string{"count"}, row: []driver.Value{n}}, nil
+	case strings.HasPrefix(query, "SELECT verified, last_seen_at FROM recent_logins"):
+		login, ok := c.h.logins[email+" "+args[1].Value.(string)]
+		if !ok {
+			return &historyRows{cols: []string{"verified", "last_seen_at"}}, nil
+		}
+		return &historyRows{cols: []string{"verified", "last_seen_at"}, row: []driver.Value{login.verified, login.lastSeen}}, nil
+	case strings.HasPrefix(query, "SELECT identifier FROM user_channels"):
+		identifier, ok := c.h.channels[email]
+		if !ok {
+			return &historyRows{cols: []string{"identifier"}}, nil
+		}
+		return &historyRows{cols: []string{"identifier"}, row: []driver.Value{identifier}}, nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+func (c historyConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.h.mu.Lock()
+	defer c.h.mu.Unlock()
+	query = strings.TrimSpace(query)
+	switch {
+	case strings.HasPrefix(query, "DELETE FROM recent_logins"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(query, "INSERT INTO recent_logins"):
+		key := args[0].Value.(string) + " " + args[1].Value.(string)
+		login, ok := c.h.logins[key]
+		if !ok {
+			login = &recentLogin{}
+			c.h.logins[key] = login
+		}
+		if strings.Contains(query, "VALUES (?, ?, ?, 1, ?, ?)") {
+			login.verified = true
+		}
+		login.lastSeen = args[len(args)-1].Value.(time.Time)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+type historyRows struct {
+	cols []string
+	row  []driver.Value
+}
+
+func (r *historyRows) Columns() []string { return r.cols }
+func (r *historyRows) Close() error      { return nil }
+func (r *historyRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+func withLoginHistory(t *testing.T, history *loginHistory) {
+	t.Helper()
+	savedDB, savedPolicy, savedProxies := db, suspiciousLoginPolicy, trustedProxies
+	db = sql.OpenDB(history)
+	suspiciousLoginPolicy = loginPolicyBlock
+	trustedProxies = nil
+	t.Cleanup(func() {
+		db.Close()
+		db, suspiciousLoginPolicy, trustedProxies = savedDB, savedPolicy, savedProxies
+	})
+}
+
+func assessFrom(t *testing.T, email, remote, forwardedFor string, stepUpVerified bool) loginAssessment {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/verify-otp", nil)
+	r.RemoteAddr = remote
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	result, err := assessLogin(context.Background(), r, email, stepUpVerified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestAssessLoginStepUpGoesToSecondChannel(t *testing.T) {
+	const email = "alice@example.com"
+	history := &loginHistory{
+		logins:   map[string]*recentLogin{email + " 203.0.113.5": {verified: true, lastSeen: time.Now()}},
+		channels: map[string]string{email: "+15551234567"},
+	}
+	withLoginHistory(t, history)
+
+	// A forged X-Forwarded-For naming the known address is not believed.
+	got := assessFrom(t, email, "198.51.100.9:4000", "203.0.113.5", false)
+	if !got.StepUp || got.SecondChannel != "+15551234567" {
+		t.Fatalf("login from a new address = %+v, want a step-up to the second channel", got)
+	}
+
+	// Logging in again with a fresh code from the login channel does not
+	// answer a challenge sent to the second channel.
+	if got := assessFrom(t, email, "198.51.100.9:4000", "", false); !got.StepUp {
+		t.Fatal("a login-channel code answered the second-channel challenge")
+	}
+
+	if got := assessFrom(t, email, "198.51.100.9:4000", "", true); got.StepUp || !got.Unrecognized {
+		t.Fatalf("answered challenge = %+v, want an allowed, flagged login", got)
+	}
+	if got := assessFrom(t, email, "198.51.100.9:4000", "", false); got.StepUp || got.Unrecognized {
+		t.Fatalf("login from the confirmed address = %+v, want it recognized", got)
+	}
+}
+
+func TestAssessLoginStepUpWithoutSecondChannel(t *testing.T) {
+	const email = "bob@example.com"
+	history := &loginHistory{
+		logins:   map[string]*recentLogin{email + " 203.0.113.5": {verified: true, lastSeen: time.Now()}},
+		channels: map[string]string{},
+	}
+	withLoginHistory(t, history)
+
+	got := assessFrom(t, email, "198.51.100.9:4000", "", false)
+	if !got.StepUp || got.SecondChannel != "" {
+		t.Fatalf("login from a new address = %+v, want a step-up on the login channel", got)
+	}
+	if got := assessFrom(t, email, "198.51.100.9:4000", "", false); got.StepUp {
+		t.Fatal("a fresh login code did not answer the challenge")
+	}
+}
+
+func TestMaskIdentifier(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice@example.com": "a****@example.com",
+		"+15551234567":      "********4567",
+	} {
+		if got := maskIdentifier(in); got != want {
+			t.Errorf("maskIdentifier(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if channelLinkKey("a@example.com", "+15551234567") == channelLinkKey("a@example.com", "+15557654321") {
+		t.Fatal("channel codes for different destinations share a key")
+	}
+}
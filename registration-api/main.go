@@ -13,18 +13,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	redis "github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 var (
@@ -32,50 +36,110 @@ var (
 	writer           *kafka.Writer
 	messageSvc       *messageServiceClient
 	jwtSecret        []byte
+	jwtIssuer        string
+	jwtAudience      string
 	redisClient      *redis.Client
 	allowedOrigins   []string
 	allowedOriginSet map[string]struct{}
 	allowAnyOrigin   bool
+	internalAPIToken string
+	otpPepper        []byte
 )
 
 type session struct {
 	Token     string
 	Email     string
+	Scope     string
 	ExpiresAt time.Time
+	// ID is the listed id of the backing sessions row. It is empty for a
+	// JWT issued before tokens carried one.
+	ID string
+	// FromJWT is set when the request authenticated with a JWT rather than
+	// a session token.
+	FromJWT bool
+}
+
+// Principal is the caller identity resolved from a request. Services fill in
+// whichever fields their credentials carry: registration-api knows the email
+// (and scope for JWTs) but has no numeric user id.
+type Principal struct {
+	Email  string
+	UserID int64
+	Scope  string
 }
 
 type deviceTokenPayload struct {
 	DeviceToken string `json:"device_token"`
 	Platform    string `json:"platform,omitempty"`
+	Logout      bool   `json:"logout,omitempty"`
 }
 
 func main() {
-	kafkaURL := os.Getenv("KAFKA_URL")
-	mysqlDSN := os.Getenv("MYSQL_DSN")
-	messageSvcURL := os.Getenv("MESSAGE_SERVICE_URL")
-	jwtSecretValue := strings.TrimSpace(os.Getenv("JWT_SECRET"))
-	if jwtSecretValue != "" {
-		jwtSecret = []byte(jwtSecretValue)
-	} else {
-		log.Println("JWT_SECRET is not set; JWT access tokens will be disabled")
-	}
-	if kafkaURL == "" {
-		log.Fatal("KAFKA_URL must be set")
-	}
-	if mysqlDSN == "" {
-		log.Fatal("MYSQL_DSN must be set")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-	if messageSvcURL == "" {
-		log.Fatal("MESSAGE_SERVICE_URL must be set")
+	cfg.logSummary()
+
+	shutdownTracing, err := setupTracing(context.Background(), "registration-api")
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	redisAddr := strings.TrimSpace(os.Getenv("REDIS_ADDR"))
-	if redisAddr == "" {
-		redisAddr = "redis:6379"
+	if cfg.jwtSecret != "" {
+		jwtSecret = []byte(cfg.jwtSecret)
+	} else {
+		log.Println("JWT_SECRET is not set; JWT access tokens will be disabled")
 	}
+	jwtIssuer = cfg.jwtIssuer
+	jwtAudience = cfg.jwtAudience
+	suspiciousLoginPolicy = cfg.loginPolicy
+	internalAPIToken = cfg.internalAPIToken
+	otpPepper = []byte(cfg.otpPepper)
+	sessionLifetime = cfg.sessions
+	conversationWebhook = newWebhookNotifier(cfg.webhookURL, cfg.webhookSecret)
+	messagePageSize = cfg.messagePageSize
+
+	auditHashIPs = cfg.auditHashIPs
+	auditIPSalt = []byte(cfg.auditIPSalt)
+	trustedProxies = cfg.trustedProxies
 
-	var err error
-	db, err = sql.Open("mysql", mysqlDSN)
+	configureAllowedOrigins(cfg.corsAllowedOrigins)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleHealth)
+	mux.HandleFunc("/api/request-otp", handleAPIRequestOTP)
+	mux.HandleFunc("/api/verify-otp", handleAPIVerifyOTP)
+	mux.HandleFunc("/api/conversations", handleAPIConversations)
+	mux.HandleFunc("/api/conversations/", handleAPIConversationResource)
+	mux.HandleFunc("/api/conversations/unread", handleAPIConversationsUnread)
+	mux.HandleFunc("/api/messages/sync", handleAPIMessagesSync)
+	mux.HandleFunc("/api/device", handleRegisterDevice)
+	mux.HandleFunc("/api/device/associate", handleAssociateDevice)
+	mux.HandleFunc("/api/session", handleAPISession)
+	mux.HandleFunc("/api/sessions", handleAPISessions)
+	mux.HandleFunc("/api/sessions/", handleAPISessionResource)
+	mux.HandleFunc("/api/token/refresh", handleAPITokenRefresh)
+	mux.HandleFunc("/api/users", handleAPIUsers)
+	mux.HandleFunc("/api/users/all", handleAPIUsersAll)
+	mux.HandleFunc("/api/profile", handleAPIProfile)
+	mux.HandleFunc("/api/profile/photo", handleAPIProfilePhoto)
+	mux.HandleFunc("/api/profile/channel", handleAPIProfileChannel)
+	mux.HandleFunc("/api/profile/channel/verify", handleAPIProfileChannel)
+	mux.HandleFunc("/api/users/photo", handleAPIUserPhoto)
+	mux.HandleFunc("/internal/users/lookup", handleInternalUserLookup)
+
+	// Bind early so /readyz can report "migrating"; every other route is
+	// held back until the schema has been applied.
+	listenAddr := cfg.listenAddr
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Registration API running on " + listenAddr)
+		serveErr <- http.ListenAndServe(listenAddr, traceHandler(mux, corsMiddleware(ready.Wrap(csrfProtect(mux)))))
+	}()
+
+	db, err = sql.Open("mysql", cfg.mysqlDSN)
 	if err != nil {
 		log.Fatalf("mysql connection error: %v", err)
 	}
@@ -90,45 +154,66 @@ func main() {
 	}
 
 	redisClient = redis.NewClient(&redis.Options{
-		Addr: redisAddr,
+		Addr: cfg.redisAddr,
 	})
 	if err := redisClient.Ping(context.Background()).Err(); err != nil {
 		log.Fatalf("redis connection error: %v", err)
 	}
 
 	writer = &kafka.Writer{
-		Addr:     kafka.TCP(kafkaURL),
+		Addr:     kafka.TCP(cfg.kafkaURL),
 		Topic:    "new-registration",
 		Balancer: &kafka.LeastBytes{},
 	}
 
-	messageSvc = newMessageServiceClient(messageSvcURL)
-	configureAllowedOrigins()
+	messageSvc = newMessageServiceClient(cfg.messageSvcURL, cfg.messageCallTimeout, cfg.messageHTTPTimeout, cfg.messageSyncTimeout, cfg.messageRetries, cfg.messageBackoff)
+	go syncConversationAvatars(context.Background())
+	ready.MarkReady()
+	log.Println("schema ready; serving requests")
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleHealth)
-	mux.HandleFunc("/api/request-otp", handleAPIRequestOTP)
-	mux.HandleFunc("/api/verify-otp", handleAPIVerifyOTP)
-	mux.HandleFunc("/api/conversations", handleAPIConversations)
-	mux.HandleFunc("/api/conversations/", handleAPIConversationResource)
-	mux.HandleFunc("/api/device", handleRegisterDevice)
-	mux.HandleFunc("/api/device/associate", handleAssociateDevice)
-	mux.HandleFunc("/api/session", handleAPISession)
-	mux.HandleFunc("/api/users", handleAPIUsers)
-	mux.HandleFunc("/api/users/all", handleAPIUsersAll)
-	mux.HandleFunc("/api/profile", handleAPIProfile)
-	mux.HandleFunc("/api/profile/photo", handleAPIProfilePhoto)
-	mux.HandleFunc("/api/users/photo", handleAPIUserPhoto)
+	log.Fatal(<-serveErr)
+}
+
+// columnExists reports whether table in the current database has column, so
+// schema changes run once instead of rewriting the table on every boot.
+func columnExists(table, column string) (bool, error) {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		table, column,
+	).Scan(&n)
+	return n > 0, err
+}
+
+// tableExists reports whether the current database has table.
+func tableExists(table string) (bool, error) {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`,
+		table,
+	).Scan(&n)
+	return n > 0, err
+}
 
-	fmt.Println("Registration API running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", corsMiddleware(mux)))
+// columnLength returns the declared maximum length of a character column, or
+// 0 when the column does not exist.
+func columnLength(table, column string) (int64, error) {
+	var n sql.NullInt64
+	err := db.QueryRow(
+		`SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		table, column,
+	).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return n.Int64, err
 }
 
 func ensureSchema() error {
 	createOTPs := `
         CREATE TABLE IF NOT EXISTS otp_codes (
             email VARCHAR(255) NOT NULL PRIMARY KEY,
-            code VARCHAR(12) NOT NULL,
+            code VARCHAR(128) NOT NULL,
             expires_at DATETIME NOT NULL,
             created_at DATETIME NOT NULL
         ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -136,6 +221,14 @@ func ensureSchema() error {
 	if _, err := db.Exec(createOTPs); err != nil {
 		return err
 	}
+	// Tables created before codes were hashed have a VARCHAR(12) column.
+	if n, err := columnLength("otp_codes", "code"); err != nil {
+		return err
+	} else if n < 128 {
+		if _, err := db.Exec(`ALTER TABLE otp_codes MODIFY code VARCHAR(128) NOT NULL`); err != nil {
+			return err
+		}
+	}
 
 	createSessions := `
         CREATE TABLE IF NOT EXISTS sessions (
@@ -170,13 +263,42 @@ func ensureSchema() error {
             name VARCHAR(255) NOT NULL DEFAULT '',
             avatar LONGBLOB NULL,
             avatar_content_type VARCHAR(64) DEFAULT NULL,
-            updated_at DATETIME NOT NULL
+            updated_at DATETIME NOT NULL,
+            INDEX idx_profile_name (name)
         ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
     `
 	if _, err := db.Exec(createProfiles); err != nil {
 		return err
 	}
 
+	// users has one row per identifier that has ever signed in. Sessions
+	// expire and are deleted on logout, so they cannot say who is
+	// registered. When the table is first created it is filled from the
+	// sessions and profiles that exist.
+	hadUsers, err := tableExists("users")
+	if err != nil {
+		return err
+	}
+	createUsers := `
+        CREATE TABLE IF NOT EXISTS users (
+            email VARCHAR(255) NOT NULL PRIMARY KEY,
+            created_at DATETIME NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `
+	if _, err := db.Exec(createUsers); err != nil {
+		return err
+	}
+	if !hadUsers {
+		if _, err := db.Exec(`
+            INSERT IGNORE INTO users (email, created_at)
+            SELECT LOWER(email), MIN(created_at) FROM sessions GROUP BY LOWER(email)
+            UNION ALL
+            SELECT LOWER(email), MIN(updated_at) FROM user_profiles GROUP BY LOWER(email)
+        `); err != nil {
+			return err
+		}
+	}
+
 	createConversationAvatars := `
         CREATE TABLE IF NOT EXISTS conversation_avatars (
             conversation_id VARCHAR(64) NOT NULL PRIMARY KEY,
@@ -188,30 +310,62 @@ func ensureSchema() error {
 	if _, err := db.Exec(createConversationAvatars); err != nil {
 		return err
 	}
+	// avatar_synced records that message-service knows the row's current
+	// avatar state. Rows from before it existed start unsynced, so
+	// syncConversationAvatars backfills has_avatar for them.
+	synced, err := columnExists("conversation_avatars", "avatar_synced")
+	if err != nil {
+		return err
+	}
+	if !synced {
+		if _, err := db.Exec(`ALTER TABLE conversation_avatars ADD COLUMN avatar_synced TINYINT(1) NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+
+	if err := ensureAuditSchema(); err != nil {
+		return err
+	}
+
+	if err := ensureChannelSchema(); err != nil {
+		return err
+	}
+
+	if err := ensureLoginRiskSchema(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func handleAPISession(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		handleAPILogout(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Checking for a session is not a refresh attempt, so only a JWT
+	// actually issued is audited.
 	sess, err := getSessionFromRequest(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
 	response := map[string]interface{}{
-		"email": sess.Email,
-		"token": sess.Token,
+		"email":      sess.Email,
+		"token":      sess.Token,
+		"csrf_token": issueCSRFToken(w, r),
 	}
 
 	if len(jwtSecret) > 0 {
-		if jwtToken, err := generateJWT(sess.Email, sess.ExpiresAt); err == nil {
+		if jwtToken, err := generateJWT(sess.Email, sess.ID, sess.ExpiresAt); err == nil {
 			expiresIn := sess.ExpiresAt.Unix() - time.Now().Unix()
 			if expiresIn < 0 {
 				expiresIn = 0
@@ -219,6 +373,7 @@ func handleAPISession(w http.ResponseWriter, r *http.Request) {
 			response["access_token"] = jwtToken
 			response["token_type"] = "Bearer"
 			response["expires_in"] = expiresIn
+			recordAuthEvent(r, auditTokenRefresh, sess.Email, auditSuccess, "")
 		} else {
 			log.Printf("jwt generation error: %v", err)
 		}
@@ -227,9 +382,35 @@ func handleAPISession(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, response)
 }
 
+// handleAPILogout revokes the caller's session token. JWT-only callers have
+// no server-side session, so there is nothing to delete for them.
+func handleAPILogout(w http.ResponseWriter, r *http.Request) {
+	sess, err := getSessionFromRequest(r)
+	if err != nil {
+		recordAuthEvent(r, auditLogout, "", auditFailure, err.Error())
+		writeAuthError(w, err)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM sessions WHERE token = ?", sess.Token); err != nil {
+		log.Printf("session revoke error: %v", err)
+		recordAuthEvent(r, auditLogout, sess.Email, auditFailure, "revoke failed")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to revoke session"})
+		return
+	}
+
+	recordAuthEvent(r, auditLogout, sess.Email, auditSuccess, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.Header().Set("Allow", "POST")
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		handleDeregisterDevice(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -265,6 +446,31 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// handleDeregisterDevice removes a device token entirely, e.g. when the app
+// signs out on a shared device and should stop receiving pushes.
+func handleDeregisterDevice(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var payload deviceTokenPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+		return
+	}
+
+	token := strings.TrimSpace(payload.DeviceToken)
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "device_token is required"})
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM device_tokens WHERE device_token = ?`, token); err != nil {
+		log.Printf("deregister device token error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to deregister device"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func handleAssociateDevice(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", "POST")
@@ -272,9 +478,9 @@ func handleAssociateDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess, err := getSessionFromRequest(r)
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
@@ -293,11 +499,29 @@ func handleAssociateDevice(w http.ResponseWriter, r *http.Request) {
 
 	now := time.Now()
 
+	if payload.Logout {
+		// Only the current owner may detach the token, so a stale client cannot
+		// silence pushes for whoever signed in on the device afterwards.
+		_, err := db.Exec(
+			`UPDATE device_tokens
+             SET user_email = NULL, updated_at = ?
+             WHERE device_token = ? AND user_email = ?`,
+			now, token, me.Email,
+		)
+		if err != nil {
+			log.Printf("disassociate device token error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to disassociate device"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	res, err := db.Exec(
 		`UPDATE device_tokens
          SET user_email = ?, updated_at = ?
          WHERE device_token = ?`,
-		sess.Email, now, token,
+		me.Email, now, token,
 	)
 	if err != nil {
 		log.Printf("associate device token update error: %v", err)
@@ -317,7 +541,7 @@ func handleAssociateDevice(w http.ResponseWriter, r *http.Request) {
 			`INSERT INTO device_tokens (device_token, user_email, created_at, updated_at)
              VALUES (?, ?, ?, ?)
              ON DUPLICATE KEY UPDATE user_email = VALUES(user_email), updated_at = VALUES(updated_at)`,
-			token, sess.Email, now, now,
+			token, me.Email, now, now,
 		)
 		if err != nil {
 			log.Printf("associate device token insert error: %v", err)
@@ -345,21 +569,23 @@ func handleAPIRequestOTP(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 	var payload struct {
-		Email string `json:"email"`
+		Email   string `json:"email"`
+		Phone   string `json:"phone"`
+		Channel string `json:"channel"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
 		return
 	}
 
-	email := strings.TrimSpace(payload.Email)
-	if email == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "email is required"})
+	channel, destination := otpDestination(payload.Channel, payload.Email, payload.Phone)
+	identifier, err := normalizeOTPIdentifier(channel, destination)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	msg := kafka.Message{Value: []byte(email)}
-	if err := writer.WriteMessages(r.Context(), msg); err != nil {
+	if err := enqueueOTP(r.Context(), channel, identifier); err != nil {
 		log.Printf("Kafka write error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to queue otp"})
 		return
@@ -377,29 +603,81 @@ func handleAPIVerifyOTP(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 	var payload struct {
-		Email string `json:"email"`
-		OTP   string `json:"otp"`
+		Email   string `json:"email"`
+		Phone   string `json:"phone"`
+		Channel string `json:"channel"`
+		OTP     string `json:"otp"`
+		// StepUpOTP answers a step-up challenge sent to the user's second
+		// channel, in place of otp.
+		StepUpOTP string `json:"step_up_otp"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
 		return
 	}
 
-	email := strings.TrimSpace(payload.Email)
+	// The identifier (lowercased email or E.164 phone) is both the otp_codes
+	// key and the identity the session is issued for.
 	code := strings.TrimSpace(payload.OTP)
-	if email == "" || code == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "email and otp are required"})
+	stepUpCode := strings.TrimSpace(payload.StepUpOTP)
+	if code == "" && stepUpCode == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "otp is required"})
+		return
+	}
+	email, err := normalizeOTPIdentifier(otpDestination(payload.Channel, payload.Email, payload.Phone))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	if err := verifyOTP(email, code); err != nil {
+	key := email
+	if stepUpCode != "" {
+		key, code = stepUpKey(email), stepUpCode
+	}
+	if err := verifyOTP(key, code); err != nil {
+		recordAuthEvent(r, auditLogin, email, auditFailure, err.Error())
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	assessment, err := assessLogin(ctx, r, email, stepUpCode != "")
+	cancel()
+	if err != nil {
+		// Detection is best effort; a storage error must not lock users out.
+		log.Printf("assess login for %s error: %v", email, err)
+	}
+	if assessment.StepUp {
+		recordAuthEvent(r, auditStepUp, email, auditFailure, "login from unrecognized address")
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		err := requestStepUpOTP(ctx, email, assessment.SecondChannel)
+		cancel()
+		if err != nil {
+			log.Printf("step-up otp enqueue error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to queue otp"})
+			return
+		}
+		response := map[string]interface{}{
+			"error":            "additional verification required; a new code has been sent",
+			"step_up_required": true,
+		}
+		// With a second channel the client sends that code back as
+		// step_up_otp.
+		if assessment.SecondChannel != "" {
+			response["step_up_channel"] = otpChannelFor(assessment.SecondChannel)
+			response["step_up_destination"] = maskIdentifier(assessment.SecondChannel)
+		}
+		writeJSON(w, http.StatusForbidden, response)
+		return
+	}
+	if assessment.Unrecognized {
+		recordAuthEvent(r, auditSuspiciousLogin, email, auditSuccess, "login from unrecognized address")
+	}
+
 	token, expiresAt, err := createSession(email)
 	if err != nil {
 		log.Printf("session creation error: %v", err)
+		recordAuthEvent(r, auditLogin, email, auditFailure, "session creation failed")
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to create session"})
 		return
 	}
@@ -410,7 +688,7 @@ func handleAPIVerifyOTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jwtToken, err := generateJWT(email, expiresAt)
+	jwtToken, err := generateJWT(email, sessionID(token), expiresAt)
 	if err != nil {
 		log.Printf("jwt generation error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to issue access token"})
@@ -422,19 +700,54 @@ func handleAPIVerifyOTP(w http.ResponseWriter, r *http.Request) {
 		expiresIn = 0
 	}
 
+	// The profile is included so the app can render the user without a
+	// second call to /api/profile. Failing to load it does not fail the
+	// sign-in; the client sees an empty profile.
+	profile, err := loadProfileSummary(email)
+	if err != nil {
+		log.Printf("load profile for %s during verify-otp error: %v", email, err)
+	}
+
+	recordAuthEvent(r, auditLogin, email, auditSuccess, "")
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"email":         email,
-		"session_token": token,
-		"access_token":  jwtToken,
-		"token_type":    "Bearer",
-		"expires_in":    expiresIn,
+		"email":              email,
+		"session_token":      token,
+		"access_token":       jwtToken,
+		"token_type":         "Bearer",
+		"expires_in":         expiresIn,
+		"unrecognized_login": assessment.Unrecognized,
+		"csrf_token":         issueCSRFToken(w, r),
+		"profile":            profile,
 	})
 }
 
+// profileSummary is the part of a user's profile returned at sign-in.
+type profileSummary struct {
+	Name      string `json:"name"`
+	HasAvatar bool   `json:"has_avatar"`
+}
+
+// loadProfileSummary returns the user's name and whether they have an
+// avatar, or an empty profile when they never saved one.
+func loadProfileSummary(email string) (profileSummary, error) {
+	var profile profileSummary
+	err := db.QueryRow(
+		"SELECT name, avatar IS NOT NULL AND LENGTH(avatar) > 0 FROM user_profiles WHERE email = ?",
+		email,
+	).Scan(&profile.Name, &profile.HasAvatar)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profileSummary{}, nil
+	}
+	if err != nil {
+		return profileSummary{}, err
+	}
+	return profile, nil
+}
+
 func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
-	sess, err := getSessionFromRequest(r)
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
@@ -447,11 +760,11 @@ func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
 
 		err := db.QueryRow(
 			"SELECT name, avatar_content_type FROM user_profiles WHERE email = ?",
-			sess.Email,
+			me.Email,
 		).Scan(&name, &avatarContentType)
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, map[string]interface{}{
-				"email": sess.Email,
+				"email": me.Email,
 				"name":  "",
 			})
 			return
@@ -463,7 +776,7 @@ func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
 		}
 
 		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"email": sess.Email,
+			"email": me.Email,
 			"name":  name,
 		})
 
@@ -484,7 +797,7 @@ func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
             INSERT INTO user_profiles (email, name, updated_at)
             VALUES (?, ?, ?)
             ON DUPLICATE KEY UPDATE name = VALUES(name), updated_at = VALUES(updated_at)
-        `, sess.Email, name, now)
+        `, me.Email, name, now)
 		if err != nil {
 			log.Printf("upsert profile error: %v", err)
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to save profile"})
@@ -492,7 +805,7 @@ func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
 		}
 
 		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"email": sess.Email,
+			"email": me.Email,
 			"name":  name,
 		})
 
@@ -503,9 +816,9 @@ func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAPIProfilePhoto(w http.ResponseWriter, r *http.Request) {
-	sess, err := getSessionFromRequest(r)
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
@@ -520,7 +833,7 @@ func handleAPIProfilePhoto(w http.ResponseWriter, r *http.Request) {
 
 		err := db.QueryRow(
 			"SELECT avatar, avatar_content_type, name, updated_at FROM user_profiles WHERE email = ?",
-			sess.Email,
+			me.Email,
 		).Scan(&data, &contentType, &name, &lastUpdated)
 		if errors.Is(err, sql.ErrNoRows) || len(data) == 0 {
 			http.NotFound(w, r)
@@ -536,6 +849,9 @@ func handleAPIProfilePhoto(w http.ResponseWriter, r *http.Request) {
 		if ct == "" {
 			ct = "image/jpeg"
 		}
+		if notModified(w, r, len(data), lastUpdated) {
+			return
+		}
 		w.Header().Set("Content-Type", ct)
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write(data); err != nil {
@@ -565,7 +881,7 @@ func handleAPIProfilePhoto(w http.ResponseWriter, r *http.Request) {
             INSERT INTO user_profiles (email, avatar, avatar_content_type, updated_at)
             VALUES (?, ?, ?, ?)
             ON DUPLICATE KEY UPDATE avatar = VALUES(avatar), avatar_content_type = VALUES(avatar_content_type), updated_at = VALUES(updated_at)
-        `, sess.Email, body, contentType, now)
+        `, me.Email, body, contentType, now)
 		if err != nil {
 			log.Printf("update avatar error: %v", err)
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to save avatar"})
@@ -574,8 +890,23 @@ func handleAPIProfilePhoto(w http.ResponseWriter, r *http.Request) {
 
 		w.WriteHeader(http.StatusNoContent)
 
+	case http.MethodDelete:
+		// Clearing rather than deleting the row keeps the profile name; GET
+		// then answers 404 exactly as for an avatar that was never set.
+		_, err := db.Exec(
+			"UPDATE user_profiles SET avatar = NULL, avatar_content_type = NULL, updated_at = ? WHERE email = ?",
+			time.Now(), me.Email,
+		)
+		if err != nil {
+			log.Printf("delete avatar error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to delete avatar"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
 	default:
-		w.Header().Set("Allow", "GET, POST")
+		w.Header().Set("Allow", "GET, POST, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -587,8 +918,8 @@ func handleAPIUserPhoto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := getSessionFromRequest(r); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	if _, err := resolvePrincipal(r); err != nil {
+		writeAuthError(w, err)
 		return
 	}
 
@@ -601,12 +932,13 @@ func handleAPIUserPhoto(w http.ResponseWriter, r *http.Request) {
 	var (
 		data        []byte
 		contentType sql.NullString
+		lastUpdated time.Time
 	)
 
 	err := db.QueryRow(
-		"SELECT avatar, avatar_content_type FROM user_profiles WHERE email = ?",
+		"SELECT avatar, avatar_content_type, updated_at FROM user_profiles WHERE email = ?",
 		email,
-	).Scan(&data, &contentType)
+	).Scan(&data, &contentType, &lastUpdated)
 	if errors.Is(err, sql.ErrNoRows) || len(data) == 0 {
 		http.NotFound(w, r)
 		return
@@ -621,6 +953,9 @@ func handleAPIUserPhoto(w http.ResponseWriter, r *http.Request) {
 	if ct == "" {
 		ct = "image/jpeg"
 	}
+	if notModified(w, r, len(data), lastUpdated) {
+		return
+	}
 	w.Header().Set("Content-Type", ct)
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(data); err != nil {
@@ -628,6 +963,58 @@ func handleAPIUserPhoto(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// notModified sets caching validators for an avatar and, when the request's
+// If-None-Match or If-Modified-Since shows the client already has this
+// version, answers 304 and reports true. The ETag is derived from the
+// stored updated_at and the image size, so no hashing is needed.
+func notModified(w http.ResponseWriter, r *http.Request, size int, updatedAt time.Time) bool {
+	updatedAt = updatedAt.UTC().Truncate(time.Second)
+	etag := fmt.Sprintf(`"%x-%x"`, updatedAt.Unix(), size)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", updatedAt.Format(http.TimeFormat))
+	// Clients may keep the image but must revalidate, so a new upload
+	// shows up on the next fetch.
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since.
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				match = true
+				break
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if since, err := http.ParseTime(ims); err == nil && !updatedAt.After(since) {
+			match = true
+		}
+	}
+	if !match {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// userSearchLimit is the default page size of /api/users/all and
+// maxUserSearchLimit the largest a caller may ask for.
+const (
+	userSearchLimit    = 50
+	maxUserSearchLimit = 200
+)
+
+// escapeLike escapes the LIKE wildcards in s so user input is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// handleAPIUsersAll lists users who have signed in, one row per email, a
+// page at a time. It answers with the page and the total number of matches
+// so a contact picker can page through them. The caller is left out unless
+// include_self=true.
 func handleAPIUsersAll(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.Header().Set("Allow", "GET")
@@ -635,33 +1022,84 @@ func handleAPIUsersAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := getSessionFromRequest(r); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	me, err := resolvePrincipal(r)
+	if err != nil {
+		writeAuthError(w, err)
 		return
 	}
 
-	q := strings.TrimSpace(r.URL.Query().Get("q"))
-	like := "%" + q + "%"
+	params := r.URL.Query()
+	q := strings.ToLower(strings.TrimSpace(params.Get("q")))
+	limit := userSearchLimit
+	if raw := strings.TrimSpace(params.Get("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxUserSearchLimit {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", maxUserSearchLimit)})
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if raw := strings.TrimSpace(params.Get("offset")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+	includeSelf, _ := strconv.ParseBool(strings.TrimSpace(params.Get("include_self")))
 
-	query := `
-        SELECT s.email, COALESCE(p.name, ''), p.avatar
-        FROM sessions s
-        LEFT JOIN user_profiles p ON p.email = s.email
-        GROUP BY s.email, p.name, p.avatar
+	// sessions holds a row per sign-in, so collapse it to distinct emails
+	// before joining profiles.
+	from := `
+        FROM (SELECT DISTINCT email FROM sessions) u
+        LEFT JOIN user_profiles p ON p.email = u.email
     `
-	args := []interface{}{}
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if !includeSelf {
+		conditions = append(conditions, "u.email <> ?")
+		args = append(args, me.Email)
+	}
+	order := "u.email"
+	var orderArgs []interface{}
 	if q != "" {
-		query = `
-            SELECT s.email, COALESCE(p.name, ''), p.avatar
-            FROM sessions s
-            LEFT JOIN user_profiles p ON p.email = s.email
-            WHERE s.email LIKE ? OR p.name LIKE ?
-            GROUP BY s.email, p.name, p.avatar
-        `
-		args = append(args, like, like)
+		escaped := escapeLike(q)
+		contains := "%" + escaped + "%"
+		conditions = append(conditions, "(LOWER(u.email) LIKE ? OR LOWER(p.name) LIKE ?)")
+		args = append(args, contains, contains)
+		// Rank exact matches first, then prefix matches, then anything
+		// containing the query.
+		prefix := escaped + "%"
+		order = `
+            CASE
+                WHEN LOWER(u.email) = ? OR LOWER(p.name) = ? THEN 0
+                WHEN LOWER(u.email) LIKE ? OR LOWER(p.name) LIKE ? THEN 1
+                ELSE 2
+            END,
+            u.email`
+		orderArgs = []interface{}{q, q, prefix, prefix}
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) "+from+where, args...).Scan(&total); err != nil {
+		log.Printf("count users error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load users"})
+		return
 	}
 
-	rows, err := db.Query(query, args...)
+	pageArgs := append(append(append([]interface{}{}, args...), orderArgs...), limit, offset)
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT u.email, COALESCE(p.name, ''), COALESCE(LENGTH(p.avatar) > 0, FALSE) "+from+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		pageArgs...,
+	)
 	if err != nil {
 		log.Printf("list users error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load users"})
@@ -675,41 +1113,47 @@ func handleAPIUsersAll(w http.ResponseWriter, r *http.Request) {
 		HasAvatar bool   `json:"has_avatar"`
 	}
 
-	users := make([]userSummary, 0, 64)
+	users := make([]userSummary, 0, limit)
 	for rows.Next() {
 		var (
-			email  string
-			name   string
-			avatar []byte
+			email     string
+			name      string
+			hasAvatar bool
 		)
-		if err := rows.Scan(&email, &name, &avatar); err != nil {
+		if err := rows.Scan(&email, &name, &hasAvatar); err != nil {
 			log.Printf("scan users error: %v", err)
 			continue
 		}
 		users = append(users, userSummary{
 			Email:     email,
 			Name:      strings.TrimSpace(name),
-			HasAvatar: len(avatar) > 0,
+			HasAvatar: hasAvatar,
 		})
 	}
 	if err := rows.Err(); err != nil {
 		log.Printf("iterate users error: %v", err)
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users":  users,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
 }
 
 func handleAPIConversations(w http.ResponseWriter, r *http.Request) {
-	sess, err := getSessionFromRequest(r)
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		conversations, err := messageSvc.ListConversations(ctx, sess.Email)
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		includeArchived, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("include_archived")))
+		conversations, err := messageSvc.ListConversations(ctx, me.Email, includeArchived)
 		cancel()
 		if err != nil {
 			log.Printf("list conversations error: %v", err)
@@ -729,39 +1173,65 @@ func handleAPIConversations(w http.ResponseWriter, r *http.Request) {
 		}
 		defer r.Body.Close()
 
-		participants := uniqueNonEmpty(payload.Participants)
-		if !contains(participants, sess.Email) {
-			participants = append(participants, sess.Email)
-		}
+		// Normalize before both the duplicate check and creation so the
+		// stored participant set is exactly what dedup compares against;
+		// otherwise alice@x and Alice@x would both be added.
+		participants := normalizeParticipantEmails(append(payload.Participants, me.Email))
 		if len(participants) < 2 {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "select at least one other participant"})
 			return
 		}
 
-		normalizedTarget := normalizeParticipantEmails(participants)
-
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		existing, err := messageSvc.ListConversations(ctx, sess.Email)
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		// Archived conversations still count as a match so archiving does
+		// not cause a duplicate conversation to be created.
+		existing, err := messageSvc.ListConversations(ctx, me.Email, true)
 		cancel()
 		if err != nil {
 			log.Printf("list conversations for match error: %v", err)
 		} else {
 			for _, conv := range existing {
-				if participantsMatch(conv.Participants, normalizedTarget) {
+				if participantsMatch(conv.Participants, participants) {
 					writeJSON(w, http.StatusOK, map[string]interface{}{"conversation": conv, "reused": true})
 					return
 				}
 			}
 		}
 
-		ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
-		conversation, err := messageSvc.CreateConversation(ctx, sess.Email, payload.Name, participants)
+		ctx, cancel = messageSvc.withTimeout(r.Context())
+		conversation, err := messageSvc.CreateConversation(ctx, strings.ToLower(me.Email), payload.Name, participants)
 		cancel()
+		var unknownErr *unknownParticipantsError
+		if errors.As(err, &unknownErr) {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":                "unknown participants",
+				"unknown_participants": unknownErr.Emails,
+			})
+			return
+		}
+		if errors.Is(err, errRateLimited) {
+			writeRateLimited(w, err, "conversation limit reached")
+			return
+		}
 		if err != nil {
 			log.Printf("create conversation error: %v", err)
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to create conversation"})
 			return
 		}
+
+		// Tell connected participants their membership changed so they can
+		// refresh without polling.
+		event := &chatRedisEvent{
+			Type:             "membership",
+			Participants:     conversation.Participants,
+			ConversationID:   conversation.ID,
+			ConversationName: conversation.Name,
+			From:             strings.ToLower(me.Email),
+		}
+		if err := publishChatEvent(context.Background(), event); err != nil {
+			log.Printf("redis publish error: %v", err)
+		}
+		conversationWebhook.notifyConversationCreated(conversation, strings.ToLower(me.Email))
 		writeJSON(w, http.StatusCreated, map[string]interface{}{"conversation": conversation})
 
 	default:
@@ -770,28 +1240,102 @@ func handleAPIConversations(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
-	sess, err := getSessionFromRequest(r)
+// handleAPIConversationsUnread returns just the unread badge counts, keyed
+// by conversation id, plus their total. Archived conversations are left
+// out unless include_archived=true, matching the conversation list.
+func handleAPIConversationsUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	me, err := resolvePrincipal(r)
 	if err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		writeAuthError(w, err)
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/api/conversations/")
-	if path == "" {
-		http.NotFound(w, r)
+	ctx, cancel := messageSvc.withTimeout(r.Context())
+	includeArchived, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("include_archived")))
+	conversations, err := messageSvc.ListConversations(ctx, me.Email, includeArchived)
+	cancel()
+	if err != nil {
+		log.Printf("list conversations for unread error: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load unread counts"})
 		return
 	}
-	parts := strings.Split(path, "/")
-	conversationID := parts[0]
-	if conversationID == "" {
-		http.NotFound(w, r)
-		return
+
+	unread := make(map[string]int, len(conversations))
+	total := 0
+	for _, conv := range conversations {
+		unread[conv.ID] = conv.UnreadCount
+		total += conv.UnreadCount
 	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"unread": unread,
+		"total":  total,
+	})
+}
 
-	if len(parts) == 2 && parts[1] == "photo" {
-		handleAPIConversationPhoto(w, r, conversationID)
-		return
+// Message listings return messagePageSize messages unless the client asks
+// for a limit of its own, which may be at most maxMessagePageSize.
+const (
+	defaultMessagePageSize = 200
+	maxMessagePageSize     = 1000
+)
+
+var messagePageSize = defaultMessagePageSize
+
+// messagePage reads the limit and direction query parameters of a message
+// listing, which the receipts endpoint takes too so its delivered map covers
+// the same messages. direction=latest selects the newest limit messages,
+// still returned oldest first, so a chat can open at the bottom without
+// paging through the whole history. It writes a 400 and reports false for an
+// unknown direction.
+func messagePage(w http.ResponseWriter, r *http.Request) (int, bool, bool) {
+	limit := messagePageSize
+	if limitParam := strings.TrimSpace(r.URL.Query().Get("limit")); limitParam != "" {
+		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 && parsed <= maxMessagePageSize {
+			limit = parsed
+		}
+	}
+	switch direction := strings.TrimSpace(r.URL.Query().Get("direction")); direction {
+	case "", "oldest":
+		return limit, false, true
+	case "latest":
+		return limit, true, true
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "direction must be oldest or latest"})
+		return 0, false, false
+	}
+}
+
+// maxConversationNameLength caps a conversation name, in characters. It
+// matches message-service's limit so renames are rejected before the call.
+const maxConversationNameLength = 100
+
+func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
+	me, err := resolvePrincipal(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/conversations/")
+	if path == "" {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	conversationID := parts[0]
+	if conversationID == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "photo" {
+		handleAPIConversationPhoto(w, r, conversationID)
+		return
 	}
 	if len(parts) == 2 && parts[1] == "read" {
 		if r.Method != http.MethodPost {
@@ -799,7 +1343,7 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		ctx, cancel := messageSvc.withTimeout(r.Context())
 		conversation, err := messageSvc.GetConversation(ctx, conversationID)
 		cancel()
 		if err != nil {
@@ -811,29 +1355,183 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load conversation"})
 			return
 		}
-		if !contains(conversation.Participants, sess.Email) {
+		if !isParticipant(conversation.Participants, me.Email) {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 			return
 		}
-		ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
-		err = messageSvc.MarkConversationRead(ctx, conversationID, sess.Email)
+		ctx, cancel = messageSvc.withTimeout(r.Context())
+		readCount, err := messageSvc.MarkConversationRead(ctx, conversationID, me.Email)
 		cancel()
 		if err != nil {
 			log.Printf("mark conversation read error: %v", err)
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to update read state"})
 			return
 		}
+
+		// Relay a receipt to the other participants' open sockets.
+		event := &chatRedisEvent{
+			Type:           "read",
+			Participants:   conversation.Participants,
+			ConversationID: conversation.ID,
+			From:           me.Email,
+			SentAt:         time.Now().UTC().Format(time.RFC3339),
+			UserEmail:      me.Email,
+			ReadCount:      readCount,
+		}
+		if err := publishChatEvent(context.Background(), event); err != nil {
+			log.Printf("redis publish error: %v", err)
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	if len(parts) == 1 {
+	if len(parts) == 2 && parts[1] == "archive" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var payload struct {
+			Archived bool `json:"archived"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+			return
+		}
+		defer r.Body.Close()
+
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		err := messageSvc.SetConversationArchived(ctx, conversationID, me.Email, payload.Archived)
+		cancel()
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("archive conversation error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to update conversation"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "pin" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var payload struct {
+			Pinned bool `json:"pinned"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+			return
+		}
+		defer r.Body.Close()
+
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		err := messageSvc.SetConversationPinned(ctx, conversationID, me.Email, payload.Pinned)
+		cancel()
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("pin conversation error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to update conversation"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "receipts" {
 		if r.Method != http.MethodGet {
 			w.Header().Set("Allow", "GET")
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
+		if _, err := loadConversationForUser(w, r, conversationID, me.Email); err != nil {
+			return
+		}
+		limit, latest, ok := messagePage(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		receipts, err := messageSvc.ListReadReceipts(ctx, conversationID, limit, latest)
+		cancel()
+		if err != nil {
+			log.Printf("list read receipts error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load receipts"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"conversation_id": conversationID,
+			"receipts":        receipts.Receipts,
+			"delivered":       receipts.Delivered,
+		})
+		return
+	}
+	if len(parts) == 1 && r.Method == http.MethodPatch {
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+			return
+		}
+		defer r.Body.Close()
+
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+			return
+		}
+		if utf8.RuneCountInString(name) > maxConversationNameLength {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("name must be at most %d characters", maxConversationNameLength)})
+			return
+		}
+
+		ctx, cancel := messageSvc.withTimeout(r.Context())
+		conversation, err := messageSvc.RenameConversation(ctx, conversationID, strings.ToLower(me.Email), name)
+		cancel()
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			if errors.Is(err, errForbidden) {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+				return
+			}
+			log.Printf("rename conversation error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to rename conversation"})
+			return
+		}
+
+		// Push the new name to connected participants so open chats
+		// update their header without reloading.
+		event := &chatRedisEvent{
+			Type:             "rename",
+			Participants:     conversation.Participants,
+			ConversationID:   conversation.ID,
+			ConversationName: conversation.Name,
+			From:             strings.ToLower(me.Email),
+		}
+		if err := publishChatEvent(context.Background(), event); err != nil {
+			log.Printf("redis publish error: %v", err)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"conversation": conversation})
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET, PATCH")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		ctx, cancel := messageSvc.withTimeout(r.Context())
 		conversation, err := messageSvc.GetConversation(ctx, conversationID)
 		cancel()
 		if err != nil {
@@ -845,7 +1543,7 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load conversation"})
 			return
 		}
-		if !contains(conversation.Participants, sess.Email) {
+		if !isParticipant(conversation.Participants, me.Email) {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 			return
 		}
@@ -853,8 +1551,12 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 4 && parts[1] == "messages" && parts[3] == "reactions" {
+		handleAPIMessageReaction(w, r, conversationID, parts[2], me.Email)
+		return
+	}
 	if len(parts) == 2 && parts[1] == "messages" {
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		ctx, cancel := messageSvc.withTimeout(r.Context())
 		conversation, err := messageSvc.GetConversation(ctx, conversationID)
 		cancel()
 		if err != nil {
@@ -866,28 +1568,20 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load conversation"})
 			return
 		}
-		if !contains(conversation.Participants, sess.Email) {
+		if !isParticipant(conversation.Participants, me.Email) {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 			return
 		}
 
 		switch r.Method {
 		case http.MethodGet:
-			limit := 0
-			if limitParam := strings.TrimSpace(r.URL.Query().Get("limit")); limitParam != "" {
-				if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 && parsed <= 1000 {
-					limit = parsed
-				}
+			limit, latest, ok := messagePage(w, r)
+			if !ok {
+				return
 			}
 
-			ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
-			var messages []messageView
-			reader := sess.Email
-			if limit > 0 {
-				messages, err = messageSvc.ListMessagesWithLimit(ctx, conversationID, limit, reader)
-			} else {
-				messages, err = messageSvc.ListMessages(ctx, conversationID, reader)
-			}
+			ctx, cancel = messageSvc.withTimeout(r.Context())
+			messages, err := messageSvc.ListMessagesWithLimit(ctx, conversationID, limit, me.Email, latest)
 			cancel()
 			if err != nil {
 				log.Printf("list messages error: %v", err)
@@ -902,7 +1596,8 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 
 		case http.MethodPost:
 			var payload struct {
-				Text string `json:"text"`
+				Text     string `json:"text"`
+				ViewOnce bool   `json:"view_once"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
@@ -916,9 +1611,34 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
-			msg, err := messageSvc.CreateMessage(ctx, conversationID, sess.Email, text)
+			// Idempotency-Key is passed through so a client can safely retry
+			// a send whose response it never got.
+			idempotencyKey := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key must be at most 255 characters"})
+				return
+			}
+
+			ctx, cancel = messageSvc.withTimeout(r.Context())
+			msg, err := messageSvc.CreateMessage(ctx, conversationID, me.Email, text, payload.ViewOnce, idempotencyKey)
 			cancel()
+			if errors.Is(err, errRateLimited) {
+				writeRateLimited(w, err, "sending too fast; try again shortly")
+				return
+			}
+			if errors.Is(err, errIdempotencyInProgress) {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "a request with this Idempotency-Key is still in progress"})
+				return
+			}
+			var rejected *messageRejectedError
+			if errors.As(err, &rejected) {
+				body := map[string]string{"error": rejected.message}
+				if rejected.reason != "" {
+					body["reason"] = rejected.reason
+				}
+				writeJSON(w, http.StatusUnprocessableEntity, body)
+				return
+			}
 			if err != nil {
 				log.Printf("create message error: %v", err)
 				writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to send message"})
@@ -926,22 +1646,28 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Broadcast chat event to websocket server via Redis so all
-			// connected clients receive this message in real time.
-			if redisClient != nil {
+			// connected clients receive this message in real time. A
+			// replayed message was broadcast by the original request.
+			if redisClient != nil && !msg.Replayed {
 				event := &chatRedisEvent{
 					Type:             "message",
+					MessageID:        msg.ID,
 					Participants:     msg.Participants,
 					ConversationID:   msg.ConversationID,
 					ConversationName: msg.Name,
 					From:             msg.Sender,
 					Text:             msg.Text,
 					SentAt:           msg.SentAt,
+					ViewOnce:         msg.ViewOnce,
 				}
 				if err := publishChatEvent(context.Background(), event); err != nil {
 					log.Printf("redis publish error: %v", err)
 				}
 			}
 
+			if msg.Replayed {
+				w.Header().Set(idempotentReplayHeader, "true")
+			}
 			writeJSON(w, http.StatusCreated, map[string]interface{}{"message": msg})
 			return
 
@@ -955,6 +1681,37 @@ func handleAPIConversationResource(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+func handleAPIMessagesSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	me, err := resolvePrincipal(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+	var payload struct {
+		Cursors map[string]string `json:"cursors"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+		return
+	}
+
+	result, err := messageSvc.SyncMessages(r.Context(), me.Email, payload.Cursors)
+	if err != nil {
+		log.Printf("sync messages error: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to sync messages"})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
 func verifyOTP(email, code string) error {
 	var storedCode string
 	var expires time.Time
@@ -976,12 +1733,23 @@ func verifyOTP(email, code string) error {
 		}
 		return errors.New("OTP expired, request a new one")
 	}
-	if subtle.ConstantTimeCompare([]byte(code), []byte(storedCode)) != 1 {
+	if !otpMatches(otpPepper, storedCode, code) {
 		return errors.New("Invalid OTP code")
 	}
 
-	if _, err := db.Exec("DELETE FROM otp_codes WHERE email = ?", email); err != nil {
-		log.Printf("failed to delete otp: %v", err)
+	// Consume the code with a conditional delete: of several concurrent
+	// verifies with the same code, only the one whose DELETE removes the
+	// row succeeds.
+	res, err := db.Exec(
+		"DELETE FROM otp_codes WHERE email = ? AND code = ?",
+		email, storedCode,
+	)
+	if err != nil {
+		log.Printf("consume otp error: %v", err)
+		return errors.New("Unable to verify OTP")
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return errors.New("OTP not found or expired")
 	}
 	return nil
 }
@@ -989,9 +1757,14 @@ func verifyOTP(email, code string) error {
 func createSession(email string) (string, time.Time, error) {
 	token := uuid.NewString()
 	now := time.Now()
-	// Extend session lifetime to 90 days for long-lived mobile and web sessions.
-	expires := now.Add(90 * 24 * time.Hour)
+	expires := now.Add(sessionLifetime.ttl)
 
+	if _, err := db.Exec(
+		"INSERT IGNORE INTO users (email, created_at) VALUES (?, ?)",
+		email, now,
+	); err != nil {
+		return "", time.Time{}, err
+	}
 	if _, err := db.Exec(
 		"INSERT INTO sessions (token, email, expires_at, created_at) VALUES (?, ?, ?, ?)",
 		token, email, expires, now,
@@ -1001,24 +1774,29 @@ func createSession(email string) (string, time.Time, error) {
 	return token, expires, nil
 }
 
-func getSessionFromRequest(r *http.Request) (*session, error) {
-	token := ""
-
-	if cookie, err := r.Cookie("session_token"); err == nil {
-		token = strings.TrimSpace(cookie.Value)
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
+	if strings.HasPrefix(strings.ToLower(authHeader), "bearer ") {
+		return strings.TrimSpace(authHeader[len("bearer "):])
 	}
+	return ""
+}
+
+// getSessionFromRequest authenticates with the Authorization header when one
+// is sent and otherwise with the session_token cookie; csrfProtect relies on
+// that order.
+func getSessionFromRequest(r *http.Request) (*session, error) {
+	token := bearerToken(r)
 
 	if token == "" {
-		authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
-		if authHeader != "" {
-			if strings.HasPrefix(strings.ToLower(authHeader), "bearer ") {
-				token = strings.TrimSpace(authHeader[len("bearer "):])
-			}
+		if cookie, err := r.Cookie("session_token"); err == nil {
+			token = strings.TrimSpace(cookie.Value)
 		}
 	}
 
 	if token == "" {
-		return nil, errors.New("missing session token")
+		return nil, errMissingToken
 	}
 
 	var sess session
@@ -1029,23 +1807,24 @@ func getSessionFromRequest(r *http.Request) (*session, error) {
 	if errors.Is(err, sql.ErrNoRows) {
 		// Fall back to validating as a JWT if configured.
 		if len(jwtSecret) > 0 {
-			email, exp, jwtErr := parseJWT(token)
+			claims, jwtErr := parseJWT(token)
 			if jwtErr != nil {
 				return nil, jwtErr
 			}
-			if time.Now().After(exp) {
-				return nil, errors.New("session expired")
-			}
+			exp := time.Unix(claims.Exp, 0)
 			return &session{
 				Token:     token,
-				Email:     email,
+				Email:     claims.Sub,
+				Scope:     claims.Scope,
 				ExpiresAt: exp,
+				ID:        claims.Sid,
+				FromJWT:   true,
 			}, nil
 		}
 		return nil, errors.New("session not found")
 	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errSessionLookup, err)
 	}
 	if time.Now().After(sess.ExpiresAt) {
 		go func(token string) {
@@ -1053,19 +1832,74 @@ func getSessionFromRequest(r *http.Request) (*session, error) {
 				log.Printf("session cleanup error: %v", deleteErr)
 			}
 		}(token)
-		return nil, errors.New("session expired")
+		return nil, errTokenExpired
 	}
+	sess.ID = sessionID(sess.Token)
+	sessionLifetime.slide(&sess)
 	return &sess, nil
 }
 
+// resolvePrincipal authenticates the request via session token or JWT and
+// returns the caller identity.
+func resolvePrincipal(r *http.Request) (*Principal, error) {
+	sess, err := getSessionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		Email: sess.Email,
+		Scope: sess.Scope,
+	}, nil
+}
+
 type jwtClaims struct {
 	Sub   string `json:"sub"`
+	Iss   string `json:"iss,omitempty"`
+	Aud   string `json:"aud,omitempty"`
 	Exp   int64  `json:"exp"`
 	Iat   int64  `json:"iat"`
+	Nbf   int64  `json:"nbf,omitempty"`
 	Scope string `json:"scope,omitempty"`
+	// Sid is the listed id of the session the token was issued from, so a
+	// refresh can confirm that session has not been revoked.
+	Sid string `json:"sid,omitempty"`
 }
 
-func generateJWT(email string, expiresAt time.Time) (string, error) {
+// jwtClockSkew is how far nbf and iat may be ahead of our clock before a
+// token is treated as not yet valid.
+const jwtClockSkew = time.Minute
+
+// Credential errors returned by parseJWT and getSessionFromRequest.
+// writeAuthError maps them to a response.
+var (
+	errMissingToken     = errors.New("missing session token")
+	errTokenExpired     = errors.New("token expired")
+	errTokenNotYetValid = errors.New("token not yet valid")
+	// errSessionLookup wraps storage failures, which are not the caller's
+	// fault and must not be reported as 401.
+	errSessionLookup = errors.New("session lookup failed")
+)
+
+// writeAuthError answers a request whose credentials were rejected. Expired
+// and not-yet-valid tokens get a specific message so clients know to
+// refresh rather than sign in again.
+func writeAuthError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errSessionLookup):
+		log.Printf("auth error: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "unable to verify session"})
+	case errors.Is(err, errTokenExpired):
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token expired"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "token expired"})
+	case errors.Is(err, errTokenNotYetValid):
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token not yet valid"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "token not yet valid"})
+	default:
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+}
+
+func generateJWT(email, sid string, expiresAt time.Time) (string, error) {
 	if len(jwtSecret) == 0 {
 		return "", errors.New("jwt secret not configured")
 	}
@@ -1082,8 +1916,11 @@ func generateJWT(email string, expiresAt time.Time) (string, error) {
 	now := time.Now()
 	claims := jwtClaims{
 		Sub: email,
+		Iss: jwtIssuer,
+		Aud: jwtAudience,
 		Exp: expiresAt.Unix(),
 		Iat: now.Unix(),
+		Sid: sid,
 	}
 	payloadJSON, err := json.Marshal(claims)
 	if err != nil {
@@ -1103,86 +1940,104 @@ func generateJWT(email string, expiresAt time.Time) (string, error) {
 	return token, nil
 }
 
-func parseJWT(token string) (string, time.Time, error) {
+func parseJWT(token string) (*jwtClaims, error) {
 	if len(jwtSecret) == 0 {
-		return "", time.Time{}, errors.New("jwt secret not configured")
+		return nil, errors.New("jwt secret not configured")
 	}
 
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return "", time.Time{}, errors.New("invalid jwt format")
+		return nil, errors.New("invalid jwt format")
 	}
 
 	enc := base64.RawURLEncoding
 
 	headerBytes, err := enc.DecodeString(parts[0])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt header encoding")
+		return nil, errors.New("invalid jwt header encoding")
 	}
 	var header map[string]interface{}
 	if err := json.Unmarshal(headerBytes, &header); err != nil {
-		return "", time.Time{}, errors.New("invalid jwt header")
+		return nil, errors.New("invalid jwt header")
 	}
 	alg, _ := header["alg"].(string)
 	if alg != "HS256" {
-		return "", time.Time{}, errors.New("unsupported jwt alg")
+		return nil, errors.New("unsupported jwt alg")
 	}
 
 	signature, err := enc.DecodeString(parts[2])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt signature encoding")
+		return nil, errors.New("invalid jwt signature encoding")
 	}
 
 	unsigned := parts[0] + "." + parts[1]
 	mac := hmac.New(sha256.New, jwtSecret)
 	if _, err := mac.Write([]byte(unsigned)); err != nil {
-		return "", time.Time{}, err
+		return nil, err
 	}
 	expectedSig := mac.Sum(nil)
 	if !hmac.Equal(expectedSig, signature) {
-		return "", time.Time{}, errors.New("invalid jwt signature")
+		return nil, errors.New("invalid jwt signature")
 	}
 
 	payloadBytes, err := enc.DecodeString(parts[1])
 	if err != nil {
-		return "", time.Time{}, errors.New("invalid jwt payload encoding")
+		return nil, errors.New("invalid jwt payload encoding")
 	}
 
 	var claims jwtClaims
 	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-		return "", time.Time{}, errors.New("invalid jwt claims")
+		return nil, errors.New("invalid jwt claims")
 	}
 
 	if claims.Sub == "" {
-		return "", time.Time{}, errors.New("jwt missing subject")
+		return nil, errors.New("jwt missing subject")
 	}
 	if claims.Exp == 0 {
-		return "", time.Time{}, errors.New("jwt missing exp")
+		return nil, errors.New("jwt missing exp")
+	}
+	now := time.Now()
+	if !now.Before(time.Unix(claims.Exp, 0)) {
+		return nil, errTokenExpired
+	}
+	if claims.Nbf != 0 && now.Add(jwtClockSkew).Before(time.Unix(claims.Nbf, 0)) {
+		return nil, errTokenNotYetValid
+	}
+	if claims.Iat != 0 && now.Add(jwtClockSkew).Before(time.Unix(claims.Iat, 0)) {
+		return nil, fmt.Errorf("%w: issued in the future", errTokenNotYetValid)
+	}
+	// Tokens minted for another service or environment share the same
+	// shape, so the issuer and audience must match what we issue.
+	if jwtIssuer != "" && claims.Iss != jwtIssuer {
+		return nil, errors.New("invalid jwt issuer")
+	}
+	if jwtAudience != "" && claims.Aud != jwtAudience {
+		return nil, errors.New("invalid jwt audience")
 	}
 
-	expiresAt := time.Unix(claims.Exp, 0)
-	return claims.Sub, expiresAt, nil
+	return &claims, nil
 }
 
-func configureAllowedOrigins() {
-	raw := strings.TrimSpace(os.Getenv("CORS_ALLOWED_ORIGINS"))
-	if raw == "" {
-		allowedOrigins = []string{"http://localhost:5173", "http://127.0.0.1:5173"}
-	} else {
-		parts := strings.Split(raw, ",")
-		for _, part := range parts {
-			origin := strings.TrimSpace(part)
-			if origin == "" {
-				continue
-			}
-			if origin == "*" {
-				allowAnyOrigin = true
-				allowedOrigins = nil
-				allowedOriginSet = nil
-				return
-			}
-			allowedOrigins = append(allowedOrigins, origin)
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func configureAllowedOrigins(raw string) {
+	for _, part := range strings.Split(raw, ",") {
+		origin := strings.TrimSpace(part)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			allowAnyOrigin = true
+			allowedOrigins = nil
+			allowedOriginSet = nil
+			return
 		}
+		allowedOrigins = append(allowedOrigins, origin)
 	}
 	allowedOriginSet = make(map[string]struct{}, len(allowedOrigins))
 	for _, origin := range allowedOrigins {
@@ -1208,7 +2063,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, If-Modified-Since, Idempotency-Key, X-CSRF-Token")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
@@ -1246,13 +2101,47 @@ type conversationView struct {
 	LastMessageAt  string   `json:"last_message_at"`
 	LastSender     string   `json:"last_sender"`
 	UnreadCount    int      `json:"unread_count"`
+	HasAvatar      bool     `json:"has_avatar"`
+	Archived       bool     `json:"archived"`
+	Pinned         bool     `json:"pinned"`
 }
 
 type messageView struct {
-	ID     string `json:"id"`
-	Sender string `json:"sender"`
-	Text   string `json:"text"`
-	SentAt string `json:"sent_at"`
+	ID       string   `json:"id"`
+	Sender   string   `json:"sender"`
+	Text     string   `json:"text"`
+	SentAt   string   `json:"sent_at"`
+	ViewOnce bool     `json:"view_once,omitempty"`
+	OpenedBy []string `json:"opened_by,omitempty"`
+	// Reactions is set on messages that have any.
+	Reactions []reactionView `json:"reactions,omitempty"`
+}
+
+// reactionView is one emoji's reactions on a message, most used first.
+type reactionView struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// reactionResult is message-service's answer to a reaction change.
+type reactionResult struct {
+	Emoji     string         `json:"emoji"`
+	Action    string         `json:"action"`
+	Reactions []reactionView `json:"reactions"`
+}
+
+type readReceipt struct {
+	User       string `json:"user"`
+	ReadCount  int64  `json:"read_count"`
+	LastReadAt string `json:"last_read_at"`
+}
+
+// receiptsView is a conversation's read receipts plus, per message id, the
+// users it has been delivered to.
+type receiptsView struct {
+	Receipts  []readReceipt       `json:"receipts"`
+	Delivered map[string][]string `json:"delivered"`
 }
 
 type createdMessage struct {
@@ -1263,10 +2152,15 @@ type createdMessage struct {
 	SentAt         string   `json:"sent_at"`
 	Participants   []string `json:"participants,omitempty"`
 	Name           string   `json:"conversation_name,omitempty"`
+	ViewOnce       bool     `json:"view_once,omitempty"`
+	// Replayed is set when message-service returned an existing message
+	// for a repeated Idempotency-Key.
+	Replayed bool `json:"-"`
 }
 
 type chatRedisEvent struct {
 	Type             string            `json:"type"`
+	MessageID        string            `json:"message_id,omitempty"`
 	Participants     []string          `json:"participants"`
 	ConversationID   string            `json:"conversation_id,omitempty"`
 	ConversationName string            `json:"conversation_name,omitempty"`
@@ -1274,28 +2168,121 @@ type chatRedisEvent struct {
 	Text             string            `json:"text,omitempty"`
 	SentAt           string            `json:"sent_at,omitempty"`
 	Conversation     *conversationView `json:"conversation,omitempty"`
+	ViewOnce         bool              `json:"view_once,omitempty"`
+	// UserEmail and ReadCount are set on "read" events.
+	UserEmail string `json:"user_email,omitempty"`
+	ReadCount int64  `json:"read_count,omitempty"`
+	// ReactionAction and Reactions are set on "reaction" events: From
+	// added or removed Text on MessageID, which now has Reactions.
+	ReactionAction string         `json:"reaction_action,omitempty"`
+	Reactions      []reactionView `json:"reactions,omitempty"`
 }
 
-var errNotFound = errors.New("not found")
+var (
+	errNotFound              = errors.New("not found")
+	errRateLimited           = errors.New("rate limited")
+	errForbidden             = errors.New("forbidden")
+	errIdempotencyInProgress = errors.New("idempotency key in progress")
+	errInvalidReaction       = errors.New("invalid reaction")
+)
+
+// Idempotency-Key is forwarded to message-service on message creates, which
+// marks a response returning an already stored message with
+// Idempotent-Replayed.
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength matches the limit message-service enforces.
+	maxIdempotencyKeyLength = 255
+)
 
 type messageServiceClient struct {
 	baseURL string
 	http    *http.Client
+	// callTimeout is the context deadline handlers give a message-service
+	// call; http.Timeout caps each round trip and never exceeds it.
+	callTimeout time.Duration
+	// syncTimeout replaces both for SyncMessages.
+	syncTimeout time.Duration
+	// retries and backoff bound the retries of idempotent GETs; POSTs are
+	// never retried so a lost response cannot store a message twice.
+	retries int
+	backoff time.Duration
 }
 
-func newMessageServiceClient(baseURL string) *messageServiceClient {
+func newMessageServiceClient(baseURL string, callTimeout, httpTimeout, syncTimeout time.Duration, retries int, backoff time.Duration) *messageServiceClient {
 	return &messageServiceClient{
 		baseURL: strings.TrimRight(strings.TrimSpace(baseURL), "/"),
 		http: &http.Client{
-			Timeout: 5 * time.Second,
+			Timeout: httpTimeout,
+			// Each call gets a client span and carries traceparent, so
+			// message-service joins the caller's trace.
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
 		},
+		callTimeout: callTimeout,
+		syncTimeout: syncTimeout,
+		retries:     retries,
+		backoff:     backoff,
+	}
+}
+
+// get issues a GET to message-service, retrying connection errors and 5xx
+// responses with exponential backoff until the retries or the caller's
+// deadline run out. A round trip that timed out is not retried: the call
+// deadline is already mostly spent. The last 5xx response is returned for the
+// caller to decode; a final transport error says how many attempts failed.
+func (m *messageServiceClient) get(ctx context.Context, target string) (*http.Response, error) {
+	return m.getWithRetries(ctx, target, m.retries)
+}
+
+// getWithRetries is get with its own retry budget; 0 sends the request once.
+func (m *messageServiceClient) getWithRetries(ctx context.Context, target string, retries int) (*http.Response, error) {
+	delay := m.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.http.Do(req)
+		retryable := false
+		switch {
+		case err != nil:
+			var netErr net.Error
+			retryable = ctx.Err() == nil && !(errors.As(err, &netErr) && netErr.Timeout())
+		case resp.StatusCode >= http.StatusInternalServerError:
+			retryable = true
+		}
+		if !retryable || attempt >= retries {
+			if err != nil && attempt > 0 {
+				return nil, fmt.Errorf("message service unreachable after %d attempts: %w", attempt+1, err)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			if resp != nil {
+				return nil, fmt.Errorf("message service status %d after %d attempts: %w", resp.StatusCode, attempt+1, ctx.Err())
+			}
+			return nil, fmt.Errorf("message service unreachable after %d attempts: %w", attempt+1, err)
+		case <-time.After(delay):
+		}
+		delay *= 2
 	}
 }
 
+// withTimeout derives the context for a message-service call.
+func (m *messageServiceClient) withTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, m.callTimeout)
+}
+
 // loadConversationForUser reuses the existing APIConversation logic to
 // ensure the current user is allowed to access the conversation.
 func loadConversationForUser(w http.ResponseWriter, r *http.Request, conversationID, email string) (*conversationSummary, error) {
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	ctx, cancel := messageSvc.withTimeout(r.Context())
 	defer cancel()
 
 	conv, err := messageSvc.GetConversation(ctx, conversationID)
@@ -1308,7 +2295,7 @@ func loadConversationForUser(w http.ResponseWriter, r *http.Request, conversatio
 		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to load conversation"})
 		return nil, err
 	}
-	if !contains(conv.Participants, email) {
+	if !isParticipant(conv.Participants, email) {
 		writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 		return nil, errors.New("forbidden")
 	}
@@ -1326,18 +2313,95 @@ func publishChatEvent(ctx context.Context, event *chatRedisEvent) error {
 	return redisClient.Publish(ctx, "chat:messages", data).Err()
 }
 
-func handleAPIUsers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", "GET")
+// handleInternalUserLookup lets other services check which emails belong to
+// registered users: those with a row in users, which every sign-in adds.
+// The endpoint is only served when INTERNAL_API_TOKEN is
+// set and callers must present it in X-Internal-Token.
+func handleInternalUserLookup(w http.ResponseWriter, r *http.Request) {
+	if internalAPIToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-
-	if _, err := getSessionFromRequest(r); err != nil {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Token")), []byte(internalAPIToken)) != 1 {
 		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
 		return
 	}
 
+	defer r.Body.Close()
+	var payload struct {
+		Emails []string `json:"emails"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+		return
+	}
+	emails := normalizeParticipantEmails(payload.Emails)
+	if len(emails) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"known": []string{}, "unknown": []string{}})
+		return
+	}
+	if len(emails) > 500 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "too many emails"})
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(emails)), ",")
+	args := make([]interface{}, 0, len(emails))
+	for _, e := range emails {
+		args = append(args, e)
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT email FROM users WHERE email IN (`+placeholders+`)`, args...)
+	if err != nil {
+		log.Printf("lookup users error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to lookup users"})
+		return
+	}
+	defer rows.Close()
+
+	found := make(map[string]struct{}, len(emails))
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			log.Printf("scan lookup users error: %v", err)
+			continue
+		}
+		found[strings.ToLower(strings.TrimSpace(email))] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("iterate lookup users error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to lookup users"})
+		return
+	}
+
+	known := make([]string, 0, len(emails))
+	unknown := make([]string, 0)
+	for _, e := range emails {
+		if _, ok := found[e]; ok {
+			known = append(known, e)
+		} else {
+			unknown = append(unknown, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"known": known, "unknown": unknown})
+}
+
+func handleAPIUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := resolvePrincipal(r); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
 	emailsParam := strings.TrimSpace(r.URL.Query().Get("emails"))
 	if emailsParam == "" {
 		writeJSON(w, http.StatusOK, map[string]interface{}{"users": []interface{}{}})
@@ -1363,42 +2427,92 @@ func handleAPIUsers(w http.ResponseWriter, r *http.Request) {
 		Email     string `json:"email"`
 		Name      string `json:"name"`
 		HasAvatar bool   `json:"has_avatar"`
+		// AvatarThumbnail is a data URI, set only with include_avatar=true.
+		AvatarThumbnail string `json:"avatar_thumbnail,omitempty"`
 	}
 
-	users := make([]userSummary, 0, len(emails))
+	if len(emails) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"users": []userSummary{}})
+		return
+	}
+	includeAvatar, _ := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("include_avatar")))
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(emails)), ",")
+	args := make([]interface{}, 0, len(emails)+1)
+	// Avatars too large to thumbnail are never read.
+	avatarColumn := "NULL"
+	if includeAvatar {
+		avatarColumn = "IF(LENGTH(avatar) <= ?, avatar, NULL)"
+		args = append(args, maxThumbnailSourceBytes)
+	}
 	for _, email := range emails {
+		args = append(args, email)
+	}
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT email, name, LENGTH(avatar) > 0, "+avatarColumn+" FROM user_profiles WHERE email IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		log.Printf("load user profiles error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load users"})
+		return
+	}
+	defer rows.Close()
+
+	// The email column compares case-insensitively, so key rows by the
+	// lowercased address and answer with the spelling that was asked for.
+	profiles := make(map[string]userSummary, len(emails))
+	avatars := make(map[string][]byte)
+	for rows.Next() {
 		var (
-			name   sql.NullString
-			avatar []byte
+			email     string
+			name      sql.NullString
+			hasAvatar sql.NullBool
+			avatar    []byte
 		)
-		err := db.QueryRow(
-			"SELECT name, avatar FROM user_profiles WHERE email = ?",
-			email,
-		).Scan(&name, &avatar)
-		if errors.Is(err, sql.ErrNoRows) {
-			continue
+		if err := rows.Scan(&email, &name, &hasAvatar, &avatar); err != nil {
+			log.Printf("scan user profile error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load users"})
+			return
 		}
-		if err != nil {
-			log.Printf("load user profile for %s error: %v", email, err)
+		profiles[strings.ToLower(email)] = userSummary{
+			Name:      strings.TrimSpace(name.String),
+			HasAvatar: hasAvatar.Bool,
+		}
+		if len(avatar) > 0 {
+			avatars[strings.ToLower(email)] = avatar
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("iterate user profiles error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to load users"})
+		return
+	}
+
+	users := make([]userSummary, 0, len(emails))
+	thumbnailPixels := maxThumbnailPixelsPerRequest
+	for _, email := range emails {
+		profile, ok := profiles[strings.ToLower(email)]
+		if !ok {
 			continue
 		}
-		users = append(users, userSummary{
-			Email:     email,
-			Name:      strings.TrimSpace(name.String),
-			HasAvatar: len(avatar) > 0,
-		})
+		profile.Email = email
+		if avatar := avatars[strings.ToLower(email)]; avatar != nil && len(users) < maxEmbeddedAvatars {
+			profile.AvatarThumbnail = avatarThumbnail(avatar, &thumbnailPixels)
+		}
+		users = append(users, profile)
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
 }
 
-func (m *messageServiceClient) ListConversations(ctx context.Context, email string) ([]conversationView, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/conversations?user=%s", m.baseURL, url.QueryEscape(email)), nil)
-	if err != nil {
-		return nil, err
+func (m *messageServiceClient) ListConversations(ctx context.Context, email string, includeArchived bool) ([]conversationView, error) {
+	query := url.Values{}
+	query.Set("user", email)
+	if includeArchived {
+		query.Set("include_archived", "true")
 	}
-
-	resp, err := m.http.Do(req)
+	resp, err := m.get(ctx, fmt.Sprintf("%s/conversations?%s", m.baseURL, query.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -1440,6 +2554,16 @@ func (m *messageServiceClient) CreateConversation(ctx context.Context, createdBy
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest {
+		var rejected struct {
+			Unknown []string `json:"unknown_participants"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &rejected) == nil && len(rejected.Unknown) > 0 {
+			return nil, &unknownParticipantsError{Emails: rejected.Unknown}
+		}
+		return nil, fmt.Errorf("message service status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
 	if resp.StatusCode != http.StatusCreated {
 		return nil, decodeMessageServiceError(resp)
 	}
@@ -1452,11 +2576,7 @@ func (m *messageServiceClient) CreateConversation(ctx context.Context, createdBy
 }
 
 func (m *messageServiceClient) GetConversation(ctx context.Context, id string) (*conversationSummary, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/conversations/%s", m.baseURL, id), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := m.http.Do(req)
+	resp, err := m.get(ctx, fmt.Sprintf("%s/conversations/%s", m.baseURL, id))
 	if err != nil {
 		return nil, err
 	}
@@ -1473,16 +2593,18 @@ func (m *messageServiceClient) GetConversation(ctx context.Context, id string) (
 	return &conv, nil
 }
 
-func (m *messageServiceClient) ListMessages(ctx context.Context, id, reader string) ([]messageView, error) {
-	return m.ListMessagesWithLimit(ctx, id, 0, reader)
-}
-
-func (m *messageServiceClient) ListMessagesWithLimit(ctx context.Context, id string, limit int, reader string) ([]messageView, error) {
+// ListMessagesWithLimit returns up to limit messages, oldest first. With
+// latest set they are the conversation's most recent ones rather than its
+// first.
+func (m *messageServiceClient) ListMessagesWithLimit(ctx context.Context, id string, limit int, reader string, latest bool) ([]messageView, error) {
 	base := fmt.Sprintf("%s/conversations/%s/messages", m.baseURL, id)
 	query := url.Values{}
 	if limit > 0 {
 		query.Set("limit", strconv.Itoa(limit))
 	}
+	if latest {
+		query.Set("tail", "true")
+	}
 	if reader != "" {
 		query.Set("reader", reader)
 	}
@@ -1490,11 +2612,14 @@ func (m *messageServiceClient) ListMessagesWithLimit(ctx context.Context, id str
 		base = fmt.Sprintf("%s?%s", base, encoded)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
-	if err != nil {
-		return nil, err
+	// A listing for a reader is not idempotent: it claims the view-once
+	// messages it reveals and advances the reader's read state, so a retry
+	// after a lost response would consume them a second time.
+	retries := m.retries
+	if reader != "" {
+		retries = 0
 	}
-	resp, err := m.http.Do(req)
+	resp, err := m.getWithRetries(ctx, base, retries)
 	if err != nil {
 		return nil, err
 	}
@@ -1513,10 +2638,11 @@ func (m *messageServiceClient) ListMessagesWithLimit(ctx context.Context, id str
 	return payload.Messages, nil
 }
 
-func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID, sender, text string) (*createdMessage, error) {
-	body := map[string]string{
-		"sender": sender,
-		"text":   text,
+func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID, sender, text string, viewOnce bool, idempotencyKey string) (*createdMessage, error) {
+	body := map[string]interface{}{
+		"sender":    sender,
+		"text":      text,
+		"view_once": viewOnce,
 	}
 	buf, err := json.Marshal(body)
 	if err != nil {
@@ -1528,6 +2654,9 @@ func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
 
 	resp, err := m.http.Do(req)
 	if err != nil {
@@ -1535,6 +2664,19 @@ func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict && idempotencyKey != "" {
+		return nil, errIdempotencyInProgress
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		var body struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, fmt.Errorf("message service status %d: %w", resp.StatusCode, err)
+		}
+		return nil, &messageRejectedError{message: body.Error, reason: body.Reason}
+	}
 	if resp.StatusCode != http.StatusCreated {
 		return nil, decodeMessageServiceError(resp)
 	}
@@ -1543,16 +2685,243 @@ func (m *messageServiceClient) CreateMessage(ctx context.Context, conversationID
 	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
 		return nil, err
 	}
+	msg.Replayed = resp.Header.Get(idempotentReplayHeader) == "true"
 	return &msg, nil
 }
 
-func (m *messageServiceClient) MarkConversationRead(ctx context.Context, conversationID, user string) error {
+// MarkConversationRead returns the reader's new read count, or 0 when
+// message-service does not report one.
+func (m *messageServiceClient) MarkConversationRead(ctx context.Context, conversationID, user string) (int64, error) {
 	payload := map[string]string{"user": user}
 	buf, err := json.Marshal(payload)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/read", m.baseURL, conversationID), bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, decodeMessageServiceError(resp)
+	}
+	readCount, _ := strconv.ParseInt(resp.Header.Get("X-Read-Count"), 10, 64)
+	return readCount, nil
+}
+
+// SyncMessages returns what changed in the user's conversations since
+// cursors. It runs under syncTimeout rather than the per-call deadline.
+func (m *messageServiceClient) SyncMessages(ctx context.Context, user string, cursors map[string]string) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.syncTimeout)
+	defer cancel()
+	body := map[string]interface{}{
+		"user":    user,
+		"cursors": cursors,
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/messages/sync", m.baseURL), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := *m.http
+	client.Timeout = m.syncTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeMessageServiceError(resp)
+	}
+
+	var result json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListReadReceipts returns the read counts and, for the page of messages
+// ListMessagesWithLimit would return for the same limit and latest, who each
+// message has been delivered to.
+func (m *messageServiceClient) ListReadReceipts(ctx context.Context, conversationID string, limit int, latest bool) (*receiptsView, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if latest {
+		query.Set("tail", "true")
+	}
+	resp, err := m.get(ctx, fmt.Sprintf("%s/conversations/%s/receipts?%s", m.baseURL, conversationID, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeMessageServiceError(resp)
+	}
+
+	var payload receiptsView
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	if payload.Delivered == nil {
+		payload.Delivered = map[string][]string{}
+	}
+	return &payload, nil
+}
+
+func (m *messageServiceClient) SetConversationArchived(ctx context.Context, conversationID, user string, archived bool) error {
+	payload := map[string]interface{}{
+		"user":     user,
+		"archived": archived,
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/archive", m.baseURL, conversationID), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return decodeMessageServiceError(resp)
+	}
+	return nil
+}
+
+func (m *messageServiceClient) SetConversationPinned(ctx context.Context, conversationID, user string, pinned bool) error {
+	payload := map[string]interface{}{
+		"user":   user,
+		"pinned": pinned,
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/pin", m.baseURL, conversationID), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return decodeMessageServiceError(resp)
+	}
+	return nil
+}
+
+// RenameConversation sets the conversation's name for all participants on
+// behalf of user, who must be one of them.
+func (m *messageServiceClient) RenameConversation(ctx context.Context, conversationID, user, name string) (*conversationView, error) {
+	payload := map[string]string{
+		"user": user,
+		"name": name,
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, fmt.Sprintf("%s/conversations/%s", m.baseURL, conversationID), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeMessageServiceError(resp)
+	}
+
+	var conv conversationView
+	if err := json.NewDecoder(resp.Body).Decode(&conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// ReactToMessage toggles user's emoji reaction on a message, or removes it
+// when remove is set.
+func (m *messageServiceClient) ReactToMessage(ctx context.Context, conversationID, messageID, user, emoji string, remove bool) (*reactionResult, error) {
+	payload := map[string]string{
+		"user":  user,
+		"emoji": emoji,
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	method := http.MethodPost
+	if remove {
+		method = http.MethodDelete
+	}
+	target := fmt.Sprintf("%s/conversations/%s/messages/%s/reactions", m.baseURL, url.PathEscape(conversationID), url.PathEscape(messageID))
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", errInvalidReaction, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeMessageServiceError(resp)
+	}
+
+	var result reactionResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (m *messageServiceClient) SetConversationAvatar(ctx context.Context, conversationID string, hasAvatar bool) error {
+	payload := map[string]bool{"has_avatar": hasAvatar}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/conversations/%s/avatar", m.baseURL, conversationID), bytes.NewReader(buf))
 	if err != nil {
 		return err
 	}
@@ -1576,6 +2945,49 @@ type conversationSummary struct {
 	Participants   []string `json:"participants"`
 	LastActivityAt string   `json:"last_activity_at"`
 	CreatedBy      string   `json:"created_by"`
+	IsGroup        bool     `json:"is_group"`
+	HasAvatar      bool     `json:"has_avatar"`
+}
+
+// unknownParticipantsError is returned when message-service runs with
+// STRICT_PARTICIPANTS and rejects emails that are not registered users.
+type unknownParticipantsError struct {
+	Emails []string
+}
+
+func (e *unknownParticipantsError) Error() string {
+	return "unknown participants: " + strings.Join(e.Emails, ", ")
+}
+
+// rateLimitedError matches errRateLimited and keeps the Retry-After that
+// message-service sent with its 429, if any.
+type rateLimitedError struct {
+	retryAfter string
+}
+
+func (e *rateLimitedError) Error() string { return errRateLimited.Error() }
+
+func (e *rateLimitedError) Is(target error) bool { return target == errRateLimited }
+
+// writeRateLimited answers 429, passing on message-service's Retry-After.
+func writeRateLimited(w http.ResponseWriter, err error, message string) {
+	var limited *rateLimitedError
+	if errors.As(err, &limited) && limited.retryAfter != "" {
+		w.Header().Set("Retry-After", limited.retryAfter)
+	}
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": message})
+}
+
+// messageRejectedError is message-service refusing a message with 422: a
+// moderation rejection, which carries a reason, or an Idempotency-Key reused
+// for a different message.
+type messageRejectedError struct {
+	message string
+	reason  string
+}
+
+func (e *messageRejectedError) Error() string {
+	return fmt.Sprintf("message rejected: %s: %s", e.message, e.reason)
 }
 
 func decodeMessageServiceError(resp *http.Response) error {
@@ -1584,36 +2996,48 @@ func decodeMessageServiceError(resp *http.Response) error {
 	if resp.StatusCode == http.StatusNotFound {
 		return errNotFound
 	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &rateLimitedError{retryAfter: resp.Header.Get("Retry-After")}
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return errForbidden
+	}
 	if msg == "" {
 		msg = http.StatusText(resp.StatusCode)
 	}
 	return fmt.Errorf("message service status %d: %s", resp.StatusCode, msg)
 }
 
-func uniqueNonEmpty(values []string) []string {
-	seen := make(map[string]struct{}, len(values))
-	result := make([]string, 0, len(values))
-	for _, v := range values {
-		v = strings.TrimSpace(v)
-		if v == "" {
-			continue
-		}
-		if _, exists := seen[v]; exists {
-			continue
+// isParticipant reports whether email is in participants. Emails are
+// compared case-insensitively: message-service stores participants as the
+// creating client sent them, so their case need not match the session's.
+func isParticipant(participants []string, email string) bool {
+	email = strings.TrimSpace(email)
+	for _, p := range participants {
+		if strings.EqualFold(strings.TrimSpace(p), email) {
+			return true
 		}
-		seen[v] = struct{}{}
-		result = append(result, v)
 	}
-	return result
+	return false
 }
 
-func contains(list []string, target string) bool {
-	for _, v := range list {
-		if v == target {
-			return true
-		}
+// emailPattern is a pragmatic subset of RFC 5322: a dot-atom local part and
+// a domain with at least one dot. It is matched against the lowercased
+// address.
+var emailPattern = regexp.MustCompile("^[a-z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?(?:\\.[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)+$")
+
+// validateEmail trims and lowercases an address and rejects anything that
+// does not look deliverable, so the same mailbox always maps to one
+// identity and garbage never reaches Mailgun.
+func validateEmail(raw string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(raw))
+	if email == "" {
+		return "", errors.New("email is required")
 	}
-	return false
+	if len(email) > 254 || !emailPattern.MatchString(email) {
+		return "", errors.New("a valid email is required")
+	}
+	return email, nil
 }
 
 func normalizeParticipantEmails(list []string) []string {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessagePage(t *testing.T) {
+	cases := []struct {
+		query      string
+		wantLimit  int
+		wantLatest bool
+		wantOK     bool
+	}{
+		{"", messagePageSize, false, true},
+		{"?limit=50", 50, false, true},
+		{"?limit=50&direction=latest", 50, true, true},
+		{"?direction=oldest", messagePageSize, false, true},
+		{"?limit=0", messagePageSize, false, true},
+		{"?limit=5000", messagePageSize, false, true},
+		{"?direction=sideways", 0, false, false},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/conversations/x/receipts"+tc.query, nil)
+		limit, latest, ok := messagePage(w, r)
+		if limit != tc.wantLimit || latest != tc.wantLatest || ok != tc.wantOK {
+			t.Errorf("%q: got (%d, %v, %v), want (%d, %v, %v)", tc.query, limit, latest, ok, tc.wantLimit, tc.wantLatest, tc.wantOK)
+		}
+		if !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", tc.query, w.Code)
+		}
+	}
+}
+
+func TestIsParticipant(t *testing.T) {
+	participants := []string{"Alice@Example.com", " bob@example.com"}
+	for email, want := range map[string]bool{
+		"alice@example.com":   true,
+		"ALICE@EXAMPLE.COM":   true,
+		"bob@example.com":     true,
+		"mallory@example.com": false,
+		"":                    false,
+	} {
+		if got := isParticipant(participants, email); got != want {
+			t.Errorf("isParticipant(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
+
+func TestListMessagesRetriesOnlyWithoutReader(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client := newMessageServiceClient(srv.URL, time.Second, time.Second, time.Second, 2, time.Millisecond)
+
+	if _, err := client.ListMessagesWithLimit(context.Background(), "c1", 10, "", false); err == nil {
+		t.Fatal("listing succeeded against a failing server")
+	}
+	if n := calls.Swap(0); n != 3 {
+		t.Fatalf("listing without a reader made %d calls, want 3", n)
+	}
+
+	// With a reader the listing claims view-once messages and marks them
+	// read, so it is sent once.
+	if _, err := client.ListMessagesWithLimit(context.Background(), "c1", 10, "alice@example.com", false); err == nil {
+		t.Fatal("listing succeeded against a failing server")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("listing for a reader made %d calls, want 1", n)
+	}
+}
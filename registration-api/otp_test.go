@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otpTable is an in-memory otp_codes table behind database/sql. Every SELECT
+// waits until `readers` SELECTs have arrived, so concurrent verifiers all
+// see the code before any of them deletes it.
+type otpTable struct {
+	mu      sync.Mutex
+	codes   map[string]string
+	expires time.Time
+	readers sync.WaitGroup
+}
+
+func (t *otpTable) Connect(context.Context) (driver.Conn, error) { return otpConn{t}, nil }
+func (t *otpTable) Driver() driver.Driver                        { return nil }
+
+type otpConn struct{ t *otpTable }
+
+func (c otpConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c otpConn) Close() error                        { return nil }
+func (c otpConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c otpConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT code, expires_at FROM otp_codes WHERE email = ?") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.t.readers.Done()
+	c.t.readers.Wait()
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	code, ok := c.t.codes[args[0].Value.(string)]
+	if !ok {
+		return &otpRows{}, nil
+	}
+	return &otpRows{row: []driver.Value{code, c.t.expires}}, nil
+}
+
+func (c otpConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "DELETE FROM otp_codes WHERE email = ? AND code = ?") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	email := args[0].Value.(string)
+	if code, ok := c.t.codes[email]; !ok || code != args[1].Value.(string) {
+		return driver.RowsAffected(0), nil
+	}
+	delete(c.t.codes, email)
+	return driver.RowsAffected(1), nil
+}
+
+type otpRows struct{ row []driver.Value }
+
+func (r *otpRows) Columns() []string { return []string{"code", "expires_at"} }
+func (r *otpRows) Close() error      { return nil }
+func (r *otpRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+func TestVerifyOTPConcurrentVerifiesConsumeOnce(t *testing.T) {
+	const verifiers = 2
+	table := &otpTable{
+		codes:   map[string]string{"alice@example.com": "123456"},
+		expires: time.Now().Add(time.Minute),
+	}
+	table.readers.Add(verifiers)
+	saved := db
+	db = sql.OpenDB(table)
+	defer func() {
+		db.Close()
+		db = saved
+	}()
+
+	errs := make(chan error, verifiers)
+	for i := 0; i < verifiers; i++ {
+		go func() { errs <- verifyOTP("alice@example.com", "123456") }()
+	}
+	accepted := 0
+	for i := 0; i < verifiers; i++ {
+		if err := <-errs; err == nil {
+			accepted++
+		} else if err.Error() != "OTP not found or expired" {
+			t.Errorf("losing verify failed with %q", err)
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("%d of %d concurrent verifies accepted the code, want exactly 1", accepted, verifiers)
+	}
+}
+
+// otpVector was produced by email-worker's hashOTP with pepper "test-pepper",
+// code "123456" and salt 00..0f; email-worker's tests check the same value.
+const otpVector = "hmac$000102030405060708090a0b0c0d0e0f$21eff9a40144e4b3f2bee3ecfb00b44d271fb29a3cbfbd8bb47ab488bcb49343"
+
+func TestOTPMatches(t *testing.T) {
+	pepper := []byte("test-pepper")
+	tests := []struct {
+		name, stored, code string
+		pepper             []byte
+		want               bool
+	}{
+		{"hmac round trip", otpVector, "123456", pepper, true},
+		{"hmac wrong code", otpVector, "123457", pepper, false},
+		{"hmac wrong pepper", otpVector, "123456", []byte("other-pepper"), false},
+		{"hmac without pepper", otpVector, "123456", nil, false},
+		{"hmac tampered salt", strings.Replace(otpVector, "$00", "$ff", 1), "123456", pepper, false},
+		{"hmac malformed", "hmac$zz$21ef", "123456", pepper, false},
+		{"hmac missing mac", "hmac$000102", "123456", pepper, false},
+		{"unpeppered sha256", "sha256$000102030405060708090a0b0c0d0e0f$99c90773ea9ce66a355bd6a2a6e55122c3caf5a164785c90b1d58c2d63bb8680", "123456", pepper, false},
+		{"legacy plain", "123456", "123456", pepper, true},
+		{"legacy plain wrong code", "123456", "12345", pepper, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := otpMatches(tt.pepper, tt.stored, tt.code); got != tt.want {
+				t.Fatalf("otpMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
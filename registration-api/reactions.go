@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleAPIMessageReaction serves POST and DELETE
+// /api/conversations/{id}/messages/{messageId}/reactions with {"emoji"}:
+// POST toggles the caller's reaction and DELETE removes it. The change is
+// relayed to the participants' open sockets as a "reaction" event carrying
+// the message's reactions, so clients can replace what they show.
+func handleAPIMessageReaction(w http.ResponseWriter, r *http.Request, conversationID, messageID, email string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json payload"})
+		return
+	}
+	defer r.Body.Close()
+	emoji := strings.TrimSpace(payload.Emoji)
+	if emoji == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "emoji is required"})
+		return
+	}
+
+	conversation, err := loadConversationForUser(w, r, conversationID, email)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := messageSvc.withTimeout(r.Context())
+	result, err := messageSvc.ReactToMessage(ctx, conversationID, messageID, strings.ToLower(email), emoji, r.Method == http.MethodDelete)
+	cancel()
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotFound):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "message not found"})
+		case errors.Is(err, errForbidden):
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+		case errors.Is(err, errInvalidReaction):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid emoji"})
+		default:
+			log.Printf("update reaction error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "unable to update reaction"})
+		}
+		return
+	}
+
+	event := &chatRedisEvent{
+		Type:             "reaction",
+		MessageID:        messageID,
+		Participants:     conversation.Participants,
+		ConversationID:   conversation.ID,
+		ConversationName: conversation.Name,
+		From:             strings.ToLower(email),
+		Text:             result.Emoji,
+		SentAt:           time.Now().UTC().Format(time.RFC3339),
+		ReactionAction:   result.Action,
+		Reactions:        result.Reactions,
+	}
+	if err := publishChatEvent(context.Background(), event); err != nil {
+		log.Printf("redis publish error: %v", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation_id": conversationID,
+		"message_id":      messageID,
+		"emoji":           result.Emoji,
+		"action":          result.Action,
+		"reactions":       result.Reactions,
+	})
+}
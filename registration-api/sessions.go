@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionIDLength is how much of a token is shown when listing sessions.
+// It is enough to tell sessions apart and to revoke one, but never enough
+// to use as a credential.
+const sessionIDLength = 8
+
+// sessionPolicy controls how long sessions live. With a refreshWindow set,
+// a session used within that long of expiring is pushed out to a full ttl
+// again, so active users stay signed in while idle sessions lapse.
+type sessionPolicy struct {
+	ttl           time.Duration
+	refreshWindow time.Duration
+	// refreshMinInterval is the smallest extension worth writing, which
+	// caps sliding updates at one per session per interval.
+	refreshMinInterval time.Duration
+}
+
+var sessionLifetime = sessionPolicy{ttl: 90 * 24 * time.Hour}
+
+// slide extends sess if it is inside the refresh window, persisting the new
+// expiry. Failures are logged and leave the session as it was.
+func (p sessionPolicy) slide(sess *session) {
+	if p.refreshWindow <= 0 {
+		return
+	}
+	now := time.Now()
+	if sess.ExpiresAt.Sub(now) > p.refreshWindow {
+		return
+	}
+	extended := now.Add(p.ttl)
+	if extended.Sub(sess.ExpiresAt) < p.refreshMinInterval {
+		return
+	}
+	if _, err := db.Exec("UPDATE sessions SET expires_at = ? WHERE token = ?", extended, sess.Token); err != nil {
+		log.Printf("session refresh error: %v", err)
+		return
+	}
+	sess.ExpiresAt = extended
+}
+
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+}
+
+// handleAPISessions lists the caller's active sessions (GET) or revokes all
+// of them except the one making the request (DELETE).
+func handleAPISessions(w http.ResponseWriter, r *http.Request) {
+	sess, err := getSessionFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(
+			"SELECT token, created_at, expires_at FROM sessions WHERE email = ? AND expires_at > ? ORDER BY created_at DESC",
+			sess.Email, time.Now(),
+		)
+		if err != nil {
+			log.Printf("list sessions error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to list sessions"})
+			return
+		}
+		defer rows.Close()
+
+		sessions := make([]sessionInfo, 0)
+		for rows.Next() {
+			var (
+				token string
+				info  sessionInfo
+			)
+			if err := rows.Scan(&token, &info.CreatedAt, &info.ExpiresAt); err != nil {
+				log.Printf("scan session error: %v", err)
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to list sessions"})
+				return
+			}
+			info.ID = sessionID(token)
+			info.Current = token == sess.Token
+			sessions = append(sessions, info)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("list sessions error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to list sessions"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+
+	case http.MethodDelete:
+		// A JWT caller has no row of its own, so every stored session goes.
+		res, err := db.Exec("DELETE FROM sessions WHERE email = ? AND token <> ?", sess.Email, sess.Token)
+		if err != nil {
+			log.Printf("revoke sessions error: %v", err)
+			recordAuthEvent(r, auditSessionRevoke, sess.Email, auditFailure, "revoke others failed")
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to revoke sessions"})
+			return
+		}
+		n, _ := res.RowsAffected()
+		recordAuthEvent(r, auditSessionRevoke, sess.Email, auditSuccess, "revoked other sessions: "+strconv.FormatInt(n, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPISessionResource revokes one of the caller's sessions by the id
+// shown in the listing: DELETE /api/sessions/{id}.
+func handleAPISessionResource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess, err := getSessionFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	id := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/sessions/")))
+	if !validSessionID(id) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid session id"})
+		return
+	}
+
+	// Matching by prefix and email means a caller can only ever revoke
+	// their own sessions, whatever id they send.
+	res, err := db.Exec("DELETE FROM sessions WHERE email = ? AND token LIKE ?", sess.Email, id+"%")
+	if err != nil {
+		log.Printf("revoke session error: %v", err)
+		recordAuthEvent(r, auditSessionRevoke, sess.Email, auditFailure, "revoke failed")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to revoke session"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	recordAuthEvent(r, auditSessionRevoke, sess.Email, auditSuccess, "revoked session "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPITokenRefresh issues a new JWT for a caller holding a valid JWT
+// or session token, without another OTP. The session the credential came
+// from must still exist, so revoking a session also stops its JWTs from
+// being refreshed.
+func handleAPITokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(jwtSecret) == 0 {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "jwt not configured"})
+		return
+	}
+
+	sess, err := getSessionFromRequest(r)
+	if err != nil {
+		recordAuthEvent(r, auditTokenRefresh, "", auditFailure, err.Error())
+		writeAuthError(w, err)
+		return
+	}
+
+	if sess.FromJWT {
+		backing, err := sessionForJWT(sess)
+		if err != nil {
+			recordAuthEvent(r, auditTokenRefresh, sess.Email, auditFailure, err.Error())
+			writeAuthError(w, err)
+			return
+		}
+		sess = backing
+	}
+
+	jwtToken, err := generateJWT(sess.Email, sess.ID, sess.ExpiresAt)
+	if err != nil {
+		log.Printf("jwt generation error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to issue access token"})
+		return
+	}
+	expiresIn := sess.ExpiresAt.Unix() - time.Now().Unix()
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+
+	recordAuthEvent(r, auditTokenRefresh, sess.Email, auditSuccess, "")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"email":        sess.Email,
+		"access_token": jwtToken,
+		"token_type":   "Bearer",
+		"expires_in":   expiresIn,
+	})
+}
+
+// sessionForJWT loads the unexpired session row a JWT was issued from,
+// applying sliding expiry to it.
+func sessionForJWT(claims *session) (*session, error) {
+	if claims.ID == "" {
+		return nil, errors.New("token predates refresh support; sign in again")
+	}
+	var sess session
+	err := db.QueryRow(
+		"SELECT token, email, expires_at FROM sessions WHERE email = ? AND token LIKE ? AND expires_at > ? ORDER BY expires_at DESC LIMIT 1",
+		claims.Email, claims.ID+"%", time.Now(),
+	).Scan(&sess.Token, &sess.Email, &sess.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("session revoked or expired")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSessionLookup, err)
+	}
+	sess.ID = claims.ID
+	sessionLifetime.slide(&sess)
+	return &sess, nil
+}
+
+func sessionID(token string) string {
+	if len(token) > sessionIDLength {
+		return token[:sessionIDLength]
+	}
+	return token
+}
+
+// validSessionID accepts a listed id or a full token. Only the characters
+// tokens are made of are allowed, so the value is safe inside LIKE.
+func validSessionID(id string) bool {
+	if len(id) < sessionIDLength || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// usersTable is an in-memory users table behind database/sql. Only the
+// users table is served, so a lookup that consults sessions or profiles
+// fails.
+type usersTable map[string]bool
+
+func (t usersTable) Connect(context.Context) (driver.Conn, error) { return usersConn{t}, nil }
+func (t usersTable) Driver() driver.Driver                        { return nil }
+
+type usersConn struct{ t usersTable }
+
+func (c usersConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c usersConn) Close() error                        { return nil }
+func (c usersConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c usersConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT email FROM users WHERE email IN (") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	rows := &usersRows{}
+	for _, arg := range args {
+		if email := arg.Value.(string); c.t[email] {
+			rows.emails = append(rows.emails, email)
+		}
+	}
+	return rows, nil
+}
+
+type usersRows struct{ emails []string }
+
+func (r *usersRows) Columns() []string { return []string{"email"} }
+func (r *usersRows) Close() error      { return nil }
+func (r *usersRows) Next(dest []driver.Value) error {
+	if len(r.emails) == 0 {
+		return io.EOF
+	}
+	dest[0], r.emails = r.emails[0], r.emails[1:]
+	return nil
+}
+
+func TestInternalUserLookupUsesUsersTable(t *testing.T) {
+	savedDB, savedToken := db, internalAPIToken
+	// bob has logged out, so he has no session, and never saved a profile.
+	db = sql.OpenDB(usersTable{"alice@example.com": true, "bob@example.com": true})
+	internalAPIToken = "internal"
+	defer func() {
+		db.Close()
+		db, internalAPIToken = savedDB, savedToken
+	}()
+
+	body := `{"emails":["Alice@example.com","bob@example.com","mallory@example.com"]}`
+	r := httptest.NewRequest(http.MethodPost, "/internal/users/lookup", strings.NewReader(body))
+	r.Header.Set("X-Internal-Token", "internal")
+	w := httptest.NewRecorder()
+	handleInternalUserLookup(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		Known   []string `json:"known"`
+		Unknown []string `json:"unknown"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got.Known, ",") != "alice@example.com,bob@example.com" || strings.Join(got.Unknown, ",") != "mallory@example.com" {
+		t.Fatalf("known %v, unknown %v", got.Known, got.Unknown)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// When WEBHOOK_URL is set, every newly created conversation is POSTed there
+// as JSON, signed so the receiver can trust it:
+//
+//   - X-Webhook-Timestamp is the Unix time the payload was signed.
+//   - X-Webhook-Signature is "sha256=" followed by the hex HMAC-SHA256 of
+//     "<timestamp>.<body>" keyed with WEBHOOK_SECRET. Receivers should also
+//     reject stale timestamps to stop replays.
+//
+// Delivery is fire-and-forget: it runs after the response, with one retry
+// on a transport error or 5xx, and failures are only logged.
+const (
+	webhookTimeout    = 5 * time.Second
+	webhookRetryDelay = time.Second
+	webhookAttempts   = 2
+)
+
+// conversationWebhook is nil when WEBHOOK_URL is unset.
+var conversationWebhook *webhookNotifier
+
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	if url == "" {
+		return nil
+	}
+	return &webhookNotifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// conversationCreatedEvent is the body sent for a new conversation.
+type conversationCreatedEvent struct {
+	Event          string   `json:"event"`
+	ConversationID string   `json:"conversation_id"`
+	Name           string   `json:"name,omitempty"`
+	Participants   []string `json:"participants"`
+	CreatedBy      string   `json:"created_by"`
+	CreatedAt      string   `json:"created_at"`
+}
+
+// notifyConversationCreated sends the webhook in the background. It is a
+// no-op on a nil notifier.
+func (n *webhookNotifier) notifyConversationCreated(conv *conversationView, createdBy string) {
+	if n == nil || conv == nil {
+		return
+	}
+	body, err := json.Marshal(conversationCreatedEvent{
+		Event:          "conversation.created",
+		ConversationID: conv.ID,
+		Name:           conv.Name,
+		Participants:   conv.Participants,
+		CreatedBy:      createdBy,
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("webhook marshal error: %v", err)
+		return
+	}
+	go n.deliver(conv.ID, body)
+}
+
+func (n *webhookNotifier) deliver(conversationID string, body []byte) {
+	var lastErr error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookRetryDelay)
+		}
+		lastErr = n.post(body)
+		if lastErr == nil {
+			return
+		}
+	}
+	log.Printf("webhook for conversation %s failed after %d attempts: %v", conversationID, webhookAttempts, lastErr)
+}
+
+func (n *webhookNotifier) post(body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
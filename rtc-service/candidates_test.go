@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(maxCandidates int) *server {
+	return &server{
+		store:         newMemoryStore(),
+		subscribers:   make(map[string]map[chan sessionEvent]struct{}),
+		sessionTTL:    time.Minute,
+		maxCandidates: maxCandidates,
+	}
+}
+
+func postCandidate(s *server, id, from, candidate string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"candidate":%q,"from":%q}`, candidate, from)
+	req := httptest.NewRequest(http.MethodPost, "/sessions/"+id+"/candidates", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.handleSessionResource(rec, req)
+	return rec
+}
+
+func TestCandidateCap(t *testing.T) {
+	s := newTestServer(3)
+	sess, err := s.createSession(context.Background(), "conv", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cap counts both participants' candidates together.
+	for i, from := range []string{"alice", "bob", "alice"} {
+		if rec := postCandidate(s, sess.ID, from, fmt.Sprintf("candidate:%d", i)); rec.Code != http.StatusOK {
+			t.Fatalf("candidate %d: status %d, body %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := postCandidate(s, sess.ID, "bob", "candidate:3"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("candidate over the cap: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	got, err := s.fetchSession(context.Background(), sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got.Candidates["alice"]) + len(got.Candidates["bob"]); n != 3 {
+		t.Fatalf("stored %d candidates, want 3", n)
+	}
+}
+
+func TestCandidateDuplicateIsNoop(t *testing.T) {
+	s := newTestServer(2)
+	sess, err := s.createSession(context.Background(), "conv", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	events := s.subscribeLocked(sess.ID)
+	s.mu.Unlock()
+	defer s.unsubscribe(sess.ID, events)
+
+	for i := 0; i < 2; i++ {
+		if rec := postCandidate(s, sess.ID, "alice", "candidate:0"); rec.Code != http.StatusOK {
+			t.Fatalf("post %d: status %d, body %s", i, rec.Code, rec.Body)
+		}
+	}
+	// A re-sent candidate at the cap is still accepted, since it adds nothing.
+	if rec := postCandidate(s, sess.ID, "alice", "candidate:1"); rec.Code != http.StatusOK {
+		t.Fatalf("second candidate: status %d", rec.Code)
+	}
+	if rec := postCandidate(s, sess.ID, "alice", "candidate:1"); rec.Code != http.StatusOK {
+		t.Fatalf("re-sent candidate at the cap: status %d", rec.Code)
+	}
+
+	got, err := s.fetchSession(context.Background(), sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got.Candidates["alice"]); n != 2 {
+		t.Fatalf("stored %d candidates, want 2", n)
+	}
+	if n := len(events); n != 2 {
+		t.Fatalf("published %d candidate events, want 2", n)
+	}
+}
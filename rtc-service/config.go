@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything rtc-service reads from the environment at startup.
+// loadConfig validates it in one pass so a bad deployment fails before the
+// listener opens, listing every problem at once.
+type config struct {
+	listenAddr    string
+	sessionTTL    time.Duration
+	maxCandidates int
+	turnSecret    string
+	turnTTL       time.Duration
+	turnURLs      []string
+	redisAddr     string
+	chatRedisAddr string
+	// corsAllowedOrigins is CORS_ALLOWED_ORIGINS, kept raw for the summary.
+	corsAllowedOrigins string
+	cors               corsConfig
+}
+
+// configProblems accumulates validation failures while loading config.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// seconds parses a positive number of seconds, recording a problem rather
+// than silently falling back when the value is malformed.
+func (p *configProblems) seconds(key string, fallback time.Duration) time.Duration {
+	return time.Duration(p.intAtLeast(key, 1, int(fallback/time.Second))) * time.Second
+}
+
+// intAtLeast parses an integer no smaller than min, recording a problem
+// rather than silently falling back when the value is malformed.
+func (p *configProblems) intAtLeast(key string, min, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min {
+		p.add("%s must be an integer >= %d, got %q", key, min, raw)
+		return fallback
+	}
+	return n
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(p, "\n  - "))
+}
+
+func loadConfig() (config, error) {
+	var problems configProblems
+	cfg := config{
+		listenAddr:         envOrDefault("LISTEN_ADDR", ":"+envOrDefault("SERVICE_PORT", "8085")),
+		sessionTTL:         problems.seconds("SESSION_TTL_SECONDS", 15*time.Minute),
+		maxCandidates:      problems.intAtLeast("MAX_CANDIDATES_PER_SESSION", 1, 100),
+		turnSecret:         strings.TrimSpace(os.Getenv("TURN_SHARED_SECRET")),
+		turnTTL:            problems.seconds("TURN_CREDENTIAL_TTL", 10*time.Minute),
+		turnURLs:           parseCSVList(strings.TrimSpace(os.Getenv("TURN_SERVER_URLS"))),
+		redisAddr:          strings.TrimSpace(os.Getenv("REDIS_ADDR")),
+		chatRedisAddr:      strings.TrimSpace(os.Getenv("CHAT_REDIS_ADDR")),
+		corsAllowedOrigins: envOrDefault("CORS_ALLOWED_ORIGINS", "http://localhost:5173,http://127.0.0.1:5173"),
+	}
+	if len(cfg.turnURLs) == 0 {
+		cfg.turnURLs = []string{"turn:localhost:3478?transport=udp", "turn:localhost:3478?transport=tcp"}
+	}
+	for _, turnURL := range cfg.turnURLs {
+		if !strings.HasPrefix(turnURL, "turn:") && !strings.HasPrefix(turnURL, "turns:") && !strings.HasPrefix(turnURL, "stun:") {
+			problems.add("TURN_SERVER_URLS entries must be turn:, turns: or stun: URLs, got %q", turnURL)
+		}
+	}
+
+	for _, origin := range parseCSVList(cfg.corsAllowedOrigins) {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			problems.add("CORS_ALLOWED_ORIGINS entries must be origins such as https://example.com, got %q", origin)
+		}
+	}
+	cfg.cors = newCORSConfig(cfg.corsAllowedOrigins)
+
+	return cfg, problems.err()
+}
+
+// logSummary records the effective configuration, without secrets.
+func (c config) logSummary() {
+	log.Printf("config: listen=%s session_ttl=%s max_candidates=%d turn_secret=%t turn_ttl=%s turn_urls=%v redis=%q chat_redis=%q cors_origins=%s",
+		c.listenAddr, c.sessionTTL, c.maxCandidates, c.turnSecret != "", c.turnTTL, c.turnURLs, c.redisAddr, c.chatRedisAddr, c.corsAllowedOrigins)
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigRejectsBadValues(t *testing.T) {
+	t.Setenv("SESSION_TTL_SECONDS", "15m")
+	t.Setenv("MAX_CANDIDATES_PER_SESSION", "0")
+	t.Setenv("TURN_SERVER_URLS", "turn:turn.example.com:3478,https://turn.example.com")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com,app.example.com")
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig accepted invalid settings")
+	}
+	for _, key := range []string{"SESSION_TTL_SECONDS", "MAX_CANDIDATES_PER_SESSION", "TURN_SERVER_URLS", "CORS_ALLOWED_ORIGINS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.listenAddr != ":8085" || cfg.sessionTTL != 15*time.Minute || cfg.maxCandidates != 100 || len(cfg.turnURLs) != 2 {
+		t.Fatalf("cfg = %+v", cfg)
+	}
+	if !cfg.cors.isAllowed("http://localhost:5173") || cfg.cors.isAllowed("https://evil.example.com") {
+		t.Fatal("default CORS origins not applied")
+	}
+}
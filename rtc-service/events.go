@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionEvent is pushed to /sessions/{id}/events subscribers whenever the
+// session changes. Each event carries a full snapshot so a client that
+// reconnects never needs to replay history.
+type sessionEvent struct {
+	Type    string   `json:"type"`
+	Session *session `json:"session,omitempty"`
+}
+
+const (
+	eventSnapshot          = "snapshot"
+	eventOffer             = "offer"
+	eventAnswer            = "answer"
+	eventCandidate         = "candidate"
+	eventCandidatesCleared = "candidates_cleared"
+	eventState             = "state"
+	eventEnded             = "ended"
+	eventExpired           = "expired"
+
+	subscriberBuffer  = 16
+	keepaliveInterval = 15 * time.Second
+)
+
+// subscribeLocked registers a subscriber for a session. Callers must hold
+// s.mu.
+func (s *server) subscribeLocked(id string) chan sessionEvent {
+	ch := make(chan sessionEvent, subscriberBuffer)
+	if s.subscribers[id] == nil {
+		s.subscribers[id] = make(map[chan sessionEvent]struct{})
+	}
+	s.subscribers[id][ch] = struct{}{}
+	return ch
+}
+
+func (s *server) unsubscribe(id string, ch chan sessionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if subs, ok := s.subscribers[id]; ok {
+		if _, ok := subs[ch]; ok {
+			delete(subs, ch)
+			close(ch)
+		}
+		if len(subs) == 0 {
+			delete(s.subscribers, id)
+		}
+	}
+}
+
+// notifyLocked fans an event out to a session's subscribers. A subscriber
+// that has fallen a full buffer behind is dropped; it reconnects and gets a
+// fresh snapshot. Callers must hold s.mu.
+func (s *server) notifyLocked(id, eventType string, sess *session) {
+	subs := s.subscribers[id]
+	if len(subs) == 0 {
+		return
+	}
+	event := sessionEvent{Type: eventType, Session: cloneSession(sess)}
+	for ch := range subs {
+		select {
+		case ch <- event:
+		default:
+			delete(subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeSubscribersLocked sends a final event and disconnects everyone
+// watching a session that has ended. Callers must hold s.mu.
+func (s *server) closeSubscribersLocked(id, eventType string) {
+	for ch := range s.subscribers[id] {
+		select {
+		case ch <- sessionEvent{Type: eventType}:
+		default:
+		}
+		close(ch)
+	}
+	delete(s.subscribers, id)
+}
+
+// sessionEventsChannel carries session events between replicas when
+// sessions are stored in Redis.
+const sessionEventsChannel = "rtc:session-events"
+
+type relayedEvent struct {
+	SessionID string       `json:"session_id"`
+	Event     sessionEvent `json:"event"`
+}
+
+// publishEvent delivers a session change to subscribers. With Redis the
+// event goes through pub/sub so every replica, including this one, fans it
+// out from relayEvents; otherwise it is delivered directly.
+func (s *server) publishEvent(ctx context.Context, id, eventType string, sess *session) {
+	if s.redis != nil {
+		payload, err := json.Marshal(relayedEvent{SessionID: id, Event: sessionEvent{Type: eventType, Session: sess}})
+		if err != nil {
+			log.Printf("marshal session event error: %v", err)
+			return
+		}
+		if err := s.redis.Publish(ctx, sessionEventsChannel, payload).Err(); err != nil {
+			log.Printf("publish session event error: %v", err)
+		}
+		return
+	}
+	s.deliverEvent(id, eventType, sess)
+}
+
+func (s *server) deliverEvent(id, eventType string, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch eventType {
+	case eventEnded, eventExpired:
+		s.closeSubscribersLocked(id, eventType)
+	default:
+		s.notifyLocked(id, eventType, sess)
+	}
+}
+
+// relayEvents fans events published by any replica out to this replica's
+// subscribers.
+func (s *server) relayEvents(ctx context.Context) {
+	sub := s.redis.Subscribe(ctx, sessionEventsChannel)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		var relayed relayedEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &relayed); err != nil {
+			log.Printf("decode session event error: %v", err)
+			continue
+		}
+		s.deliverEvent(relayed.SessionID, relayed.Event.Type, relayed.Event.Session)
+	}
+}
+
+// handleEvents streams session changes as Server-Sent Events. Clients that
+// do not ask for text/event-stream get the current session, same as
+// GET /sessions/{id}, and keep polling.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		sess, err := s.fetchSession(r.Context(), id)
+		if err != nil {
+			handleSessionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"session": sess})
+		return
+	}
+
+	// Subscribe before reading the snapshot so no change in between is
+	// lost; at worst the first event repeats what the snapshot shows.
+	s.mu.Lock()
+	ch := s.subscribeLocked(id)
+	s.mu.Unlock()
+	defer s.unsubscribe(id, ch)
+
+	snapshot, err := s.fetchSession(r.Context(), id)
+	if err != nil {
+		handleSessionError(w, err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeSSE(w, sessionEvent{Type: eventSnapshot, Session: snapshot}); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event sessionEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
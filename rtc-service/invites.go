@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// chatMessagesChannel is the chat-service pub/sub channel. push-service
+// watches it for rtc_signal invites to send VoIP pushes, and chat-service
+// forwards the same events to connected participants.
+const chatMessagesChannel = "chat:messages"
+
+// inviteEvent matches the redisEvent envelope chat-service publishes; the
+// signal itself travels JSON-encoded in Text.
+type inviteEvent struct {
+	Type           string   `json:"type"`
+	Participants   []string `json:"participants"`
+	ConversationID string   `json:"conversation_id,omitempty"`
+	From           string   `json:"from,omitempty"`
+	Text           string   `json:"text"`
+}
+
+type invitePayload struct {
+	Kind         string   `json:"kind"`
+	SessionID    string   `json:"session_id"`
+	From         string   `json:"from"`
+	DisplayName  string   `json:"display_name,omitempty"`
+	Participants []string `json:"participants"`
+}
+
+// invitePublisher announces new sessions on the chat bus. A nil publisher
+// (CHAT_REDIS_ADDR unset) does nothing.
+type invitePublisher struct {
+	client *redis.Client
+}
+
+func newInvitePublisher(addr string) *invitePublisher {
+	if addr == "" {
+		log.Printf("CHAT_REDIS_ADDR not set; rtc_signal invites will not be published")
+		return nil
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		log.Fatalf("chat redis connection error: %v", err)
+	}
+	log.Printf("rtc-service publishing invites to redis at %s", addr)
+	return &invitePublisher{client: client}
+}
+
+// publishInvite tells the other participants about a new session. Only
+// sessions created with allowed_participants name a callee, so others are
+// skipped.
+func (p *invitePublisher) publishInvite(ctx context.Context, sess *session, displayName string) {
+	if p == nil {
+		return
+	}
+	if len(sess.Allowed) < 2 {
+		log.Printf("session %s has no allowed_participants; skipping invite", sess.ID)
+		return
+	}
+	text, err := json.Marshal(invitePayload{
+		Kind:         "invite",
+		SessionID:    sess.ID,
+		From:         sess.Initiator,
+		DisplayName:  displayName,
+		Participants: sess.Allowed,
+	})
+	if err != nil {
+		log.Printf("marshal invite error: %v", err)
+		return
+	}
+	payload, err := json.Marshal(inviteEvent{
+		Type:           "rtc_signal",
+		Participants:   sess.Allowed,
+		ConversationID: sess.ConversationID,
+		From:           sess.Initiator,
+		Text:           string(text),
+	})
+	if err != nil {
+		log.Printf("marshal invite error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err := p.client.Publish(ctx, chatMessagesChannel, payload).Err(); err != nil {
+		log.Printf("publish invite for session %s error: %v", sess.ID, err)
+	}
+}
@@ -1,27 +1,37 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
 type server struct {
-	mu         sync.Mutex
-	sessions   map[string]*session
-	sessionTTL time.Duration
+	store         sessionStore
+	sessionTTL    time.Duration
+	maxCandidates int
+	invites       *invitePublisher
+
+	// redis is set when sessions live in Redis; session events are then
+	// relayed through pub/sub so subscribers on any replica see them.
+	redis *redis.Client
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan sessionEvent]struct{}
 
 	turnSecret string
 	turnTTL    time.Duration
@@ -34,6 +44,10 @@ type session struct {
 	Initiator      string                    `json:"initiator"`
 	CreatedAt      time.Time                 `json:"created_at"`
 	ExpiresAt      time.Time                 `json:"expires_at"`
+	Version        int                       `json:"version"`
+	Status         string                    `json:"status"`
+	Callee         string                    `json:"callee,omitempty"`
+	Allowed        []string                  `json:"allowed_participants,omitempty"`
 	Offer          *sdpPayload               `json:"offer,omitempty"`
 	Answer         *sdpPayload               `json:"answer,omitempty"`
 	Candidates     map[string][]iceCandidate `json:"candidates,omitempty"`
@@ -55,8 +69,10 @@ type iceCandidate struct {
 }
 
 type createSessionRequest struct {
-	ConversationID string `json:"conversation_id"`
-	Initiator      string `json:"initiator"`
+	ConversationID      string   `json:"conversation_id"`
+	Initiator           string   `json:"initiator"`
+	AllowedParticipants []string `json:"allowed_participants,omitempty"`
+	DisplayName         string   `json:"display_name,omitempty"`
 }
 
 type sdpRequest struct {
@@ -65,6 +81,11 @@ type sdpRequest struct {
 	From string `json:"from"`
 }
 
+type stateRequest struct {
+	Status string `json:"status"`
+	From   string `json:"from"`
+}
+
 type candidateRequest struct {
 	Candidate     string  `json:"candidate"`
 	SDPMid        string  `json:"sdp_mid,omitempty"`
@@ -82,17 +103,58 @@ type turnCredentials struct {
 var (
 	errSessionNotFound = errors.New("session not found")
 	errSessionExpired  = errors.New("session expired")
+	errNotParticipant  = errors.New("sender is not a participant in this session")
+	errSessionFull     = errors.New("session already has two participants")
+	errBadTransition   = errors.New("invalid call state transition")
+	errTooManyCands    = errors.New("candidate limit reached for this session")
+)
+
+// Call states. A session starts as created; declined and ended are
+// terminal.
+const (
+	statusCreated  = "created"
+	statusRinging  = "ringing"
+	statusAnswered = "answered"
+	statusDeclined = "declined"
+	statusEnded    = "ended"
 )
 
+var callTransitions = map[string][]string{
+	statusCreated:  {statusRinging, statusAnswered, statusDeclined, statusEnded},
+	statusRinging:  {statusAnswered, statusDeclined, statusEnded},
+	statusAnswered: {statusEnded},
+}
+
+// terminalSessionTTL is how long a declined or ended session lingers so
+// the other side can still observe the final status.
+const terminalSessionTTL = 30 * time.Second
+
 func main() {
-	cfg := loadConfig()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.logSummary()
 
 	srv := &server{
-		sessions:   make(map[string]*session),
-		sessionTTL: cfg.sessionTTL,
-		turnSecret: cfg.turnSecret,
-		turnTTL:    cfg.turnTTL,
-		turnURLs:   cfg.turnURLs,
+		store:         newMemoryStore(),
+		subscribers:   make(map[string]map[chan sessionEvent]struct{}),
+		sessionTTL:    cfg.sessionTTL,
+		maxCandidates: cfg.maxCandidates,
+		invites:       newInvitePublisher(cfg.chatRedisAddr),
+		turnSecret:    cfg.turnSecret,
+		turnTTL:       cfg.turnTTL,
+		turnURLs:      cfg.turnURLs,
+	}
+	if cfg.redisAddr != "" {
+		client := redis.NewClient(&redis.Options{Addr: cfg.redisAddr})
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			log.Fatalf("redis connection error: %v", err)
+		}
+		srv.store = newRedisStore(client)
+		srv.redis = client
+		go srv.relayEvents(context.Background())
+		log.Printf("rtc-service storing sessions in redis at %s", cfg.redisAddr)
 	}
 
 	go srv.cleanupExpiredSessions()
@@ -101,66 +163,15 @@ func main() {
 	mux.HandleFunc("/healthz", srv.handleHealth)
 	mux.HandleFunc("/sessions", srv.handleSessions)
 	mux.HandleFunc("/sessions/", srv.handleSessionResource)
+	mux.HandleFunc("/turn", srv.handleTurn)
 
-	log.Printf("rtc-service listening on :%s", cfg.port)
+	log.Printf("rtc-service listening on %s", cfg.listenAddr)
 	handler := logRequest(corsMiddleware(cfg.cors, mux))
-	if err := http.ListenAndServe(":"+cfg.port, handler); err != nil {
+	if err := http.ListenAndServe(cfg.listenAddr, handler); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
 
-type config struct {
-	port       string
-	sessionTTL time.Duration
-	turnSecret string
-	turnTTL    time.Duration
-	turnURLs   []string
-	cors       corsConfig
-}
-
-func loadConfig() config {
-	port := strings.TrimSpace(os.Getenv("SERVICE_PORT"))
-	if port == "" {
-		port = "8085"
-	}
-
-	sessionTTL := durationFromEnv("SESSION_TTL_SECONDS", 15*time.Minute)
-	turnSecret := strings.TrimSpace(os.Getenv("TURN_SHARED_SECRET"))
-	turnTTL := durationFromEnv("TURN_CREDENTIAL_TTL", 10*time.Minute)
-	turnURLs := parseCSVEnv("TURN_SERVER_URLS")
-	if len(turnURLs) == 0 {
-		turnURLs = []string{"turn:localhost:3478?transport=udp", "turn:localhost:3478?transport=tcp"}
-	}
-
-	corsAllowed := strings.TrimSpace(os.Getenv("CORS_ALLOWED_ORIGINS"))
-
-	return config{
-		port:       port,
-		sessionTTL: sessionTTL,
-		turnSecret: turnSecret,
-		turnTTL:    turnTTL,
-		turnURLs:   turnURLs,
-		cors:       newCORSConfig(corsAllowed),
-	}
-}
-
-func durationFromEnv(key string, fallback time.Duration) time.Duration {
-	raw := strings.TrimSpace(os.Getenv(key))
-	if raw == "" {
-		return fallback
-	}
-	secs, err := strconv.Atoi(raw)
-	if err != nil || secs <= 0 {
-		log.Printf("invalid %s=%q, using fallback %s", key, raw, fallback)
-		return fallback
-	}
-	return time.Duration(secs) * time.Second
-}
-
-func parseCSVEnv(key string) []string {
-	return parseCSVList(strings.TrimSpace(os.Getenv(key)))
-}
-
 func parseCSVList(raw string) []string {
 	if raw == "" {
 		return nil
@@ -200,7 +211,13 @@ func (s *server) handleSessions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := s.createSession(req.ConversationID, req.Initiator)
+	sess, err := s.createSession(r.Context(), req.ConversationID, req.Initiator, uniqueStrings(req.AllowedParticipants))
+	if err != nil {
+		log.Printf("create session error: %v", err)
+		writeError(w, http.StatusInternalServerError, "unable to create session")
+		return
+	}
+	s.invites.publishInvite(r.Context(), sess, strings.TrimSpace(req.DisplayName))
 	resp := map[string]any{
 		"session": sess,
 	}
@@ -209,6 +226,26 @@ func (s *server) handleSessions(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, resp)
 }
 
+// handleTurn mints fresh TURN credentials outside of any session, for
+// clients whose first set is about to expire mid-call. Without
+// TURN_SHARED_SECRET the URLs are still returned but no credentials, and
+// "enabled" is false.
+func (s *server) handleTurn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	identity := strings.TrimSpace(r.URL.Query().Get("identity"))
+	if identity == "" {
+		writeError(w, http.StatusBadRequest, "identity is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"turn":    s.buildTurnCredentials(identity),
+		"enabled": s.turnSecret != "",
+	})
+}
+
 func (s *server) handleSessionResource(w http.ResponseWriter, r *http.Request) {
 	tail := strings.TrimPrefix(r.URL.Path, "/sessions/")
 	if tail == "" {
@@ -240,6 +277,10 @@ func (s *server) handleSessionResource(w http.ResponseWriter, r *http.Request) {
 		s.handleAnswer(w, r, id)
 	case "candidates":
 		s.handleCandidate(w, r, id)
+	case "events":
+		s.handleEvents(w, r, id)
+	case "state":
+		s.handleState(w, r, id)
 	default:
 		http.NotFound(w, r)
 	}
@@ -249,7 +290,7 @@ func (s *server) handleSession(w http.ResponseWriter, r *http.Request, id string
 	switch r.Method {
 	case http.MethodGet:
 		participant := strings.TrimSpace(r.URL.Query().Get("participant"))
-		sess, err := s.fetchSession(id)
+		sess, err := s.fetchSession(r.Context(), id)
 		if err != nil {
 			handleSessionError(w, err)
 			return
@@ -260,7 +301,10 @@ func (s *server) handleSession(w http.ResponseWriter, r *http.Request, id string
 		}
 		writeJSON(w, http.StatusOK, resp)
 	case http.MethodDelete:
-		s.deleteSession(id)
+		if err := s.deleteSession(r.Context(), id); err != nil {
+			handleSessionError(w, err)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
@@ -273,7 +317,13 @@ func (s *server) handleOffer(w http.ResponseWriter, r *http.Request, id string)
 		return
 	}
 
-	sess, err := s.applySDP(id, r.Body, "offer", func(sess *session, payload *sdpPayload) {
+	sess, err := s.applySDP(r.Context(), id, r.Body, "offer", func(sess *session, payload *sdpPayload) {
+		// A second offer is a renegotiation: the previous answer no longer
+		// applies, and the version bump tells polling clients to restart.
+		if sess.Offer != nil {
+			sess.Version++
+			sess.Answer = nil
+		}
 		sess.Offer = payload
 	})
 	if err != nil {
@@ -290,8 +340,13 @@ func (s *server) handleAnswer(w http.ResponseWriter, r *http.Request, id string)
 		return
 	}
 
-	sess, err := s.applySDP(id, r.Body, "answer", func(sess *session, payload *sdpPayload) {
+	sess, err := s.applySDP(r.Context(), id, r.Body, "answer", func(sess *session, payload *sdpPayload) {
 		sess.Answer = payload
+		// An answer means the call was picked up, even if the client never
+		// posted the transition itself.
+		if sess.Status == statusCreated || sess.Status == statusRinging {
+			sess.Status = statusAnswered
+		}
 	})
 	if err != nil {
 		handleSessionError(w, err)
@@ -301,12 +356,52 @@ func (s *server) handleAnswer(w http.ResponseWriter, r *http.Request, id string)
 	writeJSON(w, http.StatusOK, map[string]any{"session": sess})
 }
 
-func (s *server) handleCandidate(w http.ResponseWriter, r *http.Request, id string) {
+func (s *server) handleState(w http.ResponseWriter, r *http.Request, id string) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w, http.MethodPost)
 		return
 	}
 
+	var req stateRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Status = strings.ToLower(strings.TrimSpace(req.Status))
+	req.From = strings.TrimSpace(req.From)
+	if req.Status == "" {
+		writeError(w, http.StatusBadRequest, "status is required")
+		return
+	}
+	if req.From == "" {
+		writeError(w, http.StatusBadRequest, "from is required")
+		return
+	}
+
+	sess, err := s.transitionSession(r.Context(), id, req.From, req.Status)
+	if err != nil {
+		handleSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"session": sess})
+}
+
+func (s *server) handleCandidate(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method == http.MethodDelete {
+		sess, err := s.clearCandidates(r.Context(), id, strings.TrimSpace(r.URL.Query().Get("from")))
+		if err != nil {
+			handleSessionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"session": sess})
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+
 	var req candidateRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
@@ -323,7 +418,7 @@ func (s *server) handleCandidate(w http.ResponseWriter, r *http.Request, id stri
 		return
 	}
 
-	sess, err := s.addCandidate(id, &req)
+	sess, err := s.addCandidate(r.Context(), id, &req)
 	if err != nil {
 		handleSessionError(w, err)
 		return
@@ -332,46 +427,40 @@ func (s *server) handleCandidate(w http.ResponseWriter, r *http.Request, id stri
 	writeJSON(w, http.StatusOK, map[string]any{"session": sess})
 }
 
-func (s *server) createSession(conversationID, initiator string) *session {
+func (s *server) createSession(ctx context.Context, conversationID, initiator string, allowed []string) (*session, error) {
 	now := time.Now().UTC()
+	if len(allowed) > 0 && !containsFold(allowed, initiator) {
+		allowed = append(allowed, initiator)
+	}
 	sess := &session{
 		ID:             uuid.NewString(),
 		ConversationID: conversationID,
 		Initiator:      initiator,
+		Allowed:        allowed,
+		Status:         statusCreated,
 		CreatedAt:      now,
 		ExpiresAt:      now.Add(s.sessionTTL),
 	}
 
-	s.mu.Lock()
-	s.sessions[sess.ID] = sess
-	s.mu.Unlock()
-
-	return cloneSession(sess)
-}
-
-func (s *server) fetchSession(id string) (*session, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	sess, ok := s.sessions[id]
-	if !ok {
-		return nil, errSessionNotFound
-	}
-	if time.Now().After(sess.ExpiresAt) {
-		delete(s.sessions, id)
-		return nil, errSessionExpired
+	if err := s.store.create(ctx, sess); err != nil {
+		return nil, err
 	}
-
 	return cloneSession(sess), nil
 }
 
-func (s *server) deleteSession(id string) {
-	s.mu.Lock()
-	delete(s.sessions, id)
-	s.mu.Unlock()
+func (s *server) fetchSession(ctx context.Context, id string) (*session, error) {
+	return s.store.get(ctx, id)
+}
+
+func (s *server) deleteSession(ctx context.Context, id string) error {
+	if err := s.store.delete(ctx, id); err != nil {
+		return err
+	}
+	s.publishEvent(ctx, id, eventEnded, nil)
+	return nil
 }
 
-func (s *server) applySDP(id string, body io.Reader, defaultType string, assign func(*session, *sdpPayload)) (*session, error) {
+func (s *server) applySDP(ctx context.Context, id string, body io.Reader, defaultType string, assign func(*session, *sdpPayload)) (*session, error) {
 	var req sdpRequest
 	if err := decodeJSON(body, &req); err != nil {
 		return nil, err
@@ -385,72 +474,182 @@ func (s *server) applySDP(id string, body io.Reader, defaultType string, assign
 		return nil, errors.New("from is required")
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sess, err := s.store.update(ctx, id, func(sess *session) error {
+		if err := admit(sess, req.From); err != nil {
+			return err
+		}
+		payload := &sdpPayload{
+			Type:  defaultValue(strings.TrimSpace(req.Type), defaultType),
+			SDP:   req.SDP,
+			From:  req.From,
+			SetAt: time.Now().UTC(),
+		}
+		assign(sess, payload)
+		s.touch(sess)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvent(ctx, id, defaultType, sess)
+	return sess, nil
+}
 
-	sess, ok := s.sessions[id]
-	if !ok {
-		return nil, errSessionNotFound
+// addCandidate appends a candidate, capped at maxCandidates across the
+// whole session since every read returns the full list. Re-sending a
+// candidate that is already stored is a no-op.
+func (s *server) addCandidate(ctx context.Context, id string, req *candidateRequest) (*session, error) {
+	added := false
+	sess, err := s.store.update(ctx, id, func(sess *session) error {
+		if err := admit(sess, req.From); err != nil {
+			return err
+		}
+		total := 0
+		for _, list := range sess.Candidates {
+			total += len(list)
+		}
+		for _, existing := range sess.Candidates[req.From] {
+			if existing.Candidate == req.Candidate {
+				return nil
+			}
+		}
+		if total >= s.maxCandidates {
+			return errTooManyCands
+		}
+		if sess.Candidates == nil {
+			sess.Candidates = make(map[string][]iceCandidate)
+		}
+		candidate := iceCandidate{
+			Candidate:     req.Candidate,
+			SDPMid:        req.SDPMid,
+			SDPMLineIndex: req.SDPMLineIndex,
+			From:          req.From,
+			AddedAt:       time.Now().UTC(),
+		}
+		sess.Candidates[req.From] = append(sess.Candidates[req.From], candidate)
+		s.touch(sess)
+		added = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if time.Now().After(sess.ExpiresAt) {
-		delete(s.sessions, id)
-		return nil, errSessionExpired
+	if added {
+		s.publishEvent(ctx, id, eventCandidate, sess)
 	}
+	return sess, nil
+}
 
-	payload := &sdpPayload{
-		Type:  defaultValue(strings.TrimSpace(req.Type), defaultType),
-		SDP:   req.SDP,
-		From:  req.From,
-		SetAt: time.Now().UTC(),
+// transitionSession moves the call to a new status. Declined and ended
+// sessions are kept only briefly so both sides can see the outcome.
+func (s *server) transitionSession(ctx context.Context, id, from, status string) (*session, error) {
+	sess, err := s.store.update(ctx, id, func(sess *session) error {
+		if err := admit(sess, from); err != nil {
+			return err
+		}
+		current := defaultValue(sess.Status, statusCreated)
+		allowed := false
+		for _, next := range callTransitions[current] {
+			if next == status {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s -> %s", errBadTransition, current, status)
+		}
+		sess.Status = status
+		if status == statusDeclined || status == statusEnded {
+			if cutoff := time.Now().Add(terminalSessionTTL); sess.ExpiresAt.After(cutoff) {
+				sess.ExpiresAt = cutoff
+			}
+		} else {
+			s.touch(sess)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	assign(sess, payload)
-	sess.ExpiresAt = time.Now().Add(s.sessionTTL)
-
-	return cloneSession(sess), nil
+	s.publishEvent(ctx, id, eventState, sess)
+	return sess, nil
 }
 
-func (s *server) addCandidate(id string, req *candidateRequest) (*session, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// touch extends the session on activity. Declined and ended sessions keep
+// their shortened expiry so late signaling cannot revive them.
+func (s *server) touch(sess *session) {
+	if sess.Status == statusDeclined || sess.Status == statusEnded {
+		return
+	}
+	sess.ExpiresAt = time.Now().Add(s.sessionTTL)
+}
 
-	sess, ok := s.sessions[id]
-	if !ok {
-		return nil, errSessionNotFound
+// admit checks that from may signal on the session. The initiator is
+// always admitted; the first other identity to interact becomes the callee
+// and any third identity is rejected. When the session was created with an
+// allowed list, identities outside it are refused outright.
+func admit(sess *session, from string) error {
+	if strings.EqualFold(from, sess.Initiator) {
+		return nil
 	}
-	if time.Now().After(sess.ExpiresAt) {
-		delete(s.sessions, id)
-		return nil, errSessionExpired
+	if len(sess.Allowed) > 0 && !containsFold(sess.Allowed, from) {
+		return errNotParticipant
 	}
-
-	if sess.Candidates == nil {
-		sess.Candidates = make(map[string][]iceCandidate)
+	if sess.Callee == "" {
+		sess.Callee = from
+		return nil
 	}
-	candidate := iceCandidate{
-		Candidate:     req.Candidate,
-		SDPMid:        req.SDPMid,
-		SDPMLineIndex: req.SDPMLineIndex,
-		From:          req.From,
-		AddedAt:       time.Now().UTC(),
+	if !strings.EqualFold(from, sess.Callee) {
+		return errSessionFull
 	}
-	sess.Candidates[req.From] = append(sess.Candidates[req.From], candidate)
-	sess.ExpiresAt = time.Now().Add(s.sessionTTL)
+	return nil
+}
 
-	return cloneSession(sess), nil
+// clearCandidates drops the ICE candidates gathered so far, either for a
+// single participant or, when from is empty, for everyone.
+func (s *server) clearCandidates(ctx context.Context, id, from string) (*session, error) {
+	sess, err := s.store.update(ctx, id, func(sess *session) error {
+		if from == "" {
+			sess.Candidates = nil
+		} else {
+			delete(sess.Candidates, from)
+		}
+		s.touch(sess)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvent(ctx, id, eventCandidatesCleared, sess)
+	return sess, nil
 }
 
+// cleanupExpiredSessions sweeps the store and disconnects local event
+// subscribers whose session has gone away.
 func (s *server) cleanupExpiredSessions() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		now := time.Now()
+	for now := range ticker.C {
+		s.store.sweep(now)
+
 		s.mu.Lock()
-		for id, sess := range s.sessions {
-			if now.After(sess.ExpiresAt) {
-				delete(s.sessions, id)
-			}
+		watched := make([]string, 0, len(s.subscribers))
+		for id := range s.subscribers {
+			watched = append(watched, id)
 		}
 		s.mu.Unlock()
+
+		for _, id := range watched {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_, err := s.store.get(ctx, id)
+			cancel()
+			if errors.Is(err, errSessionNotFound) || errors.Is(err, errSessionExpired) {
+				s.mu.Lock()
+				s.closeSubscribersLocked(id, eventExpired)
+				s.mu.Unlock()
+			}
+		}
 	}
 }
 
@@ -474,6 +673,15 @@ func (s *server) buildTurnCredentials(identity string) turnCredentials {
 	return creds
 }
 
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
 func defaultValue(value, fallback string) string {
 	if value == "" {
 		return fallback
@@ -482,11 +690,20 @@ func defaultValue(value, fallback string) string {
 }
 
 func handleSessionError(w http.ResponseWriter, err error) {
-	switch err {
-	case errSessionNotFound:
+	switch {
+	case errors.Is(err, errSessionNotFound):
 		writeError(w, http.StatusNotFound, err.Error())
-	case errSessionExpired:
+	case errors.Is(err, errSessionExpired):
 		writeError(w, http.StatusGone, err.Error())
+	case errors.Is(err, errNotParticipant):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, errSessionFull), errors.Is(err, errSessionConflict), errors.Is(err, errBadTransition):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errTooManyCands):
+		writeError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, errStoreUnavailable):
+		log.Printf("session store error: %v", err)
+		writeError(w, http.StatusServiceUnavailable, errStoreUnavailable.Error())
 	default:
 		writeError(w, http.StatusBadRequest, err.Error())
 	}
@@ -523,6 +740,7 @@ func cloneSession(src *session) *session {
 		return nil
 	}
 	clone := *src
+	clone.Allowed = append([]string(nil), src.Allowed...)
 	if src.Offer != nil {
 		offer := *src.Offer
 		clone.Offer = &offer
@@ -554,6 +772,12 @@ func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lrw.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Unwrap exposes the underlying writer so http.ResponseController can flush
+// streaming responses.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
 func logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lrw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
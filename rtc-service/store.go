@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionStore holds signaling sessions. The in-memory store is the
+// default; the Redis store lets several replicas share sessions.
+type sessionStore interface {
+	create(ctx context.Context, sess *session) error
+	get(ctx context.Context, id string) (*session, error)
+	// update applies fn to the current session and persists the result.
+	// An error from fn aborts the update and is returned unchanged.
+	update(ctx context.Context, id string, fn func(*session) error) (*session, error)
+	delete(ctx context.Context, id string) error
+	// sweep drops expired sessions that the backend does not expire on
+	// its own.
+	sweep(now time.Time)
+}
+
+var (
+	errSessionConflict  = errors.New("session was modified concurrently, retry")
+	errStoreUnavailable = errors.New("session store unavailable")
+)
+
+// storeFailure marks a backend error so handlers answer 503 rather than
+// blaming the request.
+func storeFailure(err error) error {
+	return fmt.Errorf("%w: %v", errStoreUnavailable, err)
+}
+
+type memoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{sessions: make(map[string]*session)}
+}
+
+func (m *memoryStore) create(_ context.Context, sess *session) error {
+	m.mu.Lock()
+	m.sessions[sess.ID] = cloneSession(sess)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) get(_ context.Context, id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, err := m.liveLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	return cloneSession(sess), nil
+}
+
+func (m *memoryStore) update(_ context.Context, id string, fn func(*session) error) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, err := m.liveLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	// Work on a copy so a rejected update leaves the stored session as it
+	// was.
+	next := cloneSession(sess)
+	if err := fn(next); err != nil {
+		return nil, err
+	}
+	m.sessions[id] = next
+	return cloneSession(next), nil
+}
+
+func (m *memoryStore) delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) sweep(now time.Time) {
+	m.mu.Lock()
+	for id, sess := range m.sessions {
+		if now.After(sess.ExpiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// liveLocked returns the stored session, removing it if it has expired.
+// Callers must hold m.mu.
+func (m *memoryStore) liveLocked(id string) (*session, error) {
+	sess, ok := m.sessions[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		delete(m.sessions, id)
+		return nil, errSessionExpired
+	}
+	return sess, nil
+}
+
+// redisStore keeps each session as a JSON value whose key TTL tracks the
+// session expiry. Updates use WATCH/MULTI so concurrent writers on
+// different replicas cannot overwrite each other.
+type redisStore struct {
+	client *redis.Client
+}
+
+const (
+	redisSessionPrefix = "rtc:session:"
+	redisUpdateRetries = 5
+)
+
+func newRedisStore(client *redis.Client) *redisStore {
+	return &redisStore{client: client}
+}
+
+func (rs *redisStore) create(ctx context.Context, sess *session) error {
+	buf, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	if err := rs.client.Set(ctx, redisSessionPrefix+sess.ID, buf, time.Until(sess.ExpiresAt)).Err(); err != nil {
+		return storeFailure(err)
+	}
+	return nil
+}
+
+func (rs *redisStore) get(ctx context.Context, id string) (*session, error) {
+	raw, err := rs.client.Get(ctx, redisSessionPrefix+id).Bytes()
+	return decodeStoredSession(raw, err)
+}
+
+func (rs *redisStore) update(ctx context.Context, id string, fn func(*session) error) (*session, error) {
+	key := redisSessionPrefix + id
+	for attempt := 0; attempt < redisUpdateRetries; attempt++ {
+		var (
+			updated *session
+			fnErr   error
+		)
+		err := rs.client.Watch(ctx, func(tx *redis.Tx) error {
+			sess, err := decodeStoredSession(tx.Get(ctx, key).Bytes())
+			if err != nil {
+				fnErr = err
+				return err
+			}
+			if err := fn(sess); err != nil {
+				fnErr = err
+				return err
+			}
+			buf, err := json.Marshal(sess)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, buf, time.Until(sess.ExpiresAt))
+				return nil
+			})
+			if err == nil {
+				updated = sess
+			}
+			return err
+		}, key)
+		switch {
+		case fnErr != nil:
+			return nil, fnErr
+		case errors.Is(err, redis.TxFailedErr):
+			continue
+		case err != nil:
+			return nil, storeFailure(err)
+		}
+		return updated, nil
+	}
+	return nil, errSessionConflict
+}
+
+func (rs *redisStore) delete(ctx context.Context, id string) error {
+	if err := rs.client.Del(ctx, redisSessionPrefix+id).Err(); err != nil {
+		return storeFailure(err)
+	}
+	return nil
+}
+
+// sweep is a no-op: Redis expires the keys itself.
+func (rs *redisStore) sweep(time.Time) {}
+
+func decodeStoredSession(raw []byte, err error) (*session, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, storeFailure(err)
+	}
+	var sess session
+	if err := json.Unmarshal(raw, &sess); err != nil {
+		return nil, storeFailure(err)
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return nil, errSessionExpired
+	}
+	return &sess, nil
+}
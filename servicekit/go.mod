@@ -0,0 +1,3 @@
+module servicekit
+
+go 1.21
@@ -0,0 +1,24 @@
+// Package logging sets up the structured logger the services share.
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Setup installs the default slog logger, tagging every record with
+// service. LOG_FORMAT=json writes one JSON object per line for log
+// aggregation; anything else keeps readable key=value text for local runs.
+// slog.SetDefault also routes the standard log package through the same
+// handler, so remaining log.Printf calls come out in the chosen format at
+// INFO level.
+func Setup(service string) {
+	var handler slog.Handler
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("LOG_FORMAT")), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(handler).With("service", service))
+}
@@ -0,0 +1,65 @@
+// Package origin decides which browser origins may open a websocket, so a
+// page on another site cannot use a visitor's browser to open a socket as
+// them.
+package origin
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policy is a parsed list of allowed origins.
+type Policy struct {
+	// any is set by "*" in the list, meant only for local development.
+	any     bool
+	allowed map[string]struct{}
+}
+
+// Parse reads a comma-separated list of exact origins such as
+// "https://app.example.com", in the same form as registration-api's
+// CORS_ALLOWED_ORIGINS.
+func Parse(raw string) Policy {
+	p := Policy{allowed: make(map[string]struct{})}
+	for _, part := range strings.Split(raw, ",") {
+		origin := strings.TrimRight(strings.TrimSpace(part), "/")
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			p.any = true
+			continue
+		}
+		p.allowed[strings.ToLower(origin)] = struct{}{}
+	}
+	return p
+}
+
+// AllowsAny reports whether the list held "*".
+func (p Policy) AllowsAny() bool {
+	return p.any
+}
+
+// Check is the websocket upgrader's CheckOrigin. Requests without an Origin
+// header come from non-browser clients and are allowed, as are pages served
+// from the same host as the API. The opaque origin "null", sent by sandboxed
+// frames and local files, is allowed only by "*".
+func (p Policy) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+	if origin == "null" {
+		log.Printf("rejected websocket upgrade from origin %q", origin)
+		return false
+	}
+	if _, ok := p.allowed[strings.ToLower(origin)]; ok {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	log.Printf("rejected websocket upgrade from origin %q", origin)
+	return false
+}
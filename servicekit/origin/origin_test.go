@@ -0,0 +1,39 @@
+package origin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name, allowed, origin string
+		want                  bool
+	}{
+		{"exact match", "https://app.example.com", "https://app.example.com", true},
+		{"match ignores case and trailing slash", "https://App.example.com/", "https://app.EXAMPLE.com", true},
+		{"one of several", "https://a.example.com, https://app.example.com", "https://app.example.com", true},
+		{"not listed", "https://app.example.com", "https://evil.example.com", false},
+		{"scheme differs", "https://app.example.com", "http://app.example.com", false},
+		{"wildcard", "*", "https://evil.example.com", true},
+		{"wildcard among others", "https://app.example.com,*", "https://evil.example.com", true},
+		{"missing origin", "https://app.example.com", "", true},
+		{"null origin", "https://app.example.com", "null", false},
+		{"null origin with empty list", "", "null", false},
+		{"null origin with wildcard", "*", "null", true},
+		{"same host as the api", "https://app.example.com", "https://api.example.com", true},
+		{"empty list", "", "https://app.example.com", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.Host = "api.example.com"
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if got := Parse(tc.allowed).Check(r); got != tc.want {
+				t.Errorf("allowed %q, origin %q: Check = %t, want %t", tc.allowed, tc.origin, got, tc.want)
+			}
+		})
+	}
+}
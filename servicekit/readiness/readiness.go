@@ -0,0 +1,75 @@
+// Package readiness holds a service's routes back until its startup
+// migrations are done and answers the /readyz probe.
+package readiness
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Gate holds back every route but the probes until MarkReady is called once
+// the schema is confirmed. /readyz answers 503 "migrating" until then, and
+// afterwards 200, or 503 when Checks reports an unhealthy dependency. The
+// liveness route always answers: before MarkReady the gate answers it
+// itself, because its handler may use what startup has not set up yet.
+type Gate struct {
+	ready atomic.Bool
+	// Liveness is the path of the liveness probe.
+	Liveness string
+	// Checks, when set, runs on every /readyz once ready and reports each
+	// dependency's status and whether all of them are healthy.
+	Checks func(context.Context) (map[string]string, bool)
+}
+
+// MarkReady lets every route through.
+func (g *Gate) MarkReady() {
+	g.ready.Store(true)
+}
+
+func (g *Gate) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !g.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "migrating"})
+		return
+	}
+	if g.Checks == nil {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+		return
+	}
+	checks, healthy := g.Checks(r.Context())
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "checks": checks})
+}
+
+// Wrap serves /readyz and the liveness probe in front of next, and passes
+// every other request to next once the gate is ready.
+func (g *Gate) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			g.handleReadyz(w, r)
+			return
+		}
+		if g.ready.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == g.Liveness {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+			return
+		}
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "migrating"})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("failed to encode json: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package readiness
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGate(t *testing.T) {
+	healthy := false
+	gate := &Gate{
+		Liveness: "/healthz",
+		Checks: func(context.Context) (map[string]string, bool) {
+			if healthy {
+				return map[string]string{"db": "ok"}, true
+			}
+			return map[string]string{"db": "connection refused"}, false
+		},
+	}
+	handler := gate.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	cases := []struct {
+		name          string
+		ready, health bool
+		path          string
+		want          int
+	}{
+		{"liveness while migrating", false, false, "/healthz", http.StatusOK},
+		{"readyz while migrating", false, true, "/readyz", http.StatusServiceUnavailable},
+		{"api while migrating", false, true, "/conversations", http.StatusServiceUnavailable},
+		{"liveness once ready", true, false, "/healthz", http.StatusNoContent},
+		{"readyz with a failing dependency", true, false, "/readyz", http.StatusServiceUnavailable},
+		{"readyz once healthy", true, true, "/readyz", http.StatusOK},
+		{"api once ready", true, false, "/conversations", http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		gate.ready.Store(tc.ready)
+		healthy = tc.health
+		if got := status(tc.path); got != tc.want {
+			t.Errorf("%s: %s answered %d, want %d", tc.name, tc.path, got, tc.want)
+		}
+	}
+
+	gate.Checks = nil
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("readyz without checks answered %d, want %d", got, http.StatusOK)
+	}
+}